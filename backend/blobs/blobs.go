@@ -0,0 +1,493 @@
+package blobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"my-cloud-project/backend/encryption"
+	"my-cloud-project/backend/storage"
+)
+
+// Store keeps file contents as content-addressed, reference-counted blobs.
+// Blobs are scoped per owner, so two users uploading the same file each get
+// their own copy while repeated uploads by one user share a single one.
+//
+// When a keyring is configured new blobs are encrypted with the owner's data key.
+// Blobs written before that stay readable as plaintext; BLOB_LIST.ENCRYPTED tells them apart.
+// Blobs may also be compressed, in which case the codec is recorded in BLOB_LIST.CODEC.
+type Store struct {
+	db      *sql.DB
+	backend storage.Backend
+	keys    *encryption.Keyring
+}
+
+// Ref locates stored file contents and says how to read them back
+type Ref struct {
+	OwnerID   int
+	Key       string
+	Encrypted bool
+	Codec     string
+	Size      int64 // logical size, reported for compressed blobs
+}
+
+// Blob is a stored blob row as seen by the reference that acquired it
+type Blob struct {
+	ID      int64
+	Created bool // the row is new, so its object may be missing or left over from a released blob
+	Ref
+}
+
+// Object is an open blob. Reader yields the original contents and also implements
+// io.Seeker whenever the underlying storage allows random access.
+type Object struct {
+	Reader  io.Reader
+	Size    int64
+	ModTime time.Time
+	closers []io.Closer
+}
+
+func (o *Object) Read(p []byte) (int, error) {
+	return o.Reader.Read(p)
+}
+
+func (o *Object) Close() error {
+	var err error
+	for i := len(o.closers) - 1; i >= 0; i-- {
+		if closeErr := o.closers[i].Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// NewStore creates a blob store on top of a storage backend. keys may be nil to store plaintext.
+func NewStore(db *sql.DB, backend storage.Backend, keys *encryption.Keyring) *Store {
+	return &Store{db: db, backend: backend, keys: keys}
+}
+
+// Key returns the storage key of the blob with the given hash owned by ownerID
+func Key(ownerID int, hash string) string {
+	return fmt.Sprintf(".blobs/%d/%s/%s", ownerID, hash[:2], hash)
+}
+
+// parseKey returns the owner and hash of a storage key made by Key
+func parseKey(key string) (int, string, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 4 || parts[0] != ".blobs" || len(parts[3]) != sha256.Size*2 || !strings.HasPrefix(parts[3], parts[2]) || len(parts[2]) != 2 {
+		return 0, "", false
+	}
+	ownerID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, "", false
+	}
+	return ownerID, parts[3], true
+}
+
+// HashFile returns the hex-encoded SHA-256 and size of a local file
+func HashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	return hashReader(f)
+}
+
+func hashReader(r io.Reader) (string, int64, error) {
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// Acquire takes a reference on the owner's blob with this hash, creating the row if it is new.
+// An existing blob keeps its encryption state and codec, so content stored under older
+// settings is still shared; codec only applies to a blob created by this call.
+func (s *Store) Acquire(tx *sql.Tx, ownerID int, hash string, size int64, codec string) (*Blob, error) {
+	// LAST_INSERT_ID(BLOB_ID) makes LastInsertId report the existing row on a duplicate
+	res, err := tx.Exec(`
+		INSERT INTO BLOB_LIST (OWNER_ID, CONTENT_HASH, BLOB_SIZE, STORAGE_KEY, REF_COUNT, ENCRYPTED, CODEC)
+		VALUES (?, ?, ?, ?, 1, ?, ?)
+		ON DUPLICATE KEY UPDATE REF_COUNT = REF_COUNT + 1, BLOB_ID = LAST_INSERT_ID(BLOB_ID)
+	`, ownerID, hash, size, Key(ownerID, hash), s.keys != nil, codec)
+	if err != nil {
+		return nil, err
+	}
+	blobID, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	// Released blobs lose their row, so a count of one means nobody else holds a reference
+	var refCount int
+	blob := &Blob{ID: blobID, Ref: Ref{OwnerID: ownerID}}
+	err = tx.QueryRow("SELECT STORAGE_KEY, ENCRYPTED, CODEC, BLOB_SIZE, REF_COUNT FROM BLOB_LIST WHERE BLOB_ID = ?", blobID).
+		Scan(&blob.Key, &blob.Encrypted, &blob.Codec, &blob.Size, &refCount)
+	if err != nil {
+		return nil, err
+	}
+	blob.Created = refCount == 1
+	return blob, nil
+}
+
+// Release drops a reference on a blob. When it was the last one the row is deleted
+// and the storage key is returned so the caller can Remove the object after committing.
+func (s *Store) Release(tx *sql.Tx, blobID int64) (string, error) {
+	if _, err := tx.Exec("UPDATE BLOB_LIST SET REF_COUNT = REF_COUNT - 1 WHERE BLOB_ID = ?", blobID); err != nil {
+		return "", err
+	}
+
+	var refCount int
+	var key string
+	err := tx.QueryRow("SELECT REF_COUNT, STORAGE_KEY FROM BLOB_LIST WHERE BLOB_ID = ?", blobID).Scan(&refCount, &key)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if refCount > 0 {
+		return "", nil
+	}
+
+	if _, err := tx.Exec("DELETE FROM BLOB_LIST WHERE BLOB_ID = ?", blobID); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// releaseBatch bounds the blob IDs sent in one statement
+const releaseBatch = 500
+
+// ReleaseAll drops one reference per entry of blobIDs, so a blob listed twice loses two.
+// It works like Release but takes a handful of statements for any number of blobs.
+func (s *Store) ReleaseAll(tx *sql.Tx, blobIDs []int64) ([]string, error) {
+	counts := map[int64]int{}
+	var ids []int64
+	for _, id := range blobIDs {
+		if counts[id] == 0 {
+			ids = append(ids, id)
+		}
+		counts[id]++
+	}
+
+	var staleKeys []string
+	for start := 0; start < len(ids); start += releaseBatch {
+		batch := ids[start:min(start+releaseBatch, len(ids))]
+		in := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+		var cases strings.Builder
+		args := make([]interface{}, 0, 3*len(batch))
+		for _, id := range batch {
+			cases.WriteString(" WHEN ? THEN ?")
+			args = append(args, id, counts[id])
+		}
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		if _, err := tx.Exec("UPDATE BLOB_LIST SET REF_COUNT = REF_COUNT - CASE BLOB_ID"+cases.String()+" END WHERE BLOB_ID IN ("+in+")", args...); err != nil {
+			return nil, err
+		}
+
+		idArgs := args[2*len(batch):]
+		rows, err := tx.Query("SELECT STORAGE_KEY FROM BLOB_LIST WHERE REF_COUNT <= 0 AND BLOB_ID IN ("+in+")", idArgs...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			staleKeys = append(staleKeys, key)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM BLOB_LIST WHERE REF_COUNT <= 0 AND BLOB_ID IN ("+in+")", idArgs...); err != nil {
+			return nil, err
+		}
+	}
+	return staleKeys, nil
+}
+
+// Put moves a local file into a blob acquired for its content. If the content
+// is already stored the local copy is simply removed. A blob created by its Acquire
+// is always written: an object under its key belongs to a released blob that is
+// about to be removed, or was stored with other encryption or codec settings.
+func (s *Store) Put(ctx context.Context, blob *Blob, localPath string) error {
+	if !blob.Created {
+		if _, err := s.backend.Stat(ctx, blob.Key); err == nil {
+			return os.Remove(localPath)
+		} else if !errors.Is(err, storage.ErrNotExist) {
+			return err
+		}
+	}
+
+	if !blob.Encrypted && blob.Codec == CodecNone {
+		if err := storage.ImportFile(ctx, s.backend, localPath, blob.Key); err != nil {
+			return err
+		}
+		return s.recordStoredSize(ctx, blob, blob.Size)
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	storedSize, err := s.write(ctx, blob, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	os.Remove(localPath)
+	return s.recordStoredSize(ctx, blob, storedSize)
+}
+
+// Remove deletes a stored object once nothing refers to it anymore. For a blob key
+// released by Release or ReleaseAll the owner's hash stays locked while the object is
+// deleted, so an Acquire of the same content waits and then writes it anew. A blob
+// acquired again before that keeps its object, which Put of the new row rewrites.
+func (s *Store) Remove(ctx context.Context, key string) error {
+	ownerID, hash, ok := parseKey(key)
+	if !ok {
+		return s.backend.Delete(ctx, key)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var blobID int64
+	err = tx.QueryRow("SELECT BLOB_ID FROM BLOB_LIST WHERE OWNER_ID = ? AND CONTENT_HASH = ? FOR UPDATE", ownerID, hash).Scan(&blobID)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	if err := s.backend.Delete(ctx, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// countingReader tracks how many bytes were handed to the storage backend
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// write stores the original contents read from r under the blob's key, compressing
+// and encrypting them as the blob row says. It returns the number of bytes stored.
+func (s *Store) write(ctx context.Context, blob *Blob, r io.Reader) (int64, error) {
+	size := blob.Size
+	if blob.Codec != CodecNone {
+		compressed := compressReader(r, blob.Codec)
+		defer compressed.Close()
+		r = compressed
+		size = -1
+	}
+
+	if blob.Encrypted {
+		if s.keys == nil {
+			return 0, errors.New("blob is encrypted but no master key is configured")
+		}
+		dataKey, err := s.keys.DataKey(ctx, blob.OwnerID)
+		if err != nil {
+			return 0, err
+		}
+		if r, err = encryption.EncryptReader(r, dataKey); err != nil {
+			return 0, err
+		}
+		if size >= 0 {
+			if size, err = encryption.EncryptedSize(size); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	counter := &countingReader{r: r}
+	if err := s.backend.Put(ctx, blob.Key, counter, size); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+// recordStoredSize notes how many bytes a blob takes in storage, which is what compression saves on
+func (s *Store) recordStoredSize(ctx context.Context, blob *Blob, size int64) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE BLOB_LIST SET STORED_SIZE = ? WHERE BLOB_ID = ?", size, blob.ID)
+	return err
+}
+
+// Open returns the original contents stored for ref.
+// Files that predate the blob store are never encrypted or compressed.
+func (s *Store) Open(ctx context.Context, ref Ref) (*Object, error) {
+	info, err := s.backend.Stat(ctx, ref.Key)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := s.backend.Get(ctx, ref.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &Object{Reader: reader, Size: info.Size, ModTime: info.ModTime, closers: []io.Closer{reader}}
+	if ref.Encrypted {
+		if err := s.decrypt(ctx, ref, obj); err != nil {
+			obj.Close()
+			return nil, err
+		}
+	}
+	if ref.Codec != "" && ref.Codec != CodecNone {
+		decompressed, err := decompressReader(obj.Reader, ref.Codec)
+		if err != nil {
+			obj.Close()
+			return nil, err
+		}
+		obj.Reader = decompressed
+		obj.Size = ref.Size
+		obj.closers = append(obj.closers, decompressed)
+	}
+	return obj, nil
+}
+
+func (s *Store) decrypt(ctx context.Context, ref Ref, obj *Object) error {
+	if s.keys == nil {
+		return errors.New("blob is encrypted but no master key is configured")
+	}
+	dataKey, err := s.keys.DataKey(ctx, ref.OwnerID)
+	if err != nil {
+		return err
+	}
+	size, err := encryption.DecryptedSize(obj.Size)
+	if err != nil {
+		return err
+	}
+
+	// An empty file encrypts to nothing at all, which is not a stream sio can decrypt
+	if size == 0 {
+		obj.Reader = bytes.NewReader(nil)
+	} else if readerAt, ok := obj.Reader.(io.ReaderAt); ok {
+		// Decrypting through ReaderAt keeps range requests working for local files and S3 objects
+		plain, err := encryption.DecryptReaderAt(readerAt, dataKey)
+		if err != nil {
+			return err
+		}
+		obj.Reader = io.NewSectionReader(plain, 0, size)
+	} else {
+		plain, err := encryption.DecryptReader(obj.Reader, dataKey)
+		if err != nil {
+			return err
+		}
+		obj.Reader = plain
+	}
+	obj.Size = size
+	return nil
+}
+
+// Adopt moves a file stored under its legacy per-file key into the blob store
+// and points its FILE_LIST row at the blob. New blobs are encrypted when a keyring is configured.
+func (s *Store) Adopt(ctx context.Context, ownerID int, fileID int64, legacyKey string) error {
+	reader, err := s.backend.Get(ctx, legacyKey)
+	if err != nil {
+		return err
+	}
+	hash, size, err := hashReader(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	blob, err := s.Acquire(tx, ownerID, hash, size, CodecNone)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE FILE_LIST SET BLOB_ID = ? WHERE FILE_ID = ? AND BLOB_ID IS NULL", blob.ID, fileID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("file %d no longer needs adopting", fileID)
+	}
+
+	// Store the bytes before committing so the row never points at a blob that is not there yet
+	written, movedIn := false, false
+	if _, err := s.backend.Stat(ctx, blob.Key); blob.Created || errors.Is(err, storage.ErrNotExist) {
+		var storedSize int64
+		if storedSize, movedIn, err = s.adoptContents(ctx, blob, legacyKey); err != nil {
+			return err
+		}
+		written = true
+		if _, err := tx.Exec("UPDATE BLOB_LIST SET STORED_SIZE = ? WHERE BLOB_ID = ?", storedSize, blob.ID); err != nil {
+			s.undoAdopt(ctx, blob, legacyKey, movedIn)
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		if written {
+			s.undoAdopt(ctx, blob, legacyKey, movedIn)
+		}
+		return err
+	}
+
+	// A blob that took over the legacy object itself leaves nothing behind; anything else does
+	if !movedIn {
+		s.backend.Delete(ctx, legacyKey)
+	}
+	return nil
+}
+
+// undoAdopt puts a legacy object back the way it was after its blob could not be recorded
+func (s *Store) undoAdopt(ctx context.Context, blob *Blob, legacyKey string, movedIn bool) {
+	if movedIn {
+		s.backend.Move(ctx, blob.Key, legacyKey)
+	} else {
+		s.backend.Delete(ctx, blob.Key)
+	}
+}
+
+// adoptContents writes a legacy object into its blob, reporting the stored size and
+// whether the object was moved rather than copied
+func (s *Store) adoptContents(ctx context.Context, blob *Blob, legacyKey string) (int64, bool, error) {
+	if !blob.Encrypted && blob.Codec == CodecNone {
+		return blob.Size, true, s.backend.Move(ctx, legacyKey, blob.Key)
+	}
+	reader, err := s.backend.Get(ctx, legacyKey)
+	if err != nil {
+		return 0, false, err
+	}
+	defer reader.Close()
+	storedSize, err := s.write(ctx, blob, reader)
+	return storedSize, false, err
+}
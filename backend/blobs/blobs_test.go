@@ -0,0 +1,326 @@
+package blobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"my-cloud-project/backend/storage"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+func TestParseKey(t *testing.T) {
+	hash := strings.Repeat("ab", sha256.Size)
+	tests := []struct {
+		key       string
+		wantOwner int
+		wantOK    bool
+	}{
+		{Key(42, hash), 42, true},
+		{".blobs/x/ab/" + hash, 0, false},
+		{".blobs/42/cd/" + hash, 0, false},
+		{".blobs/42/ab/abcd", 0, false},
+		{"alice/docs/report.pdf", 0, false},
+		{".blobs/42/ab/" + hash + "/more", 0, false},
+	}
+	for _, tt := range tests {
+		ownerID, gotHash, ok := parseKey(tt.key)
+		if ok != tt.wantOK || ownerID != tt.wantOwner || ok && gotHash != hash {
+			t.Errorf("parseKey(%q) = %d, %q, %v; want %d, %v", tt.key, ownerID, gotHash, ok, tt.wantOwner, tt.wantOK)
+		}
+	}
+}
+
+// testStore opens the database named by TEST_DB_DSN and recreates BLOB_LIST in it.
+// The DSN must point at a scratch database, as its BLOB_LIST is dropped.
+func testStore(t *testing.T) (*Store, *storage.LocalBackend) {
+	t.Helper()
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN is not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, stmt := range []string{
+		"DROP TABLE IF EXISTS BLOB_LIST",
+		`CREATE TABLE BLOB_LIST (
+			BLOB_ID int(11) NOT NULL AUTO_INCREMENT,
+			OWNER_ID int(11) NOT NULL,
+			CONTENT_HASH char(64) NOT NULL,
+			BLOB_SIZE bigint(20) NOT NULL,
+			STORED_SIZE bigint(20) DEFAULT NULL,
+			STORAGE_KEY varchar(255) NOT NULL,
+			REF_COUNT int(11) NOT NULL DEFAULT 0,
+			ENCRYPTED tinyint(1) NOT NULL DEFAULT 0,
+			CODEC varchar(16) NOT NULL DEFAULT 'none',
+			created_at timestamp NOT NULL DEFAULT current_timestamp(),
+			PRIMARY KEY (BLOB_ID),
+			UNIQUE KEY BLOB_LIST_OWNER_HASH_UK (OWNER_ID, CONTENT_HASH)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("setting up BLOB_LIST: %v", err)
+		}
+	}
+
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	return NewStore(db, backend, nil), backend
+}
+
+func hashOf(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// inTx runs fn in a transaction and commits it
+func inTx(t *testing.T, s *Store, fn func(tx *sql.Tx)) {
+	t.Helper()
+	tx, err := s.db.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	defer tx.Rollback()
+	fn(tx)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+}
+
+func acquire(t *testing.T, s *Store, tx *sql.Tx, ownerID int, data string) *Blob {
+	t.Helper()
+	blob, err := s.Acquire(tx, ownerID, hashOf(data), int64(len(data)), CodecNone)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	return blob
+}
+
+func refCount(t *testing.T, s *Store, blobID int64) int {
+	t.Helper()
+	var n int
+	err := s.db.QueryRow("SELECT REF_COUNT FROM BLOB_LIST WHERE BLOB_ID = ?", blobID).Scan(&n)
+	if err == sql.ErrNoRows {
+		return 0
+	}
+	if err != nil {
+		t.Fatalf("reading REF_COUNT: %v", err)
+	}
+	return n
+}
+
+func spool(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func stored(t *testing.T, b *storage.LocalBackend, key string) string {
+	t.Helper()
+	r, err := b.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestAcquireRelease(t *testing.T) {
+	s, _ := testStore(t)
+
+	var first, second, other *Blob
+	inTx(t, s, func(tx *sql.Tx) {
+		first = acquire(t, s, tx, 1, "hello")
+		second = acquire(t, s, tx, 1, "hello")
+		other = acquire(t, s, tx, 2, "hello")
+	})
+	if second.ID != first.ID || !first.Created || second.Created {
+		t.Errorf("acquiring twice = %+v and %+v, want the same row created once", first, second)
+	}
+	if other.ID == first.ID || other.Key != Key(2, hashOf("hello")) {
+		t.Errorf("another owner got %+v, want a blob of their own", other)
+	}
+	if n := refCount(t, s, first.ID); n != 2 {
+		t.Errorf("REF_COUNT = %d, want 2", n)
+	}
+
+	inTx(t, s, func(tx *sql.Tx) {
+		if key, err := s.Release(tx, first.ID); err != nil || key != "" {
+			t.Errorf("Release of a shared blob = %q, %v; want no key", key, err)
+		}
+	})
+	if n := refCount(t, s, first.ID); n != 1 {
+		t.Errorf("REF_COUNT = %d, want 1", n)
+	}
+
+	// The last reference deletes the row and hands back the key to remove
+	inTx(t, s, func(tx *sql.Tx) {
+		if key, err := s.Release(tx, first.ID); err != nil || key != first.Key {
+			t.Errorf("Release of the last reference = %q, %v; want %q", key, err, first.Key)
+		}
+		if key, err := s.Release(tx, first.ID); err != nil || key != "" {
+			t.Errorf("Release of a deleted blob = %q, %v; want no key", key, err)
+		}
+	})
+	if n := refCount(t, s, first.ID); n != 0 {
+		t.Errorf("released blob still has its row with REF_COUNT %d", n)
+	}
+
+	// The same content acquired again gets a new row that counts as created
+	inTx(t, s, func(tx *sql.Tx) {
+		if again := acquire(t, s, tx, 1, "hello"); again.ID == first.ID || !again.Created {
+			t.Errorf("acquiring released content = %+v, want a new created row", again)
+		}
+	})
+}
+
+func TestReleaseAll(t *testing.T) {
+	s, _ := testStore(t)
+
+	var a, b, c *Blob
+	inTx(t, s, func(tx *sql.Tx) {
+		for i := 0; i < 3; i++ {
+			a = acquire(t, s, tx, 1, "a")
+		}
+		b = acquire(t, s, tx, 1, "b")
+		c = acquire(t, s, tx, 1, "c")
+		c = acquire(t, s, tx, 1, "c")
+	})
+
+	// An ID listed twice drops two references
+	inTx(t, s, func(tx *sql.Tx) {
+		keys, err := s.ReleaseAll(tx, []int64{a.ID, b.ID, a.ID, c.ID, c.ID})
+		if err != nil {
+			t.Fatalf("ReleaseAll: %v", err)
+		}
+		sort.Strings(keys)
+		want := []string{b.Key, c.Key}
+		sort.Strings(want)
+		if strings.Join(keys, ",") != strings.Join(want, ",") {
+			t.Errorf("ReleaseAll keys = %v, want %v", keys, want)
+		}
+	})
+	if n := refCount(t, s, a.ID); n != 1 {
+		t.Errorf("REF_COUNT of a = %d, want 1", n)
+	}
+	for _, blob := range []*Blob{b, c} {
+		if n := refCount(t, s, blob.ID); n != 0 {
+			t.Errorf("blob %d still has its row with REF_COUNT %d", blob.ID, n)
+		}
+	}
+
+	inTx(t, s, func(tx *sql.Tx) {
+		if keys, err := s.ReleaseAll(tx, nil); err != nil || len(keys) != 0 {
+			t.Errorf("ReleaseAll(nil) = %v, %v", keys, err)
+		}
+	})
+}
+
+func TestPut(t *testing.T) {
+	ctx := context.Background()
+	s, backend := testStore(t)
+
+	var blob *Blob
+	inTx(t, s, func(tx *sql.Tx) { blob = acquire(t, s, tx, 1, "hello") })
+	local := spool(t, "hello")
+	if err := s.Put(ctx, blob, local); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := stored(t, backend, blob.Key); got != "hello" {
+		t.Errorf("stored %q, want %q", got, "hello")
+	}
+	if _, err := os.Stat(local); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("local file still there after Put: %v", err)
+	}
+
+	// Content that is already stored is not written again
+	var shared *Blob
+	inTx(t, s, func(tx *sql.Tx) { shared = acquire(t, s, tx, 1, "hello") })
+	if err := backend.Put(ctx, blob.Key, strings.NewReader("kept"), 4); err != nil {
+		t.Fatal(err)
+	}
+	local = spool(t, "hello")
+	if err := s.Put(ctx, shared, local); err != nil {
+		t.Fatalf("Put of stored content: %v", err)
+	}
+	if got := stored(t, backend, blob.Key); got != "kept" {
+		t.Errorf("Put rewrote stored content to %q", got)
+	}
+	if _, err := os.Stat(local); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("local file still there after Put: %v", err)
+	}
+}
+
+func TestPutAfterRelease(t *testing.T) {
+	ctx := context.Background()
+	s, backend := testStore(t)
+
+	var blob *Blob
+	inTx(t, s, func(tx *sql.Tx) { blob = acquire(t, s, tx, 1, "hello") })
+	if err := s.Put(ctx, blob, spool(t, "hello")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// A release that has committed but not yet removed its object races with a new upload
+	var key string
+	inTx(t, s, func(tx *sql.Tx) {
+		var err error
+		if key, err = s.Release(tx, blob.ID); err != nil {
+			t.Fatalf("Release: %v", err)
+		}
+	})
+	var again *Blob
+	inTx(t, s, func(tx *sql.Tx) { again = acquire(t, s, tx, 1, "hello") })
+	if err := backend.Put(ctx, key, strings.NewReader("stale"), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put(ctx, again, spool(t, "hello")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := stored(t, backend, again.Key); got != "hello" {
+		t.Errorf("Put of a created blob left %q, want it rewritten", got)
+	}
+	if err := s.Remove(ctx, key); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if got := stored(t, backend, again.Key); got != "hello" {
+		t.Errorf("Remove deleted the object of a blob acquired again")
+	}
+
+	// Without a new reference the object goes
+	inTx(t, s, func(tx *sql.Tx) {
+		var err error
+		if key, err = s.Release(tx, again.ID); err != nil {
+			t.Fatalf("Release: %v", err)
+		}
+	})
+	if err := s.Remove(ctx, key); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := backend.Stat(ctx, key); !errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("Stat after Remove = %v, want ErrNotExist", err)
+	}
+}
@@ -0,0 +1,83 @@
+package blobs
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs a blob can be compressed with at rest
+const (
+	CodecNone = "none"
+	CodecZstd = "zstd"
+	CodecGzip = "gzip"
+)
+
+// Types that are usually already compressed gain nothing from another pass
+var incompressibleTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp", "video/", "audio/", "application/zip",
+	"application/gzip", "application/x-gzip", "application/x-7z-compressed", "application/x-rar-compressed", "application/zstd",
+	"application/vnd.openxmlformats-officedocument"}
+
+var incompressibleExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".mp4": true,
+	".mkv": true, ".mov": true, ".mp3": true, ".ogg": true, ".zip": true, ".gz": true, ".tgz": true, ".7z": true, ".rar": true,
+	".zst": true, ".docx": true, ".xlsx": true, ".pptx": true}
+
+// Compressible reports whether a file is worth compressing, judged by its MIME type and extension
+func Compressible(fileName, fileType string) bool {
+	if incompressibleExts[strings.ToLower(filepath.Ext(fileName))] {
+		return false
+	}
+	fileType = strings.ToLower(fileType)
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(fileType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// compressReader returns a reader producing r compressed with codec.
+// Closing it stops the compressor early if the consumer gives up.
+func compressReader(r io.Reader, codec string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var w io.WriteCloser
+		var err error
+		switch codec {
+		case CodecZstd:
+			w, err = zstd.NewWriter(pw)
+		case CodecGzip:
+			w = gzip.NewWriter(pw)
+		default:
+			err = fmt.Errorf("unknown codec %q", codec)
+		}
+		if err == nil {
+			_, err = io.Copy(w, r)
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// decompressReader returns a reader producing the decompressed contents of r
+func decompressReader(r io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case CodecZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case CodecGzip:
+		return gzip.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+}
@@ -0,0 +1,78 @@
+package blobs
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	inputs := map[string][]byte{
+		"empty":      nil,
+		"short":      []byte("hello"),
+		"repetitive": bytes.Repeat([]byte("abcdefgh"), 100*1024),
+	}
+	for _, codec := range []string{CodecZstd, CodecGzip} {
+		for name, plain := range inputs {
+			compressed := compressReader(bytes.NewReader(plain), codec)
+			data, err := io.ReadAll(compressed)
+			compressed.Close()
+			if err != nil {
+				t.Fatalf("%s/%s: compressing: %v", codec, name, err)
+			}
+			if name == "repetitive" && len(data) >= len(plain)/10 {
+				t.Errorf("%s/%s: compressed %d bytes to %d", codec, name, len(plain), len(data))
+			}
+
+			decompressed, err := decompressReader(bytes.NewReader(data), codec)
+			if err != nil {
+				t.Fatalf("%s/%s: decompressReader: %v", codec, name, err)
+			}
+			got, err := io.ReadAll(decompressed)
+			decompressed.Close()
+			if err != nil {
+				t.Fatalf("%s/%s: decompressing: %v", codec, name, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("%s/%s: round trip changed the data", codec, name)
+			}
+		}
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	compressed := compressReader(strings.NewReader("data"), "lz4")
+	defer compressed.Close()
+	if _, err := io.ReadAll(compressed); err == nil {
+		t.Error("compressing with an unknown codec succeeded, want an error")
+	}
+	if _, err := decompressReader(strings.NewReader("data"), "lz4"); err == nil {
+		t.Error("decompressing with an unknown codec succeeded, want an error")
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := []struct {
+		fileName string
+		fileType string
+		want     bool
+	}{
+		{"notes.txt", "text/plain", true},
+		{"data.json", "application/json", true},
+		{"report.pdf", "application/pdf", true},
+		{"photo.JPG", "", false},
+		{"photo", "image/jpeg", false},
+		{"clip.bin", "video/mp4", false},
+		{"song", "Audio/MPEG", false},
+		{"archive.tar.gz", "application/octet-stream", false},
+		{"sheet.xlsx", "", false},
+		{"doc", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", false},
+		{"image.svg", "image/svg+xml", true},
+	}
+	for _, tt := range tests {
+		if got := Compressible(tt.fileName, tt.fileType); got != tt.want {
+			t.Errorf("Compressible(%q, %q) = %v, want %v", tt.fileName, tt.fileType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Querier runs queries, as *sql.DB and *sql.Tx do
+type Querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// FolderPaths derives the paths of folders from the names of the folders above them, keyed by
+// folder ID. Folders are only stored with their parent, so a path is always current however
+// the folders above it have been moved or renamed. IDs without a folder row are left out.
+// The climb stops at the same depth as the other walks of the folder tree, which only keeps a
+// PARENT_ID cycle, which should never exist, from running away.
+func FolderPaths(q Querier, folderIDs []string) (map[string]string, error) {
+	paths := make(map[string]string, len(folderIDs))
+	if len(folderIDs) == 0 {
+		return paths, nil
+	}
+	args := make([]interface{}, len(folderIDs))
+	for i, id := range folderIDs {
+		args[i] = id
+	}
+	rows, err := q.Query(`
+		WITH RECURSIVE up (START_ID, PARENT_ID, FOLDER_NAME, DEPTH) AS (
+			SELECT FOLDER_ID, PARENT_ID, FOLDER_NAME, 0 FROM FOLDER_LIST
+			WHERE FOLDER_ID IN (`+strings.TrimSuffix(strings.Repeat("?,", len(folderIDs)), ",")+`)
+			UNION ALL
+			SELECT u.START_ID, p.PARENT_ID, p.FOLDER_NAME, u.DEPTH + 1
+			FROM FOLDER_LIST p JOIN up u ON p.FOLDER_ID = u.PARENT_ID
+			WHERE u.DEPTH < 256
+		)
+		SELECT START_ID, GROUP_CONCAT(FOLDER_NAME ORDER BY DEPTH DESC SEPARATOR '/') FROM up GROUP BY START_ID
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, names string
+		if err := rows.Scan(&id, &names); err != nil {
+			return nil, err
+		}
+		paths[id] = "/" + names
+	}
+	return paths, rows.Err()
+}
@@ -0,0 +1,451 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// migration is a numbered set of schema changes applied once, in order.
+// Statements should be safe to re-run in case a previous attempt stopped halfway,
+// and so should prepare, which runs first for data fixes that need more than SQL.
+type migration struct {
+	version     int
+	description string
+	prepare     func(db *sql.DB) error
+	statements  []string
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "content-addressed blob store",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS BLOB_LIST (
+				BLOB_ID int(11) NOT NULL AUTO_INCREMENT,
+				OWNER_ID int(11) NOT NULL,
+				CONTENT_HASH char(64) NOT NULL,
+				BLOB_SIZE bigint(20) NOT NULL,
+				STORAGE_KEY varchar(255) NOT NULL,
+				REF_COUNT int(11) NOT NULL DEFAULT 0,
+				created_at timestamp NOT NULL DEFAULT current_timestamp(),
+				PRIMARY KEY (BLOB_ID),
+				UNIQUE KEY BLOB_LIST_OWNER_HASH_UK (OWNER_ID, CONTENT_HASH),
+				CONSTRAINT BLOB_LIST_USERS_FK FOREIGN KEY (OWNER_ID) REFERENCES USERS (USER_ID) ON DELETE CASCADE ON UPDATE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`ALTER TABLE FILE_LIST ADD COLUMN IF NOT EXISTS BLOB_ID int(11) DEFAULT NULL AFTER FILE_PATH`,
+			`ALTER TABLE FILE_LIST ADD INDEX IF NOT EXISTS FILE_LIST_BLOB_ID_IDX (BLOB_ID)`,
+		},
+	},
+	{
+		version:     2,
+		description: "per-user data keys for encryption at rest",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS USER_KEYS (
+				USER_ID int(11) NOT NULL,
+				WRAPPED_KEY varbinary(255) NOT NULL,
+				MASTER_KEY_ID varchar(32) NOT NULL,
+				created_at timestamp NOT NULL DEFAULT current_timestamp(),
+				rotated_at timestamp NULL DEFAULT NULL,
+				PRIMARY KEY (USER_ID),
+				KEY USER_KEYS_MASTER_KEY_ID_IDX (MASTER_KEY_ID),
+				CONSTRAINT USER_KEYS_USERS_FK FOREIGN KEY (USER_ID) REFERENCES USERS (USER_ID) ON DELETE CASCADE ON UPDATE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`ALTER TABLE BLOB_LIST ADD COLUMN IF NOT EXISTS ENCRYPTED tinyint(1) NOT NULL DEFAULT 0 AFTER REF_COUNT`,
+		},
+	},
+	{
+		version:     3,
+		description: "persisted admin settings and compressed blobs",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS SYSTEM_SETTINGS (
+				SETTINGS_GROUP varchar(32) NOT NULL,
+				SETTINGS_VALUE longtext NOT NULL,
+				updated_at timestamp NOT NULL DEFAULT current_timestamp() ON UPDATE current_timestamp(),
+				PRIMARY KEY (SETTINGS_GROUP)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`ALTER TABLE BLOB_LIST ADD COLUMN IF NOT EXISTS CODEC varchar(16) NOT NULL DEFAULT 'none' AFTER ENCRYPTED`,
+			`ALTER TABLE BLOB_LIST ADD COLUMN IF NOT EXISTS STORED_SIZE bigint(20) DEFAULT NULL AFTER BLOB_SIZE`,
+		},
+	},
+	{
+		version:     4,
+		description: "quota reconciliation audit",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS QUOTA_AUDIT (
+				AUDIT_ID int(11) NOT NULL AUTO_INCREMENT,
+				USER_ID int(11) NOT NULL,
+				OLD_USED bigint(20) NOT NULL,
+				NEW_USED bigint(20) NOT NULL,
+				DELTA bigint(20) NOT NULL,
+				SOURCE varchar(100) NOT NULL,
+				created_at timestamp NOT NULL DEFAULT current_timestamp(),
+				PRIMARY KEY (AUDIT_ID),
+				KEY QUOTA_AUDIT_USER_IDX (USER_ID),
+				CONSTRAINT QUOTA_AUDIT_USERS_FK FOREIGN KEY (USER_ID) REFERENCES USERS (USER_ID) ON DELETE CASCADE ON UPDATE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+	},
+	{
+		version:     5,
+		description: "finalized tus uploads",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS UPLOAD_LIST (
+				UPLOAD_ID varchar(64) NOT NULL,
+				USER_ID int(11) NOT NULL,
+				FILE_ID int(11) DEFAULT NULL,
+				created_at timestamp NOT NULL DEFAULT current_timestamp(),
+				PRIMARY KEY (UPLOAD_ID),
+				KEY UPLOAD_LIST_USER_IDX (USER_ID),
+				KEY UPLOAD_LIST_FILE_IDX (FILE_ID),
+				CONSTRAINT UPLOAD_LIST_USERS_FK FOREIGN KEY (USER_ID) REFERENCES USERS (USER_ID) ON DELETE CASCADE ON UPDATE CASCADE,
+				CONSTRAINT UPLOAD_LIST_FILE_LIST_FK FOREIGN KEY (FILE_ID) REFERENCES FILE_LIST (FILE_ID) ON DELETE SET NULL
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+	},
+	{
+		version:     6,
+		description: "file version history",
+		statements: []string{
+			`ALTER TABLE FILE_LIST ADD COLUMN IF NOT EXISTS VERSION_NO int(11) NOT NULL DEFAULT 1 AFTER BLOB_ID`,
+			`CREATE TABLE IF NOT EXISTS FILE_VERSIONS (
+				VERSION_ID int(11) NOT NULL AUTO_INCREMENT,
+				FILE_ID int(11) NOT NULL,
+				VERSION_NO int(11) NOT NULL,
+				BLOB_ID int(11) NOT NULL,
+				FILE_TYPE varchar(100) DEFAULT NULL,
+				FILE_SIZE bigint(20) NOT NULL,
+				created_at timestamp NOT NULL DEFAULT current_timestamp(),
+				PRIMARY KEY (VERSION_ID),
+				UNIQUE KEY FILE_VERSIONS_FILE_VERSION_UK (FILE_ID, VERSION_NO),
+				KEY FILE_VERSIONS_BLOB_ID_IDX (BLOB_ID),
+				CONSTRAINT FILE_VERSIONS_FILE_LIST_FK FOREIGN KEY (FILE_ID) REFERENCES FILE_LIST (FILE_ID) ON DELETE CASCADE ON UPDATE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`ALTER TABLE UPLOAD_LIST ADD COLUMN IF NOT EXISTS VERSION_NO int(11) NOT NULL DEFAULT 1 AFTER FILE_ID`,
+			`ALTER TABLE USERS ADD COLUMN IF NOT EXISTS VERSION_RETENTION int(11) DEFAULT NULL`,
+		},
+	},
+	{
+		version:     7,
+		description: "unique names among active items of a folder",
+		prepare:     renameDuplicateFiles,
+		statements: []string{
+			// Folders are found by path, so duplicates already show the same contents and the extra rows
+			// can go. Their shares would go with them, so those are moved to the first folder of each
+			// name, which is the one kept.
+			`UPDATE SHARED_FOLDER sf
+			JOIN FOLDER_LIST d ON d.FOLDER_ID = sf.FOLDER_ID AND d.STATUS = 'active'
+			JOIN FOLDER_LIST o ON o.OWNER_ID = d.OWNER_ID AND o.PATH = d.PATH AND o.FOLDER_NAME = d.FOLDER_NAME
+				AND o.STATUS = 'active' AND (o.created_at, o.FOLDER_ID) < (d.created_at, d.FOLDER_ID)
+			LEFT JOIN FOLDER_LIST e ON e.OWNER_ID = o.OWNER_ID AND e.PATH = o.PATH AND e.FOLDER_NAME = o.FOLDER_NAME
+				AND e.STATUS = 'active' AND (e.created_at, e.FOLDER_ID) < (o.created_at, o.FOLDER_ID)
+			SET sf.FOLDER_ID = o.FOLDER_ID
+			WHERE e.FOLDER_ID IS NULL`,
+			`DELETE d FROM FOLDER_LIST d
+			JOIN FOLDER_LIST o ON o.OWNER_ID = d.OWNER_ID AND o.PATH = d.PATH AND o.FOLDER_NAME = d.FOLDER_NAME
+				AND o.STATUS = 'active' AND (o.created_at, o.FOLDER_ID) < (d.created_at, d.FOLDER_ID)
+			WHERE d.STATUS = 'active'`,
+			// Paths are text, so the key is a hash; names compare case-insensitively like the lookups do
+			`ALTER TABLE FILE_LIST ADD COLUMN IF NOT EXISTS NAME_KEY char(64) AS
+				(IF(STATUS = 'active', SHA2(CONCAT(LOWER(FILE_PATH), '/', LOWER(FILE_NAME)), 256), NULL)) PERSISTENT`,
+			`ALTER TABLE FILE_LIST ADD UNIQUE KEY IF NOT EXISTS FILE_LIST_ACTIVE_NAME_UK (OWNER_ID, NAME_KEY)`,
+			`ALTER TABLE FOLDER_LIST ADD COLUMN IF NOT EXISTS NAME_KEY char(64) AS
+				(IF(STATUS = 'active', SHA2(CONCAT(LOWER(PATH), '/', LOWER(FOLDER_NAME)), 256), NULL)) PERSISTENT`,
+			`ALTER TABLE FOLDER_LIST ADD UNIQUE KEY IF NOT EXISTS FOLDER_LIST_ACTIVE_NAME_UK (OWNER_ID, NAME_KEY)`,
+		},
+	},
+	{
+		version:     8,
+		description: "folder hierarchy by parent ID",
+		statements: []string{
+			// PARENT_ID and FOLDER_ID are NULL for items at the root. PATH and FILE_PATH stay as a
+			// cache of where an item is, which legacy storage keys and path-based routes rely on.
+			`ALTER TABLE FOLDER_LIST ADD COLUMN IF NOT EXISTS PARENT_ID varchar(100) DEFAULT NULL AFTER OWNER_ID`,
+			`ALTER TABLE FOLDER_LIST ADD INDEX IF NOT EXISTS FOLDER_LIST_PARENT_ID_IDX (PARENT_ID, OWNER_ID)`,
+			`ALTER TABLE FILE_LIST ADD COLUMN IF NOT EXISTS FOLDER_ID varchar(100) DEFAULT NULL AFTER OWNER_ID`,
+			`ALTER TABLE FILE_LIST ADD INDEX IF NOT EXISTS FILE_LIST_FOLDER_ID_IDX (FOLDER_ID, OWNER_ID)`,
+			// Items are linked to the folder their path names, the active one where a trashed folder has the same path.
+			// Linking isn't a change to the item, so modified_at is kept rather than updated.
+			`UPDATE FOLDER_LIST f JOIN FOLDER_LIST p ON p.OWNER_ID = f.OWNER_ID AND p.STATUS = 'active'
+				AND CONCAT(IF(p.PATH = '/', '', p.PATH), '/', p.FOLDER_NAME) = f.PATH
+			SET f.PARENT_ID = p.FOLDER_ID, f.modified_at = f.modified_at
+			WHERE f.PARENT_ID IS NULL AND f.PATH <> '/'`,
+			`UPDATE FOLDER_LIST f JOIN FOLDER_LIST p ON p.OWNER_ID = f.OWNER_ID
+				AND CONCAT(IF(p.PATH = '/', '', p.PATH), '/', p.FOLDER_NAME) = f.PATH
+			SET f.PARENT_ID = p.FOLDER_ID, f.modified_at = f.modified_at
+			WHERE f.PARENT_ID IS NULL AND f.PATH <> '/'`,
+			`UPDATE FILE_LIST f JOIN FOLDER_LIST p ON p.OWNER_ID = f.OWNER_ID AND p.STATUS = 'active'
+				AND CONCAT(IF(p.PATH = '/', '', p.PATH), '/', p.FOLDER_NAME) = f.FILE_PATH
+			SET f.FOLDER_ID = p.FOLDER_ID, f.modified_at = f.modified_at
+			WHERE f.FOLDER_ID IS NULL AND f.FILE_PATH <> '/'`,
+			`UPDATE FILE_LIST f JOIN FOLDER_LIST p ON p.OWNER_ID = f.OWNER_ID
+				AND CONCAT(IF(p.PATH = '/', '', p.PATH), '/', p.FOLDER_NAME) = f.FILE_PATH
+			SET f.FOLDER_ID = p.FOLDER_ID, f.modified_at = f.modified_at
+			WHERE f.FOLDER_ID IS NULL AND f.FILE_PATH <> '/'`,
+		},
+	},
+	{
+		version:     9,
+		description: "one share per user and item",
+		statements: []string{
+			// Shares were inserted without a key to catch repeats, so duplicates are dropped while adding one
+			`ALTER IGNORE TABLE SHARED_FILE ADD UNIQUE KEY IF NOT EXISTS SHARED_FILE_USER_FILE_UK (USER_ID, FILE_ID)`,
+			`ALTER IGNORE TABLE SHARED_FOLDER ADD UNIQUE KEY IF NOT EXISTS SHARED_FOLDER_USER_FOLDER_UK (USER_ID, FOLDER_ID)`,
+		},
+	},
+	{
+		version:     10,
+		description: "search indexes",
+		statements: []string{
+			// Search filters an owner's items by status and then one of these; a name pattern that
+			// doesn't start with a wildcard is a range on the name index
+			`ALTER TABLE FILE_LIST ADD INDEX IF NOT EXISTS FILE_LIST_OWNER_NAME_IDX (OWNER_ID, STATUS, FILE_NAME)`,
+			`ALTER TABLE FILE_LIST ADD INDEX IF NOT EXISTS FILE_LIST_OWNER_TYPE_IDX (OWNER_ID, STATUS, FILE_TYPE)`,
+			`ALTER TABLE FILE_LIST ADD INDEX IF NOT EXISTS FILE_LIST_OWNER_SIZE_IDX (OWNER_ID, STATUS, FILE_SIZE)`,
+			`ALTER TABLE FILE_LIST ADD INDEX IF NOT EXISTS FILE_LIST_OWNER_MODIFIED_IDX (OWNER_ID, STATUS, modified_at)`,
+			// FOLDER_NAME is text, so only its start is indexed
+			`ALTER TABLE FOLDER_LIST ADD INDEX IF NOT EXISTS FOLDER_LIST_OWNER_NAME_IDX (OWNER_ID, STATUS, FOLDER_NAME(100))`,
+			`ALTER TABLE FOLDER_LIST ADD INDEX IF NOT EXISTS FOLDER_LIST_OWNER_MODIFIED_IDX (OWNER_ID, STATUS, modified_at)`,
+		},
+	},
+	{
+		version:     11,
+		description: "full-text index queue",
+		statements: []string{
+			// Entries outlive the files they name, so there are no foreign keys
+			`CREATE TABLE IF NOT EXISTS FULLTEXT_QUEUE (
+				QUEUE_ID bigint(20) NOT NULL AUTO_INCREMENT,
+				FILE_ID int(11) DEFAULT NULL,
+				FOLDER_ID varchar(100) DEFAULT NULL,
+				CONTENTS tinyint(1) NOT NULL DEFAULT 0,
+				created_at timestamp NOT NULL DEFAULT current_timestamp(),
+				PRIMARY KEY (QUEUE_ID)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+	},
+	{
+		version:     12,
+		description: "tags and metadata",
+		statements: []string{
+			// Tags are stored lowercase, so each is kept once per item. The folder tables use the
+			// collation of FOLDER_LIST, which their foreign keys require.
+			`CREATE TABLE IF NOT EXISTS FILE_TAGS (
+				FILE_ID int(11) NOT NULL,
+				TAG varchar(64) NOT NULL,
+				created_at timestamp NOT NULL DEFAULT current_timestamp(),
+				PRIMARY KEY (FILE_ID, TAG),
+				KEY FILE_TAGS_TAG_IDX (TAG),
+				CONSTRAINT FILE_TAGS_FILE_LIST_FK FOREIGN KEY (FILE_ID) REFERENCES FILE_LIST (FILE_ID) ON DELETE CASCADE ON UPDATE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS FOLDER_TAGS (
+				FOLDER_ID varchar(100) NOT NULL,
+				TAG varchar(64) NOT NULL,
+				created_at timestamp NOT NULL DEFAULT current_timestamp(),
+				PRIMARY KEY (FOLDER_ID, TAG),
+				KEY FOLDER_TAGS_TAG_IDX (TAG),
+				CONSTRAINT FOLDER_TAGS_FOLDER_LIST_FK FOREIGN KEY (FOLDER_ID) REFERENCES FOLDER_LIST (FOLDER_ID) ON DELETE CASCADE ON UPDATE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_uca1400_ai_ci`,
+			`CREATE TABLE IF NOT EXISTS FILE_METADATA (
+				FILE_ID int(11) NOT NULL,
+				META_KEY varchar(64) NOT NULL,
+				META_VALUE text NOT NULL,
+				modified_at timestamp NOT NULL DEFAULT current_timestamp() ON UPDATE current_timestamp(),
+				PRIMARY KEY (FILE_ID, META_KEY),
+				CONSTRAINT FILE_METADATA_FILE_LIST_FK FOREIGN KEY (FILE_ID) REFERENCES FILE_LIST (FILE_ID) ON DELETE CASCADE ON UPDATE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS FOLDER_METADATA (
+				FOLDER_ID varchar(100) NOT NULL,
+				META_KEY varchar(64) NOT NULL,
+				META_VALUE text NOT NULL,
+				modified_at timestamp NOT NULL DEFAULT current_timestamp() ON UPDATE current_timestamp(),
+				PRIMARY KEY (FOLDER_ID, META_KEY),
+				CONSTRAINT FOLDER_METADATA_FOLDER_LIST_FK FOREIGN KEY (FOLDER_ID) REFERENCES FOLDER_LIST (FOLDER_ID) ON DELETE CASCADE ON UPDATE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_uca1400_ai_ci`,
+		},
+	},
+	{
+		version:     13,
+		description: "starred items and recent activity",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS STARRED_FILE (
+				USER_ID int(11) NOT NULL,
+				FILE_ID int(11) NOT NULL,
+				created_at timestamp NOT NULL DEFAULT current_timestamp(),
+				PRIMARY KEY (USER_ID, FILE_ID),
+				KEY STARRED_FILE_FILE_IDX (FILE_ID),
+				CONSTRAINT STARRED_FILE_USERS_FK FOREIGN KEY (USER_ID) REFERENCES USERS (USER_ID) ON DELETE CASCADE ON UPDATE CASCADE,
+				CONSTRAINT STARRED_FILE_FILE_LIST_FK FOREIGN KEY (FILE_ID) REFERENCES FILE_LIST (FILE_ID) ON DELETE CASCADE ON UPDATE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS STARRED_FOLDER (
+				USER_ID int(11) NOT NULL,
+				FOLDER_ID varchar(100) NOT NULL,
+				created_at timestamp NOT NULL DEFAULT current_timestamp(),
+				PRIMARY KEY (USER_ID, FOLDER_ID),
+				KEY STARRED_FOLDER_FOLDER_IDX (FOLDER_ID),
+				CONSTRAINT STARRED_FOLDER_USERS_FK FOREIGN KEY (USER_ID) REFERENCES USERS (USER_ID) ON DELETE CASCADE ON UPDATE CASCADE,
+				CONSTRAINT STARRED_FOLDER_FOLDER_LIST_FK FOREIGN KEY (FOLDER_ID) REFERENCES FOLDER_LIST (FOLDER_ID) ON DELETE CASCADE ON UPDATE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_uca1400_ai_ci`,
+			// Only a user's latest action on each file is kept, so the table grows with files, not with requests
+			`CREATE TABLE IF NOT EXISTS FILE_ACTIVITY (
+				USER_ID int(11) NOT NULL,
+				FILE_ID int(11) NOT NULL,
+				ACTION varchar(16) NOT NULL,
+				accessed_at timestamp NOT NULL DEFAULT current_timestamp(),
+				PRIMARY KEY (USER_ID, FILE_ID),
+				KEY FILE_ACTIVITY_USER_TIME_IDX (USER_ID, accessed_at),
+				KEY FILE_ACTIVITY_FILE_IDX (FILE_ID),
+				CONSTRAINT FILE_ACTIVITY_USERS_FK FOREIGN KEY (USER_ID) REFERENCES USERS (USER_ID) ON DELETE CASCADE ON UPDATE CASCADE,
+				CONSTRAINT FILE_ACTIVITY_FILE_LIST_FK FOREIGN KEY (FILE_ID) REFERENCES FILE_LIST (FILE_ID) ON DELETE CASCADE ON UPDATE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+	},
+	{
+		version:     14,
+		description: "items trashed along with a replaced folder",
+		statements: []string{
+			// The contents of a replaced folder go to the trash with it and name it here, so they are
+			// restored together with the folder instead of being listed in the trash one by one
+			`ALTER TABLE FOLDER_LIST ADD COLUMN IF NOT EXISTS TRASHED_WITH varchar(100) DEFAULT NULL AFTER STATUS`,
+			`ALTER TABLE FOLDER_LIST ADD INDEX IF NOT EXISTS FOLDER_LIST_TRASHED_WITH_IDX (TRASHED_WITH)`,
+			`ALTER TABLE FILE_LIST ADD COLUMN IF NOT EXISTS TRASHED_WITH varchar(100) DEFAULT NULL AFTER STATUS`,
+			`ALTER TABLE FILE_LIST ADD INDEX IF NOT EXISTS FILE_LIST_TRASHED_WITH_IDX (TRASHED_WITH)`,
+		},
+	},
+	{
+		version:     15,
+		description: "folder hierarchy by parent ID alone",
+		statements: []string{
+			// Items are found through the folder they are in rather than its path, so a move or rename
+			// only changes the item's own row. Names are unique per parent ID from now on, and PATH and
+			// FILE_PATH, which every folder move had to rewrite for everything below the folder, go.
+			// Paths are derived from the folder names above an item where they are needed.
+			`ALTER TABLE FILE_LIST DROP INDEX IF EXISTS FILE_LIST_ACTIVE_NAME_UK, DROP COLUMN IF EXISTS NAME_KEY`,
+			`ALTER TABLE FILE_LIST ADD COLUMN NAME_KEY char(64) AS
+				(IF(STATUS = 'active', SHA2(CONCAT(IFNULL(FOLDER_ID, ''), '/', LOWER(FILE_NAME)), 256), NULL)) PERSISTENT,
+				ADD UNIQUE KEY FILE_LIST_ACTIVE_NAME_UK (OWNER_ID, NAME_KEY)`,
+			`ALTER TABLE FOLDER_LIST DROP INDEX IF EXISTS FOLDER_LIST_ACTIVE_NAME_UK, DROP COLUMN IF EXISTS NAME_KEY`,
+			`ALTER TABLE FOLDER_LIST ADD COLUMN NAME_KEY char(64) AS
+				(IF(STATUS = 'active', SHA2(CONCAT(IFNULL(PARENT_ID, ''), '/', LOWER(FOLDER_NAME)), 256), NULL)) PERSISTENT,
+				ADD UNIQUE KEY FOLDER_LIST_ACTIVE_NAME_UK (OWNER_ID, NAME_KEY)`,
+			`ALTER TABLE FILE_LIST DROP COLUMN IF EXISTS FILE_PATH`,
+			`ALTER TABLE FOLDER_LIST DROP COLUMN IF EXISTS PATH`,
+		},
+	},
+}
+
+// Migrate brings the schema up to date. Applied versions are recorded in SCHEMA_MIGRATIONS.
+func Migrate(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS SCHEMA_MIGRATIONS (
+		VERSION int(11) NOT NULL,
+		DESCRIPTION varchar(255) NOT NULL,
+		applied_at timestamp NOT NULL DEFAULT current_timestamp(),
+		PRIMARY KEY (VERSION)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	var current int
+	if err := db.QueryRow("SELECT COALESCE(MAX(VERSION), 0) FROM SCHEMA_MIGRATIONS").Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		log.Printf("Applying schema migration %d: %s", m.version, m.description)
+		if m.prepare != nil {
+			if err := m.prepare(db); err != nil {
+				return fmt.Errorf("migration %d failed: %w", m.version, err)
+			}
+		}
+		for _, stmt := range m.statements {
+			if _, err := db.Exec(stmt); err != nil {
+				return fmt.Errorf("migration %d failed: %w", m.version, err)
+			}
+		}
+		if _, err := db.Exec("INSERT INTO SCHEMA_MIGRATIONS (VERSION, DESCRIPTION) VALUES (?, ?)", m.version, m.description); err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+// maxFileName is the length of FILE_LIST.FILE_NAME in characters
+const maxFileName = 100
+
+// renameDuplicateFiles gives every active file named like an earlier one in the same folder
+// the first free "name (n).ext", as uploads get on a conflict. Renaming isn't a change to the
+// file's contents, so modified_at is kept.
+func renameDuplicateFiles(db *sql.DB) error {
+	// Names compare like the unique key added afterwards
+	rows, err := db.Query(`SELECT FILE_ID, OWNER_ID, FILE_PATH, FILE_NAME FROM (
+			SELECT FILE_ID, OWNER_ID, FILE_PATH, FILE_NAME, ROW_NUMBER() OVER (
+				PARTITION BY OWNER_ID, SHA2(CONCAT(LOWER(FILE_PATH), '/', LOWER(FILE_NAME)), 256) ORDER BY FILE_ID) AS N
+			FROM FILE_LIST WHERE STATUS = 'active' AND FILE_PATH IS NOT NULL AND FILE_NAME IS NOT NULL
+		) f
+		WHERE N > 1
+		ORDER BY FILE_ID`)
+	if err != nil {
+		return err
+	}
+	type duplicate struct {
+		fileID, ownerID int
+		path, name      string
+	}
+	var duplicates []duplicate
+	for rows.Next() {
+		var d duplicate
+		if err := rows.Scan(&d.fileID, &d.ownerID, &d.path, &d.name); err != nil {
+			rows.Close()
+			return err
+		}
+		duplicates = append(duplicates, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range duplicates {
+		for n := 1; ; n++ {
+			// Files renamed before this one count as taken as well
+			candidate := numberedName(d.name, n)
+			var taken bool
+			err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM FILE_LIST WHERE OWNER_ID = ? AND STATUS = 'active'
+				AND SHA2(CONCAT(LOWER(FILE_PATH), '/', LOWER(FILE_NAME)), 256) = SHA2(CONCAT(LOWER(?), '/', LOWER(?)), 256))`,
+				d.ownerID, d.path, candidate).Scan(&taken)
+			if err != nil {
+				return err
+			}
+			if taken {
+				continue
+			}
+			if _, err := db.Exec("UPDATE FILE_LIST SET FILE_NAME = ?, modified_at = modified_at WHERE FILE_ID = ?", candidate, d.fileID); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// numberedName is name with " (n)" added before its extension, with the name
+// shortened where that would not fit in FILE_NAME
+func numberedName(name string, n int) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if base == "" || utf8.RuneCountInString(ext) > maxFileName/2 {
+		// A dotfile such as .env has no extension, just a name, and neither has a long run after a dot
+		base, ext = name, ""
+	}
+	suffix := fmt.Sprintf(" (%d)%s", n, ext)
+	if room := maxFileName - utf8.RuneCountInString(suffix); utf8.RuneCountInString(base) > room {
+		base = string([]rune(base)[:room])
+	}
+	return base + suffix
+}
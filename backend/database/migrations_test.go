@@ -0,0 +1,33 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNumberedName(t *testing.T) {
+	long := strings.Repeat("x", 120)
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"report.pdf", 1, "report (1).pdf"},
+		{"archive.tar.gz", 2, "archive.tar (2).gz"},
+		{".env", 1, ".env (1)"},
+		{strings.Repeat("a", 96) + ".pdf", 3, strings.Repeat("a", 92) + " (3).pdf"},
+		{strings.Repeat("é", 100), 12, strings.Repeat("é", 95) + " (12)"},
+		{long, 1, long[:96] + " (1)"},
+		{"a." + long, 1, ("a." + long)[:96] + " (1)"},
+	}
+	for _, tt := range tests {
+		got := numberedName(tt.name, tt.n)
+		if got != tt.want {
+			t.Errorf("numberedName(%q, %d) = %q, want %q", tt.name, tt.n, got, tt.want)
+		}
+		if utf8.RuneCountInString(got) > maxFileName {
+			t.Errorf("numberedName(%q, %d) is %d characters long", tt.name, tt.n, utf8.RuneCountInString(got))
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/minio/sio"
+)
+
+const dataKeySize = 32
+
+// masterKey wraps per-user data keys. Its ID is derived from the key itself
+// so rows record which master key they were wrapped with.
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func parseMasterKey(encoded string) (*masterKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %w", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &masterKey{id: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+// wrap seals a data key; the user ID is bound as additional data so a wrapped
+// key cannot be copied onto another account.
+func (m *masterKey) wrap(userID int, dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return m.aead.Seal(nonce, nonce, dataKey, []byte(strconv.Itoa(userID))), nil
+}
+
+func (m *masterKey) unwrap(userID int, wrapped []byte) ([]byte, error) {
+	nonceSize := m.aead.NonceSize()
+	if len(wrapped) < nonceSize {
+		return nil, errors.New("wrapped key is too short")
+	}
+	return m.aead.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], []byte(strconv.Itoa(userID)))
+}
+
+// Keyring hands out per-user data keys, stored in USER_KEYS wrapped by the master key
+type Keyring struct {
+	db       *sql.DB
+	current  *masterKey
+	previous *masterKey
+
+	mu    sync.Mutex
+	cache map[int][]byte
+}
+
+// NewKeyringFromEnv loads MASTER_KEY (and MASTER_KEY_PREVIOUS during a rotation).
+// It returns nil when no master key is configured, which leaves encryption off.
+func NewKeyringFromEnv(db *sql.DB) (*Keyring, error) {
+	encoded := os.Getenv("MASTER_KEY")
+	if encoded == "" {
+		return nil, nil
+	}
+	current, err := parseMasterKey(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("MASTER_KEY: %w", err)
+	}
+
+	k := &Keyring{db: db, current: current, cache: make(map[int][]byte)}
+	if encodedPrevious := os.Getenv("MASTER_KEY_PREVIOUS"); encodedPrevious != "" {
+		if k.previous, err = parseMasterKey(encodedPrevious); err != nil {
+			return nil, fmt.Errorf("MASTER_KEY_PREVIOUS: %w", err)
+		}
+	}
+	return k, nil
+}
+
+func (k *Keyring) masterFor(id string) (*masterKey, error) {
+	if id == k.current.id {
+		return k.current, nil
+	}
+	if k.previous != nil && id == k.previous.id {
+		return k.previous, nil
+	}
+	return nil, fmt.Errorf("data key is wrapped with unknown master key %s", id)
+}
+
+// DataKey returns the user's data key, generating and storing one on first use
+func (k *Keyring) DataKey(ctx context.Context, userID int) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if key, ok := k.cache[userID]; ok {
+		return key, nil
+	}
+
+	var wrapped []byte
+	var masterID string
+	err := k.db.QueryRowContext(ctx, "SELECT WRAPPED_KEY, MASTER_KEY_ID FROM USER_KEYS WHERE USER_ID = ?", userID).Scan(&wrapped, &masterID)
+	if err == sql.ErrNoRows {
+		if err := k.createDataKey(ctx, userID); err != nil {
+			return nil, err
+		}
+		// Read back whatever won, in case another request created the key concurrently
+		err = k.db.QueryRowContext(ctx, "SELECT WRAPPED_KEY, MASTER_KEY_ID FROM USER_KEYS WHERE USER_ID = ?", userID).Scan(&wrapped, &masterID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load data key for user %d: %w", userID, err)
+	}
+
+	master, err := k.masterFor(masterID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := master.unwrap(userID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key for user %d: %w", userID, err)
+	}
+	k.cache[userID] = key
+	return key, nil
+}
+
+func (k *Keyring) createDataKey(ctx context.Context, userID int) error {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	wrapped, err := k.current.wrap(userID, key)
+	if err != nil {
+		return err
+	}
+	_, err = k.db.ExecContext(ctx, "INSERT IGNORE INTO USER_KEYS (USER_ID, WRAPPED_KEY, MASTER_KEY_ID) VALUES (?, ?, ?)", userID, wrapped, k.current.id)
+	return err
+}
+
+// Rotate re-wraps every data key that is not yet wrapped by the current master key.
+// File contents are untouched because the data keys themselves do not change.
+func (k *Keyring) Rotate(ctx context.Context) (int, error) {
+	rows, err := k.db.QueryContext(ctx, "SELECT USER_ID, WRAPPED_KEY, MASTER_KEY_ID FROM USER_KEYS WHERE MASTER_KEY_ID <> ?", k.current.id)
+	if err != nil {
+		return 0, err
+	}
+	type wrappedKey struct {
+		userID   int
+		wrapped  []byte
+		masterID string
+	}
+	var pending []wrappedKey
+	for rows.Next() {
+		var w wrappedKey
+		if err := rows.Scan(&w.userID, &w.wrapped, &w.masterID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, w)
+	}
+	rows.Close()
+
+	rotated := 0
+	for _, w := range pending {
+		master, err := k.masterFor(w.masterID)
+		if err != nil {
+			return rotated, fmt.Errorf("user %d: %w", w.userID, err)
+		}
+		key, err := master.unwrap(w.userID, w.wrapped)
+		if err != nil {
+			return rotated, fmt.Errorf("user %d: failed to unwrap data key: %w", w.userID, err)
+		}
+		rewrapped, err := k.current.wrap(w.userID, key)
+		if err != nil {
+			return rotated, err
+		}
+		_, err = k.db.ExecContext(ctx, "UPDATE USER_KEYS SET WRAPPED_KEY = ?, MASTER_KEY_ID = ?, rotated_at = current_timestamp() WHERE USER_ID = ? AND MASTER_KEY_ID = ?", rewrapped, k.current.id, w.userID, w.masterID)
+		if err != nil {
+			return rotated, fmt.Errorf("user %d: failed to store re-wrapped key: %w", w.userID, err)
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+func sioConfig(key []byte) sio.Config {
+	return sio.Config{MinVersion: sio.Version20, Key: key}
+}
+
+// EncryptReader returns a reader producing the encrypted form of src
+func EncryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	return sio.EncryptReader(src, sioConfig(key))
+}
+
+// DecryptReader returns a reader producing the plaintext of an encrypted stream
+func DecryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	return sio.DecryptReader(src, sioConfig(key))
+}
+
+// DecryptReaderAt allows random access into an encrypted stream, which keeps range requests working
+func DecryptReaderAt(src io.ReaderAt, key []byte) (io.ReaderAt, error) {
+	return sio.DecryptReaderAt(src, sioConfig(key))
+}
+
+// EncryptedSize returns how large plaintext of the given size becomes once encrypted
+func EncryptedSize(size int64) (int64, error) {
+	n, err := sio.EncryptedSize(uint64(size))
+	return int64(n), err
+}
+
+// DecryptedSize returns the plaintext size of an encrypted stream
+func DecryptedSize(size int64) (int64, error) {
+	n, err := sio.DecryptedSize(uint64(size))
+	return int64(n), err
+}
@@ -0,0 +1,169 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+)
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testMasterKey(t *testing.T) *masterKey {
+	t.Helper()
+	m, err := parseMasterKey(base64.StdEncoding.EncodeToString(randomBytes(t, 32)))
+	if err != nil {
+		t.Fatalf("parseMasterKey: %v", err)
+	}
+	return m
+}
+
+func TestParseMasterKey(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	tests := []struct {
+		name    string
+		encoded string
+		wantErr bool
+	}{
+		{"valid", valid, false},
+		{"not base64", "not base64!", true},
+		{"too short", base64.StdEncoding.EncodeToString(make([]byte, 16)), true},
+		{"too long", base64.StdEncoding.EncodeToString(make([]byte, 64)), true},
+	}
+	for _, tt := range tests {
+		_, err := parseMasterKey(tt.encoded)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseMasterKey error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// The ID follows from the key, so the same key always gets the same ID
+	a, _ := parseMasterKey(valid)
+	b, _ := parseMasterKey(valid)
+	if a.id != b.id || len(a.id) != 16 {
+		t.Errorf("IDs of the same key = %q and %q, want the same 16 hex digits", a.id, b.id)
+	}
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	m := testMasterKey(t)
+	other := testMasterKey(t)
+	dataKey := randomBytes(t, dataKeySize)
+
+	wrapped, err := m.wrap(42, dataKey)
+	if err != nil {
+		t.Fatalf("wrap: %v", err)
+	}
+	again, _ := m.wrap(42, dataKey)
+	if bytes.Equal(wrapped, again) {
+		t.Error("wrapping the same key twice gave the same bytes, want a fresh nonce each time")
+	}
+
+	tests := []struct {
+		name    string
+		master  *masterKey
+		userID  int
+		wrapped []byte
+		wantErr bool
+	}{
+		{"same user", m, 42, wrapped, false},
+		{"other user", m, 43, wrapped, true},
+		{"other master key", other, 42, wrapped, true},
+		{"tampered", m, 42, append(append([]byte{}, wrapped[:len(wrapped)-1]...), wrapped[len(wrapped)-1]^1), true},
+		{"too short", m, 42, wrapped[:4], true},
+	}
+	for _, tt := range tests {
+		got, err := tt.master.unwrap(tt.userID, tt.wrapped)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unwrap error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !bytes.Equal(got, dataKey) {
+			t.Errorf("%s: unwrap did not return the data key", tt.name)
+		}
+	}
+}
+
+func TestKeyringMasterFor(t *testing.T) {
+	k := &Keyring{current: testMasterKey(t), previous: testMasterKey(t)}
+	if m, err := k.masterFor(k.current.id); err != nil || m != k.current {
+		t.Errorf("masterFor(current) = %v, %v", m, err)
+	}
+	if m, err := k.masterFor(k.previous.id); err != nil || m != k.previous {
+		t.Errorf("masterFor(previous) = %v, %v", m, err)
+	}
+	if _, err := k.masterFor("0000000000000000"); err == nil {
+		t.Error("masterFor(unknown) succeeded, want an error")
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := randomBytes(t, dataKeySize)
+	for _, size := range []int{0, 1, 64 * 1024, 64*1024 + 1, 300 * 1000} {
+		plain := randomBytes(t, size)
+		encrypted, err := EncryptReader(bytes.NewReader(plain), key)
+		if err != nil {
+			t.Fatalf("EncryptReader: %v", err)
+		}
+		ciphertext, err := io.ReadAll(encrypted)
+		if err != nil {
+			t.Fatalf("size %d: encrypting: %v", size, err)
+		}
+		if want, _ := EncryptedSize(int64(size)); int64(len(ciphertext)) != want {
+			t.Errorf("size %d: encrypted to %d bytes, EncryptedSize says %d", size, len(ciphertext), want)
+		}
+		if got, _ := DecryptedSize(int64(len(ciphertext))); got != int64(size) {
+			t.Errorf("size %d: DecryptedSize = %d", size, got)
+		}
+		// Nothing encrypts to nothing, which is not a stream DecryptReader takes
+		if size == 0 {
+			continue
+		}
+
+		decrypted, err := DecryptReader(bytes.NewReader(ciphertext), key)
+		if err != nil {
+			t.Fatalf("DecryptReader: %v", err)
+		}
+		got, err := io.ReadAll(decrypted)
+		if err != nil {
+			t.Fatalf("size %d: decrypting: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: round trip changed the data", size)
+		}
+
+		// Range requests read from the middle of the stream
+		if size > 10 {
+			at, err := DecryptReaderAt(bytes.NewReader(ciphertext), key)
+			if err != nil {
+				t.Fatalf("DecryptReaderAt: %v", err)
+			}
+			part := make([]byte, 10)
+			if _, err := at.ReadAt(part, int64(size/2)); err != nil {
+				t.Fatalf("size %d: ReadAt: %v", size, err)
+			}
+			if !bytes.Equal(part, plain[size/2:size/2+10]) {
+				t.Errorf("size %d: ReadAt returned the wrong bytes", size)
+			}
+		}
+	}
+
+	encrypted, _ := EncryptReader(strings.NewReader("secret"), key)
+	ciphertext, _ := io.ReadAll(encrypted)
+	decrypted, err := DecryptReader(bytes.NewReader(ciphertext), randomBytes(t, dataKeySize))
+	if err == nil {
+		_, err = io.ReadAll(decrypted)
+	}
+	if err == nil {
+		t.Error("decrypting with another key succeeded, want an error")
+	}
+}
@@ -0,0 +1,164 @@
+package fulltext
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+)
+
+// Limits on what gets indexed. Larger files are skipped; longer text is cut off.
+const (
+	maxSourceSize = 64 << 20
+	maxTextSize   = 1 << 20
+)
+
+// errNotText is returned for contents that turn out not to be text after all
+var errNotText = errors.New("contents are not text")
+
+// Kinds of extraction
+const (
+	kindText = "text"
+	kindHTML = "html"
+	kindPDF  = "pdf"
+)
+
+// extensions maps file extensions to how their text is extracted: prose, markup, data and source code
+var extensions = map[string]string{
+	".txt": kindText, ".md": kindText, ".markdown": kindText, ".rst": kindText, ".csv": kindText, ".tsv": kindText,
+	".log": kindText, ".json": kindText, ".xml": kindText, ".yaml": kindText, ".yml": kindText, ".toml": kindText,
+	".ini": kindText, ".conf": kindText, ".tex": kindText, ".sql": kindText, ".css": kindText,
+	".go": kindText, ".py": kindText, ".js": kindText, ".mjs": kindText, ".ts": kindText, ".jsx": kindText,
+	".tsx": kindText, ".svelte": kindText, ".vue": kindText, ".java": kindText, ".kt": kindText, ".c": kindText,
+	".h": kindText, ".cpp": kindText, ".hpp": kindText, ".cs": kindText, ".rs": kindText, ".rb": kindText,
+	".php": kindText, ".sh": kindText, ".swift": kindText, ".scala": kindText, ".lua": kindText, ".r": kindText,
+	".html": kindHTML, ".htm": kindHTML, ".xhtml": kindHTML,
+	".pdf": kindPDF,
+}
+
+// textTypes are MIME types other than text/* whose contents are text
+var textTypes = map[string]bool{
+	"application/json": true, "application/xml": true, "application/javascript": true, "application/x-javascript": true,
+	"application/x-sh": true, "application/sql": true, "application/x-yaml": true, "application/toml": true,
+}
+
+// extractKind says how text is extracted from a file, "" if it isn't.
+// The extension decides first, since browsers often report source files without a type.
+func extractKind(name, fileType string) string {
+	if kind, ok := extensions[strings.ToLower(filepath.Ext(name))]; ok {
+		return kind
+	}
+	fileType, _, _ = strings.Cut(strings.ToLower(fileType), ";")
+	switch {
+	case fileType == "application/pdf":
+		return kindPDF
+	case fileType == "text/html" || fileType == "application/xhtml+xml":
+		return kindHTML
+	case strings.HasPrefix(fileType, "text/") || textTypes[fileType]:
+		return kindText
+	}
+	return ""
+}
+
+// Extractable reports whether text can be extracted from a file of this name, type and size
+func Extractable(name, fileType string, size int64) bool {
+	return size <= maxSourceSize && extractKind(name, fileType) != ""
+}
+
+// Extract returns the text of a file, cut off at maxTextSize
+func Extract(r io.Reader, name, fileType string) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSourceSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxSourceSize {
+		return "", fmt.Errorf("file is larger than %d bytes", maxSourceSize)
+	}
+
+	var text string
+	switch extractKind(name, fileType) {
+	case kindText:
+		if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+			return "", errNotText
+		}
+		text = string(data)
+	case kindHTML:
+		text = htmlText(data)
+	case kindPDF:
+		text, err = pdfText(data)
+	default:
+		return "", errNotText
+	}
+	if err != nil {
+		return "", err
+	}
+	return truncate(text, maxTextSize), nil
+}
+
+// htmlText returns the text of an HTML document, leaving out scripts and styles
+func htmlText(data []byte) string {
+	var b strings.Builder
+	z := html.NewTokenizer(bytes.NewReader(data))
+	skip := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return b.String()
+		case html.StartTagToken:
+			if name, _ := z.TagName(); string(name) == "script" || string(name) == "style" {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); (string(name) == "script" || string(name) == "style") && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				if text := strings.TrimSpace(string(z.Text())); text != "" {
+					b.WriteString(text)
+					b.WriteByte('\n')
+				}
+			}
+		}
+	}
+}
+
+// pdfText returns the text of a PDF. The parser panics on some malformed files, which is
+// reported as an error like any other.
+func pdfText(data []byte) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unreadable PDF: %v", r)
+		}
+	}()
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	plain, err := reader.GetPlainText()
+	if err != nil {
+		return "", err
+	}
+	out, err := io.ReadAll(io.LimitReader(plain, maxTextSize))
+	if err != nil {
+		return "", err
+	}
+	return strings.ToValidUTF8(string(out), ""), nil
+}
+
+// truncate cuts text to at most n bytes without splitting a character
+func truncate(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n]
+}
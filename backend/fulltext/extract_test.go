@@ -0,0 +1,103 @@
+package fulltext
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExtractKind(t *testing.T) {
+	tests := []struct {
+		name, fileType string
+		want           string
+	}{
+		{"notes.txt", "", kindText},
+		{"README.MD", "", kindText},
+		{"main.go", "application/octet-stream", kindText},
+		{"page.html", "text/plain", kindHTML},
+		{"report.pdf", "", kindPDF},
+		// The extension wins over the type the browser sent
+		{"data.json", "application/pdf", kindText},
+		{"scan.pdf", "text/plain", kindPDF},
+		// Without a known extension the type decides
+		{"page", "text/html; charset=utf-8", kindHTML},
+		{"page", "application/xhtml+xml", kindHTML},
+		{"paper", "Application/PDF", kindPDF},
+		{"notes", "text/x-anything", kindText},
+		{"config", "application/x-yaml", kindText},
+		{"photo.jpg", "image/jpeg", ""},
+		{"archive", "application/zip", ""},
+		{"blob", "", ""},
+	}
+	for _, tt := range tests {
+		if got := extractKind(tt.name, tt.fileType); got != tt.want {
+			t.Errorf("extractKind(%q, %q) = %q, want %q", tt.name, tt.fileType, got, tt.want)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name, fileType string
+		data           string
+		want           string
+		wantErr        error // errNotText, or nil
+	}{
+		{"notes.txt", "text/plain", "hello world", "hello world", nil},
+		{"notes.txt", "text/plain", "héllo ✓", "héllo ✓", nil},
+		{"notes.txt", "text/plain", "hello\x00world", "", errNotText},
+		{"notes.txt", "text/plain", "hello \xff\xfe", "", errNotText},
+		{"page.html", "", "<p>Hello</p><script>var x = 1</script><p>there</p>", "Hello\nthere\n", nil},
+		{"photo.jpg", "image/jpeg", "\xff\xd8\xff", "", errNotText},
+	}
+	for _, tt := range tests {
+		got, err := Extract(strings.NewReader(tt.data), tt.name, tt.fileType)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("Extract(%q, %q) = %q, %v; want %q, %v", tt.data, tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestHTMLText(t *testing.T) {
+	tests := []struct {
+		html string
+		want string
+	}{
+		{"<html><body><h1>Title</h1><p>Some <b>bold</b> text</p></body></html>", "Title\nSome\nbold\ntext\n"},
+		{"<head><style>p { color: red }</style><title>Page</title></head>", "Page\n"},
+		{"<p>before</p><script>if (a < b) { alert('no') }</script><p>after</p>", "before\nafter\n"},
+		{"<SCRIPT type=\"module\">import x from 'y'</SCRIPT>kept", "kept\n"},
+		{"<p>   </p>\n\t<div>\n</div>", ""},
+		{"unclosed <p>text", "unclosed\ntext\n"},
+	}
+	for _, tt := range tests {
+		if got := htmlText([]byte(tt.html)); got != tt.want {
+			t.Errorf("htmlText(%q) = %q, want %q", tt.html, got, tt.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		text string
+		n    int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello", 3, "hel"},
+		{"hello", 0, ""},
+		// é is two bytes and ✓ three; a cut inside one drops the whole character
+		{"héllo", 2, "h"},
+		{"héllo", 3, "hé"},
+		{"a✓b", 2, "a"},
+		{"a✓b", 3, "a"},
+		{"a✓b", 4, "a✓"},
+		{"✓", 1, ""},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.text, tt.n); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.text, tt.n, got, tt.want)
+		}
+	}
+}
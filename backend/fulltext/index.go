@@ -0,0 +1,473 @@
+// Package fulltext keeps the text of users' documents in a local Bleve index so they can be
+// searched by content.
+//
+// The database stays the source of truth. Changes are queued in FULLTEXT_QUEUE, usually in
+// the transaction that makes them, and a background indexer brings the index in line with
+// the committed rows. Searches only see files the user owns or has been shared.
+package fulltext
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"my-cloud-project/backend/blobs"
+	"my-cloud-project/backend/database"
+	"my-cloud-project/backend/storage"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+	htmlhighlight "github.com/blevesearch/bleve/v2/search/highlight/highlighter/html"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+const (
+	// How often the indexer looks for queued changes
+	pollInterval = 2 * time.Second
+	// Queue entries and files handled per round
+	batchSize = 500
+	// Snippets returned per hit
+	maxSnippets = 3
+)
+
+// Index is the full-text index of all users' files
+type Index struct {
+	db    *sql.DB
+	blobs *blobs.Store
+	index bleve.Index
+	// Set when the index was just created and has to be filled from the database
+	created bool
+}
+
+// document is what the index keeps for a file. Status is "trashed" when the file or any folder
+// above it is in the trash, and Folders lists the IDs of every folder above it.
+type document struct {
+	Owner   string   `json:"owner"`
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Status  string   `json:"status"`
+	Folders []string `json:"folders"`
+	Content string   `json:"content"`
+}
+
+// Query is a content search on behalf of a user
+type Query struct {
+	Text    string
+	OwnerID int
+	// Active files shared with the user
+	SharedIDs []int64
+	// Limits the search to files below this folder
+	FolderID string
+	// Searches the user's trashed files instead of the active ones
+	Trashed    bool
+	From, Size int
+}
+
+// Hit is a file matching a search, with the matching passages marked up in HTML
+type Hit struct {
+	FileID   int64
+	Score    float64
+	Snippets []string
+}
+
+func newMapping() mapping.IndexMapping {
+	keyword := bleve.NewKeywordFieldMapping()
+	keyword.Store = false
+	// Stored text with term vectors is what snippets are cut from
+	text := bleve.NewTextFieldMapping()
+
+	doc := bleve.NewDocumentStaticMapping()
+	doc.AddFieldMappingsAt("owner", keyword)
+	doc.AddFieldMappingsAt("type", keyword)
+	doc.AddFieldMappingsAt("status", keyword)
+	doc.AddFieldMappingsAt("folders", keyword)
+	doc.AddFieldMappingsAt("name", text)
+	doc.AddFieldMappingsAt("content", text)
+
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+	return m
+}
+
+// Open opens the index in dir, creating it if there is none yet
+func Open(db *sql.DB, store *blobs.Store, dir string) (*Index, error) {
+	x := &Index{db: db, blobs: store}
+	index, err := bleve.Open(dir)
+	if errors.Is(err, bleve.ErrorIndexPathDoesNotExist) {
+		index, err = bleve.New(dir, newMapping())
+		x.created = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	x.index = index
+	return x, nil
+}
+
+// Close closes the index
+func (x *Index) Close() error {
+	return x.index.Close()
+}
+
+// Start runs the indexer until ctx is done. A new index is first filled with every file.
+func (x *Index) Start(ctx context.Context) {
+	go func() {
+		if x.created {
+			if _, err := x.db.Exec("INSERT INTO FULLTEXT_QUEUE (FILE_ID, CONTENTS) SELECT FILE_ID, 1 FROM FILE_LIST"); err != nil {
+				log.Printf("Full-text index: failed to queue existing files: %v", err)
+			}
+		}
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			for {
+				more, err := x.drain(ctx)
+				if err != nil {
+					log.Printf("Full-text index: %v", err)
+				}
+				if !more || err != nil {
+					break
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// drain applies the oldest queued changes and reports whether there are more
+func (x *Index) drain(ctx context.Context) (bool, error) {
+	rows, err := x.db.QueryContext(ctx, "SELECT QUEUE_ID, FILE_ID, FOLDER_ID, CONTENTS FROM FULLTEXT_QUEUE ORDER BY QUEUE_ID LIMIT ?", batchSize)
+	if err != nil {
+		return false, err
+	}
+	files := map[int64]bool{}
+	var folders []string
+	var lastID int64
+	count := 0
+	for rows.Next() {
+		var fileID sql.NullInt64
+		var folderID sql.NullString
+		var contents bool
+		if err := rows.Scan(&lastID, &fileID, &folderID, &contents); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if fileID.Valid {
+			files[fileID.Int64] = files[fileID.Int64] || contents
+		}
+		if folderID.Valid {
+			folders = append(folders, folderID.String)
+		}
+		count++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if count == 0 {
+		return false, nil
+	}
+
+	for _, folderID := range folders {
+		ids, err := x.filesBelow(ctx, folderID)
+		if err != nil {
+			return false, err
+		}
+		for _, id := range ids {
+			if _, ok := files[id]; !ok {
+				files[id] = false
+			}
+		}
+	}
+
+	ids := make([]int64, 0, len(files))
+	for id := range files {
+		ids = append(ids, id)
+	}
+	for start := 0; start < len(ids); start += batchSize {
+		if err := x.update(ctx, ids[start:min(start+batchSize, len(ids))], files); err != nil {
+			return false, err
+		}
+	}
+
+	if _, err := x.db.ExecContext(ctx, "DELETE FROM FULLTEXT_QUEUE WHERE QUEUE_ID <= ?", lastID); err != nil {
+		return false, err
+	}
+	return count == batchSize, nil
+}
+
+// filesBelow returns the files below a folder, both those the database has there now and those
+// the index has there, which covers files that were moved out or deleted with the folder
+func (x *Index) filesBelow(ctx context.Context, folderID string) ([]int64, error) {
+	rows, err := x.db.QueryContext(ctx, `
+		WITH RECURSIVE subtree (FOLDER_ID, DEPTH) AS (
+			SELECT FOLDER_ID, 0 FROM FOLDER_LIST WHERE FOLDER_ID = ?
+			UNION ALL
+			SELECT c.FOLDER_ID, s.DEPTH + 1 FROM FOLDER_LIST c JOIN subtree s ON c.PARENT_ID = s.FOLDER_ID
+			WHERE s.DEPTH < 256
+		)
+		SELECT f.FILE_ID FROM FILE_LIST f JOIN subtree s ON f.FOLDER_ID = s.FOLDER_ID
+	`, folderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	below := bleve.NewTermQuery(folderID)
+	below.SetField("folders")
+	for from := 0; ; from += batchSize {
+		res, err := x.index.SearchInContext(ctx, bleve.NewSearchRequestOptions(below, batchSize, from, false))
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range res.Hits {
+			if id, err := strconv.ParseInt(hit.ID, 10, 64); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		if len(res.Hits) < batchSize {
+			return ids, nil
+		}
+	}
+}
+
+// indexedFile is a file's row as the indexer needs it
+type indexedFile struct {
+	id        int64
+	doc       document
+	size      int64
+	ref       blobs.Ref
+	blobKey   sql.NullString
+	username  string
+	folderID  sql.NullString
+	reextract bool
+}
+
+// update brings files in line with the database. contents marks those whose text is extracted
+// again; the others keep the text already indexed for them.
+func (x *Index) update(ctx context.Context, ids []int64, contents map[int64]bool) error {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	rows, err := x.db.QueryContext(ctx, `
+		SELECT f.FILE_ID, f.OWNER_ID, u.USERNAME, f.FILE_NAME, COALESCE(f.FILE_TYPE, ''), COALESCE(f.FILE_SIZE, 0), f.FOLDER_ID,
+			COALESCE(f.STATUS, ''), b.STORAGE_KEY, COALESCE(b.ENCRYPTED, 0), COALESCE(b.CODEC, 'none')
+		FROM FILE_LIST f JOIN USERS u ON f.OWNER_ID = u.USER_ID LEFT JOIN BLOB_LIST b ON f.BLOB_ID = b.BLOB_ID
+		WHERE f.FILE_ID IN (`+placeholders+`)
+	`, args...)
+	if err != nil {
+		return err
+	}
+	found := map[int64]*indexedFile{}
+	for rows.Next() {
+		f := &indexedFile{}
+		if err := rows.Scan(&f.id, &f.ref.OwnerID, &f.username, &f.doc.Name, &f.doc.Type, &f.size, &f.folderID,
+			&f.doc.Status, &f.blobKey, &f.ref.Encrypted, &f.ref.Codec); err != nil {
+			rows.Close()
+			return err
+		}
+		f.doc.Owner = strconv.Itoa(f.ref.OwnerID)
+		f.reextract = contents[f.id]
+		found[f.id] = f
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Every folder above a file, and whether any of them is in the trash
+	rows, err = x.db.QueryContext(ctx, `
+		WITH RECURSIVE up (FILE_ID, FOLDER_ID, DEPTH) AS (
+			SELECT FILE_ID, FOLDER_ID, 0 FROM FILE_LIST WHERE FILE_ID IN (`+placeholders+`) AND FOLDER_ID IS NOT NULL
+			UNION ALL
+			SELECT u.FILE_ID, p.PARENT_ID, u.DEPTH + 1 FROM up u JOIN FOLDER_LIST p ON p.FOLDER_ID = u.FOLDER_ID
+			WHERE p.PARENT_ID IS NOT NULL AND u.DEPTH < 256
+		)
+		SELECT u.FILE_ID, u.FOLDER_ID, COALESCE(fl.STATUS, '') FROM up u JOIN FOLDER_LIST fl ON fl.FOLDER_ID = u.FOLDER_ID
+	`, args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var fileID int64
+		var folderID, status string
+		if err := rows.Scan(&fileID, &folderID, &status); err != nil {
+			rows.Close()
+			return err
+		}
+		if f := found[fileID]; f != nil {
+			f.doc.Folders = append(f.doc.Folders, folderID)
+			if status != "active" {
+				f.doc.Status = "trashed"
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	indexed, err := x.storedContent(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	batch := x.index.NewBatch()
+	for _, id := range ids {
+		docID := strconv.FormatInt(id, 10)
+		f := found[id]
+		if f == nil || !Extractable(f.doc.Name, f.doc.Type, f.size) {
+			batch.Delete(docID)
+			continue
+		}
+		if f.doc.Status != "active" {
+			f.doc.Status = "trashed"
+		}
+		content, ok := indexed[docID]
+		if f.reextract || !ok {
+			content, err = x.extract(ctx, f)
+			if err != nil {
+				log.Printf("Full-text index: skipping file %d: %v", id, err)
+				batch.Delete(docID)
+				continue
+			}
+		}
+		f.doc.Content = content
+		if err := batch.Index(docID, f.doc); err != nil {
+			return err
+		}
+	}
+	return x.index.Batch(batch)
+}
+
+// storedContent returns the text indexed for the files that are in the index
+func (x *Index) storedContent(ctx context.Context, ids []int64) (map[string]string, error) {
+	docIDs := make([]string, len(ids))
+	for i, id := range ids {
+		docIDs[i] = strconv.FormatInt(id, 10)
+	}
+	req := bleve.NewSearchRequestOptions(bleve.NewDocIDQuery(docIDs), len(docIDs), 0, false)
+	req.Fields = []string{"content"}
+	res, err := x.index.SearchInContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	content := make(map[string]string, len(res.Hits))
+	for _, hit := range res.Hits {
+		text, _ := hit.Fields["content"].(string)
+		content[hit.ID] = text
+	}
+	return content, nil
+}
+
+// extract reads a file's contents and returns its text
+func (x *Index) extract(ctx context.Context, f *indexedFile) (string, error) {
+	f.ref.Key = f.blobKey.String
+	if !f.blobKey.Valid {
+		// Files from before the blob store are named by their FILE_ID in the owner's tree
+		folder := "/"
+		if f.folderID.Valid {
+			paths, err := database.FolderPaths(x.db, []string{f.folderID.String})
+			if err != nil {
+				return "", err
+			}
+			if folder = paths[f.folderID.String]; folder == "" {
+				return "", fmt.Errorf("folder %s of file %d not found", f.folderID.String, f.id)
+			}
+		}
+		key, err := storage.UserKey(f.username, folder, strconv.FormatInt(f.id, 10))
+		if err != nil {
+			return "", err
+		}
+		f.ref.Key = key
+	}
+	f.ref.Size = f.size
+	obj, err := x.blobs.Open(ctx, f.ref)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	return Extract(obj, f.doc.Name, f.doc.Type)
+}
+
+// Search returns a page of the files matching q.Text that the user can see, best first, along
+// with the number of matches
+func (x *Index) Search(ctx context.Context, q Query) ([]Hit, uint64, error) {
+	content := bleve.NewMatchQuery(q.Text)
+	content.SetField("content")
+	name := bleve.NewMatchQuery(q.Text)
+	name.SetField("name")
+	name.SetBoost(2)
+
+	owner := bleve.NewTermQuery(strconv.Itoa(q.OwnerID))
+	owner.SetField("owner")
+	status := bleve.NewTermQuery("active")
+	if q.Trashed {
+		status = bleve.NewTermQuery("trashed")
+	}
+	status.SetField("status")
+
+	// Other users' files are only seen through a share, and only while they are active
+	access := bleve.NewDisjunctionQuery(owner)
+	if len(q.SharedIDs) > 0 && !q.Trashed {
+		ids := make([]string, len(q.SharedIDs))
+		for i, id := range q.SharedIDs {
+			ids[i] = strconv.FormatInt(id, 10)
+		}
+		access.AddQuery(bleve.NewDocIDQuery(ids))
+	}
+
+	conjuncts := []query.Query{bleve.NewDisjunctionQuery(content, name), access, status}
+	if q.FolderID != "" {
+		below := bleve.NewTermQuery(q.FolderID)
+		below.SetField("folders")
+		conjuncts = append(conjuncts, below)
+	}
+
+	req := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(conjuncts...), q.Size, q.From, false)
+	req.Highlight = bleve.NewHighlightWithStyle(htmlhighlight.Name)
+	req.Highlight.AddField("content")
+	req.Highlight.AddField("name")
+	res, err := x.index.SearchInContext(ctx, req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("searching the index: %w", err)
+	}
+
+	hits := make([]Hit, 0, len(res.Hits))
+	for _, match := range res.Hits {
+		id, err := strconv.ParseInt(match.ID, 10, 64)
+		if err != nil {
+			continue
+		}
+		// Passages of the text come first; a match on the name alone shows the name
+		snippets := match.Fragments["content"]
+		if len(snippets) == 0 {
+			snippets = match.Fragments["name"]
+		}
+		hits = append(hits, Hit{FileID: id, Score: match.Score, Snippets: snippets[:min(len(snippets), maxSnippets)]})
+	}
+	return hits, res.Total, nil
+}
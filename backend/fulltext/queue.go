@@ -0,0 +1,42 @@
+package fulltext
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Execer is what both *sql.DB and *sql.Tx offer for running a statement
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// QueueFiles asks for files to be brought up to date in the index, dropping those that no longer
+// exist. Queued inside a transaction, the request only takes effect if it commits, and the
+// indexer then sees the committed state. contents says the files' contents changed as well,
+// so their text has to be extracted again.
+func QueueFiles(db Execer, contents bool, fileIDs ...int64) error {
+	if len(fileIDs) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, 2*len(fileIDs))
+	for _, id := range fileIDs {
+		args = append(args, id, contents)
+	}
+	_, err := db.Exec("INSERT INTO FULLTEXT_QUEUE (FILE_ID, CONTENTS) VALUES "+strings.TrimSuffix(strings.Repeat("(?, ?),", len(fileIDs)), ","), args...)
+	return err
+}
+
+// QueueFolders asks for every file below the folders to be brought up to date, after a folder
+// was moved, renamed, trashed, restored or deleted. Files of a deleted folder are still found
+// through the index.
+func QueueFolders(db Execer, folderIDs ...string) error {
+	if len(folderIDs) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(folderIDs))
+	for i, id := range folderIDs {
+		args[i] = id
+	}
+	_, err := db.Exec("INSERT INTO FULLTEXT_QUEUE (FOLDER_ID) VALUES "+strings.TrimSuffix(strings.Repeat("(?),", len(folderIDs)), ","), args...)
+	return err
+}
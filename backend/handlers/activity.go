@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// What a user last did to a file, as the recent activity feed shows it
+const (
+	activityUploaded   = "uploaded"
+	activityDownloaded = "downloaded"
+	activityModified   = "modified"
+)
+
+// Page sizes for the recent activity feed
+const (
+	defaultRecentLimit = 50
+	maxRecentLimit     = 200
+)
+
+// RecentItem is a file the user recently uploaded, downloaded or modified
+type RecentItem struct {
+	SearchResult
+	Action     string    `json:"action"`
+	AccessedAt time.Time `json:"accessedAt"`
+}
+
+// recordActivity remembers that a user just did action to a file, replacing what they did to it
+// before. The feed is a convenience, so a failure is only logged.
+func (h *FileHandler) recordActivity(userID int, fileID int64, action string) {
+	_, err := h.db.Exec(`
+		INSERT INTO FILE_ACTIVITY (USER_ID, FILE_ID, ACTION) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE ACTION = VALUES(ACTION), accessed_at = current_timestamp()
+	`, userID, fileID, action)
+	if err != nil {
+		log.Printf("Warning: Failed to record %s of file %d by user %d: %v", action, fileID, userID, err)
+	}
+}
+
+// recordStored records a file the user just added, which is an upload unless it became a new
+// version of a file already there
+func (h *FileHandler) recordStored(userID int, inserted *insertedFile) {
+	if inserted.NewVersion {
+		h.recordActivity(userID, inserted.ID, activityModified)
+	} else {
+		h.recordActivity(userID, inserted.ID, activityUploaded)
+	}
+}
+
+// recordDownload records a download once the file was sent, leaving out requests that failed
+func (h *FileHandler) recordDownload(c *gin.Context, userID int, fileID int64) {
+	if c.Writer.Status() < http.StatusBadRequest {
+		h.recordActivity(userID, fileID, activityDownloaded)
+	}
+}
+
+// ListRecent lists the files the user recently uploaded, downloaded or modified, latest first,
+// with what they last did to each. Only active files the user owns or still has shared with
+// them are listed. The action parameter limits the feed to one kind of activity.
+func (h *FileHandler) ListRecent(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	limit := defaultRecentLimit
+	if v := c.Query("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = min(limit, maxRecentLimit)
+	}
+	where := "a.USER_ID = ? AND t.STATUS = 'active' AND (t.OWNER_ID = a.USER_ID OR sh.USER_ID IS NOT NULL)"
+	args := []interface{}{userID}
+	switch action := c.Query("action"); action {
+	case "":
+	case activityUploaded, activityDownloaded, activityModified:
+		where += " AND a.ACTION = ?"
+		args = append(args, action)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "action must be uploaded, downloaded or modified"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT 'file', CAST(t.FILE_ID AS CHAR), t.FILE_NAME, COALESCE(t.FILE_SIZE, 0), COALESCE(t.FILE_TYPE, ''), t.modified_at,
+			t.FOLDER_ID, IF(t.OWNER_ID = a.USER_ID, '', u.USERNAME), COALESCE(sh.PERMISSION, ''), a.ACTION, a.accessed_at
+		FROM FILE_ACTIVITY a JOIN FILE_LIST t ON t.FILE_ID = a.FILE_ID JOIN USERS u ON u.USER_ID = t.OWNER_ID
+		LEFT JOIN SHARED_FILE sh ON sh.FILE_ID = t.FILE_ID AND sh.USER_ID = a.USER_ID
+		WHERE `+where+`
+		ORDER BY a.accessed_at DESC, a.FILE_ID DESC LIMIT ?
+	`, append(args, limit)...)
+	if err != nil {
+		log.Printf("Error fetching recent files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch recent files"})
+		return
+	}
+	defer rows.Close()
+
+	items := []RecentItem{}
+	for rows.Next() {
+		var item RecentItem
+		if item.SearchResult, err = scanListedItem(rows, &item.Action, &item.AccessedAt); err != nil {
+			log.Printf("Error scanning recent file: %v", err)
+			continue
+		}
+		items = append(items, item)
+	}
+
+	refs := itemRefs(items)
+	if err := attachPaths(h.db, refs); err != nil {
+		log.Printf("Error fetching paths of recent files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch recent files"})
+		return
+	}
+	h.attachTags(refs)
+
+	c.JSON(http.StatusOK, gin.H{"items": items})
+}
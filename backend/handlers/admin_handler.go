@@ -2,22 +2,30 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"my-cloud-project/backend/maintenance"
+	"my-cloud-project/backend/storage"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	tusd "github.com/tus/tusd/v2/pkg/handler"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // AdminHandler handles admin-related operations
 type AdminHandler struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Store   storage.Backend
+	Uploads *maintenance.Uploads
 }
 
 // NewAdminHandler creates a new admin handler instance
-func NewAdminHandler(db *sql.DB) *AdminHandler {
-	return &AdminHandler{DB: db}
+func NewAdminHandler(db *sql.DB, store storage.Backend, uploads *maintenance.Uploads) *AdminHandler {
+	return &AdminHandler{DB: db, Store: store, Uploads: uploads}
 }
 
 // UserResponse represents user data in API responses
@@ -30,6 +38,8 @@ type UserResponse struct {
 	Status     string `json:"status"` // Add status field
 	QuotaLimit int64  `json:"quotaLimit"`
 	QuotaUsed  int64  `json:"quotaUsed"`
+	// Old versions kept per file, nil when the storage default applies
+	VersionRetention *int `json:"versionRetention"`
 }
 
 // SystemStats represents system-wide statistics
@@ -40,6 +50,24 @@ type SystemStats struct {
 	UsedStorage  int64 `json:"usedStorage"`
 }
 
+// CodecUsage summarizes the blobs stored with one compression codec
+type CodecUsage struct {
+	Codec         string `json:"codec"`
+	Blobs         int    `json:"blobs"`
+	OriginalBytes int64  `json:"originalBytes"`
+	StoredBytes   int64  `json:"storedBytes"`
+}
+
+// StorageSavings compares what users are charged for with what is actually stored
+type StorageSavings struct {
+	LogicalBytes          int64        `json:"logicalBytes"`
+	UniqueBytes           int64        `json:"uniqueBytes"`
+	StoredBytes           int64        `json:"storedBytes"`
+	DedupSavedBytes       int64        `json:"dedupSavedBytes"`
+	CompressionSavedBytes int64        `json:"compressionSavedBytes"`
+	Codecs                []CodecUsage `json:"codecs"`
+}
+
 // UpdateUserRequest represents the request body for updating a user
 type UpdateUserRequest struct {
 	Email      string  `json:"email,omitempty"`
@@ -48,6 +76,8 @@ type UpdateUserRequest struct {
 	Status     string  `json:"status,omitempty"`
 	QuotaLimit *int64  `json:"quotaLimit,omitempty"`
 	Password   *string `json:"password,omitempty"`
+	// A negative retention resets the user to the storage default
+	VersionRetention *int `json:"versionRetention,omitempty"`
 }
 
 // AdminMiddleware checks if the user has admin privileges
@@ -97,7 +127,8 @@ func (h *AdminHandler) GetAllUsers(c *gin.Context) {
 			ROLE, 
 			STATUS,
 			USER_QUOTA,
-			USED_QUOTA
+			USED_QUOTA,
+			VERSION_RETENTION
 		FROM USERS;
 	`
 
@@ -121,6 +152,7 @@ func (h *AdminHandler) GetAllUsers(c *gin.Context) {
 			&user.Status,
 			&user.QuotaLimit,
 			&user.QuotaUsed,
+			&user.VersionRetention,
 		)
 		if err != nil {
 			log.Printf("Error scanning user row: %v", err)
@@ -162,6 +194,186 @@ func (h *AdminHandler) GetSystemStats(c *gin.Context) {
 	c.JSON(http.StatusOK, stats)
 }
 
+// GetStorageSavings reports how much space deduplication and compression save on disk
+func (h *AdminHandler) GetStorageSavings(c *gin.Context) {
+	savings := StorageSavings{Codecs: []CodecUsage{}}
+
+	// Quota is charged on logical size, older versions included, so this is what storage would
+	// cost without either feature
+	err := h.DB.QueryRow(`
+		SELECT (SELECT COALESCE(SUM(FILE_SIZE), 0) FROM FILE_LIST) + (SELECT COALESCE(SUM(FILE_SIZE), 0) FROM FILE_VERSIONS)
+	`).Scan(&savings.LogicalBytes)
+	if err != nil {
+		log.Printf("Error getting logical storage size: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute storage savings"})
+		return
+	}
+
+	// Files stored before the blob store existed are kept once each, uncompressed
+	var legacyBytes int64
+	if err := h.DB.QueryRow("SELECT COALESCE(SUM(FILE_SIZE), 0) FROM FILE_LIST WHERE BLOB_ID IS NULL").Scan(&legacyBytes); err != nil {
+		log.Printf("Error getting legacy storage size: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute storage savings"})
+		return
+	}
+
+	rows, err := h.DB.Query(`
+		SELECT CODEC, COUNT(*), COALESCE(SUM(BLOB_SIZE), 0), COALESCE(SUM(COALESCE(STORED_SIZE, BLOB_SIZE)), 0)
+		FROM BLOB_LIST
+		GROUP BY CODEC
+	`)
+	if err != nil {
+		log.Printf("Error getting blob storage size: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute storage savings"})
+		return
+	}
+	defer rows.Close()
+
+	savings.UniqueBytes = legacyBytes
+	savings.StoredBytes = legacyBytes
+	for rows.Next() {
+		var usage CodecUsage
+		if err := rows.Scan(&usage.Codec, &usage.Blobs, &usage.OriginalBytes, &usage.StoredBytes); err != nil {
+			log.Printf("Error scanning codec usage: %v", err)
+			continue
+		}
+		savings.UniqueBytes += usage.OriginalBytes
+		savings.StoredBytes += usage.StoredBytes
+		savings.Codecs = append(savings.Codecs, usage)
+	}
+
+	savings.DedupSavedBytes = savings.LogicalBytes - savings.UniqueBytes
+	savings.CompressionSavedBytes = savings.UniqueBytes - savings.StoredBytes
+
+	c.JSON(http.StatusOK, savings)
+}
+
+// RunFsck checks that stored files and database rows agree. With ?repair=true orphans
+// are quarantined and broken rows are marked.
+func (h *AdminHandler) RunFsck(c *gin.Context) {
+	opts := maintenance.FsckOptions{
+		Repair:      c.Query("repair") == "true",
+		GracePeriod: maintenance.DefaultGracePeriod,
+	}
+
+	report, err := maintenance.Fsck(c.Request.Context(), h.DB, h.Store, opts)
+	if err != nil {
+		log.Printf("Error running consistency check: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run consistency check"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// QuotaAuditEntry is one applied quota correction
+type QuotaAuditEntry struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"userId"`
+	Username  string    `json:"username"`
+	OldUsed   int64     `json:"oldUsed"`
+	NewUsed   int64     `json:"newUsed"`
+	Delta     int64     `json:"delta"`
+	Source    string    `json:"source"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ReconcileQuota recomputes USED_QUOTA from FILE_LIST. Differences are only reported
+// unless ?apply=true is given.
+func (h *AdminHandler) ReconcileQuota(c *gin.Context) {
+	username, _ := c.Get("username")
+	apply := c.Query("apply") == "true"
+
+	report, err := maintenance.ReconcileQuota(c.Request.Context(), h.DB, apply, fmt.Sprintf("admin:%v", username))
+	if err != nil {
+		log.Printf("Error reconciling quota: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reconcile quota"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// GetQuotaAudit lists the most recent quota corrections
+func (h *AdminHandler) GetQuotaAudit(c *gin.Context) {
+	rows, err := h.DB.Query(`
+		SELECT a.AUDIT_ID, a.USER_ID, u.USERNAME, a.OLD_USED, a.NEW_USED, a.DELTA, a.SOURCE, a.created_at
+		FROM QUOTA_AUDIT a JOIN USERS u ON a.USER_ID = u.USER_ID
+		ORDER BY a.AUDIT_ID DESC
+		LIMIT 200
+	`)
+	if err != nil {
+		log.Printf("Error fetching quota audit: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch quota audit"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []QuotaAuditEntry{}
+	for rows.Next() {
+		var e QuotaAuditEntry
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Username, &e.OldUsed, &e.NewUsed, &e.Delta, &e.Source, &e.CreatedAt); err != nil {
+			log.Printf("Error scanning quota audit: %v", err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// InFlightUploadResponse is an unfinished upload along with who is uploading it
+type InFlightUploadResponse struct {
+	maintenance.InFlightUpload
+	Username string `json:"username"`
+}
+
+// ListUploads lists tus uploads that have not been finalized yet
+func (h *AdminHandler) ListUploads(c *gin.Context) {
+	uploads, err := h.Uploads.List()
+	if err != nil {
+		log.Printf("Error listing uploads: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list uploads"})
+		return
+	}
+
+	usernames := map[int]string{}
+	rows, err := h.DB.Query("SELECT USER_ID, USERNAME FROM USERS")
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			var username string
+			if err := rows.Scan(&id, &username); err == nil {
+				usernames[id] = username
+			}
+		}
+	}
+
+	response := make([]InFlightUploadResponse, 0, len(uploads))
+	for _, upload := range uploads {
+		response = append(response, InFlightUploadResponse{InFlightUpload: upload, Username: usernames[upload.OwnerID]})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// TerminateUpload cancels an unfinished upload and removes its data
+func (h *AdminHandler) TerminateUpload(c *gin.Context) {
+	if err := h.Uploads.Terminate(c.Request.Context(), c.Param("id")); err != nil {
+		var tusErr tusd.Error
+		if errors.As(err, &tusErr) && tusErr.ErrorCode == tusd.ErrNotFound.ErrorCode {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
+		}
+		log.Printf("Error terminating upload: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to terminate upload"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Upload terminated successfully"})
+}
+
 // UpdateUser updates user information
 func (h *AdminHandler) UpdateUser(c *gin.Context) {
 	userID, err := strconv.Atoi(c.Param("id"))
@@ -213,6 +425,15 @@ func (h *AdminHandler) UpdateUser(c *gin.Context) {
 		values = append(values, *req.QuotaLimit)
 	}
 
+	if req.VersionRetention != nil {
+		updates = append(updates, "VERSION_RETENTION = ?")
+		if *req.VersionRetention < 0 {
+			values = append(values, nil)
+		} else {
+			values = append(values, *req.VersionRetention)
+		}
+	}
+
 	if req.Password != nil && *req.Password != "" {
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*req.Password), bcrypt.DefaultCost)
 		if err != nil {
@@ -310,6 +531,8 @@ type StorageSettings struct {
 	CleanupDays             int   `json:"cleanupDays"`
 	StorageWarningThreshold int   `json:"storageWarningThreshold"`
 	CompressionEnabled      bool  `json:"compressionEnabled"`
+	// Old versions kept per file unless a user has their own limit
+	VersionRetention int `json:"versionRetention"`
 }
 
 type SecuritySettings struct {
@@ -331,37 +554,11 @@ type AllSettings struct {
 
 // GetSettings retrieves all system settings
 func (h *AdminHandler) GetSettings(c *gin.Context) {
-	// For now, return default settings
-	// In a real implementation, you would load these from a database or config file
-	settings := AllSettings{
-		System: SystemSettings{
-			SiteName:                 "IT Cloud Storage",
-			SiteDescription:          "Secure file storage and sharing platform",
-			MaintenanceMode:          false,
-			AllowRegistration:        true,
-			MaxFileSize:              100, // MB
-			AllowedFileTypes:         []string{"pdf", "doc", "docx", "txt", "jpg", "png", "gif", "zip"},
-			RequireEmailVerification: false,
-			SupportEmail:             "admin@itcloud.com",
-		},
-		Storage: StorageSettings{
-			DefaultUserQuota:        5000,  // MB
-			MaxUserQuota:            50000, // MB
-			AutoCleanupEnabled:      true,
-			CleanupDays:             30,
-			StorageWarningThreshold: 80, // percentage
-			CompressionEnabled:      true,
-		},
-		Security: SecuritySettings{
-			SessionTimeout:        24, // hours
-			PasswordMinLength:     8,
-			RequireStrongPassword: true,
-			MaxLoginAttempts:      5,
-			LockoutDuration:       15, // minutes
-			TwoFactorEnabled:      false,
-			AutoBackupEnabled:     true,
-			BackupRetentionDays:   30,
-		},
+	settings, err := loadSettings(h.DB)
+	if err != nil {
+		log.Printf("Error loading settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
 	}
 
 	c.JSON(http.StatusOK, settings)
@@ -396,8 +593,11 @@ func (h *AdminHandler) UpdateSettings(c *gin.Context) {
 		return
 	}
 
-	// In a real implementation, you would save these settings to a database or config file
-	// For now, we'll just return success
+	if err := saveSettings(h.DB, settings); err != nil {
+		log.Printf("Error saving settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save settings"})
+		return
+	}
 	log.Printf("Settings updated: %+v", settings)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Settings updated successfully"})
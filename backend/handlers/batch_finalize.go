@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"my-cloud-project/backend/storage"
+	"net/http"
+	"path"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchFinalize bounds how many uploads one batch finalize may take
+const maxBatchFinalize = 1000
+
+// Outcomes of a single upload in a batch finalize
+const (
+	batchFinalized = "finalized"
+	batchFailed    = "failed"
+	batchSkipped   = "skipped"
+)
+
+type batchFinalizeItem struct {
+	UploadID string `json:"uploadId"`
+	// Path of the file below the batch destination, including its name
+	RelativePath string `json:"relativePath"`
+}
+
+type batchFinalizeResult struct {
+	UploadID     string `json:"uploadId"`
+	RelativePath string `json:"relativePath"`
+	Status       string `json:"status"`
+	FileID       int64  `json:"fileId,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// batchFile is an upload of the batch that still has to become a file
+type batchFile struct {
+	result          *batchFinalizeResult
+	uploadID        string
+	tusInfo         TusInfo
+	sourceFile      string
+	destinationPath string
+	file            incomingFile
+}
+
+// FinalizeUploads turns a whole folder of completed uploads into files at once. The folders
+// and files are created in a single transaction, so if any upload cannot be used nothing is
+// imported and the results say which uploads were at fault.
+func (h *FileHandler) FinalizeUploads(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	var payload struct {
+		DestinationPath string              `json:"destinationPath"`
+		SharedFolderID  string              `json:"sharedFolderId"`
+		RelativePath    string              `json:"relativePath"`
+		Conflict        string              `json:"conflict"`
+		Items           []batchFinalizeItem `json:"items"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil || len(payload.Items) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	if len(payload.Items) > maxBatchFinalize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many uploads in one batch"})
+		return
+	}
+	conflict, err := parseConflict(payload.Conflict, conflictKeepBoth)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Lock every upload of the batch, in a fixed order so concurrent batches cannot deadlock
+	uploadIDs := make([]string, 0, len(payload.Items))
+	seen := map[string]bool{}
+	for _, item := range payload.Items {
+		if item.UploadID == "" || seen[item.UploadID] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Every item needs a distinct uploadId"})
+			return
+		}
+		seen[item.UploadID] = true
+		uploadIDs = append(uploadIDs, item.UploadID)
+	}
+	sort.Strings(uploadIDs)
+	for _, uploadID := range uploadIDs {
+		unlock := h.uploadLocks.lock(uploadID)
+		defer unlock()
+	}
+
+	// The files outlive the request that asked for them, so storage work is not cancelled with it
+	ctx := context.WithoutCancel(c.Request.Context())
+
+	target := uploadTarget{DestinationPath: payload.DestinationPath, SharedFolderID: payload.SharedFolderID, RelativePath: payload.RelativePath}
+	ownerID, ownerUsername, baseDestination, err := h.resolveUploadTarget(userID, target)
+	if err != nil {
+		respondFinalizeError(c, err)
+		return
+	}
+
+	results := make([]batchFinalizeResult, len(payload.Items))
+	var pending []*batchFile
+	var totalSize int64
+	failed := false
+	for i, item := range payload.Items {
+		result := &results[i]
+		*result = batchFinalizeResult{UploadID: item.UploadID, RelativePath: item.RelativePath}
+
+		bf, finalizedFileID, err := h.prepareBatchFile(userID, ownerUsername, baseDestination, item)
+		if err != nil {
+			_, message := finalizeStatus(err)
+			result.Status, result.Error = batchFailed, message
+			failed = true
+			continue
+		}
+		if finalizedFileID != 0 {
+			// Finalized by an earlier attempt, the file already exists
+			result.Status, result.FileID = batchFinalized, finalizedFileID
+			continue
+		}
+		bf.result = result
+		pending = append(pending, bf)
+		totalSize += bf.file.Size
+	}
+
+	if failed {
+		for _, bf := range pending {
+			bf.result.Status = batchSkipped
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Some uploads could not be finalized, nothing was imported", "results": results})
+		return
+	}
+
+	// Check quota once for everything the batch adds
+	if err := h.checkQuotaLimit(ownerID, totalSize); err != nil {
+		status, message := finalizeStatus(quotaFailed(userID, ownerID, err))
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database transaction could not be started"})
+		return
+	}
+	defer tx.Rollback()
+
+	inserted := make([]*insertedFile, len(pending))
+	for i, bf := range pending {
+		if _, err := ensureFolderPath(tx, ownerID, bf.destinationPath); err != nil {
+			respondFinalizeError(c, folderPathFailed(bf.destinationPath, err))
+			return
+		}
+		inserted[i], err = h.insertFile(tx, userID, ownerID, bf.destinationPath, bf.file, conflict)
+		if err != nil {
+			respondFinalizeError(c, err)
+			return
+		}
+		if err := recordUpload(tx, bf.uploadID, userID, inserted[i]); err != nil {
+			log.Printf("DB Error on batch finalize: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+			return
+		}
+		bf.result.FileID = inserted[i].ID
+	}
+
+	if err := h.updateUserQuota(tx, ownerID, totalSize); err != nil {
+		log.Printf("Failed to update user quota: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota usage"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit file upload"})
+		return
+	}
+
+	// Move the data only after the commit, a file that cannot be stored is rolled back on its own
+	status := http.StatusOK
+	for i, bf := range pending {
+		if err := h.storeFile(ctx, ownerID, inserted[i], bf.file); err != nil {
+			_, message := finalizeStatus(err)
+			bf.result.Status, bf.result.Error, bf.result.FileID = batchFailed, message, 0
+			status = http.StatusMultiStatus
+			continue
+		}
+		cleanupFinalizedUpload(bf.tusInfo, bf.sourceFile)
+		h.recordStored(userID, inserted[i])
+		bf.result.Status = batchFinalized
+	}
+
+	c.JSON(status, gin.H{"message": "Uploads finalized", "results": results})
+}
+
+// prepareBatchFile checks one upload of a batch and works out where its file goes. For an
+// upload that was finalized before it returns the FILE_ID it became instead.
+func (h *FileHandler) prepareBatchFile(uploaderID int, ownerUsername, baseDestination string, item batchFinalizeItem) (*batchFile, int64, error) {
+	tusInfo, sourceFile, finalizedFileID, err := h.completedUpload(uploaderID, item.UploadID)
+	if err != nil || finalizedFileID != 0 {
+		return nil, finalizedFileID, err
+	}
+
+	relativePath := path.Clean("/" + item.RelativePath)
+	folder, fileName := path.Split(relativePath)
+	if relativePath == "/" {
+		folder, fileName = "/", tusInfo.MetaData.Filename
+	}
+	if !validFileName(fileName) {
+		return nil, 0, finalizeFailed(http.StatusBadRequest, "Invalid file name")
+	}
+
+	destinationPath := path.Join(baseDestination, folder)
+	if _, err := storage.UserKey(ownerUsername, destinationPath); err != nil {
+		return nil, 0, finalizeFailed(http.StatusBadRequest, "Invalid destination path")
+	}
+
+	bf := &batchFile{
+		uploadID:        item.UploadID,
+		tusInfo:         tusInfo,
+		sourceFile:      sourceFile,
+		destinationPath: destinationPath,
+		file:            incomingFile{Path: sourceFile, Name: fileName, Type: tusInfo.MetaData.Filetype},
+	}
+	if err := bf.file.prepare(); err != nil {
+		return nil, 0, err
+	}
+	return bf, 0, nil
+}
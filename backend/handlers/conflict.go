@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Ways to settle an item arriving under a name that is already taken in its folder
+const (
+	// conflictFail refuses the operation
+	conflictFail = "fail"
+	// conflictRename gives the incoming item the first free "name (n).ext"
+	conflictRename = "rename"
+	// conflictReplace moves the existing item to the trash
+	conflictReplace = "replace"
+	// conflictKeepBoth keeps the contents of both under the one name: a file becomes a new
+	// version of the existing file and a folder is merged into the existing folder. Where
+	// that is not possible, e.g. a file meeting a folder, the incoming item is renamed.
+	conflictKeepBoth = "keepBoth"
+)
+
+// maxRenameAttempts bounds the search for a free name
+const maxRenameAttempts = 1000
+
+// mysqlDuplicateEntry is the error MariaDB reports for a violated unique key
+const mysqlDuplicateEntry = 1062
+
+// parseConflict checks a conflict option sent by a client, falling back to def when it is empty
+func parseConflict(value, def string) (string, error) {
+	switch value {
+	case "":
+		return def, nil
+	case conflictFail, conflictRename, conflictReplace, conflictKeepBoth:
+		return value, nil
+	}
+	return "", fmt.Errorf("conflict must be one of %s, %s, %s or %s", conflictFail, conflictRename, conflictReplace, conflictKeepBoth)
+}
+
+// parseRestoreConflict checks the conflict option of a restore, which can only fail or rename
+// since the item in the way was not part of the request
+func parseRestoreConflict(value string) (string, error) {
+	switch value {
+	case "", conflictFail:
+		return conflictFail, nil
+	case conflictRename:
+		return value, nil
+	}
+	return "", fmt.Errorf("conflict must be %s or %s", conflictFail, conflictRename)
+}
+
+// isDuplicateName reports whether err is the unique name constraint catching two items with the same name
+func isDuplicateName(err error) bool {
+	var me *mysql.MySQLError
+	return errors.As(err, &me) && me.Number == mysqlDuplicateEntry
+}
+
+// nameTaken is the error for an operation refused because the name is in use
+func nameTaken(name string) error {
+	return finalizeFailed(http.StatusConflict, fmt.Sprintf("An item named %s already exists", name))
+}
+
+// namedItem is a file or folder along with the folder it is in and its name
+type namedItem struct {
+	FileID   int64
+	FolderID string
+	// Files from before the blob store have no blob to keep as a version
+	BlobID sql.NullInt64
+	Folder string
+	Name   string
+}
+
+func (i *namedItem) isFolder() bool {
+	return i.FolderID != ""
+}
+
+func (i *namedItem) path() string {
+	return path.Join(i.Folder, i.Name)
+}
+
+// is reports whether i and other are the same file or folder
+func (i *namedItem) is(other *namedItem) bool {
+	return i.FileID == other.FileID && i.FolderID == other.FolderID
+}
+
+// versionable reports whether a file can take an incoming file's data as a new version
+func (i *namedItem) versionable() bool {
+	return !i.isFolder() && i.BlobID.Valid
+}
+
+// activeItem finds the active file or folder of ownerID named name in folder, or nil if the
+// name is free. A file found is locked, since it may be about to get a new version.
+func activeItem(tx *sql.Tx, ownerID int, folder, name string) (*namedItem, error) {
+	folderID, err := folderIDAt(tx, ownerID, folder)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return activeItemIn(tx, ownerID, folderID, folder, name)
+}
+
+// activeItemIn is activeItem for a folder already looked up: folderID, invalid for the root, at folder
+func activeItemIn(tx *sql.Tx, ownerID int, folderID sql.NullString, folder, name string) (*namedItem, error) {
+	item := namedItem{Folder: folder}
+	err := tx.QueryRow(`
+		SELECT FILE_ID, BLOB_ID, FILE_NAME FROM FILE_LIST
+		WHERE OWNER_ID = ? AND FOLDER_ID <=> ? AND FILE_NAME = ? AND STATUS = 'active'
+		LIMIT 1
+		FOR UPDATE
+	`, ownerID, folderID, name).Scan(&item.FileID, &item.BlobID, &item.Name)
+	if err == nil {
+		return &item, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	err = tx.QueryRow("SELECT FOLDER_ID, FOLDER_NAME FROM FOLDER_LIST WHERE OWNER_ID = ? AND PARENT_ID <=> ? AND FOLDER_NAME = ? AND STATUS = 'active' LIMIT 1",
+		ownerID, folderID, name).Scan(&item.FolderID, &item.Name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// numberedName is name with " (n)" added before its extension
+func numberedName(name string, n int) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if base == "" {
+		// A dotfile such as .env has no extension, just a name
+		base, ext = name, ""
+	}
+	return fmt.Sprintf("%s (%d)%s", base, n, ext)
+}
+
+// freeName finds the first "name (n).ext" that no active item in folder folderID uses
+func freeName(tx *sql.Tx, ownerID int, folderID sql.NullString, name string) (string, error) {
+	for n := 1; n <= maxRenameAttempts; n++ {
+		candidate := numberedName(name, n)
+		item, err := activeItemIn(tx, ownerID, folderID, "", candidate)
+		if err != nil {
+			return "", err
+		}
+		if item == nil {
+			return candidate, nil
+		}
+	}
+	return "", finalizeFailed(http.StatusConflict, fmt.Sprintf("Could not find a free name for %s", name))
+}
+
+// trashItem moves an item to the trash, e.g. out of the way of one replacing it. A folder goes
+// together with everything in it, so none of its contents stay in use or show up in a
+// replacement; the contents are marked as trashed with the folder, which restoring it brings
+// them back from.
+func trashItem(tx *sql.Tx, item *namedItem) error {
+	if err := queueIndexing(tx, item); err != nil {
+		return err
+	}
+	if !item.isFolder() {
+		_, err := tx.Exec("UPDATE FILE_LIST SET STATUS = 'trashed' WHERE FILE_ID = ?", item.FileID)
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE FOLDER_LIST SET STATUS = 'trashed' WHERE FOLDER_ID = ?", item.FolderID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		UPDATE FOLDER_LIST f JOIN (`+subtreeCTE+` SELECT FOLDER_ID FROM subtree WHERE DEPTH > 0) s ON f.FOLDER_ID = s.FOLDER_ID
+		SET f.STATUS = 'trashed', f.TRASHED_WITH = ? WHERE f.STATUS = 'active'
+	`, "", item.FolderID, item.FolderID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE FILE_LIST f JOIN (`+subtreeCTE+` SELECT FOLDER_ID FROM subtree) s ON f.FOLDER_ID = s.FOLDER_ID
+		SET f.STATUS = 'trashed', f.TRASHED_WITH = ? WHERE f.STATUS = 'active'
+	`, "", item.FolderID, item.FolderID)
+	return err
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestNumberedName(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"report.pdf", 1, "report (1).pdf"},
+		{"archive.tar.gz", 2, "archive.tar (2).gz"},
+		{"README", 3, "README (3)"},
+		{".env", 1, ".env (1)"},
+		{"photo (1).jpg", 2, "photo (1) (2).jpg"},
+		{"folder.", 1, "folder (1)."},
+	}
+	for _, tt := range tests {
+		if got := numberedName(tt.name, tt.n); got != tt.want {
+			t.Errorf("numberedName(%q, %d) = %q, want %q", tt.name, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestParseConflict(t *testing.T) {
+	tests := []struct {
+		value   string
+		def     string
+		want    string
+		wantErr bool
+	}{
+		{"", conflictRename, conflictRename, false},
+		{"", conflictFail, conflictFail, false},
+		{conflictFail, conflictRename, conflictFail, false},
+		{conflictRename, conflictFail, conflictRename, false},
+		{conflictReplace, conflictFail, conflictReplace, false},
+		{conflictKeepBoth, conflictFail, conflictKeepBoth, false},
+		{"overwrite", conflictFail, "", true},
+		{"Rename", conflictFail, "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseConflict(tt.value, tt.def)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseConflict(%q, %q) = %q, %v; want %q, error %v", tt.value, tt.def, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseRestoreConflict(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", conflictFail, false},
+		{conflictFail, conflictFail, false},
+		{conflictRename, conflictRename, false},
+		{conflictReplace, "", true},
+		{conflictKeepBoth, "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseRestoreConflict(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseRestoreConflict(%q) = %q, %v; want %q, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestIsDuplicateName(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("Duplicate entry"), false},
+		{&mysql.MySQLError{Number: mysqlDuplicateEntry}, true},
+		{fmt.Errorf("renaming: %w", &mysql.MySQLError{Number: mysqlDuplicateEntry}), true},
+		{&mysql.MySQLError{Number: 1452}, false},
+	}
+	for _, tt := range tests {
+		if got := isDuplicateName(tt.err); got != tt.want {
+			t.Errorf("isDuplicateName(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
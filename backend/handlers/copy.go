@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"my-cloud-project/backend/blobs"
+	"my-cloud-project/backend/fulltext"
+	"my-cloud-project/backend/storage"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// copiedFile is a file of a copied tree along with where its data is read from
+type copiedFile struct {
+	// Folder below the copied item the file is in, empty for files directly in it
+	relFolder string
+	name      string
+	file      incomingFile
+	source    blobs.Ref
+	inserted  *insertedFile
+}
+
+// copySource works out whose item a copy reads and where it is. A shared folder ID makes
+// sourcePath relative to that folder and a shared file ID names the file itself.
+func (h *FileHandler) copySource(userID int, sharedFolderID, sharedFileID, sourcePath string) (int, string, error) {
+	switch {
+	case sharedFolderID != "":
+		var folderName, parentPath string
+		var parentID sql.NullString
+		var ownerID int
+		err := h.db.QueryRow(`
+			SELECT fl.FOLDER_NAME, fl.PARENT_ID, fl.OWNER_ID
+			FROM FOLDER_LIST fl
+			JOIN SHARED_FOLDER sf ON fl.FOLDER_ID = sf.FOLDER_ID
+			WHERE sf.USER_ID = ? AND fl.FOLDER_ID = ? AND fl.STATUS = 'active'
+		`, userID, sharedFolderID).Scan(&folderName, &parentID, &ownerID)
+		if err == nil {
+			parentPath, err = folderPath(h.db, parentID)
+		}
+		if err != nil {
+			return 0, "", finalizeFailed(http.StatusNotFound, "Shared folder not found or access denied")
+		}
+		return ownerID, path.Join(parentPath, folderName, path.Clean("/"+sourcePath)), nil
+	case sharedFileID != "":
+		var fileName, filePath string
+		var parentID sql.NullString
+		var ownerID int
+		err := h.db.QueryRow(`
+			SELECT fl.FILE_NAME, fl.FOLDER_ID, fl.OWNER_ID
+			FROM FILE_LIST fl
+			JOIN SHARED_FILE sf ON fl.FILE_ID = sf.FILE_ID
+			WHERE sf.USER_ID = ? AND fl.FILE_ID = ? AND fl.STATUS = 'active'
+		`, userID, sharedFileID).Scan(&fileName, &parentID, &ownerID)
+		if err == nil {
+			filePath, err = folderPath(h.db, parentID)
+		}
+		if err != nil {
+			return 0, "", finalizeFailed(http.StatusNotFound, "Shared file not found or access denied")
+		}
+		return ownerID, path.Join(filePath, fileName), nil
+	}
+	return userID, path.Clean("/" + sourcePath), nil
+}
+
+// copiedFileQuery selects copied files along with the blob holding their data. The folder
+// each file is in is formatted in as its path, which the caller knows.
+const copiedFileQuery = `
+	SELECT f.FILE_ID, f.FILE_NAME, f.FILE_TYPE, %s, COALESCE(f.FILE_SIZE, 0),
+		b.CONTENT_HASH, b.STORAGE_KEY, COALESCE(b.ENCRYPTED, 0), COALESCE(b.CODEC, 'none')
+	FROM FILE_LIST f LEFT JOIN BLOB_LIST b ON f.BLOB_ID = b.BLOB_ID`
+
+// copiedTree lists the folders, as paths relative to item, and the files of a copied item.
+// A copied file is the only file of its own tree.
+func (h *FileHandler) copiedTree(tx *sql.Tx, ownerID int, ownerUsername string, item *namedItem) ([]string, []*copiedFile, error) {
+	var folders []string
+	query := fmt.Sprintf(copiedFileQuery, "?") + " WHERE f.FILE_ID = ?"
+	args := []interface{}{item.Folder, item.FileID}
+
+	root := item.path()
+	if item.isFolder() {
+		// Only what is still reachable through active folders is copied
+		folderRows, err := tx.Query(subtreeCTE+`
+			SELECT FULL_PATH FROM subtree WHERE ACTIVE AND DEPTH > 0 ORDER BY DEPTH
+		`, root, item.FolderID)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer folderRows.Close()
+		for folderRows.Next() {
+			var folderPath string
+			if err := folderRows.Scan(&folderPath); err != nil {
+				return nil, nil, err
+			}
+			folders = append(folders, strings.TrimPrefix(folderPath, root))
+		}
+		if err := folderRows.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		query = subtreeCTE + fmt.Sprintf(copiedFileQuery, "s.FULL_PATH") + " JOIN subtree s ON f.FOLDER_ID = s.FOLDER_ID WHERE s.ACTIVE AND f.STATUS = 'active'"
+		args = []interface{}{root, item.FolderID}
+	}
+
+	fileRows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fileRows.Close()
+
+	var files []*copiedFile
+	for fileRows.Next() {
+		var fileID int64
+		var filePath string
+		var fileType, hash, blobKey sql.NullString
+		cf := &copiedFile{source: blobs.Ref{OwnerID: ownerID}}
+		if err := fileRows.Scan(&fileID, &cf.name, &fileType, &filePath, &cf.file.Size, &hash, &blobKey, &cf.source.Encrypted, &cf.source.Codec); err != nil {
+			return nil, nil, err
+		}
+		cf.source.Key, err = storedFileKey(ownerUsername, filePath, fileID, blobKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		cf.source.Size = cf.file.Size
+		cf.file.Name, cf.file.Type, cf.file.Hash = cf.name, fileType.String, hash.String
+		if item.isFolder() {
+			cf.relFolder = strings.TrimPrefix(filePath, root)
+		}
+		files = append(files, cf)
+	}
+	return folders, files, fileRows.Err()
+}
+
+// spoolCopy reads a copied file's data into the upload directory, ready to be stored as the copy's blob
+func (h *FileHandler) spoolCopy(ctx context.Context, cf *copiedFile) error {
+	obj, err := h.blobs.Open(ctx, cf.source)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	cf.file.Path, _, err = spoolUpload(obj, 0)
+	return err
+}
+
+// storeCopy makes sure a committed copy has its data in the blob store. A blob the caller
+// already had, which is always the case for copies within their own drive, needs nothing
+// but queuing the copy for the full-text index, which storeFile does otherwise. A blob
+// row the copy created is written like any new one.
+func (h *FileHandler) storeCopy(ctx context.Context, ownerID int, cf *copiedFile) error {
+	if cf.file.Path == "" {
+		if _, err := h.store.Stat(ctx, cf.inserted.Blob.Key); err == nil && !cf.inserted.Blob.Created {
+			if err := fulltext.QueueFiles(h.db, true, cf.inserted.ID); err != nil {
+				log.Printf("Warning: Failed to queue file %d for indexing: %v", cf.inserted.ID, err)
+			}
+			if cf.inserted.NewVersion {
+				h.pruneVersions(ctx, ownerID, cf.inserted.ID)
+			}
+			return nil
+		} else if err != nil && !errors.Is(err, storage.ErrNotExist) {
+			h.undoInsert(ownerID, cf.inserted, cf.file.Size)
+			return err
+		}
+		if err := h.spoolCopy(ctx, cf); err != nil {
+			h.undoInsert(ownerID, cf.inserted, cf.file.Size)
+			return err
+		}
+	}
+	defer os.Remove(cf.file.Path)
+	return h.storeFile(ctx, ownerID, cf.inserted, cf.file)
+}
+
+// CopyItem copies a file or a whole folder into a folder of the user's drive. The source is in
+// the user's drive, or in a folder or file shared with them. Copies are charged to the user and
+// share the blobs the user already has, so only data new to them is copied.
+func (h *FileHandler) CopyItem(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	var payload struct {
+		SourcePath        string `json:"sourcePath"`
+		SharedFolderID    string `json:"sharedFolderId"`
+		SharedFileID      string `json:"sharedFileId"`
+		DestinationFolder string `json:"destinationFolder"`
+		Conflict          string `json:"conflict"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	// A copy next to its original is the usual case, so by default it gets a name of its own
+	conflict, err := parseConflict(payload.Conflict, conflictRename)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	destinationFolder := path.Clean("/" + payload.DestinationFolder)
+	if _, err := storage.UserKey(username, destinationFolder); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid destination path"})
+		return
+	}
+
+	ownerID, sourcePath, err := h.copySource(userID, payload.SharedFolderID, payload.SharedFileID, payload.SourcePath)
+	if err != nil {
+		respondFinalizeError(c, err)
+		return
+	}
+	sourceFolder, sourceName := path.Split(sourcePath)
+	if sourceName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid source path"})
+		return
+	}
+	sourceFolder = path.Clean(sourceFolder)
+
+	var ownerUsername string
+	if err := h.db.QueryRow("SELECT USERNAME FROM USERS WHERE USER_ID = ?", ownerID).Scan(&ownerUsername); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not determine item owner"})
+		return
+	}
+
+	// The copies outlive the request that asked for them, so storage work is not cancelled with it
+	ctx := context.WithoutCancel(c.Request.Context())
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database transaction could not be started"})
+		return
+	}
+	defer tx.Rollback()
+
+	item, err := activeItem(tx, ownerID, sourceFolder, sourceName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking source item"})
+		return
+	}
+	if item == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Source item not found"})
+		return
+	}
+	destinationID, err := folderIDAt(tx, userID, destinationFolder)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Destination folder not found"})
+		return
+	}
+	if ownerID == userID && item.isFolder() {
+		if inside, err := isWithin(tx, destinationID, item.FolderID); err != nil || inside {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A folder cannot be copied into itself"})
+			return
+		}
+	}
+
+	folders, files, err := h.copiedTree(tx, ownerID, ownerUsername, item)
+	if err != nil {
+		log.Printf("Failed to read %s for copying: %v", sourcePath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read source item"})
+		return
+	}
+
+	var totalSize int64
+	for _, cf := range files {
+		// Files from before the blob store have no hash to share the blob by, so their data is read now
+		if cf.file.Hash == "" {
+			err := h.spoolCopy(ctx, cf)
+			if err == nil {
+				defer os.Remove(cf.file.Path)
+				err = cf.file.prepare()
+			}
+			if err != nil {
+				log.Printf("Failed to read %s for copying: %v", cf.source.Key, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read " + cf.name})
+				return
+			}
+		}
+		totalSize += cf.file.Size
+	}
+
+	if err := h.checkQuotaLimit(userID, totalSize); err != nil {
+		respondFinalizeError(c, quotaFailed(userID, userID, err))
+		return
+	}
+
+	// The copied item itself is subject to conflict, everything inside a copied folder is merged
+	copyName := item.Name
+	if item.isFolder() {
+		_, copyName, err = h.createFolder(tx, userID, destinationFolder, item.Name, conflict)
+		for i := 0; err == nil && i < len(folders); i++ {
+			parent, name := path.Split(path.Join(destinationFolder, copyName) + folders[i])
+			var created string
+			// Merging into a folder only works if no file is where one of its folders goes
+			if _, created, err = h.createFolder(tx, userID, path.Clean(parent), name, conflictKeepBoth); err == nil && created != name {
+				err = nameTaken(name)
+			}
+		}
+		if err != nil {
+			respondFinalizeError(c, folderPathFailed(destinationFolder, err))
+			return
+		}
+	}
+	for _, cf := range files {
+		folder, fileConflict := destinationFolder, conflict
+		if item.isFolder() {
+			folder, fileConflict = path.Join(destinationFolder, copyName+cf.relFolder), conflictKeepBoth
+		}
+		cf.inserted, err = h.insertFile(tx, userID, userID, folder, cf.file, fileConflict)
+		if err != nil {
+			respondFinalizeError(c, err)
+			return
+		}
+		if !item.isFolder() {
+			copyName = cf.inserted.Name
+		}
+	}
+
+	if err := h.updateUserQuota(tx, userID, totalSize); err != nil {
+		log.Printf("Failed to update user quota: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota usage"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit copy"})
+		return
+	}
+
+	// A file whose data cannot be copied is rolled back on its own, the rest of the copy stays
+	failed := []string{}
+	for _, cf := range files {
+		if err := h.storeCopy(ctx, userID, cf); err != nil {
+			log.Printf("Failed to copy %s: %v", cf.source.Key, err)
+			failed = append(failed, path.Join(cf.relFolder, cf.name))
+			continue
+		}
+		h.recordStored(userID, cf.inserted)
+	}
+	if len(failed) > 0 {
+		c.JSON(http.StatusMultiStatus, gin.H{"error": "Some files could not be copied", "name": copyName, "failed": failed})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Item copied successfully", "name": copyName})
+}
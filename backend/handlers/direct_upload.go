@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"my-cloud-project/backend/utils"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxFormFieldSize bounds the plain form fields accepted alongside uploaded files
+const maxFormFieldSize = 4096
+
+// spoolUpload copies an upload body to a temporary file in the upload directory so it can be
+// hashed and stored like a finished tus upload. maxSize is in bytes, 0 means no limit.
+func spoolUpload(body io.Reader, maxSize int64) (string, int64, error) {
+	baseUploadPath, _ := utils.GetBaseUploadPath()
+	spool, err := os.CreateTemp(baseUploadPath, ".upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer spool.Close()
+
+	if maxSize > 0 {
+		body = io.LimitReader(body, maxSize+1)
+	}
+	n, err := io.Copy(spool, body)
+	if err != nil {
+		os.Remove(spool.Name())
+		return "", 0, err
+	}
+	return spool.Name(), n, nil
+}
+
+// uploadFileType picks the type of a directly uploaded file, guessing from its name if the client sent none
+func uploadFileType(fileName, contentType string) string {
+	if contentType == "" || contentType == "application/octet-stream" {
+		if guessed := mime.TypeByExtension(filepath.Ext(fileName)); guessed != "" {
+			return guessed
+		}
+	}
+	if contentType == "" {
+		return "application/octet-stream"
+	}
+	return contentType
+}
+
+// validFileName reports whether name can be used as the name of a file in a folder
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// receiveFile spools one uploaded file and adds it to the tree at target, applying the same
+// size, type and quota limits as a tus upload. size is -1 when the client did not announce it.
+func (h *FileHandler) receiveFile(c *gin.Context, userID int, target uploadTarget, fileName, fileType string, body io.Reader, size int64) (int64, error) {
+	settings, err := loadSettings(h.db)
+	if err != nil {
+		log.Printf("Failed to load settings for upload check: %v", err)
+		return 0, finalizeFailed(http.StatusInternalServerError, "Could not verify upload limits")
+	}
+
+	// Refuse what is known to be too large before reading any of it
+	if size >= 0 {
+		if err := checkUploadAllowed(settings.System, fileName, size); err != nil {
+			return 0, err
+		}
+	}
+
+	sourceFile, received, err := spoolUpload(body, settings.System.MaxFileSize*1024*1024)
+	if err != nil {
+		log.Printf("Failed to receive upload %s: %v", fileName, err)
+		return 0, finalizeFailed(http.StatusBadRequest, "Could not read uploaded file")
+	}
+	// Once stored the file is gone from the spool, this only cleans up after failures
+	defer os.Remove(sourceFile)
+
+	if err := checkUploadAllowed(settings.System, fileName, received); err != nil {
+		return 0, err
+	}
+
+	file := incomingFile{Path: sourceFile, Name: fileName, Type: uploadFileType(fileName, fileType)}
+	return h.addFile(c.Request.Context(), userID, target, file, nil)
+}
+
+// PutFile stores the request body as the file at the given path, creating missing folders.
+// It is meant for scripts, e.g. curl -T report.pdf -H "Authorization: Bearer $TOKEN" .../api/files/docs/report.pdf
+func (h *FileHandler) PutFile(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	destinationPath, fileName := path.Split(path.Clean("/" + c.Param("path")))
+	if !validFileName(fileName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A file name is required"})
+		return
+	}
+
+	target := uploadTarget{DestinationPath: path.Clean(destinationPath), CreateFolders: true, Conflict: c.Query("conflict")}
+	fileID, err := h.receiveFile(c, userID, target, fileName, c.ContentType(), c.Request.Body, c.Request.ContentLength)
+	if err != nil {
+		respondFinalizeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "File uploaded successfully", "fileId": fileID})
+}
+
+// UploadFiles stores the files of a multipart form, streaming each one instead of buffering the form.
+// The destinationPath, or sharedFolderId and relativePath, and conflict fields apply to the files that follow them.
+func (h *FileHandler) UploadFiles(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a multipart form"})
+		return
+	}
+
+	type uploadedFile struct {
+		FileName string `json:"fileName"`
+		FileID   int64  `json:"fileId"`
+	}
+	uploaded := []uploadedFile{}
+	target := uploadTarget{CreateFolders: true}
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Malformed multipart form", "files": uploaded})
+			return
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			part.Close()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Malformed multipart form", "files": uploaded})
+				return
+			}
+			switch part.FormName() {
+			case "destinationPath":
+				target.DestinationPath = string(value)
+			case "sharedFolderId":
+				target.SharedFolderID = string(value)
+			case "relativePath":
+				target.RelativePath = string(value)
+			case "conflict":
+				target.Conflict = string(value)
+			}
+			continue
+		}
+
+		fileName := part.FileName()
+		if !validFileName(fileName) {
+			part.Close()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file name", "files": uploaded})
+			return
+		}
+
+		fileID, err := h.receiveFile(c, userID, target, fileName, part.Header.Get("Content-Type"), part, -1)
+		part.Close()
+		if err != nil {
+			// Files before this one are already stored, so tell the client which
+			status, message := finalizeStatus(err)
+			c.JSON(status, gin.H{"error": message, "fileName": fileName, "files": uploaded})
+			return
+		}
+		uploaded = append(uploaded, uploadedFile{FileName: fileName, FileID: fileID})
+	}
+
+	if len(uploaded) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No files in the form"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Files uploaded successfully", "files": uploaded})
+}
@@ -2,15 +2,21 @@ package handlers
 
 import (
 	"archive/zip"
+	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"my-cloud-project/backend/utils"
+	"my-cloud-project/backend/blobs"
+	"my-cloud-project/backend/encryption"
+	"my-cloud-project/backend/fulltext"
+	"my-cloud-project/backend/storage"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,7 +27,11 @@ import (
 // --- Structs ---
 
 type FileHandler struct {
-	db *sql.DB
+	db          *sql.DB
+	store       storage.Backend
+	blobs       *blobs.Store
+	index       *fulltext.Index
+	uploadLocks uploadLocks
 }
 
 type ItemInfo struct {
@@ -32,15 +42,30 @@ type ItemInfo struct {
 	Modified     time.Time `json:"modified"`
 	IsDir        bool      `json:"isDir"`
 	Path         string    `json:"path"`
+	Tags         []string  `json:"tags,omitempty"`
+	// The folder the item is in, which its path is derived from; invalid at the root
+	parentID sql.NullString
 }
 
 type TusInfo struct {
 	MetaData struct {
 		Filename string `json:"filename"`
 		Filetype string `json:"filetype"`
+		OwnerID  string `json:"ownerId"`
+		// Where the server should put the file once the upload completes
+		DestinationPath string `json:"destinationPath"`
+		SharedFolderID  string `json:"sharedFolderId"`
+		RelativePath    string `json:"relativePath"`
+		// How to settle a name already taken in the destination
+		Conflict string `json:"conflict"`
 	} `json:"MetaData"`
-	ID   string `json:"ID"`
-	Size int64  `json:"Size"`
+	ID     string `json:"ID"`
+	Size   int64  `json:"Size"`
+	Offset int64  `json:"Offset"`
+	// Set for uploads taking part in tus concatenation
+	IsPartial      bool     `json:"IsPartial"`
+	IsFinal        bool     `json:"IsFinal"`
+	PartialUploads []string `json:"PartialUploads"`
 }
 
 type SharePayload struct {
@@ -77,8 +102,8 @@ type BulkDownloadPayload struct {
 
 // --- Constructor & Helper ---
 
-func NewFileHandler(db *sql.DB) *FileHandler {
-	return &FileHandler{db: db}
+func NewFileHandler(db *sql.DB, store storage.Backend, keys *encryption.Keyring, index *fulltext.Index) *FileHandler {
+	return &FileHandler{db: db, store: store, blobs: blobs.NewStore(db, store, keys), index: index}
 }
 
 func getUsername(c *gin.Context) (string, bool) {
@@ -125,8 +150,101 @@ func (h *FileHandler) checkQuotaLimit(userID int, fileSize int64) error {
 	return nil
 }
 
+// fileKey returns the legacy storage key of a file, which is named by its FILE_ID inside the owner's tree
+func fileKey(username, dir string, fileID int64) (string, error) {
+	return storage.UserKey(username, dir, strconv.FormatInt(fileID, 10))
+}
+
+// storedFileKey resolves where a file's contents live: its blob, or the
+// per-file key used before uploads were deduplicated
+func storedFileKey(username, dir string, fileID int64, blobKey sql.NullString) (string, error) {
+	if blobKey.Valid {
+		return blobKey.String, nil
+	}
+	return fileKey(username, dir, fileID)
+}
+
+// uploadCodec picks how a new upload is compressed at rest, following StorageSettings.CompressionEnabled
+func (h *FileHandler) uploadCodec(fileName, fileType string) string {
+	settings, err := loadSettings(h.db)
+	if err != nil {
+		log.Printf("Warning: Failed to load settings, storing upload uncompressed: %v", err)
+		return blobs.CodecNone
+	}
+	if !settings.Storage.CompressionEnabled || !blobs.Compressible(fileName, fileType) {
+		return blobs.CodecNone
+	}
+	if os.Getenv("COMPRESSION_CODEC") == blobs.CodecGzip {
+		return blobs.CodecGzip
+	}
+	return blobs.CodecZstd
+}
+
+// removeStored deletes objects that no database row refers to anymore
+func (h *FileHandler) removeStored(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := h.blobs.Remove(ctx, key); err != nil {
+			log.Printf("Warning: Failed to delete %s from storage: %v", key, err)
+		}
+	}
+}
+
+// undoFinalize removes a committed file row whose contents could not be stored
+func (h *FileHandler) undoFinalize(ownerID int, fileID, blobID, size int64) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Failed to roll back file %d: %v", fileID, err)
+		return
+	}
+	defer tx.Rollback()
+
+	tx.Exec("DELETE FROM UPLOAD_LIST WHERE FILE_ID = ?", fileID)
+	tx.Exec("DELETE FROM FILE_LIST WHERE FILE_ID = ?", fileID)
+	h.blobs.Release(tx, blobID)
+	h.updateUserQuota(tx, ownerID, -size)
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to roll back file %d: %v", fileID, err)
+	}
+}
+
+// serveStoredFile streams a stored file to the client as an attachment, decrypting and decompressing it if needed
+func (h *FileHandler) serveStoredFile(c *gin.Context, ref blobs.Ref, fileName, fileType string) {
+	obj, err := h.blobs.Open(c.Request.Context(), ref)
+	if errors.Is(err, storage.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File does not exist on server"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error opening %s from storage: %v", ref.Key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer obj.Close()
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
+	if fileType == "" {
+		fileType = "application/octet-stream"
+	}
+	c.Header("Content-Type", fileType)
+
+	// Seekable objects get range request support, anything else is streamed as-is
+	if seeker, ok := obj.Reader.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, fileName, obj.ModTime, seeker)
+		return
+	}
+	c.Header("Content-Length", strconv.FormatInt(obj.Size, 10))
+	c.Status(http.StatusOK)
+	io.Copy(c.Writer, obj)
+}
+
 // --- Core File Operations ---
 
+// ListFiles lists a page of the folders and files in a folder of the user's, folders first.
+// Items sort by name (naturally), size, modified or type and can be limited to a kind or to
+// file types; the nextCursor of a page asks for the one after it.
 func (h *FileHandler) ListFiles(c *gin.Context) {
 	username, ok := getUsername(c)
 	if !ok {
@@ -143,60 +261,31 @@ func (h *FileHandler) ListFiles(c *gin.Context) {
 		relativePath = "/"
 	}
 
-	var items []ItemInfo
-
-	// Get Folders
-	folderRows, err := h.db.Query("SELECT FOLDER_ID, FOLDER_NAME, modified_at, PATH FROM FOLDER_LIST WHERE OWNER_ID = ? AND PATH = ? AND STATUS = 'active'", userID, relativePath)
+	listing, err := parseListing(c)
 	if err != nil {
-		log.Printf("Error fetching folders: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch folders"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	defer folderRows.Close()
-
-	for folderRows.Next() {
-		var item ItemInfo
-		var folderID, folderName, path string
-		var modified time.Time
-		if err := folderRows.Scan(&folderID, &folderName, &modified, &path); err != nil {
-			continue
-		}
-		item.ID = folderID // Add the ID
-		item.Name = folderName
-		item.Modified = modified
-		item.IsDir = true
-		item.Path = filepath.ToSlash(filepath.Join(path, folderName))
-		items = append(items, item)
+	folderID, err := folderIDAt(h.db, userID, relativePath)
+	if err == sql.ErrNoRows {
+		// A folder that is not there has nothing in it
+		c.JSON(http.StatusOK, gin.H{"items": []ItemInfo{}, "nextCursor": nil, "total": 0})
+		return
 	}
-
-	// Get Files
-	fileRows, err := h.db.Query("SELECT FILE_ID, FILE_NAME, FILE_SIZE, modified_at, FILE_PATH FROM FILE_LIST WHERE OWNER_ID = ? AND FILE_PATH = ? AND STATUS = 'active'", userID, relativePath)
 	if err != nil {
-		log.Printf("Error fetching files: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+		respondListingError(c, err)
 		return
 	}
-	defer fileRows.Close()
-
-	for fileRows.Next() {
-		var item ItemInfo
-		var fileID int64
-		var size int64
-		var name, path string
-		var modified time.Time
-		if err := fileRows.Scan(&fileID, &name, &size, &modified, &path); err != nil {
-			continue
-		}
-		item.ID = fmt.Sprintf("%d", fileID) // Add the ID
-		item.Name = name
-		item.Size = size
-		item.Modified = modified
-		item.IsDir = false
-		item.Path = filepath.ToSlash(filepath.Join(path, name))
-		items = append(items, item)
+	items, nextCursor, total, err := h.page(listing,
+		"t.OWNER_ID = ? AND t.PARENT_ID <=> ? AND t.STATUS = 'active'",
+		"t.OWNER_ID = ? AND t.FOLDER_ID <=> ? AND t.STATUS = 'active'", userID, folderID)
+	if err != nil {
+		respondListingError(c, err)
+		return
 	}
 
-	c.JSON(http.StatusOK, items)
+	h.attachTags(itemRefs(items))
+	c.JSON(http.StatusOK, gin.H{"items": items, "nextCursor": nextCursor, "total": total})
 }
 
 func (h *FileHandler) CreateFolder(c *gin.Context) {
@@ -213,27 +302,29 @@ func (h *FileHandler) CreateFolder(c *gin.Context) {
 	var payload struct {
 		FolderName  string `json:"folderName"`
 		CurrentPath string `json:"path"`
+		Conflict    string `json:"conflict"`
 	}
 	if err := c.ShouldBindJSON(&payload); err != nil || payload.FolderName == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder name or path"})
 		return
 	}
+	conflict, err := parseConflict(payload.Conflict, conflictFail)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	parentPath := payload.CurrentPath
 	if parentPath == "" {
 		parentPath = "/"
 	}
+	parentPath = filepath.ToSlash(filepath.Clean(parentPath))
 
-	// Physically create the directory
-	fullPath, err := utils.GetSafePathForUser(username, filepath.Join(parentPath, payload.FolderName))
-	if err != nil {
+	// Folders only exist as metadata; the storage backend creates prefixes on demand
+	if _, err := storage.UserKey(username, parentPath, payload.FolderName); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := os.MkdirAll(fullPath, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create physical directory"})
-		return
-	}
 
 	// Use transaction for database operations
 	tx, err := h.db.Begin()
@@ -243,29 +334,23 @@ func (h *FileHandler) CreateFolder(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	newFolderID := uuid.New().String()
-	_, err = tx.Exec("INSERT INTO FOLDER_LIST (FOLDER_ID, OWNER_ID, FOLDER_NAME, PATH, STATUS) VALUES (?, ?, ?, ?, 'active')", newFolderID, userID, payload.FolderName, parentPath)
+	folderID, folderName, err := h.createFolder(tx, userID, parentPath, payload.FolderName, conflict)
+	if _, ok := err.(*finalizeError); ok {
+		respondFinalizeError(c, err)
+		return
+	}
 	if err != nil {
 		log.Printf("Error creating folder in DB: %v", err)
-		os.RemoveAll(fullPath) // Rollback physical creation
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create folder metadata"})
 		return
 	}
 
-	// Auto-share the new folder if it's created inside shared folders
-	newFolderPath := filepath.ToSlash(filepath.Join(parentPath, payload.FolderName))
-	if err := h.autoShareNewItem(tx, userID, newFolderID, "folder", newFolderPath); err != nil {
-		log.Printf("Warning: Failed to auto-share new folder: %v", err)
-		// Don't fail the entire operation, just log the warning
-	}
-
 	if err := tx.Commit(); err != nil {
-		os.RemoveAll(fullPath) // Rollback physical creation
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit folder creation"})
 		return
 	}
 
-	c.Status(http.StatusCreated)
+	c.JSON(http.StatusCreated, gin.H{"folderId": folderID, "folderName": folderName})
 }
 
 func (h *FileHandler) CreateFolderPath(c *gin.Context) {
@@ -280,154 +365,180 @@ func (h *FileHandler) CreateFolderPath(c *gin.Context) {
 	}
 
 	var payload struct {
-		Path string `json:"path"`
+		Path     string `json:"path"`
+		Conflict string `json:"conflict"`
 	}
 	if err := c.ShouldBindJSON(&payload); err != nil || payload.Path == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path provided"})
 		return
 	}
-
-	// Create physical directories
-	fullPhysicalPath, err := utils.GetSafePathForUser(username, payload.Path)
+	// Asking for a path that is already there is not an error, so by default it is reused
+	conflict, err := parseConflict(payload.Conflict, conflictKeepBoth)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := os.MkdirAll(fullPhysicalPath, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create folder structure"})
+	parentPath, folderName := filepath.Split(filepath.ToSlash(filepath.Clean("/" + payload.Path)))
+	if folderName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path provided"})
 		return
 	}
 
-	// Create database entries
-	cleanedPath := filepath.Clean(payload.Path)
-	parts := strings.Split(cleanedPath, string(filepath.Separator))
-	currentPath := "/"
-
-	for _, part := range parts {
-		if part == "" {
-			continue
-		}
-		var exists int
-		err := h.db.QueryRow("SELECT COUNT(*) FROM FOLDER_LIST WHERE OWNER_ID = ? AND FOLDER_NAME = ? AND PATH = ?", userID, part, currentPath).Scan(&exists)
-		if err == nil && exists == 0 {
-			_, err = h.db.Exec("INSERT INTO FOLDER_LIST (FOLDER_ID, OWNER_ID, FOLDER_NAME, PATH, STATUS) VALUES (?, ?, ?, ?, 'active')", uuid.New().String(), userID, part, currentPath)
-			if err != nil {
-				log.Printf("Failed to insert path component %s: %v", part, err)
-				continue
-			}
-		}
-		currentPath = filepath.ToSlash(filepath.Join(currentPath, part))
-	}
-
-	c.Status(http.StatusCreated)
-}
-
-func (h *FileHandler) FinalizeUpload(c *gin.Context) {
-	username, ok := getUsername(c)
-	if !ok {
+	if _, err := storage.UserKey(username, payload.Path); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	userID, err := h.getUserId(username)
+
+	// Create database entries
+	tx, err := h.db.Begin()
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database transaction could not be started"})
 		return
 	}
+	defer tx.Rollback()
 
-	var payload struct {
-		UploadID        string `json:"uploadId"`
-		DestinationPath string `json:"destinationPath"`
-	}
-	if err := c.ShouldBindJSON(&payload); err != nil || payload.UploadID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+	// Only the last folder of the path is subject to conflict, the ones leading to it are reused
+	if _, err := ensureFolderPath(tx, userID, parentPath); err != nil {
+		respondFinalizeError(c, folderPathFailed(payload.Path, err))
 		return
 	}
-
-	baseUploadPath, _ := utils.GetBaseUploadPath()
-	sourceFile := filepath.Join(baseUploadPath, payload.UploadID)
-	sourceInfo := sourceFile + ".info"
-	infoData, err := os.ReadFile(sourceInfo)
+	folderID, folderName, err := h.createFolder(tx, userID, filepath.ToSlash(filepath.Clean(parentPath)), folderName, conflict)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read upload metadata"})
+		respondFinalizeError(c, folderPathFailed(payload.Path, err))
 		return
 	}
-
-	var tusInfo TusInfo
-	if err := json.Unmarshal(infoData, &tusInfo); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not parse upload metadata"})
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create folders"})
 		return
 	}
 
-	fileInfo, err := os.Stat(sourceFile)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not get file info"})
-		return
+	c.JSON(http.StatusCreated, gin.H{"folderId": folderID, "folderName": folderName})
+}
+
+// ensureFolderPath creates the FOLDER_LIST rows for every folder along folderPath that is missing
+// and returns the ID of the last one. Folders already there are used as they are, but a file in
+// the way of one fails the whole path.
+func ensureFolderPath(tx *sql.Tx, ownerID int, folderPath string) (sql.NullString, error) {
+	var parentID sql.NullString
+	parts := pathNames(folderPath)
+	if len(parts) > maxFolderDepth {
+		return parentID, tooDeep()
 	}
 
-	// Check quota limit before processing upload
-	if err := h.checkQuotaLimit(userID, fileInfo.Size()); err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
-		return
+	for _, part := range parts {
+		existing, err := activeItemIn(tx, ownerID, parentID, "", part)
+		if err != nil {
+			return parentID, err
+		}
+		if existing != nil && !existing.isFolder() {
+			return parentID, finalizeFailed(http.StatusConflict, fmt.Sprintf("A file named %s is in the way of folder %s", part, folderPath))
+		}
+		folderID := uuid.New().String()
+		if existing != nil {
+			folderID = existing.FolderID
+		} else {
+			_, err = tx.Exec("INSERT INTO FOLDER_LIST (FOLDER_ID, OWNER_ID, PARENT_ID, FOLDER_NAME, STATUS) VALUES (?, ?, ?, ?, 'active')", folderID, ownerID, parentID, part)
+			if err != nil {
+				return parentID, err
+			}
+		}
+		parentID = sql.NullString{String: folderID, Valid: true}
 	}
+	return parentID, nil
+}
 
-	// Use transaction for database operations
-	tx, err := h.db.Begin()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database transaction could not be started"})
-		return
+// folderPathFailed reports an ensureFolderPath failure, logging it unless it is the client's doing
+func folderPathFailed(folderPath string, err error) error {
+	if _, ok := err.(*finalizeError); ok {
+		return err
 	}
-	defer tx.Rollback()
+	if isDuplicateName(err) {
+		return finalizeFailed(http.StatusConflict, "A folder on the way was created at the same time, try again")
+	}
+	log.Printf("Failed to create folders for %s: %v", folderPath, err)
+	return finalizeFailed(http.StatusInternalServerError, "Failed to create destination folders")
+}
 
-	res, err := tx.Exec("INSERT INTO FILE_LIST (OWNER_ID, FILE_NAME, FILE_TYPE, FILE_SIZE, FILE_PATH, STATUS) VALUES (?, ?, ?, ?, ?, 'active')", userID, tusInfo.MetaData.Filename, tusInfo.MetaData.Filetype, fileInfo.Size(), payload.DestinationPath)
+// createFolder adds folder name in parentPath, settling a name already in use with conflict.
+// It returns the folder's ID and the name it got; with keepBoth an existing folder is used as it is.
+func (h *FileHandler) createFolder(tx *sql.Tx, ownerID int, parentPath, name, conflict string) (string, string, error) {
+	parentID, err := folderIDAt(tx, ownerID, parentPath)
+	if err == sql.ErrNoRows {
+		return "", "", finalizeFailed(http.StatusNotFound, "Parent folder not found")
+	}
 	if err != nil {
-		log.Printf("DB Error on finalize: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
-		return
+		return "", "", err
+	}
+	if len(pathNames(parentPath)) >= maxFolderDepth {
+		return "", "", tooDeep()
+	}
+	existing, err := activeItemIn(tx, ownerID, parentID, parentPath, name)
+	if err != nil {
+		return "", "", err
+	}
+	if existing != nil {
+		switch {
+		case conflict == conflictFail:
+			return "", "", nameTaken(name)
+		case conflict == conflictKeepBoth && existing.isFolder():
+			return existing.FolderID, name, nil
+		case conflict == conflictReplace:
+			err = trashItem(tx, existing)
+		default:
+			name, err = freeName(tx, ownerID, parentID, name)
+		}
+		if err != nil {
+			return "", "", err
+		}
 	}
 
-	newFileID, _ := res.LastInsertId()
-
-	// Update user's quota usage
-	if err := h.updateUserQuota(tx, userID, fileInfo.Size()); err != nil {
-		log.Printf("Failed to update user quota: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota usage"})
-		return
+	newFolderID := uuid.New().String()
+	_, err = tx.Exec("INSERT INTO FOLDER_LIST (FOLDER_ID, OWNER_ID, PARENT_ID, FOLDER_NAME, STATUS) VALUES (?, ?, ?, ?, 'active')", newFolderID, ownerID, parentID, name)
+	if isDuplicateName(err) {
+		return "", "", nameTaken(name)
+	}
+	if err != nil {
+		return "", "", err
 	}
 
-	// Auto-share the new file if it's uploaded to shared folders
-	newFilePath := filepath.ToSlash(filepath.Join(payload.DestinationPath, tusInfo.MetaData.Filename))
-	if err := h.autoShareNewItem(tx, userID, fmt.Sprintf("%d", newFileID), "file", newFilePath); err != nil {
-		log.Printf("Warning: Failed to auto-share new file: %v", err)
+	// Auto-share the new folder if it's created inside shared folders
+	if err := h.autoShareNewItem(tx, ownerID, newFolderID, "folder", parentID); err != nil {
+		log.Printf("Warning: Failed to auto-share new folder: %v", err)
 		// Don't fail the entire operation, just log the warning
 	}
+	return newFolderID, name, nil
+}
 
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit file upload"})
+func (h *FileHandler) FinalizeUpload(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
 		return
 	}
-
-	// Move physical file after successful database commit
-	destinationFolder, err := utils.GetSafePathForUser(username, payload.DestinationPath)
+	userID, err := h.getUserId(username)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid destination path"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
 		return
 	}
 
-	if err := os.MkdirAll(destinationFolder, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create destination directory"})
+	var payload struct {
+		UploadID        string `json:"uploadId"`
+		DestinationPath string `json:"destinationPath"`
+		Conflict        string `json:"conflict"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.UploadID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 		return
 	}
 
-	newFileLocation := filepath.Join(destinationFolder, fmt.Sprintf("%d", newFileID))
-	if err := os.Rename(sourceFile, newFileLocation); err != nil {
-		// Rollback database entry and quota if physical move fails
-		h.db.Exec("DELETE FROM FILE_LIST WHERE FILE_ID = ?", newFileID)
-		h.db.Exec("UPDATE USERS SET USED_QUOTA = USED_QUOTA - ? WHERE USER_ID = ?", fileInfo.Size(), userID)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move file"})
+	// Uploads carrying their destination are usually finalized by the server already,
+	// in which case this just reports the file that was created
+	fileID, err := h.finalizeUpload(c.Request.Context(), userID, payload.UploadID, uploadTarget{DestinationPath: payload.DestinationPath, Conflict: payload.Conflict})
+	if err != nil {
+		respondFinalizeError(c, err)
 		return
 	}
 
-	os.Remove(sourceInfo)
-	c.JSON(http.StatusOK, gin.H{"message": "File finalized successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "File finalized successfully", "fileId": fileID})
 }
 
 // GetQuotaInfo returns the current quota information for the authenticated user
@@ -469,20 +580,24 @@ func (h *FileHandler) MoveItem(c *gin.Context) {
 	var payload struct {
 		SourcePath        string `json:"sourcePath"`
 		DestinationFolder string `json:"destinationFolder"`
+		Conflict          string `json:"conflict"`
 	}
 	if err := c.ShouldBindJSON(&payload); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 		return
 	}
-
-	sourceFullPath, err := utils.GetSafePathForUser(username, payload.SourcePath)
+	conflict, err := parseConflict(payload.Conflict, conflictFail)
 	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := storage.UserKey(username, payload.SourcePath); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid source path"})
 		return
 	}
 
-	destFullPath, err := utils.GetSafePathForUser(username, payload.DestinationFolder)
-	if err != nil {
+	if _, err := storage.UserKey(username, payload.DestinationFolder); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid destination path"})
 		return
 	}
@@ -492,6 +607,13 @@ func (h *FileHandler) MoveItem(c *gin.Context) {
 	if parentDir == "." {
 		parentDir = "/"
 	}
+	destinationFolder := filepath.ToSlash(filepath.Clean("/" + payload.DestinationFolder))
+
+	// Moving an item to where it already is changes nothing
+	if destinationFolder == filepath.ToSlash(filepath.Clean("/"+parentDir)) {
+		c.Status(http.StatusOK)
+		return
+	}
 
 	tx, err := h.db.Begin()
 	if err != nil {
@@ -500,98 +622,453 @@ func (h *FileHandler) MoveItem(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	// Check if it's a file
-	var fileID int
-	err = tx.QueryRow("SELECT FILE_ID FROM FILE_LIST WHERE OWNER_ID = ? AND FILE_NAME = ? AND FILE_PATH = ?", userID, baseName, parentDir).Scan(&fileID)
-	if err == nil { // It's a file
-		_, err = tx.Exec("UPDATE FILE_LIST SET FILE_PATH = ? WHERE FILE_ID = ?", payload.DestinationFolder, fileID)
+	item, err := activeItem(tx, userID, parentDir, baseName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking source item"})
+		return
+	}
+	if item == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Source item not found"})
+		return
+	}
+
+	var cleanup moveCleanup
+	if _, err := h.moveItem(c.Request.Context(), tx, userID, username, item, destinationFolder, item.Name, conflict, &cleanup); err != nil {
+		respondMoveError(c, err, item.Name)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	h.finishMove(c.Request.Context(), userID, &cleanup)
+	c.Status(http.StatusOK)
+}
+
+// RenameItem gives a file or folder of the user a new name in the folder it is in. Shares are
+// kept, since they point at the item and not at its name.
+func (h *FileHandler) RenameItem(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	var payload struct {
+		ItemID   string `json:"itemId"`
+		ItemType string `json:"itemType"` // "file" or "folder"
+		NewName  string `json:"newName"`
+		Conflict string `json:"conflict"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.ItemID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	if !validFileName(payload.NewName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name"})
+		return
+	}
+	conflict, err := parseConflict(payload.Conflict, conflictFail)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	item := &namedItem{}
+	var parentID sql.NullString
+	switch payload.ItemType {
+	case "file":
+		item.FileID, err = strconv.ParseInt(payload.ItemID, 10, 64)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update file path in DB"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
 			return
 		}
+		err = tx.QueryRow("SELECT FOLDER_ID, FILE_NAME, BLOB_ID FROM FILE_LIST WHERE FILE_ID = ? AND OWNER_ID = ? AND STATUS = 'active' FOR UPDATE",
+			item.FileID, userID).Scan(&parentID, &item.Name, &item.BlobID)
+	case "folder":
+		item.FolderID = payload.ItemID
+		err = tx.QueryRow("SELECT PARENT_ID, FOLDER_NAME FROM FOLDER_LIST WHERE FOLDER_ID = ? AND OWNER_ID = ? AND STATUS = 'active' FOR UPDATE",
+			item.FolderID, userID).Scan(&parentID, &item.Name)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "itemType must be file or folder"})
+		return
+	}
+	if err == nil {
+		item.Folder, err = folderPath(tx, parentID)
+	}
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking item"})
+		return
+	}
 
-		newPhysicalPath := filepath.Join(destFullPath, fmt.Sprintf("%d", fileID))
-		if err := os.Rename(sourceFullPath, newPhysicalPath); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move physical file"})
-			return
-		}
+	if _, err := storage.UserKey(username, item.Folder, payload.NewName); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name"})
+		return
+	}
+	if payload.NewName == item.Name {
+		c.JSON(http.StatusOK, gin.H{"message": "Item renamed successfully", "name": item.Name})
+		return
+	}
 
-	} else if err == sql.ErrNoRows { // Check if it's a folder
-		var folderID string
-		err = tx.QueryRow("SELECT FOLDER_ID FROM FOLDER_LIST WHERE OWNER_ID = ? AND FOLDER_NAME = ? AND PATH = ?", userID, baseName, parentDir).Scan(&folderID)
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Source item not found"})
-			return
+	var cleanup moveCleanup
+	newName, err := h.moveItem(c.Request.Context(), tx, userID, username, item, item.Folder, payload.NewName, conflict, &cleanup)
+	if err != nil {
+		respondMoveError(c, err, payload.NewName)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	h.finishMove(c.Request.Context(), userID, &cleanup)
+	c.JSON(http.StatusOK, gin.H{"message": "Item renamed successfully", "name": newName})
+}
+
+// respondMoveError reports a failed move or rename of the item called name
+func respondMoveError(c *gin.Context, err error, name string) {
+	if _, ok := err.(*finalizeError); ok {
+		respondFinalizeError(c, err)
+		return
+	}
+	if isDuplicateName(err) {
+		respondFinalizeError(c, nameTaken(name))
+		return
+	}
+	log.Printf("Failed to move %s: %v", name, err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move item"})
+}
+
+// moveCleanup collects what a move leaves to do once it is committed
+type moveCleanup struct {
+	// Storage keys no longer referenced
+	staleKeys []string
+	// Files that got a new version and may now keep too many
+	versioned []int64
+}
+
+// finishMove does what a committed move left to do
+func (h *FileHandler) finishMove(ctx context.Context, userID int, cleanup *moveCleanup) {
+	h.removeStored(ctx, cleanup.staleKeys)
+	for _, fileID := range cleanup.versioned {
+		h.pruneVersions(ctx, userID, fileID)
+	}
+}
+
+// moveItem puts item into destFolder under newName, settling a name already taken there with
+// conflict, and returns the name it ends up with. Moves and renames are both this, one changing
+// the folder and the other the name.
+func (h *FileHandler) moveItem(ctx context.Context, tx *sql.Tx, userID int, username string, item *namedItem, destFolder, newName, conflict string, cleanup *moveCleanup) (string, error) {
+	destID, err := folderIDAt(tx, userID, destFolder)
+	if err == sql.ErrNoRows {
+		return "", finalizeFailed(http.StatusNotFound, "Destination folder not found")
+	}
+	if err != nil {
+		return "", err
+	}
+	if item.isFolder() {
+		if inside, err := isWithin(tx, destID, item.FolderID); err != nil || inside {
+			if err == nil {
+				err = finalizeFailed(http.StatusBadRequest, "A folder cannot be moved into itself")
+			}
+			return "", err
 		}
+		// Everything below the folder moves down or up with it
+		if destFolder != item.Folder {
+			var height int
+			if err := tx.QueryRow(subtreeCTE+" SELECT MAX(DEPTH) FROM subtree", "", item.FolderID).Scan(&height); err != nil {
+				return "", err
+			}
+			if len(pathNames(destFolder))+1+height > maxFolderDepth {
+				return "", tooDeep()
+			}
+		}
+	}
 
-		_, err = tx.Exec("UPDATE FOLDER_LIST SET PATH = ? WHERE FOLDER_ID = ?", payload.DestinationFolder, folderID)
+	existing, err := activeItemIn(tx, userID, destID, destFolder, newName)
+	if err != nil {
+		return "", err
+	}
+	// A rename that only changes case finds the item itself
+	if existing != nil && existing.is(item) {
+		existing = nil
+	}
+
+	if existing != nil {
+		switch {
+		case conflict == conflictFail:
+			return "", nameTaken(newName)
+		case conflict == conflictKeepBoth && !item.isFolder() && item.BlobID.Valid && existing.versionable():
+			return newName, h.fileIntoVersion(tx, userID, item, existing, cleanup)
+		case conflict == conflictKeepBoth && item.isFolder() && existing.isFolder():
+			return newName, h.mergeFolder(ctx, tx, userID, username, item, existing, cleanup)
+		case conflict == conflictReplace:
+			if existing.isFolder() {
+				var sourceID sql.NullString
+				if sourceID, err = parentIDOf(tx, item); err != nil {
+					return "", err
+				}
+				if inside, err := isWithin(tx, sourceID, existing.FolderID); err != nil || inside {
+					if err == nil {
+						err = finalizeFailed(http.StatusConflict, "A folder cannot be replaced by something it contains")
+					}
+					return "", err
+				}
+			}
+			err = trashItem(tx, existing)
+		default:
+			newName, err = freeName(tx, userID, destID, newName)
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update folder path in DB"})
-			return
+			return "", err
 		}
+	}
 
-		oldPathPrefix := filepath.ToSlash(filepath.Join(parentDir, baseName))
-		newPathPrefix := filepath.ToSlash(filepath.Join(payload.DestinationFolder, baseName))
-
-		if err := h.recursivePathUpdate(tx, userID, oldPathPrefix, newPathPrefix); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update children paths"})
-			return
+	if err := queueIndexing(tx, item); err != nil {
+		return "", err
+	}
+	if !item.isFolder() {
+		if _, err := tx.Exec("UPDATE FILE_LIST SET FOLDER_ID = ?, FILE_NAME = ? WHERE FILE_ID = ?", destID, newName, item.FileID); err != nil {
+			return "", err
 		}
 
-		newPhysicalPath := filepath.Join(destFullPath, baseName)
-		if err := os.Rename(sourceFullPath, newPhysicalPath); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move physical folder"})
-			return
+		// Blobs do not depend on the path; only legacy files are stored under their FILE_ID in the tree
+		if !item.BlobID.Valid && destFolder != item.Folder {
+			oldFileKey, _ := fileKey(username, item.Folder, item.FileID)
+			newFileKey, _ := fileKey(username, destFolder, item.FileID)
+			if err := h.store.Move(ctx, oldFileKey, newFileKey); err != nil {
+				return "", fmt.Errorf("moving %s to %s: %w", oldFileKey, newFileKey, err)
+			}
 		}
-	} else {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking source item"})
-		return
+		return newName, nil
 	}
 
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
-		return
+	// Only the folder's own row changes; the paths of everything below it are derived from it
+	if _, err := tx.Exec("UPDATE FOLDER_LIST SET PARENT_ID = ?, FOLDER_NAME = ? WHERE FOLDER_ID = ?", destID, newName, item.FolderID); err != nil {
+		return "", err
 	}
-	c.Status(http.StatusOK)
+	newPath := path.Join(destFolder, newName)
+
+	// A folder without any stored files has nothing to move
+	sourceKey, _ := storage.UserKey(username, item.path())
+	newFolderKey, _ := storage.UserKey(username, newPath)
+	if err := h.store.Move(ctx, sourceKey, newFolderKey); err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return "", fmt.Errorf("moving %s to %s: %w", sourceKey, newFolderKey, err)
+	}
+	return newName, nil
+}
+
+// fileIntoVersion makes a moved file the new version of the file it meets and removes its own row
+func (h *FileHandler) fileIntoVersion(tx *sql.Tx, userID int, item, existing *namedItem, cleanup *moveCleanup) error {
+	var size int64
+	var fileType sql.NullString
+	if err := tx.QueryRow("SELECT COALESCE(FILE_SIZE, 0), FILE_TYPE FROM FILE_LIST WHERE FILE_ID = ?", item.FileID).Scan(&size, &fileType); err != nil {
+		return err
+	}
+	// The moved file's blob reference is handed over to the file it becomes a version of
+	if _, err := h.addVersion(tx, existing.FileID, item.BlobID.Int64, size, fileType.String); err != nil {
+		return err
+	}
+	staleKeys, err := h.dropAllVersions(tx, userID, item.FileID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM FILE_LIST WHERE FILE_ID = ?", item.FileID); err != nil {
+		return err
+	}
+	if err := fulltext.QueueFiles(tx, false, item.FileID); err != nil {
+		return err
+	}
+	if err := fulltext.QueueFiles(tx, true, existing.FileID); err != nil {
+		return err
+	}
+	cleanup.staleKeys = append(cleanup.staleKeys, staleKeys...)
+	cleanup.versioned = append(cleanup.versioned, existing.FileID)
+	return nil
 }
 
-func (h *FileHandler) recursivePathUpdate(tx *sql.Tx, userID int, oldPrefix, newPrefix string) error {
-	_, err := tx.Exec(`UPDATE FOLDER_LIST SET PATH = CONCAT(?, SUBSTRING(PATH, ?)) WHERE OWNER_ID = ? AND PATH LIKE ?`, newPrefix, len(oldPrefix)+1, userID, oldPrefix+"%")
+// mergeFolder moves the contents of folder into the folder existing with keepBoth and then
+// removes the emptied folder
+func (h *FileHandler) mergeFolder(ctx context.Context, tx *sql.Tx, userID int, username string, folder, existing *namedItem, cleanup *moveCleanup) error {
+	var children []*namedItem
+
+	fileRows, err := tx.Query("SELECT FILE_ID, BLOB_ID, FILE_NAME FROM FILE_LIST WHERE FOLDER_ID = ? AND STATUS = 'active'", folder.FolderID)
 	if err != nil {
 		return err
 	}
+	for fileRows.Next() {
+		child := &namedItem{Folder: folder.path()}
+		if err := fileRows.Scan(&child.FileID, &child.BlobID, &child.Name); err != nil {
+			fileRows.Close()
+			return err
+		}
+		children = append(children, child)
+	}
+	fileRows.Close()
+
+	folderRows, err := tx.Query("SELECT FOLDER_ID, FOLDER_NAME FROM FOLDER_LIST WHERE PARENT_ID = ? AND STATUS = 'active'", folder.FolderID)
+	if err != nil {
+		return err
+	}
+	for folderRows.Next() {
+		child := &namedItem{Folder: folder.path()}
+		if err := folderRows.Scan(&child.FolderID, &child.Name); err != nil {
+			folderRows.Close()
+			return err
+		}
+		children = append(children, child)
+	}
+	folderRows.Close()
 
-	_, err = tx.Exec(`UPDATE FILE_LIST SET FILE_PATH = CONCAT(?, SUBSTRING(FILE_PATH, ?)) WHERE OWNER_ID = ? AND FILE_PATH LIKE ?`, newPrefix, len(oldPrefix)+1, userID, oldPrefix+"%")
+	for _, child := range children {
+		if _, err := h.moveItem(ctx, tx, userID, username, child, existing.path(), child.Name, conflictKeepBoth, cleanup); err != nil {
+			return err
+		}
+	}
+
+	// Trashed items keep their place, so restoring them puts them in the merged folder
+	if _, err := tx.Exec("UPDATE FOLDER_LIST SET PARENT_ID = ? WHERE PARENT_ID = ?", existing.FolderID, folder.FolderID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE FILE_LIST SET FOLDER_ID = ? WHERE FOLDER_ID = ?", existing.FolderID, folder.FolderID); err != nil {
+		return err
+	}
+	if err := fulltext.QueueFolders(tx, existing.FolderID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM FOLDER_LIST WHERE FOLDER_ID = ?", folder.FolderID)
 	return err
 }
 
 // --- Trash Bin Operations ---
 
-func (h *FileHandler) updateItemsStatus(userID int, paths []string, newStatus string) error {
+// trashPath moves the active file or folder at itemPath to the trash, a folder together with
+// everything in it
+func (h *FileHandler) trashPath(userID int, itemPath string) error {
 	tx, err := h.db.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	for _, path := range paths {
-		baseName := filepath.Base(path)
-		dirName := filepath.ToSlash(filepath.Dir(path))
-		if dirName == "." {
-			dirName = "/"
-		}
+	item, err := activeItem(tx, userID, path.Dir(itemPath), path.Base(itemPath))
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return sql.ErrNoRows
+	}
+	if err := trashItem(tx, item); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-		_, errFile := tx.Exec("UPDATE FILE_LIST SET STATUS = ? WHERE OWNER_ID = ? AND FILE_NAME = ? AND FILE_PATH = ?", newStatus, userID, baseName, dirName)
-		if errFile != nil {
-			return errFile
+// trashedItem finds the file or folder of ownerID named name in folder that most recently went
+// to the trash by itself, or nil if there is none. The same name may have been trashed there
+// more than once.
+func trashedItem(tx *sql.Tx, ownerID int, folder, name string) (*namedItem, error) {
+	folderID, err := folderIDAt(tx, ownerID, folder)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	item := namedItem{Folder: folder}
+	err = tx.QueryRow(`
+		SELECT * FROM (
+			SELECT FILE_ID AS ID, '' AS FOLDER_ID, BLOB_ID, FILE_NAME AS NAME, modified_at AS TRASHED_AT FROM FILE_LIST
+			WHERE OWNER_ID = ? AND FOLDER_ID <=> ? AND FILE_NAME = ? AND STATUS = 'trashed' AND TRASHED_WITH IS NULL
+			UNION ALL
+			SELECT 0, FOLDER_ID, NULL, FOLDER_NAME, modified_at FROM FOLDER_LIST
+			WHERE OWNER_ID = ? AND PARENT_ID <=> ? AND FOLDER_NAME = ? AND STATUS = 'trashed' AND TRASHED_WITH IS NULL
+		) r ORDER BY r.TRASHED_AT DESC LIMIT 1
+	`, ownerID, folderID, name, ownerID, folderID, name).Scan(&item.FileID, &item.FolderID, &item.BlobID, &item.Name, new(time.Time))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// restoreItem brings a trashed item back to where it was, along with whatever went to the trash
+// with it, and returns the name it is restored under. If an active item has taken the name in
+// the meantime, conflictRename restores it as the first free "name (n).ext" and conflictFail
+// refuses. The folder it was in has to be active to take it back.
+func (h *FileHandler) restoreItem(ctx context.Context, tx *sql.Tx, userID int, username string, item *namedItem, conflict string) (string, error) {
+	name := item.Name
+	parentID, err := parentIDOf(tx, item)
+	if err != nil {
+		return "", err
+	}
+	if parentID.Valid {
+		var status sql.NullString
+		if err := tx.QueryRow("SELECT STATUS FROM FOLDER_LIST WHERE FOLDER_ID = ?", parentID.String).Scan(&status); err != nil {
+			return "", err
 		}
+		if status.String != "active" {
+			return "", finalizeFailed(http.StatusConflict, "The folder it was in is in the trash, restore that first")
+		}
+	}
+	existing, err := activeItemIn(tx, userID, parentID, item.Folder, item.Name)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		if conflict != conflictRename {
+			return "", finalizeFailed(http.StatusConflict, "An item with the same name is already at the original location")
+		}
+		// A rename leaves no storage to clean up
+		if name, err = h.moveItem(ctx, tx, userID, username, item, item.Folder, item.Name, conflictRename, &moveCleanup{}); err != nil {
+			return "", err
+		}
+	}
 
-		_, errFolder := tx.Exec("UPDATE FOLDER_LIST SET STATUS = ? WHERE OWNER_ID = ? AND FOLDER_NAME = ? AND PATH = ?", newStatus, userID, baseName, dirName)
-		if errFolder != nil {
-			return errFolder
+	if item.isFolder() {
+		_, err = tx.Exec("UPDATE FOLDER_LIST SET STATUS = 'active', TRASHED_WITH = NULL WHERE FOLDER_ID = ? OR TRASHED_WITH = ?", item.FolderID, item.FolderID)
+		if err == nil {
+			_, err = tx.Exec("UPDATE FILE_LIST SET STATUS = 'active', TRASHED_WITH = NULL WHERE TRASHED_WITH = ?", item.FolderID)
 		}
+	} else {
+		_, err = tx.Exec("UPDATE FILE_LIST SET STATUS = 'active', TRASHED_WITH = NULL WHERE FILE_ID = ?", item.FileID)
 	}
-	return tx.Commit()
+	if err != nil {
+		return "", err
+	}
+	return name, queueIndexing(tx, item)
+}
+
+// respondRestoreError reports a failed restore
+func respondRestoreError(c *gin.Context, err error) {
+	if _, ok := err.(*finalizeError); ok {
+		respondFinalizeError(c, err)
+		return
+	}
+	if isDuplicateName(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "An item with the same name is already at the original location"})
+		return
+	}
+	log.Printf("Failed to restore item: %v", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore item"})
 }
 
 func (h *FileHandler) DeleteItem(c *gin.Context) {
@@ -605,8 +1082,12 @@ func (h *FileHandler) DeleteItem(c *gin.Context) {
 		return
 	}
 
-	relativePath := strings.TrimPrefix(c.Param("path"), "/")
-	if err := h.updateItemsStatus(userID, []string{relativePath}, "trashed"); err != nil {
+	err = h.trashPath(userID, path.Join("/", c.Param("path")))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move item to trash"})
 		return
 	}
@@ -690,14 +1171,18 @@ func (h *FileHandler) BulkDeleteItems(c *gin.Context) {
 		}
 	}
 
-	// Update folders
-	if len(payload.FolderIDs) > 0 {
-		folderInClause, folderArgs := buildInClause("FOLDER_ID", payload.FolderIDs)
-		query := fmt.Sprintf("UPDATE FOLDER_LIST SET STATUS = 'trashed' WHERE OWNER_ID = ? AND %s", folderInClause)
-
-		allFolderArgs := append([]interface{}{userID}, folderArgs...)
-
-		_, err := tx.Exec(query, allFolderArgs...)
+	// Update folders, each together with everything in it. A folder that is not the user's or
+	// not active, e.g. one that just went to the trash inside another, is left alone.
+	for _, folderID := range payload.FolderIDs {
+		item := namedItem{FolderID: folderID}
+		err := tx.QueryRow("SELECT FOLDER_NAME FROM FOLDER_LIST WHERE FOLDER_ID = ? AND OWNER_ID = ? AND STATUS = 'active'",
+			folderID, userID).Scan(&item.Name)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err == nil {
+			err = trashItem(tx, &item)
+		}
 		if err != nil {
 			log.Printf("Failed to bulk-trash folders: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move folders to trash"})
@@ -705,6 +1190,17 @@ func (h *FileHandler) BulkDeleteItems(c *gin.Context) {
 		}
 	}
 
+	// Other users' IDs were left alone above, and queuing them only finds them unchanged
+	fileIDs := make([]int64, len(payload.FileIDs))
+	for i, id := range payload.FileIDs {
+		fileIDs[i] = int64(id)
+	}
+	if err := fulltext.QueueFiles(tx, false, fileIDs...); err != nil {
+		log.Printf("Failed to queue trashed items for indexing: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to finalize operation"})
+		return
+	}
+
 	if err := tx.Commit(); err != nil {
 		log.Printf("Failed to commit transaction: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to finalize operation"})
@@ -714,6 +1210,8 @@ func (h *FileHandler) BulkDeleteItems(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
+// ListTrashItems lists a page of the user's trashed folders and files, sorted and filtered
+// like ListFiles. The contents of a trashed folder are left out, as they come back with it.
 func (h *FileHandler) ListTrashItems(c *gin.Context) {
 	username, ok := getUsername(c)
 	if !ok {
@@ -725,55 +1223,25 @@ func (h *FileHandler) ListTrashItems(c *gin.Context) {
 		return
 	}
 
-	var items []ItemInfo
-
-	folderRows, err := h.db.Query("SELECT FOLDER_ID, FOLDER_NAME, modified_at, PATH FROM FOLDER_LIST WHERE OWNER_ID = ? AND STATUS = 'trashed'", userID)
+	listing, err := parseListing(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch trashed folders"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	defer folderRows.Close()
-	for folderRows.Next() {
-		var item ItemInfo
-		var folderID, folderName, path string
-		var modified time.Time
-		if err := folderRows.Scan(&folderID, &folderName, &modified, &path); err != nil {
-			continue
-		}
-		item.ID = folderID // Add the ID
-		item.Name = folderName
-		item.Modified = modified
-		item.IsDir = true
-		item.Path = filepath.ToSlash(filepath.Join(path, folderName))
-		items = append(items, item)
-	}
-
-	fileRows, err := h.db.Query("SELECT FILE_ID, FILE_NAME, FILE_SIZE, modified_at, FILE_PATH FROM FILE_LIST WHERE OWNER_ID = ? AND STATUS = 'trashed'", userID)
+	items, nextCursor, total, err := h.page(listing,
+		"t.OWNER_ID = ? AND t.STATUS = 'trashed' AND t.TRASHED_WITH IS NULL",
+		"t.OWNER_ID = ? AND t.STATUS = 'trashed' AND t.TRASHED_WITH IS NULL", userID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch trashed files"})
+		respondListingError(c, err)
 		return
 	}
-	defer fileRows.Close()
-	for fileRows.Next() {
-		var item ItemInfo
-		var fileID, size int64
-		var name, path string
-		var modified time.Time
-		if err := fileRows.Scan(&fileID, &name, &size, &modified, &path); err != nil {
-			continue
-		}
-		item.ID = fmt.Sprintf("%d", fileID) // Add the ID
-		item.Name = name
-		item.Size = size
-		item.Modified = modified
-		item.IsDir = false
-		item.Path = filepath.ToSlash(filepath.Join(path, name))
-		items = append(items, item)
-	}
 
-	c.JSON(http.StatusOK, items)
+	h.attachTags(itemRefs(items))
+	c.JSON(http.StatusOK, gin.H{"items": items, "nextCursor": nextCursor, "total": total})
 }
 
+// RestoreItem brings the item at path back from the trash. The conflict option says what
+// happens when the name has been taken since: "fail", the default, or "rename".
 func (h *FileHandler) RestoreItem(c *gin.Context) {
 	username, ok := getUsername(c)
 	if !ok {
@@ -786,18 +1254,44 @@ func (h *FileHandler) RestoreItem(c *gin.Context) {
 	}
 
 	var payload struct {
-		Path string `json:"path"`
+		Path     string `json:"path"`
+		Conflict string `json:"conflict"`
 	}
 	if err := c.ShouldBindJSON(&payload); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
+	conflict, err := parseRestoreConflict(payload.Conflict)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	if err := h.updateItemsStatus(userID, []string{payload.Path}, "active"); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore item"})
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
-	c.Status(http.StatusOK)
+	defer tx.Rollback()
+
+	itemPath := path.Join("/", payload.Path)
+	item, err := trashedItem(tx, userID, path.Dir(itemPath), path.Base(itemPath))
+	if err == nil && item == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found in trash"})
+		return
+	}
+	var name string
+	if err == nil {
+		name, err = h.restoreItem(c.Request.Context(), tx, userID, username, item, conflict)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondRestoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Item restored", "name": name})
 }
 
 func (h *FileHandler) PermanentDeleteItem(c *gin.Context) {
@@ -825,27 +1319,41 @@ func (h *FileHandler) PermanentDeleteItem(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	var fileID int
-	var filePath string
+	dirID, err := folderIDAt(tx, userID, dirName)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found in trash"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error finding item to delete"})
+		return
+	}
+
+	// Storage is only cleaned up once the database changes are committed
+	var staleKeys []string
+
+	var fileID int64
 	var fileSize int64
-	err = tx.QueryRow("SELECT FILE_ID, FILE_PATH, FILE_SIZE FROM FILE_LIST WHERE OWNER_ID = ? AND FILE_NAME = ? AND FILE_PATH = ? AND STATUS = 'trashed'", userID, baseName, dirName).Scan(&fileID, &filePath, &fileSize)
+	var blobID sql.NullInt64
+	err = tx.QueryRow("SELECT FILE_ID, FILE_SIZE, BLOB_ID FROM FILE_LIST WHERE OWNER_ID = ? AND FILE_NAME = ? AND FOLDER_ID <=> ? AND STATUS = 'trashed'", userID, baseName, dirID).Scan(&fileID, &fileSize, &blobID)
 	if err == nil { // It's a file
-		// Update quota before deleting file record
-		if err := h.updateUserQuota(tx, userID, -fileSize); err != nil {
-			log.Printf("Failed to update quota on permanent delete: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota"})
+		staleKeys, err = h.purgeFile(tx, userID, username, fileID, dirName, fileSize, blobID)
+		if err != nil {
+			log.Printf("Failed to permanently delete file %d: %v", fileID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
 			return
 		}
-
-		_, execErr := tx.Exec("DELETE FROM FILE_LIST WHERE FILE_ID = ?", fileID)
-		if execErr != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB delete failed"})
+	} else if err == sql.ErrNoRows { // It's a folder
+		var folderID string
+		err = tx.QueryRow("SELECT FOLDER_ID FROM FOLDER_LIST WHERE OWNER_ID = ? AND FOLDER_NAME = ? AND PARENT_ID <=> ? AND STATUS = 'trashed' LIMIT 1", userID, baseName, dirID).Scan(&folderID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found in trash"})
 			return
 		}
-		physicalPath, _ := utils.GetSafePathForUser(username, filepath.Join(filePath, fmt.Sprintf("%d", fileID)))
-		os.Remove(physicalPath)
-	} else if err == sql.ErrNoRows { // It's a folder
-		if err := h.deleteFolderRecursive(tx, userID, username, baseName, dirName); err != nil {
+		if err == nil {
+			staleKeys, err = h.deleteFolderRecursive(tx, userID, username, folderID, filepath.ToSlash(filepath.Join(dirName, baseName)))
+		}
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete folder content"})
 			return
 		}
@@ -854,75 +1362,104 @@ func (h *FileHandler) PermanentDeleteItem(c *gin.Context) {
 		return
 	}
 
-	tx.Commit()
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit delete"})
+		return
+	}
+	h.removeStored(c.Request.Context(), staleKeys)
 	c.Status(http.StatusOK)
 }
 
-func (h *FileHandler) deleteFolderRecursive(tx *sql.Tx, userID int, username, folderName, path string) error {
-	fullPath := filepath.ToSlash(filepath.Join(path, folderName))
+// purgeFile deletes a file row for good along with its versions, giving back its quota. It returns
+// the storage keys that are no longer referenced, to be removed once the deletion is committed.
+func (h *FileHandler) purgeFile(tx *sql.Tx, userID int, username string, fileID int64, filePath string, fileSize int64, blobID sql.NullInt64) ([]string, error) {
+	// Update quota before deleting file record
+	if err := h.updateUserQuota(tx, userID, -fileSize); err != nil {
+		return nil, err
+	}
 
-	// Get file info including sizes for quota update
-	rows, err := tx.Query("SELECT FILE_ID, FILE_SIZE FROM FILE_LIST WHERE OWNER_ID = ? AND FILE_PATH = ?", userID, fullPath)
+	// Older versions go with the file
+	staleKeys, err := h.dropAllVersions(tx, userID, fileID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var fileInfo []struct {
-		id   int
-		size int64
+
+	if _, err := tx.Exec("DELETE FROM FILE_LIST WHERE FILE_ID = ?", fileID); err != nil {
+		return nil, err
 	}
-	for rows.Next() {
-		var id int
-		var size int64
-		if err := rows.Scan(&id, &size); err == nil {
-			fileInfo = append(fileInfo, struct {
-				id   int
-				size int64
-			}{id, size})
+	if err := fulltext.QueueFiles(tx, false, fileID); err != nil {
+		return nil, err
+	}
+	if blobID.Valid {
+		// The blob only goes away with its last reference
+		key, err := h.blobs.Release(tx, blobID.Int64)
+		if err != nil {
+			return nil, err
 		}
+		staleKeys = append(staleKeys, key)
+	} else if key, err := fileKey(username, filePath, fileID); err == nil {
+		staleKeys = append(staleKeys, key)
 	}
-	rows.Close()
+	return staleKeys, nil
+}
 
-	for _, info := range fileInfo {
-		// Update quota before deleting file record
-		if err := h.updateUserQuota(tx, userID, -info.size); err != nil {
-			log.Printf("Failed to update quota on folder delete: %v", err)
-			return err
+// deleteFolderRecursive removes a folder and everything below it from the database, whatever
+// their status. It returns the storage keys that became unreferenced, to be deleted after commit.
+func (h *FileHandler) deleteFolderRecursive(tx *sql.Tx, userID int, username, folderID, folderPath string) ([]string, error) {
+	// Every file below and every older version of them, read in one go
+	rows, err := tx.Query(subtreeCTE+`
+		SELECT f.FILE_ID, s.FULL_PATH, COALESCE(f.FILE_SIZE, 0), f.BLOB_ID
+		FROM FILE_LIST f JOIN subtree s ON f.FOLDER_ID = s.FOLDER_ID
+		UNION ALL
+		SELECT 0, '', v.FILE_SIZE, v.BLOB_ID
+		FROM FILE_VERSIONS v JOIN FILE_LIST f ON v.FILE_ID = f.FILE_ID JOIN subtree s ON f.FOLDER_ID = s.FOLDER_ID
+	`, folderPath, folderID)
+	if err != nil {
+		return nil, err
+	}
+	var staleKeys []string
+	var blobIDs []int64
+	var freed int64
+	for rows.Next() {
+		var fileID, size int64
+		var filePath string
+		var blobID sql.NullInt64
+		if err := rows.Scan(&fileID, &filePath, &size, &blobID); err != nil {
+			rows.Close()
+			return nil, err
 		}
-
-		_, err := tx.Exec("DELETE FROM FILE_LIST WHERE FILE_ID = ?", info.id)
-		if err != nil {
-			return err
+		freed += size
+		if blobID.Valid {
+			blobIDs = append(blobIDs, blobID.Int64)
+		} else if key, err := fileKey(username, filePath, fileID); err == nil {
+			staleKeys = append(staleKeys, key)
 		}
-		physicalPath, _ := utils.GetSafePathForUser(username, filepath.Join(fullPath, fmt.Sprintf("%d", info.id)))
-		os.Remove(physicalPath)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	subRows, err := tx.Query("SELECT FOLDER_NAME FROM FOLDER_LIST WHERE OWNER_ID = ? AND PATH = ?", userID, fullPath)
-	if err != nil {
-		return err
+	if err := h.updateUserQuota(tx, userID, -freed); err != nil {
+		log.Printf("Failed to update quota on folder delete: %v", err)
+		return nil, err
 	}
-	var subFolders []string
-	for subRows.Next() {
-		var name string
-		if err := subRows.Scan(&name); err == nil {
-			subFolders = append(subFolders, name)
-		}
+	// Versions and shares go with their rows
+	if _, err := tx.Exec(`DELETE f FROM FILE_LIST f JOIN (`+subtreeCTE+` SELECT FOLDER_ID FROM subtree) s ON f.FOLDER_ID = s.FOLDER_ID`, folderPath, folderID); err != nil {
+		return nil, err
 	}
-	subRows.Close()
-
-	for _, name := range subFolders {
-		if err := h.deleteFolderRecursive(tx, userID, username, name, fullPath); err != nil {
-			return err
-		}
+	if err := fulltext.QueueFolders(tx, folderID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE fl FROM FOLDER_LIST fl JOIN (`+subtreeCTE+` SELECT FOLDER_ID FROM subtree) s ON fl.FOLDER_ID = s.FOLDER_ID`, folderPath, folderID); err != nil {
+		return nil, err
 	}
 
-	_, err = tx.Exec("DELETE FROM FOLDER_LIST WHERE OWNER_ID = ? AND FOLDER_NAME = ? AND PATH = ?", userID, folderName, path)
+	keys, err := h.blobs.ReleaseAll(tx, blobIDs)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	physicalFolderPath, _ := utils.GetSafePathForUser(username, fullPath)
-	os.RemoveAll(physicalFolderPath)
-	return nil
+	return append(staleKeys, keys...), nil
 }
 
 // --- Download Operations ---
@@ -945,30 +1482,30 @@ func (h *FileHandler) DownloadFile(c *gin.Context) {
 		dirName = "/"
 	}
 
-	var fileID int
-	var fileName, fileType, filePath string
-	err = h.db.QueryRow("SELECT FILE_ID, FILE_NAME, FILE_TYPE, FILE_PATH FROM FILE_LIST WHERE OWNER_ID = ? AND FILE_NAME = ? AND FILE_PATH = ? AND STATUS = 'active'", userID, baseName, dirName).Scan(&fileID, &fileName, &fileType, &filePath)
+	var fileID int64
+	var fileName, fileType string
+	var blobKey sql.NullString
+	ref := blobs.Ref{OwnerID: userID}
+	dirID, err := folderIDAt(h.db, userID, dirName)
+	if err == nil {
+		err = h.db.QueryRow(`
+			SELECT f.FILE_ID, f.FILE_NAME, f.FILE_TYPE, COALESCE(f.FILE_SIZE, 0), b.STORAGE_KEY, COALESCE(b.ENCRYPTED, 0), COALESCE(b.CODEC, 'none')
+			FROM FILE_LIST f LEFT JOIN BLOB_LIST b ON f.BLOB_ID = b.BLOB_ID
+			WHERE f.OWNER_ID = ? AND f.FILE_NAME = ? AND f.FOLDER_ID <=> ? AND f.STATUS = 'active'
+		`, userID, baseName, dirID).Scan(&fileID, &fileName, &fileType, &ref.Size, &blobKey, &ref.Encrypted, &ref.Codec)
+	}
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "File not found in database"})
 		return
 	}
 
-	physicalPath, err := utils.GetSafePathForUser(username, filepath.Join(filePath, fmt.Sprintf("%d", fileID)))
+	ref.Key, err = storedFileKey(username, dirName, fileID, blobKey)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file path"})
 		return
 	}
-	if _, err := os.Stat(physicalPath); os.IsNotExist(err) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File does not exist on server"})
-		return
-	}
-
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
-	if fileType == "" {
-		fileType = "application/octet-stream"
-	}
-	c.Header("Content-Type", fileType)
-	c.File(physicalPath)
+	h.serveStoredFile(c, ref, fileName, fileType)
+	h.recordDownload(c, userID, fileID)
 }
 
 func (h *FileHandler) DownloadFolder(c *gin.Context) {
@@ -991,7 +1528,7 @@ func (h *FileHandler) DownloadFolder(c *gin.Context) {
 	zipWriter := zip.NewWriter(c.Writer)
 	defer zipWriter.Close()
 
-	if err := h.addPathToZipDB(zipWriter, userID, username, relativePath, ""); err != nil {
+	if err := h.addPathToZipDB(c.Request.Context(), zipWriter, userID, username, relativePath); err != nil {
 		log.Printf("[ERROR] DownloadFolder: Error during zipping for %s: %v", relativePath, err)
 	}
 }
@@ -1026,89 +1563,144 @@ func (h *FileHandler) BulkDownloadItems(c *gin.Context) {
 	defer zipWriter.Close()
 
 	for _, relPath := range payload.Paths {
-		if err := h.addPathToZipDB(zipWriter, userID, username, relPath, ""); err != nil {
+		if err := h.addPathToZipDB(c.Request.Context(), zipWriter, userID, username, relPath); err != nil {
 			log.Printf("[ERROR] BulkDownload: Failed to add '%s' to zip. Error: %v", relPath, err)
 		}
 	}
 }
 
-func (h *FileHandler) addPathToZipDB(zipWriter *zip.Writer, userID int, username, relativePath, baseInZip string) error {
+// zippedFile is a stored file on its way into a zip archive
+type zippedFile struct {
+	name string
+	ref  blobs.Ref
+}
+
+// addPathToZipDB adds the active file or folder at relativePath to a zip archive, a folder along
+// with everything below it. A folder's tree is read with one query for its folders and one for its
+// files before anything is streamed, so no query stays open while the archive is written.
+func (h *FileHandler) addPathToZipDB(ctx context.Context, zipWriter *zip.Writer, userID int, username, relativePath string) error {
+	relativePath = filepath.ToSlash(filepath.Clean("/" + relativePath))
 	baseName := filepath.Base(relativePath)
 	dirName := filepath.ToSlash(filepath.Dir(relativePath))
-	if dirName == "." {
-		dirName = "/"
+
+	dirID, err := folderIDAt(h.db, userID, dirName)
+	if err != nil {
+		return fmt.Errorf("item not found: %s", relativePath)
 	}
 
-	var fileID int
-	var fileName string
-	err := h.db.QueryRow("SELECT FILE_ID, FILE_NAME FROM FILE_LIST WHERE OWNER_ID = ? AND FILE_NAME = ? AND FILE_PATH = ? AND STATUS = 'active'", userID, baseName, dirName).Scan(&fileID, &fileName)
+	var fileID int64
+	var blobKey sql.NullString
+	file := zippedFile{ref: blobs.Ref{OwnerID: userID}}
+	err = h.db.QueryRow(`
+		SELECT f.FILE_ID, f.FILE_NAME, COALESCE(f.FILE_SIZE, 0), b.STORAGE_KEY, COALESCE(b.ENCRYPTED, 0), COALESCE(b.CODEC, 'none')
+		FROM FILE_LIST f LEFT JOIN BLOB_LIST b ON f.BLOB_ID = b.BLOB_ID
+		WHERE f.OWNER_ID = ? AND f.FILE_NAME = ? AND f.FOLDER_ID <=> ? AND f.STATUS = 'active'
+	`, userID, baseName, dirID).Scan(&fileID, &file.name, &file.ref.Size, &blobKey, &file.ref.Encrypted, &file.ref.Codec)
 	if err == nil { // It's a file
-		physicalPath, _ := utils.GetSafePathForUser(username, filepath.Join(dirName, fmt.Sprintf("%d", fileID)))
-		fileToZip, err := os.Open(physicalPath)
-		if err != nil {
-			return err
-		}
-		defer fileToZip.Close()
-
-		info, err := fileToZip.Stat()
-		if err != nil {
-			return err
-		}
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
-		}
-
-		header.Name = filepath.ToSlash(filepath.Join(baseInZip, fileName))
-		header.Method = zip.Deflate
-		writer, err := zipWriter.CreateHeader(header)
+		file.ref.Key, err = storedFileKey(username, dirName, fileID, blobKey)
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(writer, fileToZip)
+		return h.addFileToZip(ctx, zipWriter, file)
+	} else if err != sql.ErrNoRows {
 		return err
+	}
 
-	} else if err == sql.ErrNoRows { // It's a folder
-		var modTime time.Time
-		err := h.db.QueryRow("SELECT modified_at FROM FOLDER_LIST WHERE OWNER_ID = ? AND FOLDER_NAME = ? AND PATH = ? AND STATUS = 'active'", userID, baseName, dirName).Scan(&modTime)
-		if err != nil {
-			return fmt.Errorf("item not found: %s", relativePath)
-		}
+	// It's a folder
+	var folderID string
+	err = h.db.QueryRow("SELECT FOLDER_ID FROM FOLDER_LIST WHERE OWNER_ID = ? AND PARENT_ID <=> ? AND FOLDER_NAME = ? AND STATUS = 'active' LIMIT 1",
+		userID, dirID, baseName).Scan(&folderID)
+	if err != nil {
+		return fmt.Errorf("item not found: %s", relativePath)
+	}
 
-		currentBaseInZip := filepath.ToSlash(filepath.Join(baseInZip, baseName))
-		// --- EDITED: Fixed field name from ModTime to Modified ---
-		_, err = zipWriter.CreateHeader(&zip.FileHeader{Name: currentBaseInZip + "/", Modified: modTime})
-		if err != nil {
+	// Paths in the archive start at the folder's own name; only what is reachable through active folders goes in
+	folderRows, err := h.db.QueryContext(ctx, subtreeCTE+`
+		SELECT s.FULL_PATH, fl.modified_at FROM subtree s JOIN FOLDER_LIST fl ON fl.FOLDER_ID = s.FOLDER_ID
+		WHERE s.ACTIVE ORDER BY s.DEPTH
+	`, baseName, folderID)
+	if err != nil {
+		return err
+	}
+	type zippedFolder struct {
+		name     string
+		modified time.Time
+	}
+	var folders []zippedFolder
+	for folderRows.Next() {
+		var folder zippedFolder
+		if err := folderRows.Scan(&folder.name, &folder.modified); err != nil {
+			folderRows.Close()
 			return err
 		}
+		folders = append(folders, folder)
+	}
+	folderRows.Close()
+	if err := folderRows.Err(); err != nil {
+		return err
+	}
 
-		fullFolderPath := filepath.ToSlash(filepath.Join(dirName, baseName))
-
-		fileRows, err := h.db.Query("SELECT FILE_NAME FROM FILE_LIST WHERE OWNER_ID = ? AND FILE_PATH = ? AND STATUS = 'active'", userID, fullFolderPath)
-		if err != nil {
+	fileRows, err := h.db.QueryContext(ctx, subtreeCTE+`
+		SELECT s.FULL_PATH, f.FILE_ID, f.FILE_NAME, COALESCE(f.FILE_SIZE, 0),
+			b.STORAGE_KEY, COALESCE(b.ENCRYPTED, 0), COALESCE(b.CODEC, 'none')
+		FROM FILE_LIST f JOIN subtree s ON f.FOLDER_ID = s.FOLDER_ID
+		LEFT JOIN BLOB_LIST b ON f.BLOB_ID = b.BLOB_ID
+		WHERE s.ACTIVE AND f.STATUS = 'active'
+	`, baseName, folderID)
+	if err != nil {
+		return err
+	}
+	var files []zippedFile
+	for fileRows.Next() {
+		var inZip, fileName string
+		file := zippedFile{ref: blobs.Ref{OwnerID: userID}}
+		if err := fileRows.Scan(&inZip, &fileID, &fileName, &file.ref.Size, &blobKey, &file.ref.Encrypted, &file.ref.Codec); err != nil {
+			fileRows.Close()
 			return err
 		}
-		defer fileRows.Close()
-		for fileRows.Next() {
-			var name string
-			if err := fileRows.Scan(&name); err == nil {
-				h.addPathToZipDB(zipWriter, userID, username, filepath.ToSlash(filepath.Join(fullFolderPath, name)), currentBaseInZip)
-			}
+		file.name = inZip + "/" + fileName
+		if file.ref.Key, err = storedFileKey(username, path.Join(dirName, inZip), fileID, blobKey); err != nil {
+			continue
 		}
+		files = append(files, file)
+	}
+	fileRows.Close()
+	if err := fileRows.Err(); err != nil {
+		return err
+	}
 
-		folderRows, err := h.db.Query("SELECT FOLDER_NAME FROM FOLDER_LIST WHERE OWNER_ID = ? AND PATH = ? AND STATUS = 'active'", userID, fullFolderPath)
-		if err != nil {
+	for _, folder := range folders {
+		if _, err := zipWriter.CreateHeader(&zip.FileHeader{Name: folder.name + "/", Modified: folder.modified}); err != nil {
 			return err
 		}
-		defer folderRows.Close()
-		for folderRows.Next() {
-			var name string
-			if err := folderRows.Scan(&name); err == nil {
-				h.addPathToZipDB(zipWriter, userID, username, filepath.ToSlash(filepath.Join(fullFolderPath, name)), currentBaseInZip)
-			}
+	}
+	for _, file := range files {
+		// One unreadable file does not spoil the rest of the archive
+		if err := h.addFileToZip(ctx, zipWriter, file); err != nil {
+			log.Printf("Failed to add %s to zip: %v", file.name, err)
 		}
-		return nil
 	}
+	return nil
+}
+
+// addFileToZip streams a stored file into a zip archive
+func (h *FileHandler) addFileToZip(ctx context.Context, zipWriter *zip.Writer, file zippedFile) error {
+	fileToZip, err := h.blobs.Open(ctx, file.ref)
+	if err != nil {
+		return err
+	}
+	defer fileToZip.Close()
+
+	header := &zip.FileHeader{
+		Name:     file.name,
+		Method:   zip.Deflate,
+		Modified: fileToZip.ModTime,
+	}
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, fileToZip)
 	return err
 }
 
@@ -1183,8 +1775,8 @@ func (h *FileHandler) ShareItem(c *gin.Context) {
 			return
 		}
 
-		// Recursively share all contents
-		if err := h.recursiveShareFolderContents(tx, ownerID, payload.ItemID, targetUserID, payload.Permission); err != nil {
+		// Share all contents
+		if err := h.shareFolderContents(tx, payload.ItemID, targetUserID, payload.Permission); err != nil {
 			log.Printf("Error recursively sharing folder contents: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to share folder contents"})
 			return
@@ -1202,70 +1794,29 @@ func (h *FileHandler) ShareItem(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Item shared successfully"})
 }
 
-// New helper function to recursively share folder contents
-func (h *FileHandler) recursiveShareFolderContents(tx *sql.Tx, ownerID int, folderID string, targetUserID int, permission string) error {
-	// Get the folder's path information
-	var folderName, folderPath string
-	err := tx.QueryRow("SELECT FOLDER_NAME, PATH FROM FOLDER_LIST WHERE FOLDER_ID = ? AND OWNER_ID = ?", folderID, ownerID).Scan(&folderName, &folderPath)
-	if err != nil {
-		return fmt.Errorf("failed to get folder info: %v", err)
-	}
-
-	// Construct the full path of this folder
-	fullFolderPath := filepath.ToSlash(filepath.Join(folderPath, folderName))
-
-	// Collect all file IDs first, then process them
-	fileRows, err := tx.Query("SELECT FILE_ID FROM FILE_LIST WHERE OWNER_ID = ? AND FILE_PATH = ? AND STATUS = 'active'", ownerID, fullFolderPath)
+// shareFolderContents shares everything below a folder that is reachable through active
+// folders, with one statement for the folders and one for the files
+func (h *FileHandler) shareFolderContents(tx *sql.Tx, folderID string, targetUserID int, permission string) error {
+	_, err := tx.Exec(`
+		INSERT INTO SHARED_FOLDER (USER_ID, FOLDER_ID, PERMISSION)
+		SELECT ?, s.FOLDER_ID, ? FROM (`+subtreeCTE+` SELECT FOLDER_ID, ACTIVE, DEPTH FROM subtree) s
+		WHERE s.ACTIVE AND s.DEPTH > 0
+		ON DUPLICATE KEY UPDATE PERMISSION = ?
+	`, targetUserID, permission, "", folderID, permission)
 	if err != nil {
-		return fmt.Errorf("failed to query files in folder: %v", err)
-	}
-
-	var fileIDs []int
-	for fileRows.Next() {
-		var fileID int
-		if err := fileRows.Scan(&fileID); err == nil {
-			fileIDs = append(fileIDs, fileID)
-		}
-	}
-	fileRows.Close() // Important: close before using the transaction again
-
-	// Now share all collected files
-	for _, fileID := range fileIDs {
-		_, err = tx.Exec("INSERT INTO SHARED_FILE (USER_ID, FILE_ID, PERMISSION) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE PERMISSION = ?", targetUserID, fileID, permission, permission)
-		if err != nil {
-			log.Printf("Warning: Failed to share file %d: %v", fileID, err)
-		}
+		return fmt.Errorf("failed to share subfolders: %v", err)
 	}
 
-	// Collect all subfolder IDs first, then process them
-	folderRows, err := tx.Query("SELECT FOLDER_ID FROM FOLDER_LIST WHERE OWNER_ID = ? AND PATH = ? AND STATUS = 'active'", ownerID, fullFolderPath)
+	_, err = tx.Exec(`
+		INSERT INTO SHARED_FILE (USER_ID, FILE_ID, PERMISSION)
+		SELECT ?, f.FILE_ID, ? FROM FILE_LIST f
+		JOIN (`+subtreeCTE+` SELECT FOLDER_ID, ACTIVE FROM subtree) s ON f.FOLDER_ID = s.FOLDER_ID
+		WHERE s.ACTIVE AND f.STATUS = 'active'
+		ON DUPLICATE KEY UPDATE PERMISSION = ?
+	`, targetUserID, permission, "", folderID, permission)
 	if err != nil {
-		return fmt.Errorf("failed to query subfolders: %v", err)
-	}
-
-	var subFolderIDs []string
-	for folderRows.Next() {
-		var subFolderID string
-		if err := folderRows.Scan(&subFolderID); err == nil {
-			subFolderIDs = append(subFolderIDs, subFolderID)
-		}
-	}
-	folderRows.Close() // Important: close before using the transaction again
-
-	// Now share all collected subfolders and recursively share their contents
-	for _, subFolderID := range subFolderIDs {
-		// Share the subfolder
-		_, err = tx.Exec("INSERT INTO SHARED_FOLDER (USER_ID, FOLDER_ID, PERMISSION) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE PERMISSION = ?", targetUserID, subFolderID, permission, permission)
-		if err != nil {
-			log.Printf("Warning: Failed to share subfolder %s: %v", subFolderID, err)
-			continue
-		}
-		// Recursively share the subfolder's contents
-		if err := h.recursiveShareFolderContents(tx, ownerID, subFolderID, targetUserID, permission); err != nil {
-			log.Printf("Warning: Failed to recursively share subfolder %s: %v", subFolderID, err)
-		}
+		return fmt.Errorf("failed to share files in folder: %v", err)
 	}
-
 	return nil
 }
 
@@ -1322,8 +1873,8 @@ func (h *FileHandler) UnshareItem(c *gin.Context) {
 			return
 		}
 
-		// Recursively unshare all contents
-		if err := h.recursiveUnshareFolderContents(tx, ownerID, payload.ItemID, payload.ShareWithUserID); err != nil {
+		// Unshare all contents
+		if err := h.unshareFolderContents(tx, payload.ItemID, payload.ShareWithUserID); err != nil {
 			log.Printf("Error recursively unsharing folder contents: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unshare folder contents"})
 			return
@@ -1341,83 +1892,42 @@ func (h *FileHandler) UnshareItem(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Item unshared successfully"})
 }
 
-// New helper function to recursively unshare folder contents
-func (h *FileHandler) recursiveUnshareFolderContents(tx *sql.Tx, ownerID int, folderID string, targetUserID int) error {
-	// Get the folder's path information
-	var folderName, folderPath string
-	err := tx.QueryRow("SELECT FOLDER_NAME, PATH FROM FOLDER_LIST WHERE FOLDER_ID = ? AND OWNER_ID = ?", folderID, ownerID).Scan(&folderName, &folderPath)
-	if err != nil {
-		return fmt.Errorf("failed to get folder info: %v", err)
-	}
-
-	// Construct the full path of this folder
-	fullFolderPath := filepath.ToSlash(filepath.Join(folderPath, folderName))
-
-	// Collect all file IDs first, then process them
-	fileRows, err := tx.Query("SELECT FILE_ID FROM FILE_LIST WHERE OWNER_ID = ? AND FILE_PATH = ? AND STATUS = 'active'", ownerID, fullFolderPath)
+// unshareFolderContents takes back the shares of everything below a folder, trashed or not
+func (h *FileHandler) unshareFolderContents(tx *sql.Tx, folderID string, targetUserID int) error {
+	_, err := tx.Exec(`
+		DELETE sf FROM SHARED_FOLDER sf
+		JOIN (`+subtreeCTE+` SELECT FOLDER_ID, DEPTH FROM subtree) s ON sf.FOLDER_ID = s.FOLDER_ID
+		WHERE sf.USER_ID = ? AND s.DEPTH > 0
+	`, "", folderID, targetUserID)
 	if err != nil {
-		return fmt.Errorf("failed to query files in folder: %v", err)
-	}
-
-	var fileIDs []int
-	for fileRows.Next() {
-		var fileID int
-		if err := fileRows.Scan(&fileID); err == nil {
-			fileIDs = append(fileIDs, fileID)
-		}
-	}
-	fileRows.Close() // Important: close before using the transaction again
-
-	// Now unshare all collected files
-	for _, fileID := range fileIDs {
-		_, err = tx.Exec("DELETE FROM SHARED_FILE WHERE FILE_ID = ? AND USER_ID = ?", fileID, targetUserID)
-		if err != nil {
-			log.Printf("Warning: Failed to unshare file %d: %v", fileID, err)
-		}
+		return fmt.Errorf("failed to unshare subfolders: %v", err)
 	}
 
-	// Collect all subfolder IDs first, then process them
-	folderRows, err := tx.Query("SELECT FOLDER_ID FROM FOLDER_LIST WHERE OWNER_ID = ? AND PATH = ? AND STATUS = 'active'", ownerID, fullFolderPath)
+	_, err = tx.Exec(`
+		DELETE sf FROM SHARED_FILE sf
+		JOIN FILE_LIST f ON sf.FILE_ID = f.FILE_ID
+		JOIN (`+subtreeCTE+` SELECT FOLDER_ID FROM subtree) s ON f.FOLDER_ID = s.FOLDER_ID
+		WHERE sf.USER_ID = ?
+	`, "", folderID, targetUserID)
 	if err != nil {
-		return fmt.Errorf("failed to query subfolders: %v", err)
-	}
-
-	var subFolderIDs []string
-	for folderRows.Next() {
-		var subFolderID string
-		if err := folderRows.Scan(&subFolderID); err == nil {
-			subFolderIDs = append(subFolderIDs, subFolderID)
-		}
-	}
-	folderRows.Close() // Important: close before using the transaction again
-
-	// Now unshare all collected subfolders and recursively unshare their contents
-	for _, subFolderID := range subFolderIDs {
-		// Unshare the subfolder
-		_, err = tx.Exec("DELETE FROM SHARED_FOLDER WHERE FOLDER_ID = ? AND USER_ID = ?", subFolderID, targetUserID)
-		if err != nil {
-			log.Printf("Warning: Failed to unshare subfolder %s: %v", subFolderID, err)
-			continue
-		}
-		// Recursively unshare the subfolder's contents
-		if err := h.recursiveUnshareFolderContents(tx, ownerID, subFolderID, targetUserID); err != nil {
-			log.Printf("Warning: Failed to recursively unshare subfolder %s: %v", subFolderID, err)
-		}
+		return fmt.Errorf("failed to unshare files in folder: %v", err)
 	}
-
 	return nil
 }
 
-func (h *FileHandler) autoShareNewItem(tx *sql.Tx, ownerID int, itemID string, itemType string, itemPath string) error {
+func (h *FileHandler) autoShareNewItem(tx *sql.Tx, ownerID int, itemID string, itemType string, parentID sql.NullString) error {
+	if !parentID.Valid {
+		return nil
+	}
 	// Find all parent folders that are shared and inherit their sharing
 	// Collect all sharing information first, then process
-	folderRows, err := tx.Query(`
-		SELECT DISTINCT sf.USER_ID, sf.PERMISSION, fl.FOLDER_ID 
-		FROM SHARED_FOLDER sf
+	folderRows, err := tx.Query(ancestorsCTE+`
+		SELECT DISTINCT sf.USER_ID, sf.PERMISSION, fl.FOLDER_ID
+		FROM ancestors a
+		JOIN SHARED_FOLDER sf ON sf.FOLDER_ID = a.FOLDER_ID
 		JOIN FOLDER_LIST fl ON sf.FOLDER_ID = fl.FOLDER_ID
-		WHERE fl.OWNER_ID = ? AND fl.STATUS = 'active' 
-		AND ? LIKE CONCAT(fl.PATH, '/', fl.FOLDER_NAME, '/%')
-	`, ownerID, itemPath)
+		WHERE fl.OWNER_ID = ? AND fl.STATUS = 'active'
+	`, parentID.String, ownerID)
 
 	if err != nil {
 		return fmt.Errorf("failed to query parent shared folders: %v", err)
@@ -1478,7 +1988,7 @@ func (h *FileHandler) ListAllSharedItems(c *gin.Context) {
 	// --- Items Shared WITH ME ---
 	var sharedWithMe []SharedItemInfo
 	folderRows, err := h.db.Query(`
-		SELECT sf.PERMISSION, fl.FOLDER_ID, fl.FOLDER_NAME, fl.modified_at, fl.PATH, u.USERNAME 
+		SELECT sf.PERMISSION, fl.FOLDER_ID, fl.FOLDER_NAME, fl.modified_at, fl.PARENT_ID, u.USERNAME
 		FROM SHARED_FOLDER sf
 		JOIN FOLDER_LIST fl ON sf.FOLDER_ID = fl.FOLDER_ID
 		JOIN USERS u ON fl.OWNER_ID = u.USER_ID
@@ -1491,15 +2001,13 @@ func (h *FileHandler) ListAllSharedItems(c *gin.Context) {
 	defer folderRows.Close()
 	for folderRows.Next() {
 		var item SharedItemInfo
-		var path string
-		folderRows.Scan(&item.Permission, &item.ID, &item.Name, &item.Modified, &path, &item.OwnerName)
+		folderRows.Scan(&item.Permission, &item.ID, &item.Name, &item.Modified, &item.parentID, &item.OwnerName)
 		item.IsDir = true
-		item.Path = filepath.ToSlash(filepath.Join(path, item.Name))
 		sharedWithMe = append(sharedWithMe, item)
 	}
 
 	fileRows, err := h.db.Query(`
-		SELECT sf.PERMISSION, fl.FILE_ID, fl.FILE_NAME, fl.FILE_SIZE, fl.modified_at, fl.FILE_PATH, u.USERNAME
+		SELECT sf.PERMISSION, fl.FILE_ID, fl.FILE_NAME, fl.FILE_SIZE, fl.modified_at, fl.FOLDER_ID, u.USERNAME
 		FROM SHARED_FILE sf
 		JOIN FILE_LIST fl ON sf.FILE_ID = fl.FILE_ID
 		JOIN USERS u ON fl.OWNER_ID = u.USER_ID
@@ -1512,10 +2020,8 @@ func (h *FileHandler) ListAllSharedItems(c *gin.Context) {
 	defer fileRows.Close()
 	for fileRows.Next() {
 		var item SharedItemInfo
-		var path string
-		fileRows.Scan(&item.Permission, &item.ID, &item.Name, &item.Size, &item.Modified, &path, &item.OwnerName)
+		fileRows.Scan(&item.Permission, &item.ID, &item.Name, &item.Size, &item.Modified, &item.parentID, &item.OwnerName)
 		item.IsDir = false
-		item.Path = filepath.ToSlash(filepath.Join(path, item.Name))
 		sharedWithMe = append(sharedWithMe, item)
 	}
 
@@ -1524,19 +2030,20 @@ func (h *FileHandler) ListAllSharedItems(c *gin.Context) {
 	sharedFilesMap := make(map[string]*SharedByMeInfo)
 
 	mySharedFolders, _ := h.db.Query(`
-		SELECT fl.FOLDER_ID, fl.FOLDER_NAME, fl.modified_at, fl.PATH, u.USER_ID, u.USERNAME, sf.PERMISSION
+		SELECT fl.FOLDER_ID, fl.FOLDER_NAME, fl.modified_at, fl.PARENT_ID, u.USER_ID, u.USERNAME, sf.PERMISSION
 		FROM FOLDER_LIST fl JOIN SHARED_FOLDER sf ON fl.FOLDER_ID = sf.FOLDER_ID JOIN USERS u ON sf.USER_ID = u.USER_ID
 		WHERE fl.OWNER_ID = ? AND fl.STATUS = 'active' ORDER BY fl.FOLDER_NAME, u.USERNAME
 	`, userID)
 	defer mySharedFolders.Close()
 	for mySharedFolders.Next() {
-		var fID, fName, path, sUsername, perm string
+		var fID, fName, sUsername, perm string
+		var parentID sql.NullString
 		var mod time.Time
 		var sUserID int
-		mySharedFolders.Scan(&fID, &fName, &mod, &path, &sUserID, &sUsername, &perm)
+		mySharedFolders.Scan(&fID, &fName, &mod, &parentID, &sUserID, &sUsername, &perm)
 		if _, exists := sharedFoldersMap[fID]; !exists {
 			sharedFoldersMap[fID] = &SharedByMeInfo{
-				ItemInfo: ItemInfo{ID: fID, Name: fName, Modified: mod, IsDir: true, Path: filepath.ToSlash(filepath.Join(path, fName))},
+				ItemInfo: ItemInfo{ID: fID, Name: fName, Modified: mod, IsDir: true, parentID: parentID},
 				SharedWith: []struct {
 					UserID     int    `json:"userId"`
 					Username   string `json:"username"`
@@ -1552,21 +2059,22 @@ func (h *FileHandler) ListAllSharedItems(c *gin.Context) {
 	}
 
 	mySharedFiles, _ := h.db.Query(`
-		SELECT fl.FILE_ID, fl.FILE_NAME, fl.FILE_SIZE, fl.modified_at, fl.FILE_PATH, u.USER_ID, u.USERNAME, sf.PERMISSION
+		SELECT fl.FILE_ID, fl.FILE_NAME, fl.FILE_SIZE, fl.modified_at, fl.FOLDER_ID, u.USER_ID, u.USERNAME, sf.PERMISSION
 		FROM FILE_LIST fl JOIN SHARED_FILE sf ON fl.FILE_ID = sf.FILE_ID JOIN USERS u ON sf.USER_ID = u.USER_ID
 		WHERE fl.OWNER_ID = ? AND fl.STATUS = 'active' ORDER BY fl.FILE_NAME, u.USERNAME
 	`, userID)
 	defer mySharedFiles.Close()
 	for mySharedFiles.Next() {
 		var fileID, fileSize int64
-		var fName, path, sUsername, perm string
+		var fName, sUsername, perm string
+		var parentID sql.NullString
 		var mod time.Time
 		var sUserID int
-		mySharedFiles.Scan(&fileID, &fName, &fileSize, &mod, &path, &sUserID, &sUsername, &perm)
+		mySharedFiles.Scan(&fileID, &fName, &fileSize, &mod, &parentID, &sUserID, &sUsername, &perm)
 		sFileID := fmt.Sprintf("%d", fileID)
 		if _, exists := sharedFilesMap[sFileID]; !exists {
 			sharedFilesMap[sFileID] = &SharedByMeInfo{
-				ItemInfo: ItemInfo{ID: sFileID, Name: fName, Size: fileSize, Modified: mod, IsDir: false, Path: filepath.ToSlash(filepath.Join(path, fName))},
+				ItemInfo: ItemInfo{ID: sFileID, Name: fName, Size: fileSize, Modified: mod, IsDir: false, parentID: parentID},
 				SharedWith: []struct {
 					UserID     int    `json:"userId"`
 					Username   string `json:"username"`
@@ -1589,6 +2097,15 @@ func (h *FileHandler) ListAllSharedItems(c *gin.Context) {
 		sharedByMe = append(sharedByMe, *v)
 	}
 
+	// Items shared with the user show the tags their owner gave them
+	refs := append(itemRefs(sharedWithMe), itemRefs(sharedByMe)...)
+	if err := attachPaths(h.db, refs); err != nil {
+		log.Printf("Error fetching paths of shared items: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch shared items"})
+		return
+	}
+	h.attachTags(refs)
+
 	c.JSON(http.StatusOK, gin.H{"sharedWithMe": sharedWithMe, "sharedByMe": sharedByMe})
 }
 
@@ -1607,13 +2124,21 @@ func (h *FileHandler) DownloadSharedFile(c *gin.Context) {
 
 	// Check if user has access to this shared file
 	var fileName, fileType, filePath string
+	var parentID sql.NullString
 	var ownerID int
+	var storedID int64
+	var blobKey sql.NullString
+	var ref blobs.Ref
 	err = h.db.QueryRow(`
-		SELECT fl.FILE_NAME, fl.FILE_TYPE, fl.FILE_PATH, fl.OWNER_ID 
+		SELECT fl.FILE_ID, fl.FILE_NAME, fl.FILE_TYPE, fl.FOLDER_ID, COALESCE(fl.FILE_SIZE, 0), fl.OWNER_ID, b.STORAGE_KEY, COALESCE(b.ENCRYPTED, 0), COALESCE(b.CODEC, 'none')
 		FROM FILE_LIST fl 
 		JOIN SHARED_FILE sf ON fl.FILE_ID = sf.FILE_ID 
+		LEFT JOIN BLOB_LIST b ON fl.BLOB_ID = b.BLOB_ID
 		WHERE sf.USER_ID = ? AND fl.FILE_ID = ? AND fl.STATUS = 'active'
-	`, userID, fileID).Scan(&fileName, &fileType, &filePath, &ownerID)
+	`, userID, fileID).Scan(&storedID, &fileName, &fileType, &parentID, &ref.Size, &ownerID, &blobKey, &ref.Encrypted, &ref.Codec)
+	if err == nil {
+		filePath, err = folderPath(h.db, parentID)
+	}
 
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Shared file not found or access denied"})
@@ -1628,22 +2153,14 @@ func (h *FileHandler) DownloadSharedFile(c *gin.Context) {
 		return
 	}
 
-	physicalPath, err := utils.GetSafePathForUser(ownerUsername, filepath.Join(filePath, fileID))
+	ref.OwnerID = ownerID
+	ref.Key, err = storedFileKey(ownerUsername, filePath, storedID, blobKey)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file path"})
 		return
 	}
-	if _, err := os.Stat(physicalPath); os.IsNotExist(err) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File does not exist on server"})
-		return
-	}
-
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
-	if fileType == "" {
-		fileType = "application/octet-stream"
-	}
-	c.Header("Content-Type", fileType)
-	c.File(physicalPath)
+	h.serveStoredFile(c, ref, fileName, fileType)
+	h.recordDownload(c, userID, storedID)
 }
 
 func (h *FileHandler) DownloadSharedFolder(c *gin.Context) {
@@ -1660,14 +2177,18 @@ func (h *FileHandler) DownloadSharedFolder(c *gin.Context) {
 	folderID := c.Param("folderId")
 
 	// Check if user has access to this shared folder
-	var folderName, folderPath string
+	var folderName, parentPath string
+	var parentID sql.NullString
 	var ownerID int
 	err = h.db.QueryRow(`
-		SELECT fl.FOLDER_NAME, fl.PATH, fl.OWNER_ID 
+		SELECT fl.FOLDER_NAME, fl.PARENT_ID, fl.OWNER_ID 
 		FROM FOLDER_LIST fl 
 		JOIN SHARED_FOLDER sf ON fl.FOLDER_ID = sf.FOLDER_ID 
 		WHERE sf.USER_ID = ? AND fl.FOLDER_ID = ? AND fl.STATUS = 'active'
-	`, userID, folderID).Scan(&folderName, &folderPath, &ownerID)
+	`, userID, folderID).Scan(&folderName, &parentID, &ownerID)
+	if err == nil {
+		parentPath, err = folderPath(h.db, parentID)
+	}
 
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Shared folder not found or access denied"})
@@ -1689,8 +2210,8 @@ func (h *FileHandler) DownloadSharedFolder(c *gin.Context) {
 	zipWriter := zip.NewWriter(c.Writer)
 	defer zipWriter.Close()
 
-	relativePath := filepath.ToSlash(filepath.Join(folderPath, folderName))
-	if err := h.addPathToZipDB(zipWriter, ownerID, ownerUsername, relativePath, ""); err != nil {
+	relativePath := path.Join(parentPath, folderName)
+	if err := h.addPathToZipDB(c.Request.Context(), zipWriter, ownerID, ownerUsername, relativePath); err != nil {
 		log.Printf("[ERROR] DownloadSharedFolder: Error during zipping for %s: %v", relativePath, err)
 	}
 }
@@ -1712,79 +2233,53 @@ func (h *FileHandler) ListSharedFolderContents(c *gin.Context) {
 		relativePath = "/"
 	}
 
+	// The path is relative to the shared folder and may not climb out of it
+	for _, name := range strings.Split(relativePath, "/") {
+		if name == ".." {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+			return
+		}
+	}
+
 	// Check if user has access to this shared folder and get permission
-	var folderName, folderPath, permission string
+	var folderName, permission string
 	var ownerID int
 	err = h.db.QueryRow(`
-		SELECT fl.FOLDER_NAME, fl.PATH, fl.OWNER_ID, sf.PERMISSION
+		SELECT fl.FOLDER_NAME, fl.OWNER_ID, sf.PERMISSION
 		FROM FOLDER_LIST fl 
 		JOIN SHARED_FOLDER sf ON fl.FOLDER_ID = sf.FOLDER_ID 
 		WHERE sf.USER_ID = ? AND fl.FOLDER_ID = ? AND fl.STATUS = 'active'
-	`, userID, folderID).Scan(&folderName, &folderPath, &ownerID, &permission)
+	`, userID, folderID).Scan(&folderName, &ownerID, &permission)
 
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Shared folder not found or access denied"})
 		return
 	}
 
-	baseFolderPath := filepath.ToSlash(filepath.Join(folderPath, folderName))
-	requestedPath := filepath.ToSlash(filepath.Join(baseFolderPath, strings.TrimPrefix(relativePath, "/")))
-
-	var items []ItemInfo
-
-	// Get folders within the shared folder
-	folderRows, err := h.db.Query("SELECT FOLDER_ID, FOLDER_NAME, modified_at, PATH FROM FOLDER_LIST WHERE OWNER_ID = ? AND PATH = ? AND STATUS = 'active'", ownerID, requestedPath)
+	listing, err := parseListing(c)
 	if err != nil {
-		log.Printf("Error fetching shared folder contents: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch folder contents"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	defer folderRows.Close()
-
-	for folderRows.Next() {
-		var item ItemInfo
-		var folderID, folderName, path string
-		var modified time.Time
-		if err := folderRows.Scan(&folderID, &folderName, &modified, &path); err != nil {
-			continue
-		}
-		item.ID = folderID
-		item.Name = folderName
-		item.Modified = modified
-		item.IsDir = true
-		item.Path = filepath.ToSlash(filepath.Join(path, folderName))
-		items = append(items, item)
-	}
-
-	// Get files within the shared folder
-	fileRows, err := h.db.Query("SELECT FILE_ID, FILE_NAME, FILE_SIZE, modified_at, FILE_PATH FROM FILE_LIST WHERE OWNER_ID = ? AND FILE_PATH = ? AND STATUS = 'active'", ownerID, requestedPath)
+	// The requested folder is found by its names below the shared folder, never by a path of the owner's drive
+	requestedID, err := folderIDBelow(h.db, ownerID, sql.NullString{String: folderID, Valid: true}, relativePath)
 	if err != nil {
-		log.Printf("Error fetching shared files: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
 		return
 	}
-	defer fileRows.Close()
-
-	for fileRows.Next() {
-		var item ItemInfo
-		var fileID int64
-		var size int64
-		var name, path string
-		var modified time.Time
-		if err := fileRows.Scan(&fileID, &name, &size, &modified, &path); err != nil {
-			continue
-		}
-		item.ID = fmt.Sprintf("%d", fileID)
-		item.Name = name
-		item.Size = size
-		item.Modified = modified
-		item.IsDir = false
-		item.Path = filepath.ToSlash(filepath.Join(path, name))
-		items = append(items, item)
+	items, nextCursor, total, err := h.page(listing,
+		"t.OWNER_ID = ? AND t.PARENT_ID <=> ? AND t.STATUS = 'active'",
+		"t.OWNER_ID = ? AND t.FOLDER_ID <=> ? AND t.STATUS = 'active'", ownerID, requestedID)
+	if err != nil {
+		respondListingError(c, err)
+		return
 	}
+	h.attachTags(itemRefs(items))
 
 	response := gin.H{
 		"items":          items,
+		"nextCursor":     nextCursor,
+		"total":          total,
 		"permission":     permission,
 		"folderName":     folderName,
 		"sharedFolderId": folderID,
@@ -1808,125 +2303,19 @@ func (h *FileHandler) FinalizeSharedFolderUpload(c *gin.Context) {
 		UploadID       string `json:"uploadId"`
 		SharedFolderID string `json:"sharedFolderId"`
 		RelativePath   string `json:"relativePath"`
+		Conflict       string `json:"conflict"`
 	}
 	if err := c.ShouldBindJSON(&payload); err != nil || payload.UploadID == "" || payload.SharedFolderID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 		return
 	}
 
-	// Check if user has write permission to this shared folder
-	var folderName, folderPath string
-	var ownerID int
-	var permission string
-	err = h.db.QueryRow(`
-		SELECT fl.FOLDER_NAME, fl.PATH, fl.OWNER_ID, sf.PERMISSION
-		FROM FOLDER_LIST fl 
-		JOIN SHARED_FOLDER sf ON fl.FOLDER_ID = sf.FOLDER_ID 
-		WHERE sf.USER_ID = ? AND fl.FOLDER_ID = ? AND fl.STATUS = 'active'
-	`, userID, payload.SharedFolderID).Scan(&folderName, &folderPath, &ownerID, &permission)
-
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Shared folder not found or access denied"})
-		return
-	}
-
-	if permission != "write" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Write permission required"})
-		return
-	}
-
-	// Get owner's username for file operations
-	var ownerUsername string
-	err = h.db.QueryRow("SELECT USERNAME FROM USERS WHERE USER_ID = ?", ownerID).Scan(&ownerUsername)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not determine folder owner"})
-		return
-	}
-
-	// Process upload similar to regular finalize
-	baseUploadPath, _ := utils.GetBaseUploadPath()
-	sourceFile := filepath.Join(baseUploadPath, payload.UploadID)
-	sourceInfo := sourceFile + ".info"
-	infoData, err := os.ReadFile(sourceInfo)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read upload metadata"})
-		return
-	}
-
-	var tusInfo TusInfo
-	if err := json.Unmarshal(infoData, &tusInfo); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not parse upload metadata"})
-		return
-	}
-
-	fileInfo, err := os.Stat(sourceFile)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not get file info"})
-		return
-	}
-
-	// Check quota limit for folder owner before processing upload
-	if err := h.checkQuotaLimit(ownerID, fileInfo.Size()); err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Folder owner's %s", err.Error())})
-		return
-	}
-
-	// Construct destination path within shared folder
-	baseFolderPath := filepath.ToSlash(filepath.Join(folderPath, folderName))
-	destinationPath := filepath.ToSlash(filepath.Join(baseFolderPath, payload.RelativePath))
-
-	// Use transaction for database operations
-	tx, err := h.db.Begin()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database transaction could not be started"})
-		return
-	}
-	defer tx.Rollback()
-
-	// Insert file record under owner's account
-	res, err := tx.Exec("INSERT INTO FILE_LIST (OWNER_ID, FILE_NAME, FILE_TYPE, FILE_SIZE, FILE_PATH, STATUS) VALUES (?, ?, ?, ?, ?, 'active')",
-		ownerID, tusInfo.MetaData.Filename, tusInfo.MetaData.Filetype, fileInfo.Size(), destinationPath)
-	if err != nil {
-		log.Printf("DB Error on shared folder finalize: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
-		return
-	}
-
-	newFileID, _ := res.LastInsertId()
-
-	// Update owner's quota usage
-	if err := h.updateUserQuota(tx, ownerID, fileInfo.Size()); err != nil {
-		log.Printf("Failed to update owner quota: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota usage"})
-		return
-	}
-
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit file upload"})
-		return
-	}
-
-	// Move physical file after successful database commit
-	destinationFolder, err := utils.GetSafePathForUser(ownerUsername, destinationPath)
+	target := uploadTarget{SharedFolderID: payload.SharedFolderID, RelativePath: payload.RelativePath, Conflict: payload.Conflict}
+	fileID, err := h.finalizeUpload(c.Request.Context(), userID, payload.UploadID, target)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid destination path"})
-		return
-	}
-
-	if err := os.MkdirAll(destinationFolder, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create destination directory"})
-		return
-	}
-
-	newFileLocation := filepath.Join(destinationFolder, fmt.Sprintf("%d", newFileID))
-	if err := os.Rename(sourceFile, newFileLocation); err != nil {
-		// Rollback database entry and quota if physical move fails
-		h.db.Exec("DELETE FROM FILE_LIST WHERE FILE_ID = ?", newFileID)
-		h.db.Exec("UPDATE USERS SET USED_QUOTA = USED_QUOTA - ? WHERE USER_ID = ?", fileInfo.Size(), ownerID)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move file"})
+		respondFinalizeError(c, err)
 		return
 	}
 
-	os.Remove(sourceInfo)
-	c.JSON(http.StatusOK, gin.H{"message": "File uploaded to shared folder successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "File uploaded to shared folder successfully", "fileId": fileID})
 }
@@ -0,0 +1,490 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"my-cloud-project/backend/blobs"
+	"my-cloud-project/backend/fulltext"
+	"my-cloud-project/backend/storage"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// uploadTarget says where a finished upload becomes a file. A shared folder ID makes
+// RelativePath relative to that folder; otherwise DestinationPath is in the uploader's tree.
+type uploadTarget struct {
+	DestinationPath string
+	SharedFolderID  string
+	RelativePath    string
+	// CreateFolders adds any folders missing on the way to the destination
+	CreateFolders bool
+	// Conflict settles a name already taken in the destination, keepBoth when empty
+	Conflict string
+}
+
+// targetFromMetaData reads the destination a client attached to the upload when creating it
+func targetFromMetaData(tusInfo TusInfo) uploadTarget {
+	return uploadTarget{
+		DestinationPath: tusInfo.MetaData.DestinationPath,
+		SharedFolderID:  tusInfo.MetaData.SharedFolderID,
+		RelativePath:    tusInfo.MetaData.RelativePath,
+		Conflict:        tusInfo.MetaData.Conflict,
+	}
+}
+
+// finalizeError is a finalize failure along with the HTTP status it should be reported as
+type finalizeError struct {
+	status  int
+	message string
+}
+
+func (e *finalizeError) Error() string {
+	return e.message
+}
+
+func finalizeFailed(status int, message string) error {
+	return &finalizeError{status: status, message: message}
+}
+
+// finalizeStatus picks the HTTP status and message a failed finalize is reported with
+func finalizeStatus(err error) (int, string) {
+	var fe *finalizeError
+	if errors.As(err, &fe) {
+		return fe.status, fe.message
+	}
+	// Upload limit checks report their status the way tus expects it
+	var te tusd.Error
+	if errors.As(err, &te) {
+		return te.HTTPResponse.StatusCode, te.Message
+	}
+	return http.StatusInternalServerError, err.Error()
+}
+
+// respondFinalizeError reports a failed finalize to the client
+func respondFinalizeError(c *gin.Context, err error) {
+	status, message := finalizeStatus(err)
+	c.JSON(status, gin.H{"error": message})
+}
+
+// uploadLocks serializes finalizing the same upload, which the completion
+// notification and the client may both attempt at once
+type uploadLocks struct {
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+type uploadLock struct {
+	sync.Mutex
+	users int
+}
+
+func (l *uploadLocks) lock(uploadID string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*uploadLock{}
+	}
+	lock, ok := l.locks[uploadID]
+	if !ok {
+		lock = &uploadLock{}
+		l.locks[uploadID] = lock
+	}
+	lock.users++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(l.locks, uploadID)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// resolveUploadTarget works out whose file an upload becomes and in which folder
+func (h *FileHandler) resolveUploadTarget(uploaderID int, target uploadTarget) (ownerID int, ownerUsername, destinationPath string, err error) {
+	if target.SharedFolderID == "" {
+		err = h.db.QueryRow("SELECT USERNAME FROM USERS WHERE USER_ID = ?", uploaderID).Scan(&ownerUsername)
+		if err != nil {
+			return 0, "", "", finalizeFailed(http.StatusUnauthorized, "User not found")
+		}
+		destinationPath = target.DestinationPath
+		if destinationPath == "" {
+			destinationPath = "/"
+		}
+		return uploaderID, ownerUsername, destinationPath, nil
+	}
+
+	// Check if user has write permission to this shared folder
+	var folderName, parentPath, permission string
+	var parentID sql.NullString
+	err = h.db.QueryRow(`
+		SELECT fl.FOLDER_NAME, fl.PARENT_ID, fl.OWNER_ID, sf.PERMISSION
+		FROM FOLDER_LIST fl 
+		JOIN SHARED_FOLDER sf ON fl.FOLDER_ID = sf.FOLDER_ID 
+		WHERE sf.USER_ID = ? AND fl.FOLDER_ID = ? AND fl.STATUS = 'active'
+	`, uploaderID, target.SharedFolderID).Scan(&folderName, &parentID, &ownerID, &permission)
+	if err == nil {
+		parentPath, err = folderPath(h.db, parentID)
+	}
+	if err != nil {
+		return 0, "", "", finalizeFailed(http.StatusNotFound, "Shared folder not found or access denied")
+	}
+	if permission != "write" {
+		return 0, "", "", finalizeFailed(http.StatusForbidden, "Write permission required")
+	}
+
+	// Get owner's username for file operations
+	err = h.db.QueryRow("SELECT USERNAME FROM USERS WHERE USER_ID = ?", ownerID).Scan(&ownerUsername)
+	if err != nil {
+		return 0, "", "", finalizeFailed(http.StatusInternalServerError, "Could not determine folder owner")
+	}
+
+	// Construct destination path within shared folder
+	baseFolderPath := path.Join(parentPath, folderName)
+	destinationPath = filepath.ToSlash(filepath.Join(baseFolderPath, filepath.Clean("/"+target.RelativePath)))
+	return ownerID, ownerUsername, destinationPath, nil
+}
+
+// finalizeUpload turns a completed tus upload into a file and returns its FILE_ID.
+// It is idempotent: an upload that was already finalized returns the same file again.
+// Fields left empty in target are taken from the upload's metadata.
+func (h *FileHandler) finalizeUpload(ctx context.Context, uploaderID int, uploadID string, target uploadTarget) (int64, error) {
+	unlock := h.uploadLocks.lock(uploadID)
+	defer unlock()
+
+	// The file outlives the request that asked for it, so storage work is not cancelled with it
+	ctx = context.WithoutCancel(ctx)
+
+	tusInfo, sourceFile, finalizedFileID, err := h.completedUpload(uploaderID, uploadID)
+	if err != nil || finalizedFileID != 0 {
+		return finalizedFileID, err
+	}
+
+	if target.DestinationPath == "" && target.SharedFolderID == "" {
+		conflict := target.Conflict
+		target = targetFromMetaData(tusInfo)
+		if conflict != "" {
+			target.Conflict = conflict
+		}
+	}
+
+	file := incomingFile{Path: sourceFile, Name: tusInfo.MetaData.Filename, Type: tusInfo.MetaData.Filetype}
+	newFileID, err := h.addFile(ctx, uploaderID, target, file, func(tx *sql.Tx, inserted *insertedFile) error {
+		return recordUpload(tx, uploadID, uploaderID, inserted)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	cleanupFinalizedUpload(tusInfo, sourceFile)
+	return newFileID, nil
+}
+
+// completedUpload checks that uploadID is a finished tus upload created by uploaderID and
+// returns its metadata and data file. An upload that was finalized before instead returns
+// the FILE_ID it became.
+func (h *FileHandler) completedUpload(uploaderID int, uploadID string) (TusInfo, string, int64, error) {
+	var finalizedBy int
+	var finalizedFile sql.NullInt64
+	err := h.db.QueryRow("SELECT USER_ID, FILE_ID FROM UPLOAD_LIST WHERE UPLOAD_ID = ?", uploadID).Scan(&finalizedBy, &finalizedFile)
+	if err == nil {
+		if finalizedBy != uploaderID {
+			return TusInfo{}, "", 0, finalizeFailed(http.StatusForbidden, "Upload belongs to another user")
+		}
+		if !finalizedFile.Valid {
+			return TusInfo{}, "", 0, finalizeFailed(http.StatusGone, "The file this upload became has been deleted")
+		}
+		return TusInfo{}, "", finalizedFile.Int64, nil
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("Failed to look up upload %s: %v", uploadID, err)
+		return TusInfo{}, "", 0, finalizeFailed(http.StatusInternalServerError, "Could not read upload status")
+	}
+
+	tusInfo, sourceFile, err := readTusUpload(uploadID)
+	if errors.Is(err, errInvalidUploadID) {
+		return TusInfo{}, "", 0, finalizeFailed(http.StatusBadRequest, "Invalid upload ID")
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return TusInfo{}, "", 0, finalizeFailed(http.StatusNotFound, "Upload not found")
+	}
+	if err != nil {
+		return TusInfo{}, "", 0, finalizeFailed(http.StatusInternalServerError, "Could not read upload metadata")
+	}
+
+	// Only the user who created the upload may turn it into a file
+	if tusInfo.MetaData.OwnerID != strconv.Itoa(uploaderID) {
+		return TusInfo{}, "", 0, finalizeFailed(http.StatusForbidden, "Upload belongs to another user")
+	}
+	if tusInfo.IsPartial {
+		return TusInfo{}, "", 0, finalizeFailed(http.StatusConflict, "Partial uploads must be concatenated into a final upload first")
+	}
+	if tusInfo.Offset < tusInfo.Size {
+		return TusInfo{}, "", 0, finalizeFailed(http.StatusConflict, "Upload is not complete yet")
+	}
+	return tusInfo, sourceFile, 0, nil
+}
+
+// cleanupFinalizedUpload removes what tus left behind for an upload whose data is now stored
+func cleanupFinalizedUpload(tusInfo TusInfo, sourceFile string) {
+	os.Remove(sourceFile + ".info")
+	// The final upload holds its own copy of the data, so the parts it was built from can go
+	for _, partialID := range tusInfo.PartialUploads {
+		removeTusUpload(partialID)
+	}
+}
+
+// incomingFile is file data waiting on the local disk to be added to a user's tree
+type incomingFile struct {
+	Path string
+	Name string
+	Type string
+	// Filled in by prepare
+	Size int64
+	Hash string
+}
+
+// prepare measures and hashes the file's data
+func (f *incomingFile) prepare() error {
+	fileInfo, err := os.Stat(f.Path)
+	if err != nil {
+		return finalizeFailed(http.StatusInternalServerError, "Could not get file info")
+	}
+	contentHash, _, err := blobs.HashFile(f.Path)
+	if err != nil {
+		return finalizeFailed(http.StatusInternalServerError, "Could not read uploaded file")
+	}
+	f.Size = fileInfo.Size()
+	f.Hash = contentHash
+	return nil
+}
+
+// quotaFailed reports a quota check that failed for a file going to ownerID
+func quotaFailed(uploaderID, ownerID int, err error) error {
+	if ownerID != uploaderID {
+		return finalizeFailed(http.StatusForbidden, fmt.Sprintf("Folder owner's %s", err.Error()))
+	}
+	return finalizeFailed(http.StatusForbidden, err.Error())
+}
+
+// addFile adds a file on the local disk to the tree at target. Quota is checked, then the blob,
+// FILE_LIST row, quota usage and auto-share are recorded in one transaction together with
+// whatever record adds, and finally the data is moved from file.Path into the blob store.
+// The upload then shows in the uploader's recent activity.
+func (h *FileHandler) addFile(ctx context.Context, uploaderID int, target uploadTarget, file incomingFile, record func(tx *sql.Tx, inserted *insertedFile) error) (int64, error) {
+	ownerID, ownerUsername, destinationPath, err := h.resolveUploadTarget(uploaderID, target)
+	if err != nil {
+		return 0, err
+	}
+	conflict, err := parseConflict(target.Conflict, conflictKeepBoth)
+	if err != nil {
+		return 0, finalizeFailed(http.StatusBadRequest, err.Error())
+	}
+
+	if err := file.prepare(); err != nil {
+		return 0, err
+	}
+
+	// Check quota limit before processing upload
+	if err := h.checkQuotaLimit(ownerID, file.Size); err != nil {
+		return 0, quotaFailed(uploaderID, ownerID, err)
+	}
+
+	if _, err := storage.UserKey(ownerUsername, destinationPath); err != nil {
+		return 0, finalizeFailed(http.StatusBadRequest, "Invalid destination path")
+	}
+
+	// Use transaction for database operations
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, finalizeFailed(http.StatusInternalServerError, "Database transaction could not be started")
+	}
+	defer tx.Rollback()
+
+	if target.CreateFolders {
+		if _, err := ensureFolderPath(tx, ownerID, destinationPath); err != nil {
+			return 0, folderPathFailed(destinationPath, err)
+		}
+	}
+
+	inserted, err := h.insertFile(tx, uploaderID, ownerID, destinationPath, file, conflict)
+	if err != nil {
+		return 0, err
+	}
+
+	// Update owner's quota usage
+	if err := h.updateUserQuota(tx, ownerID, file.Size); err != nil {
+		log.Printf("Failed to update user quota: %v", err)
+		return 0, finalizeFailed(http.StatusInternalServerError, "Failed to update quota usage")
+	}
+
+	if record != nil {
+		if err := record(tx, inserted); err != nil {
+			log.Printf("DB Error on finalize: %v", err)
+			return 0, finalizeFailed(http.StatusInternalServerError, "Failed to save file metadata")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, finalizeFailed(http.StatusInternalServerError, "Failed to commit file upload")
+	}
+
+	if err := h.storeFile(ctx, ownerID, inserted, file); err != nil {
+		return 0, err
+	}
+	h.recordStored(uploaderID, inserted)
+	return inserted.ID, nil
+}
+
+// insertedFile is a file row written for an incoming file
+type insertedFile struct {
+	ID      int64
+	Name    string
+	Blob    *blobs.Blob
+	Version int
+	// Set when the file became a new version of one that was already there
+	NewVersion bool
+}
+
+// insertFile records a prepared file's blob and FILE_LIST row and auto-shares it. A name
+// already taken in the folder is settled with conflict, by default the file becomes a new
+// version of the one already there. Quota usage is left to the caller, so several files can
+// be charged at once.
+func (h *FileHandler) insertFile(tx *sql.Tx, uploaderID, ownerID int, destinationPath string, file incomingFile, conflict string) (*insertedFile, error) {
+	folderID, err := parentFolder(tx, ownerID, destinationPath)
+	if err != nil {
+		return nil, folderPathFailed(destinationPath, err)
+	}
+	existing, err := activeItemIn(tx, ownerID, folderID, destinationPath, file.Name)
+	if err != nil {
+		log.Printf("DB Error on finalize: %v", err)
+		return nil, finalizeFailed(http.StatusInternalServerError, "Failed to save file metadata")
+	}
+	if existing != nil && conflict == conflictFail {
+		return nil, nameTaken(file.Name)
+	}
+
+	// The blob belongs to the file owner, which is the folder owner for shared folder uploads
+	blob, err := h.blobs.Acquire(tx, ownerID, file.Hash, file.Size, h.uploadCodec(file.Name, file.Type))
+	if err != nil {
+		log.Printf("DB Error on finalize: %v", err)
+		return nil, finalizeFailed(http.StatusInternalServerError, "Failed to save file metadata")
+	}
+
+	if existing != nil {
+		switch {
+		case conflict == conflictKeepBoth && existing.versionable():
+			version, err := h.addVersion(tx, existing.FileID, blob.ID, file.Size, file.Type)
+			if err != nil {
+				log.Printf("DB Error on finalize: %v", err)
+				return nil, finalizeFailed(http.StatusInternalServerError, "Failed to save file version")
+			}
+			return &insertedFile{ID: existing.FileID, Name: existing.Name, Blob: blob, Version: version, NewVersion: true}, nil
+		case conflict == conflictReplace:
+			err = trashItem(tx, existing)
+		default:
+			file.Name, err = freeName(tx, ownerID, folderID, file.Name)
+		}
+		if err != nil {
+			if _, ok := err.(*finalizeError); ok {
+				return nil, err
+			}
+			log.Printf("DB Error on finalize: %v", err)
+			return nil, finalizeFailed(http.StatusInternalServerError, "Failed to save file metadata")
+		}
+	}
+
+	res, err := tx.Exec("INSERT INTO FILE_LIST (OWNER_ID, FOLDER_ID, FILE_NAME, FILE_TYPE, FILE_SIZE, BLOB_ID, STATUS) VALUES (?, ?, ?, ?, ?, ?, 'active')",
+		ownerID, folderID, file.Name, file.Type, file.Size, blob.ID)
+	if isDuplicateName(err) {
+		return nil, nameTaken(file.Name)
+	}
+	if err != nil {
+		log.Printf("DB Error on finalize: %v", err)
+		return nil, finalizeFailed(http.StatusInternalServerError, "Failed to save file metadata")
+	}
+
+	newFileID, _ := res.LastInsertId()
+
+	// Auto-share the new file if it's uploaded to shared folders
+	if ownerID == uploaderID {
+		if err := h.autoShareNewItem(tx, ownerID, fmt.Sprintf("%d", newFileID), "file", folderID); err != nil {
+			log.Printf("Warning: Failed to auto-share new file: %v", err)
+			// Don't fail the entire operation, just log the warning
+		}
+	}
+	return &insertedFile{ID: newFileID, Name: file.Name, Blob: blob, Version: 1}, nil
+}
+
+// storeFile moves a committed file's data into the blob store, undoing its rows if that fails.
+// Once a new version is stored, versions beyond the owner's retention are pruned.
+// The file is queued for the full-text index once its contents are stored.
+func (h *FileHandler) storeFile(ctx context.Context, ownerID int, inserted *insertedFile, file incomingFile) error {
+	if err := h.blobs.Put(ctx, inserted.Blob, file.Path); err != nil {
+		// Rollback database entry and quota if physical move fails
+		log.Printf("Failed to store %s: %v", file.Path, err)
+		h.undoInsert(ownerID, inserted, file.Size)
+		return finalizeFailed(http.StatusInternalServerError, "Failed to move file")
+	}
+	// Only now are the contents there for the indexer to read
+	if err := fulltext.QueueFiles(h.db, true, inserted.ID); err != nil {
+		log.Printf("Warning: Failed to queue file %d for indexing: %v", inserted.ID, err)
+	}
+	if inserted.NewVersion {
+		h.pruneVersions(ctx, ownerID, inserted.ID)
+	}
+	return nil
+}
+
+// undoInsert removes a committed file or version whose data never made it into the blob store
+func (h *FileHandler) undoInsert(ownerID int, inserted *insertedFile, size int64) {
+	if inserted.NewVersion {
+		h.undoVersion(ownerID, inserted.ID, inserted.Version, inserted.Blob.ID, size)
+	} else {
+		h.undoFinalize(ownerID, inserted.ID, inserted.Blob.ID, size)
+	}
+}
+
+// recordUpload remembers which file an upload became, so finalizing it again returns that file instead of a copy
+func recordUpload(tx *sql.Tx, uploadID string, uploaderID int, inserted *insertedFile) error {
+	_, err := tx.Exec("INSERT INTO UPLOAD_LIST (UPLOAD_ID, USER_ID, FILE_ID, VERSION_NO) VALUES (?, ?, ?, ?)", uploadID, uploaderID, inserted.ID, inserted.Version)
+	return err
+}
+
+// ConsumeCompletedUploads finalizes uploads as soon as tus reports them complete, so a
+// client that goes away after sending the last byte does not leave them orphaned.
+// Uploads without a destination in their metadata are left for the client to finalize,
+// and parts of a concatenated upload wait for the final upload that joins them.
+func (h *FileHandler) ConsumeCompletedUploads(events <-chan tusd.HookEvent) {
+	for event := range events {
+		meta := event.Upload.MetaData
+		if event.Upload.IsPartial || (meta["destinationPath"] == "" && meta["sharedFolderId"] == "") {
+			continue
+		}
+		uploaderID, err := strconv.Atoi(meta["ownerId"])
+		if err != nil {
+			log.Printf("Completed upload %s has no owner, leaving it unfinalized", event.Upload.ID)
+			continue
+		}
+
+		// tus waits for this channel before answering the last PATCH, so hashing happens elsewhere
+		go func(uploadID string) {
+			if _, err := h.finalizeUpload(context.Background(), uploaderID, uploadID, uploadTarget{}); err != nil {
+				log.Printf("Failed to finalize completed upload %s: %v", uploadID, err)
+			}
+		}(event.Upload.ID)
+	}
+}
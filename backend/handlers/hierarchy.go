@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"my-cloud-project/backend/database"
+)
+
+// subtreeCTE is the folder FOLDER_ID = ? and every folder below it, found through PARENT_ID.
+// FULL_PATH is each folder's path, starting from the path passed for the top folder, and
+// ACTIVE is set when the folder and all folders above it up to the top one are active.
+// Arguments: the top folder's path, then its ID. The depth limit here and in ancestorsCTE only
+// keeps a PARENT_ID cycle, which should never exist, from running away.
+const subtreeCTE = `
+	WITH RECURSIVE subtree (FOLDER_ID, FULL_PATH, ACTIVE, DEPTH) AS (
+		SELECT FOLDER_ID, CAST(? AS CHAR(4096)), STATUS = 'active', 0
+		FROM FOLDER_LIST WHERE FOLDER_ID = ?
+		UNION ALL
+		SELECT c.FOLDER_ID, CONCAT(s.FULL_PATH, '/', c.FOLDER_NAME), s.ACTIVE AND c.STATUS = 'active', s.DEPTH + 1
+		FROM FOLDER_LIST c JOIN subtree s ON c.PARENT_ID = s.FOLDER_ID
+		WHERE s.DEPTH < 256
+	)`
+
+// ancestorsCTE is the folder FOLDER_ID = ? and every folder above it, found through PARENT_ID
+const ancestorsCTE = `
+	WITH RECURSIVE ancestors (FOLDER_ID, PARENT_ID, DEPTH) AS (
+		SELECT FOLDER_ID, PARENT_ID, 0 FROM FOLDER_LIST WHERE FOLDER_ID = ?
+		UNION ALL
+		SELECT p.FOLDER_ID, p.PARENT_ID, a.DEPTH + 1
+		FROM FOLDER_LIST p JOIN ancestors a ON p.FOLDER_ID = a.PARENT_ID
+		WHERE a.DEPTH < 256
+	)`
+
+// maxFolderDepth is how deeply folders may nest. It stays below the depth limit of the walks
+// of the folder tree, so that they and the paths derived through them always reach the root.
+const maxFolderDepth = 250
+
+// tooDeep is the error for a folder that would be nested deeper than maxFolderDepth
+func tooDeep() error {
+	return finalizeFailed(http.StatusBadRequest, fmt.Sprintf("Folders cannot be nested more than %d levels deep", maxFolderDepth))
+}
+
+// pathNames splits a folder path into the names of the folders along it, none for the root
+func pathNames(folderPath string) []string {
+	clean := path.Clean("/" + folderPath)
+	if clean == "/" {
+		return nil
+	}
+	return strings.Split(clean[1:], "/")
+}
+
+// folderIDAt returns the ID of the active folder of ownerID at folderPath, following the names
+// along the path down from the root. The root has no row and no ID; a path without an active
+// folder is sql.ErrNoRows.
+func folderIDAt(q queryer, ownerID int, folderPath string) (sql.NullString, error) {
+	return folderIDBelow(q, ownerID, sql.NullString{}, folderPath)
+}
+
+// folderIDBelow is folderIDAt for a path relative to folder topID rather than the root. The
+// path cannot lead out of topID, since ".." above it is cleaned away like above the root.
+func folderIDBelow(q queryer, ownerID int, topID sql.NullString, folderPath string) (sql.NullString, error) {
+	folderID := topID
+	for _, name := range pathNames(folderPath) {
+		err := q.QueryRow("SELECT FOLDER_ID FROM FOLDER_LIST WHERE OWNER_ID = ? AND PARENT_ID <=> ? AND FOLDER_NAME = ? AND STATUS = 'active' LIMIT 1",
+			ownerID, folderID, name).Scan(&folderID)
+		if err != nil {
+			return sql.NullString{}, err
+		}
+	}
+	return folderID, nil
+}
+
+// folderPath returns the path of folder folderID, "/" for the root
+func folderPath(q queryer, folderID sql.NullString) (string, error) {
+	if !folderID.Valid {
+		return "/", nil
+	}
+	paths, err := database.FolderPaths(q, []string{folderID.String})
+	if err != nil {
+		return "", err
+	}
+	p, ok := paths[folderID.String]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return p, nil
+}
+
+// attachPaths fills in the paths of listed items from the folders they are in
+func attachPaths(q queryer, items []*ItemInfo) error {
+	var parentIDs []string
+	seen := map[string]bool{}
+	for _, item := range items {
+		if item.parentID.Valid && !seen[item.parentID.String] {
+			seen[item.parentID.String] = true
+			parentIDs = append(parentIDs, item.parentID.String)
+		}
+	}
+	paths, err := database.FolderPaths(q, parentIDs)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		parentPath, ok := paths[item.parentID.String]
+		if !item.parentID.Valid || !ok {
+			parentPath = "/"
+		}
+		item.Path = path.Join(parentPath, item.Name)
+	}
+	return nil
+}
+
+// parentFolder returns the ID of the folder items of ownerID are added to at folderPath,
+// creating the folder rows along the way if the path has none
+func parentFolder(tx *sql.Tx, ownerID int, folderPath string) (sql.NullString, error) {
+	folderID, err := folderIDAt(tx, ownerID, folderPath)
+	if err == sql.ErrNoRows {
+		return ensureFolderPath(tx, ownerID, folderPath)
+	}
+	return folderID, err
+}
+
+// isWithin reports whether folder folderID is ancestorID or lies somewhere below it
+func isWithin(q queryer, folderID sql.NullString, ancestorID string) (bool, error) {
+	if !folderID.Valid {
+		return false, nil
+	}
+	var found bool
+	err := q.QueryRow(ancestorsCTE+" SELECT COUNT(*) > 0 FROM ancestors WHERE FOLDER_ID = ?", folderID.String, ancestorID).Scan(&found)
+	return found, err
+}
+
+// parentIDOf returns the ID of the folder an item is in, invalid at the root
+func parentIDOf(q queryer, item *namedItem) (sql.NullString, error) {
+	var parentID sql.NullString
+	if item.isFolder() {
+		err := q.QueryRow("SELECT PARENT_ID FROM FOLDER_LIST WHERE FOLDER_ID = ?", item.FolderID).Scan(&parentID)
+		return parentID, err
+	}
+	err := q.QueryRow("SELECT FOLDER_ID FROM FILE_LIST WHERE FILE_ID = ?", item.FileID).Scan(&parentID)
+	return parentID, err
+}
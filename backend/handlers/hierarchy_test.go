@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPathNames(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/", nil},
+		{"", nil},
+		{"/docs/2024", []string{"docs", "2024"}},
+		{"docs//2024/", []string{"docs", "2024"}},
+		{"/docs/./2024", []string{"docs", "2024"}},
+		// Walks below a folder follow these names, so ".." never leads above where they start
+		{"/../../etc", []string{"etc"}},
+		{"docs/../../secret", []string{"secret"}},
+		{`..\x`, []string{`..\x`}},
+	}
+	for _, tt := range tests {
+		if got := pathNames(tt.path); strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("pathNames(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package handlers
+
+import "my-cloud-project/backend/fulltext"
+
+// queueIndexing queues an item for the full-text index: a file by itself, a folder with
+// everything below it
+func queueIndexing(db fulltext.Execer, item *namedItem) error {
+	if item.isFolder() {
+		return fulltext.QueueFolders(db, item.FolderID)
+	}
+	return fulltext.QueueFiles(db, false, item.FileID)
+}
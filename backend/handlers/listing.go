@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Page sizes for folder and trash listings
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// errBadCursor is returned for a cursor that wasn't made by the same listing
+var errBadCursor = errors.New("invalid cursor")
+
+// listSorts maps the sort option to what a listing is ordered by and how a cursor's value
+// compares to it. Names sort naturally, so "file2" comes before "file10".
+var listSorts = map[string]struct{ column, value string }{
+	"name":     {"NATURAL_SORT_KEY(r.NAME)", "NATURAL_SORT_KEY(?)"},
+	"size":     {"r.SIZE", "?"},
+	"modified": {"r.MODIFIED", "?"},
+	"type":     {"r.MIME", "?"},
+}
+
+// listCursor is where a page of a listing ends: whether the last item is a file, as folders come
+// first, the value it was sorted by and its ID. It is handed out base64 encoded and only fits
+// the sort it was made for.
+type listCursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	IsFile     int    `json:"f"`
+	Value      string `json:"v"`
+	ID         string `json:"i"`
+}
+
+// itemListing is a parsed request for a page of a listing
+type itemListing struct {
+	sort       string
+	descending bool
+	kind       string // "file", "folder" or "" for both
+	// Files of any of these types; folders have none
+	mimeTypes []string
+	limit     int
+	after     *listCursor
+}
+
+// parseListing reads the paging, sorting and filters of a listing request
+func parseListing(c *gin.Context) (*itemListing, error) {
+	l := &itemListing{
+		sort:       c.DefaultQuery("sort", "name"),
+		descending: c.DefaultQuery("order", "asc") == "desc",
+		kind:       c.Query("kind"),
+		mimeTypes:  c.QueryArray("type"),
+		limit:      defaultListLimit,
+	}
+	if _, ok := listSorts[l.sort]; !ok {
+		return nil, fmt.Errorf("sort must be name, size, modified or type")
+	}
+	switch l.kind {
+	case "", "file", "folder":
+	default:
+		return nil, fmt.Errorf("kind must be file or folder")
+	}
+	if v := c.Query("limit"); v != "" {
+		var err error
+		if l.limit, err = strconv.Atoi(v); err != nil || l.limit < 1 {
+			return nil, fmt.Errorf("invalid limit")
+		}
+		l.limit = min(l.limit, maxListLimit)
+	}
+	if v := c.Query("cursor"); v != "" {
+		data, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return nil, errBadCursor
+		}
+		l.after = &listCursor{}
+		if err := json.Unmarshal(data, l.after); err != nil || l.after.Sort != l.sort || l.after.Descending != l.descending {
+			return nil, errBadCursor
+		}
+	}
+	return l, nil
+}
+
+// cursorValue turns the value a cursor holds back into what its sort compares
+func (l *itemListing) cursorValue() (interface{}, error) {
+	switch l.sort {
+	case "size":
+		size, err := strconv.ParseInt(l.after.Value, 10, 64)
+		if err != nil {
+			return nil, errBadCursor
+		}
+		return size, nil
+	case "modified":
+		modified, err := time.Parse(time.RFC3339Nano, l.after.Value)
+		if err != nil {
+			return nil, errBadCursor
+		}
+		return modified, nil
+	}
+	return l.after.Value, nil
+}
+
+// cursorAfter returns the cursor that continues a listing after item
+func (l *itemListing) cursorAfter(item *ItemInfo, mimeType string) string {
+	cursor := listCursor{Sort: l.sort, Descending: l.descending, IsFile: 1, ID: item.ID}
+	if item.IsDir {
+		cursor.IsFile = 0
+	}
+	switch l.sort {
+	case "name":
+		cursor.Value = item.Name
+	case "size":
+		cursor.Value = strconv.FormatInt(item.Size, 10)
+	case "modified":
+		cursor.Value = item.Modified.Format(time.RFC3339Nano)
+	case "type":
+		cursor.Value = mimeType
+	}
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// orderBy is the order of a listing of the rows r. Folders always come first; within each the
+// sort decides, and the ID settles ties.
+func (l *itemListing) orderBy() string {
+	order := "ASC"
+	if l.descending {
+		order = "DESC"
+	}
+	return fmt.Sprintf("ORDER BY r.IS_FILE, %[1]s %[2]s, r.ID %[2]s", listSorts[l.sort].column, order)
+}
+
+// afterCondition is what the rows r past the cursor match in the order of orderBy, with its arguments
+func (l *itemListing) afterCondition() (string, []interface{}, error) {
+	value, err := l.cursorValue()
+	if err != nil {
+		return "", nil, err
+	}
+	by, cmp := listSorts[l.sort], ">"
+	if l.descending {
+		cmp = "<"
+	}
+	cond := fmt.Sprintf("(r.IS_FILE > ? OR r.IS_FILE = ? AND (%[1]s %[3]s %[2]s OR %[1]s = %[2]s AND r.ID %[3]s ?))", by.column, by.value, cmp)
+	return cond, []interface{}{l.after.IsFile, l.after.IsFile, value, value, l.after.ID}, nil
+}
+
+// page returns a page of the folders and files of FOLDER_LIST and FILE_LIST (each aliased t)
+// that match folderWhere and fileWhere, which both take args, folders first. Along come the
+// cursor of the next page, nil on the last one, and the number of items on all pages.
+func (h *FileHandler) page(l *itemListing, folderWhere, fileWhere string, args ...interface{}) ([]ItemInfo, *string, int, error) {
+	var branches []string
+	var branchArgs []interface{}
+	if l.kind != "file" && len(l.mimeTypes) == 0 {
+		branches = append(branches, `SELECT 0 AS IS_FILE, t.FOLDER_ID AS ID, t.FOLDER_NAME AS NAME, 0 AS SIZE, '' AS MIME,
+			t.modified_at AS MODIFIED, t.PARENT_ID AS PARENT_ID FROM FOLDER_LIST t WHERE `+folderWhere)
+		branchArgs = append(branchArgs, args...)
+	}
+	if l.kind != "folder" {
+		where := fileWhere
+		fileArgs := append([]interface{}{}, args...)
+		if len(l.mimeTypes) > 0 {
+			var conds []string
+			for _, mimeType := range l.mimeTypes {
+				cond, value := mimeCondition(mimeType)
+				conds = append(conds, cond)
+				fileArgs = append(fileArgs, value)
+			}
+			where += " AND (" + strings.Join(conds, " OR ") + ")"
+		}
+		branches = append(branches, `SELECT 1, CAST(t.FILE_ID AS CHAR), t.FILE_NAME, COALESCE(t.FILE_SIZE, 0), COALESCE(t.FILE_TYPE, ''),
+			t.modified_at, t.FOLDER_ID FROM FILE_LIST t WHERE `+where)
+		branchArgs = append(branchArgs, fileArgs...)
+	}
+	items := []ItemInfo{}
+	if len(branches) == 0 {
+		return items, nil, 0, nil
+	}
+	query := "SELECT * FROM (" + strings.Join(branches, " UNION ALL ") + ") r"
+
+	var total int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM ("+query+") counted", branchArgs...).Scan(&total); err != nil {
+		return nil, nil, 0, err
+	}
+
+	if l.after != nil {
+		cond, condArgs, err := l.afterCondition()
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		query += " WHERE " + cond
+		branchArgs = append(branchArgs, condArgs...)
+	}
+	query += " " + l.orderBy() + " LIMIT ?"
+	rows, err := h.db.Query(query, append(branchArgs, l.limit+1)...)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer rows.Close()
+
+	var mimeTypes []string
+	for rows.Next() {
+		var item ItemInfo
+		var isFile int
+		var mimeType string
+		if err := rows.Scan(&isFile, &item.ID, &item.Name, &item.Size, &mimeType, &item.Modified, &item.parentID); err != nil {
+			return nil, nil, 0, err
+		}
+		item.IsDir = isFile == 0
+		items = append(items, item)
+		mimeTypes = append(mimeTypes, mimeType)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, 0, err
+	}
+	if err := attachPaths(h.db, itemRefs(items)); err != nil {
+		return nil, nil, 0, err
+	}
+
+	// One row past the page says there is another page
+	var next *string
+	if len(items) > l.limit {
+		items = items[:l.limit]
+		cursor := l.cursorAfter(&items[l.limit-1], mimeTypes[l.limit-1])
+		next = &cursor
+	}
+	return items, next, total, nil
+}
+
+// respondListingError answers a request whose listing failed
+func respondListingError(c *gin.Context, err error) {
+	if errors.Is(err, errBadCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Error listing items: %v", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch items"})
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func listingContext(query url.Values) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/api/files?"+query.Encode(), nil)
+	return c
+}
+
+// errAny stands for any error in the table of TestParseListing
+var errAny = errors.New("any error")
+
+func TestParseListing(t *testing.T) {
+	nameCursor := (&itemListing{sort: "name"}).cursorAfter(&ItemInfo{ID: "7", Name: "a"}, "")
+	tests := []struct {
+		name    string
+		query   url.Values
+		want    itemListing
+		wantErr error // errBadCursor, or any error when errAny
+	}{
+		{"defaults", url.Values{}, itemListing{sort: "name", limit: defaultListLimit}, nil},
+		{"sort and order", url.Values{"sort": {"size"}, "order": {"desc"}}, itemListing{sort: "size", descending: true, limit: defaultListLimit}, nil},
+		{"unknown order is ascending", url.Values{"order": {"sideways"}}, itemListing{sort: "name", limit: defaultListLimit}, nil},
+		{"filters", url.Values{"kind": {"file"}, "type": {"image/*", "application/pdf"}}, itemListing{sort: "name", kind: "file", mimeTypes: []string{"image/*", "application/pdf"}, limit: defaultListLimit}, nil},
+		{"limit", url.Values{"limit": {"25"}}, itemListing{sort: "name", limit: 25}, nil},
+		{"limit above the maximum", url.Values{"limit": {"5000"}}, itemListing{sort: "name", limit: maxListLimit}, nil},
+		{"cursor", url.Values{"cursor": {nameCursor}}, itemListing{sort: "name", limit: defaultListLimit, after: &listCursor{Sort: "name", IsFile: 1, Value: "a", ID: "7"}}, nil},
+		{"unknown sort", url.Values{"sort": {"owner"}}, itemListing{}, errAny},
+		{"unknown kind", url.Values{"kind": {"link"}}, itemListing{}, errAny},
+		{"zero limit", url.Values{"limit": {"0"}}, itemListing{}, errAny},
+		{"limit not a number", url.Values{"limit": {"ten"}}, itemListing{}, errAny},
+		{"cursor not base64", url.Values{"cursor": {"%%%"}}, itemListing{}, errBadCursor},
+		{"cursor not JSON", url.Values{"cursor": {base64.RawURLEncoding.EncodeToString([]byte("nope"))}}, itemListing{}, errBadCursor},
+		{"cursor of another sort", url.Values{"sort": {"size"}, "cursor": {nameCursor}}, itemListing{}, errBadCursor},
+		{"cursor of another order", url.Values{"order": {"desc"}, "cursor": {nameCursor}}, itemListing{}, errBadCursor},
+	}
+	for _, tt := range tests {
+		got, err := parseListing(listingContext(tt.query))
+		switch {
+		case tt.wantErr == nil && err != nil:
+			t.Errorf("%s: parseListing error = %v", tt.name, err)
+		case tt.wantErr == errAny && err == nil, tt.wantErr == errBadCursor && !errors.Is(err, errBadCursor):
+			t.Errorf("%s: parseListing error = %v, want %v", tt.name, err, tt.wantErr)
+		case tt.wantErr == nil && !reflect.DeepEqual(*got, tt.want):
+			t.Errorf("%s: parseListing = %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 12, 30, 15, 123456000, time.UTC)
+	folder := &ItemInfo{ID: "9f1c", Name: "Photos", IsDir: true, Modified: modified}
+	file := &ItemInfo{ID: "42", Name: "file10.txt", Size: 1234, Modified: modified}
+	tests := []struct {
+		sort       string
+		descending bool
+		item       *ItemInfo
+		mimeType   string
+		wantIsFile int
+		wantValue  interface{}
+	}{
+		{"name", false, file, "text/plain", 1, "file10.txt"},
+		{"name", true, folder, "", 0, "Photos"},
+		{"size", false, file, "text/plain", 1, int64(1234)},
+		{"size", true, folder, "", 0, int64(0)},
+		{"modified", false, file, "text/plain", 1, modified},
+		{"type", true, file, "text/plain", 1, "text/plain"},
+		{"type", false, folder, "", 0, ""},
+	}
+	for _, tt := range tests {
+		l := &itemListing{sort: tt.sort, descending: tt.descending}
+		cursor := l.cursorAfter(tt.item, tt.mimeType)
+
+		query := url.Values{"sort": {tt.sort}, "cursor": {cursor}}
+		if tt.descending {
+			query.Set("order", "desc")
+		}
+		parsed, err := parseListing(listingContext(query))
+		if err != nil {
+			t.Errorf("%s: parsing its own cursor: %v", tt.sort, err)
+			continue
+		}
+		if parsed.after.IsFile != tt.wantIsFile || parsed.after.ID != tt.item.ID {
+			t.Errorf("%s: cursor after %s = %+v, want IsFile %d", tt.sort, tt.item.Name, parsed.after, tt.wantIsFile)
+		}
+		value, err := parsed.cursorValue()
+		if err != nil {
+			t.Errorf("%s: cursorValue: %v", tt.sort, err)
+			continue
+		}
+		if v, ok := value.(time.Time); ok {
+			if !v.Equal(tt.wantValue.(time.Time)) {
+				t.Errorf("%s: cursorValue = %v, want %v", tt.sort, v, tt.wantValue)
+			}
+		} else if value != tt.wantValue {
+			t.Errorf("%s: cursorValue = %#v, want %#v", tt.sort, value, tt.wantValue)
+		}
+	}
+}
+
+func TestCursorValueRejectsBadValues(t *testing.T) {
+	for _, tt := range []struct{ sort, value string }{
+		{"size", "big"},
+		{"modified", "yesterday"},
+	} {
+		l := &itemListing{sort: tt.sort, after: &listCursor{Sort: tt.sort, Value: tt.value}}
+		if _, err := l.cursorValue(); !errors.Is(err, errBadCursor) {
+			t.Errorf("cursorValue of %s %q = %v, want errBadCursor", tt.sort, tt.value, err)
+		}
+	}
+}
+
+func TestListingOrder(t *testing.T) {
+	tests := []struct {
+		sort       string
+		descending bool
+		after      listCursor
+		wantOrder  string
+		wantCond   string
+		wantArgs   []interface{}
+	}{
+		{
+			"name", false, listCursor{IsFile: 0, Value: "b", ID: "f1"},
+			"ORDER BY r.IS_FILE, NATURAL_SORT_KEY(r.NAME) ASC, r.ID ASC",
+			"(r.IS_FILE > ? OR r.IS_FILE = ? AND (NATURAL_SORT_KEY(r.NAME) > NATURAL_SORT_KEY(?) OR NATURAL_SORT_KEY(r.NAME) = NATURAL_SORT_KEY(?) AND r.ID > ?))",
+			[]interface{}{0, 0, "b", "b", "f1"},
+		},
+		{
+			"size", true, listCursor{IsFile: 1, Value: "10", ID: "3"},
+			"ORDER BY r.IS_FILE, r.SIZE DESC, r.ID DESC",
+			"(r.IS_FILE > ? OR r.IS_FILE = ? AND (r.SIZE < ? OR r.SIZE = ? AND r.ID < ?))",
+			[]interface{}{1, 1, int64(10), int64(10), "3"},
+		},
+		{
+			"type", false, listCursor{IsFile: 1, Value: "image/png", ID: "5"},
+			"ORDER BY r.IS_FILE, r.MIME ASC, r.ID ASC",
+			"(r.IS_FILE > ? OR r.IS_FILE = ? AND (r.MIME > ? OR r.MIME = ? AND r.ID > ?))",
+			[]interface{}{1, 1, "image/png", "image/png", "5"},
+		},
+	}
+	for _, tt := range tests {
+		after := tt.after
+		after.Sort, after.Descending = tt.sort, tt.descending
+		l := &itemListing{sort: tt.sort, descending: tt.descending, after: &after}
+		if got := l.orderBy(); got != tt.wantOrder {
+			t.Errorf("%s: orderBy = %q, want %q", tt.sort, got, tt.wantOrder)
+		}
+		cond, args, err := l.afterCondition()
+		if err != nil {
+			t.Errorf("%s: afterCondition: %v", tt.sort, err)
+			continue
+		}
+		if cond != tt.wantCond || !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("%s: afterCondition = %q %v, want %q %v", tt.sort, cond, args, tt.wantCond, tt.wantArgs)
+		}
+	}
+}
@@ -0,0 +1,513 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"my-cloud-project/backend/fulltext"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Page sizes for search results
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 200
+)
+
+// likeEscaper escapes the LIKE wildcards in text that is to be matched literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// globReplacer turns a glob into a LIKE pattern, escaping LIKE's own wildcards first
+var globReplacer = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `*`, `%`, `?`, `_`)
+
+// SearchResult is an item found by a search. Items shared with the user carry their owner and
+// the user's permission; the user's own items leave both empty.
+type SearchResult struct {
+	ItemInfo
+	Type       string  `json:"type"` // "file" or "folder"
+	MimeType   string  `json:"mimeType,omitempty"`
+	Status     string  `json:"status"`
+	ParentID   *string `json:"parentId"`
+	OwnerName  string  `json:"ownerName,omitempty"`
+	Permission string  `json:"permission,omitempty"`
+}
+
+// searchQuery is a parsed search request. Each filter becomes a condition in every branch of the
+// query it applies to, so it can use the indexes of the table that branch reads.
+type searchQuery struct {
+	namePattern  string
+	mimeType     string
+	minSize      int64
+	maxSize      int64
+	from, to     time.Time
+	kind         string // "file", "folder" or "" for both
+	status       string // "active", "trashed" or "all"
+	owner        string // "me", "shared" or "any"
+	scopeID      string
+	sort         string
+	descending   bool
+	limit        int
+	offset       int
+	hasSizeRange bool
+	tags         []string
+}
+
+// searchSorts maps the sort option to the column of the combined results
+var searchSorts = map[string]string{
+	"name":     "NAME",
+	"size":     "SIZE",
+	"modified": "MODIFIED",
+	"type":     "MIME",
+}
+
+// parseSearchTime reads a time given as RFC 3339 or as a date. A date as upper bound
+// includes the whole day.
+func parseSearchTime(value string, upper bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q, use YYYY-MM-DD or RFC 3339", value)
+	}
+	if upper {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
+
+// parseSearch reads the filters of a search request
+func parseSearch(c *gin.Context) (*searchQuery, error) {
+	q := &searchQuery{
+		kind:       c.Query("kind"),
+		status:     c.DefaultQuery("status", "active"),
+		owner:      c.DefaultQuery("owner", "any"),
+		scopeID:    c.Query("folderId"),
+		sort:       c.DefaultQuery("sort", "modified"),
+		descending: c.DefaultQuery("order", "desc") == "desc",
+		limit:      defaultSearchLimit,
+		mimeType:   c.Query("type"),
+	}
+
+	// A name with * or ? is a glob matched against the whole name, anything else a substring
+	if name := c.Query("q"); name != "" {
+		if strings.ContainsAny(name, "*?") {
+			q.namePattern = globReplacer.Replace(name)
+		} else {
+			q.namePattern = "%" + likeEscaper.Replace(name) + "%"
+		}
+	}
+
+	switch q.kind {
+	case "", "file", "folder":
+	default:
+		return nil, fmt.Errorf("kind must be file or folder")
+	}
+	switch q.status {
+	case "active", "trashed", "all":
+	default:
+		return nil, fmt.Errorf("status must be active, trashed or all")
+	}
+	switch q.owner {
+	case "me", "shared", "any":
+	default:
+		return nil, fmt.Errorf("owner must be me, shared or any")
+	}
+	if _, ok := searchSorts[q.sort]; !ok {
+		return nil, fmt.Errorf("sort must be name, size, modified or type")
+	}
+
+	var err error
+	if v := c.Query("minSize"); v != "" {
+		if q.minSize, err = strconv.ParseInt(v, 10, 64); err != nil || q.minSize < 0 {
+			return nil, fmt.Errorf("invalid minSize")
+		}
+		q.hasSizeRange = true
+	}
+	q.maxSize = -1
+	if v := c.Query("maxSize"); v != "" {
+		if q.maxSize, err = strconv.ParseInt(v, 10, 64); err != nil || q.maxSize < 0 {
+			return nil, fmt.Errorf("invalid maxSize")
+		}
+		q.hasSizeRange = true
+	}
+	if v := c.Query("modifiedFrom"); v != "" {
+		if q.from, err = parseSearchTime(v, false); err != nil {
+			return nil, err
+		}
+	}
+	if v := c.Query("modifiedTo"); v != "" {
+		if q.to, err = parseSearchTime(v, true); err != nil {
+			return nil, err
+		}
+	}
+	// Every tag given has to be on an item
+	if q.tags, err = normalizeTags(c.QueryArray("tag")); err != nil {
+		return nil, err
+	}
+	if v := c.Query("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit < 1 {
+			return nil, fmt.Errorf("invalid limit")
+		}
+		q.limit = min(q.limit, maxSearchLimit)
+	}
+	if v := c.Query("offset"); v != "" {
+		if q.offset, err = strconv.Atoi(v); err != nil || q.offset < 0 {
+			return nil, fmt.Errorf("invalid offset")
+		}
+	}
+	return q, nil
+}
+
+// mimeCondition returns the condition on a file aliased t for a type filter and its argument.
+// "image/*" matches every image type.
+func mimeCondition(mimeType string) (string, interface{}) {
+	if prefix, ok := strings.CutSuffix(mimeType, "/*"); ok {
+		return "t.FILE_TYPE LIKE ?", likeEscaper.Replace(prefix) + "/%"
+	}
+	return "t.FILE_TYPE = ?", mimeType
+}
+
+// wantFolders reports whether folders can match at all; type and size only describe files
+func (q *searchQuery) wantFolders() bool {
+	return q.kind != "file" && q.mimeType == "" && !q.hasSizeRange
+}
+
+// conditions adds the filters on a table aliased t to where, for a branch over files or folders
+func (q *searchQuery) conditions(files bool, where *[]string, args *[]interface{}) {
+	add := func(cond string, values ...interface{}) {
+		*where = append(*where, cond)
+		*args = append(*args, values...)
+	}
+	name, parent := "t.FOLDER_NAME", "t.PARENT_ID"
+	if files {
+		name, parent = "t.FILE_NAME", "t.FOLDER_ID"
+	}
+
+	if q.namePattern != "" {
+		add(name+" LIKE ?", q.namePattern)
+	}
+	if files {
+		if q.mimeType != "" {
+			add(mimeCondition(q.mimeType))
+		}
+		if q.minSize > 0 {
+			add("t.FILE_SIZE >= ?", q.minSize)
+		}
+		if q.maxSize >= 0 {
+			add("t.FILE_SIZE <= ?", q.maxSize)
+		}
+	}
+	if !q.from.IsZero() {
+		add("t.modified_at >= ?", q.from)
+	}
+	if !q.to.IsZero() {
+		add("t.modified_at <= ?", q.to)
+	}
+	for _, tag := range q.tags {
+		if files {
+			add("EXISTS (SELECT 1 FROM FILE_TAGS g WHERE g.FILE_ID = t.FILE_ID AND g.TAG = ?)", tag)
+		} else {
+			add("EXISTS (SELECT 1 FROM FOLDER_TAGS g WHERE g.FOLDER_ID = t.FOLDER_ID AND g.TAG = ?)", tag)
+		}
+	}
+	if q.scopeID != "" {
+		*where = append(*where, parent+" IN (SELECT FOLDER_ID FROM subtree)")
+	}
+}
+
+// build returns the query for the matching items and its arguments. The results of all branches
+// come out with the same columns so they can be sorted and paged together.
+func (q *searchQuery) build(userID int) (string, []interface{}) {
+	var branches []string
+	var args []interface{}
+	if q.scopeID != "" {
+		args = append(args, "", q.scopeID)
+	}
+
+	branch := func(files, shared bool) {
+		var where []string
+		var columns, from string
+		if files {
+			columns = `'file' AS KIND, CAST(t.FILE_ID AS CHAR) AS ID, t.FILE_NAME AS NAME, COALESCE(t.FILE_SIZE, 0) AS SIZE,
+				COALESCE(t.FILE_TYPE, '') AS MIME, t.modified_at AS MODIFIED, t.FOLDER_ID AS PARENT_ID,
+				COALESCE(t.STATUS, '') AS STATUS`
+			from = "FILE_LIST t"
+			if shared {
+				from = "SHARED_FILE s JOIN FILE_LIST t ON s.FILE_ID = t.FILE_ID JOIN USERS u ON t.OWNER_ID = u.USER_ID"
+			}
+		} else {
+			columns = `'folder', t.FOLDER_ID, t.FOLDER_NAME, 0, '', t.modified_at, t.PARENT_ID, COALESCE(t.STATUS, '')`
+			from = "FOLDER_LIST t"
+			if shared {
+				from = "SHARED_FOLDER s JOIN FOLDER_LIST t ON s.FOLDER_ID = t.FOLDER_ID JOIN USERS u ON t.OWNER_ID = u.USER_ID"
+			}
+		}
+
+		if shared {
+			columns += ", u.USERNAME AS OWNER_NAME, s.PERMISSION AS PERMISSION"
+			// Nobody sees what others have in their trash
+			where = append(where, "s.USER_ID = ?", "t.STATUS = 'active'")
+		} else {
+			columns += ", '' AS OWNER_NAME, '' AS PERMISSION"
+			where = append(where, "t.OWNER_ID = ?")
+			switch q.status {
+			case "active":
+				where = append(where, "t.STATUS = 'active'")
+			case "trashed":
+				where = append(where, "t.STATUS = 'trashed'")
+			}
+		}
+		args = append(args, userID)
+		q.conditions(files, &where, &args)
+		branches = append(branches, "SELECT "+columns+" FROM "+from+" WHERE "+strings.Join(where, " AND "))
+	}
+
+	for _, shared := range []bool{false, true} {
+		if shared && (q.owner == "me" || q.status == "trashed") || !shared && q.owner == "shared" {
+			continue
+		}
+		if q.kind != "folder" {
+			branch(true, shared)
+		}
+		if q.wantFolders() {
+			branch(false, shared)
+		}
+	}
+	if len(branches) == 0 {
+		return "", nil
+	}
+
+	query := "SELECT * FROM (" + strings.Join(branches, " UNION ALL ") + ") r"
+	if q.scopeID != "" {
+		query = subtreeCTE + " " + query
+	}
+	return query, args
+}
+
+// searchScope checks that the user may search the folder folderId, owned or shared
+func (h *FileHandler) searchScope(userID int, folderID string) error {
+	var found int
+	return h.db.QueryRow(`
+		SELECT 1 FROM FOLDER_LIST fl
+		WHERE fl.FOLDER_ID = ? AND fl.STATUS = 'active'
+			AND (fl.OWNER_ID = ? OR EXISTS (SELECT 1 FROM SHARED_FOLDER sf WHERE sf.FOLDER_ID = fl.FOLDER_ID AND sf.USER_ID = ?))
+	`, folderID, userID, userID).Scan(&found)
+}
+
+// Search finds the user's own items and items shared with them by name, type, size, modification
+// time, folder, tags and status. Results come a page at a time along with the total number of matches.
+func (h *FileHandler) Search(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	q, err := parseSearch(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if q.scopeID != "" {
+		if err := h.searchScope(userID, q.scopeID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+			return
+		}
+	}
+
+	results := []SearchResult{}
+	query, args := q.build(userID)
+	if query == "" {
+		c.JSON(http.StatusOK, gin.H{"items": results, "total": 0, "limit": q.limit, "offset": q.offset})
+		return
+	}
+
+	var total int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM ("+query+") counted", args...).Scan(&total); err != nil {
+		log.Printf("Error counting search results: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		return
+	}
+
+	order := "ASC"
+	if q.descending {
+		order = "DESC"
+	}
+	// KIND and ID keep the order of equal values stable from page to page
+	query += fmt.Sprintf(" ORDER BY r.%s %s, r.KIND, r.ID LIMIT ? OFFSET ?", searchSorts[q.sort], order)
+	rows, err := h.db.Query(query, append(args, q.limit, q.offset)...)
+	if err != nil {
+		log.Printf("Error searching: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r SearchResult
+		if err := rows.Scan(&r.Type, &r.ID, &r.Name, &r.Size, &r.MimeType, &r.Modified, &r.parentID, &r.Status, &r.OwnerName, &r.Permission); err != nil {
+			log.Printf("Error scanning search result: %v", err)
+			continue
+		}
+		r.IsDir = r.Type == "folder"
+		if r.parentID.Valid {
+			r.ParentID = &r.parentID.String
+		}
+		results = append(results, r)
+	}
+
+	refs := itemRefs(results)
+	if err := attachPaths(h.db, refs); err != nil {
+		log.Printf("Error fetching paths of search results: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		return
+	}
+	h.attachTags(refs)
+
+	c.JSON(http.StatusOK, gin.H{"items": results, "total": total, "limit": q.limit, "offset": q.offset})
+}
+
+// ContentSearchResult is a file whose contents match a search, with the passages that match
+// marked up in HTML
+type ContentSearchResult struct {
+	SearchResult
+	Score    float64  `json:"score"`
+	Snippets []string `json:"snippets"`
+}
+
+// SearchContent finds the user's own files and files shared with them by what they contain.
+// Results are ranked best first and come a page at a time along with the total number of matches.
+func (h *FileHandler) SearchContent(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	q := fulltext.Query{Text: strings.TrimSpace(c.Query("q")), OwnerID: userID, FolderID: c.Query("folderId"), Size: defaultSearchLimit}
+	if q.Text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A search text is required"})
+		return
+	}
+	switch c.DefaultQuery("status", "active") {
+	case "active":
+	case "trashed":
+		q.Trashed = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be active or trashed"})
+		return
+	}
+	if v := c.Query("limit"); v != "" {
+		if q.Size, err = strconv.Atoi(v); err != nil || q.Size < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		q.Size = min(q.Size, maxSearchLimit)
+	}
+	if v := c.Query("offset"); v != "" {
+		if q.From, err = strconv.Atoi(v); err != nil || q.From < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+			return
+		}
+	}
+	if q.FolderID != "" {
+		if err := h.searchScope(userID, q.FolderID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+			return
+		}
+	}
+
+	// Other users' files are found through the user's shares as they are right now
+	if !q.Trashed {
+		rows, err := h.db.Query("SELECT sf.FILE_ID FROM SHARED_FILE sf JOIN FILE_LIST f ON sf.FILE_ID = f.FILE_ID WHERE sf.USER_ID = ? AND f.STATUS = 'active'", userID)
+		if err != nil {
+			log.Printf("Error fetching shared files: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+			return
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err == nil {
+				q.SharedIDs = append(q.SharedIDs, id)
+			}
+		}
+		rows.Close()
+	}
+
+	hits, total, err := h.index.Search(c.Request.Context(), q)
+	if err != nil {
+		log.Printf("Error searching contents: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		return
+	}
+
+	results := []ContentSearchResult{}
+	if len(hits) > 0 {
+		ids := make([]string, len(hits))
+		for i, hit := range hits {
+			ids[i] = strconv.FormatInt(hit.FileID, 10)
+		}
+		inClause, args := buildInClause("f.FILE_ID", ids)
+		rows, err := h.db.Query(`
+			SELECT f.FILE_ID, f.OWNER_ID, f.FILE_NAME, COALESCE(f.FILE_SIZE, 0), COALESCE(f.FILE_TYPE, ''), f.modified_at,
+				f.FOLDER_ID, COALESCE(f.STATUS, ''), u.USERNAME, COALESCE(sf.PERMISSION, '')
+			FROM FILE_LIST f JOIN USERS u ON f.OWNER_ID = u.USER_ID
+			LEFT JOIN SHARED_FILE sf ON sf.FILE_ID = f.FILE_ID AND sf.USER_ID = ?
+			WHERE `+inClause, append([]interface{}{userID}, args...)...)
+		if err != nil {
+			log.Printf("Error fetching search results: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+			return
+		}
+		defer rows.Close()
+
+		found := map[string]*SearchResult{}
+		for rows.Next() {
+			r := &SearchResult{Type: "file"}
+			var ownerID int
+			if err := rows.Scan(&r.ID, &ownerID, &r.Name, &r.Size, &r.MimeType, &r.Modified, &r.parentID, &r.Status, &r.OwnerName, &r.Permission); err != nil {
+				log.Printf("Error scanning search result: %v", err)
+				continue
+			}
+			// The index may lag behind a share that was just taken away
+			if ownerID == userID {
+				r.OwnerName = ""
+			} else if r.Permission == "" {
+				continue
+			}
+			if r.parentID.Valid {
+				r.ParentID = &r.parentID.String
+			}
+			found[r.ID] = r
+		}
+
+		for i, hit := range hits {
+			if r := found[ids[i]]; r != nil {
+				results = append(results, ContentSearchResult{SearchResult: *r, Score: hit.Score, Snippets: hit.Snippets})
+			}
+		}
+
+		refs := itemRefs(results)
+		if err := attachPaths(h.db, refs); err != nil {
+			log.Printf("Error fetching paths of search results: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+			return
+		}
+		h.attachTags(refs)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": results, "total": total, "limit": q.Size, "offset": q.From})
+}
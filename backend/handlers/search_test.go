@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Where each branch of a search reads from and what it filters on, as build writes them
+const (
+	ownFiles      = "FILE_LIST t WHERE t.OWNER_ID = ?"
+	ownFolders    = "FOLDER_LIST t WHERE t.OWNER_ID = ?"
+	sharedFiles   = "SHARED_FILE s JOIN FILE_LIST t ON s.FILE_ID = t.FILE_ID JOIN USERS u ON t.OWNER_ID = u.USER_ID WHERE s.USER_ID = ? AND t.STATUS = 'active'"
+	sharedFolders = "SHARED_FOLDER s JOIN FOLDER_LIST t ON s.FOLDER_ID = t.FOLDER_ID JOIN USERS u ON t.OWNER_ID = u.USER_ID WHERE s.USER_ID = ? AND t.STATUS = 'active'"
+	active        = " AND t.STATUS = 'active'"
+	inScopeFiles  = " AND t.FOLDER_ID IN (SELECT FOLDER_ID FROM subtree)"
+	inScopeFolder = " AND t.PARENT_ID IN (SELECT FOLDER_ID FROM subtree)"
+)
+
+// searchBranches splits a search query into the FROM and WHERE of each of its branches
+func searchBranches(t *testing.T, query string, scoped bool) []string {
+	t.Helper()
+	if scoped {
+		if !strings.HasPrefix(query, subtreeCTE+" ") {
+			t.Fatalf("scoped query does not start with the subtree CTE: %s", query)
+		}
+		query = strings.TrimPrefix(query, subtreeCTE+" ")
+	}
+	inner, prefixed := strings.CutPrefix(query, "SELECT * FROM (")
+	inner, suffixed := strings.CutSuffix(inner, ") r")
+	if !prefixed || !suffixed {
+		t.Fatalf("query is not a union of branches: %s", query)
+	}
+	var branches []string
+	for _, branch := range strings.Split(inner, " UNION ALL ") {
+		_, from, found := strings.Cut(branch, " FROM ")
+		if !found {
+			t.Fatalf("branch without FROM: %s", branch)
+		}
+		branches = append(branches, from)
+	}
+	return branches
+}
+
+func TestSearchQueryBuild(t *testing.T) {
+	const userID = 7
+	from := time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local)
+	to := time.Date(2024, 1, 31, 0, 0, 0, 0, time.Local).AddDate(0, 0, 1).Add(-time.Nanosecond)
+	tests := []struct {
+		name         string
+		query        url.Values
+		wantBranches []string
+		wantArgs     []interface{}
+	}{
+		{
+			"defaults",
+			url.Values{},
+			[]string{ownFiles + active, ownFolders + active, sharedFiles, sharedFolders},
+			[]interface{}{userID, userID, userID, userID},
+		},
+		{
+			"substring escapes LIKE wildcards",
+			url.Values{"q": {`50%_off\`}, "owner": {"me"}},
+			[]string{ownFiles + active + " AND t.FILE_NAME LIKE ?", ownFolders + active + " AND t.FOLDER_NAME LIKE ?"},
+			[]interface{}{userID, `%50\%\_off\\%`, userID, `%50\%\_off\\%`},
+		},
+		{
+			"glob matches the whole name",
+			url.Values{"q": {"report_*.pd?"}, "owner": {"me"}, "kind": {"file"}},
+			[]string{ownFiles + active + " AND t.FILE_NAME LIKE ?"},
+			[]interface{}{userID, `report\_%.pd_`},
+		},
+		{
+			"shared only",
+			url.Values{"owner": {"shared"}, "kind": {"folder"}},
+			[]string{sharedFolders},
+			[]interface{}{userID},
+		},
+		{
+			"trash leaves out shared items",
+			url.Values{"status": {"trashed"}},
+			[]string{ownFiles + " AND t.STATUS = 'trashed'", ownFolders + " AND t.STATUS = 'trashed'"},
+			[]interface{}{userID, userID},
+		},
+		{
+			"any status",
+			url.Values{"status": {"all"}, "owner": {"me"}},
+			[]string{ownFiles, ownFolders},
+			[]interface{}{userID, userID},
+		},
+		{
+			"type leaves out folders",
+			url.Values{"type": {"image/*"}},
+			[]string{ownFiles + active + " AND t.FILE_TYPE LIKE ?", sharedFiles + " AND t.FILE_TYPE LIKE ?"},
+			[]interface{}{userID, "image/%", userID, "image/%"},
+		},
+		{
+			"size leaves out folders",
+			url.Values{"minSize": {"10"}, "maxSize": {"0"}, "owner": {"me"}},
+			[]string{ownFiles + active + " AND t.FILE_SIZE >= ? AND t.FILE_SIZE <= ?"},
+			[]interface{}{userID, int64(10), int64(0)},
+		},
+		{
+			"dates and tags",
+			url.Values{"modifiedFrom": {"2024-01-02"}, "modifiedTo": {"2024-01-31"}, "tag": {" Work ", "work", "2024"}, "owner": {"me"}, "kind": {"folder"}},
+			[]string{ownFolders + active + " AND t.modified_at >= ? AND t.modified_at <= ?" +
+				" AND EXISTS (SELECT 1 FROM FOLDER_TAGS g WHERE g.FOLDER_ID = t.FOLDER_ID AND g.TAG = ?)" +
+				" AND EXISTS (SELECT 1 FROM FOLDER_TAGS g WHERE g.FOLDER_ID = t.FOLDER_ID AND g.TAG = ?)"},
+			[]interface{}{userID, from, to, "work", "2024"},
+		},
+		{
+			"scope arguments come first",
+			url.Values{"folderId": {"f1"}, "q": {"a"}, "tag": {"x"}},
+			[]string{
+				ownFiles + active + " AND t.FILE_NAME LIKE ? AND EXISTS (SELECT 1 FROM FILE_TAGS g WHERE g.FILE_ID = t.FILE_ID AND g.TAG = ?)" + inScopeFiles,
+				ownFolders + active + " AND t.FOLDER_NAME LIKE ? AND EXISTS (SELECT 1 FROM FOLDER_TAGS g WHERE g.FOLDER_ID = t.FOLDER_ID AND g.TAG = ?)" + inScopeFolder,
+				sharedFiles + " AND t.FILE_NAME LIKE ? AND EXISTS (SELECT 1 FROM FILE_TAGS g WHERE g.FILE_ID = t.FILE_ID AND g.TAG = ?)" + inScopeFiles,
+				sharedFolders + " AND t.FOLDER_NAME LIKE ? AND EXISTS (SELECT 1 FROM FOLDER_TAGS g WHERE g.FOLDER_ID = t.FOLDER_ID AND g.TAG = ?)" + inScopeFolder,
+			},
+			[]interface{}{"", "f1", userID, "%a%", "x", userID, "%a%", "x", userID, "%a%", "x", userID, "%a%", "x"},
+		},
+		{
+			"nothing can match",
+			url.Values{"owner": {"shared"}, "status": {"trashed"}},
+			nil,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		q, err := parseSearch(listingContext(tt.query))
+		if err != nil {
+			t.Errorf("%s: parseSearch error = %v", tt.name, err)
+			continue
+		}
+		query, args := q.build(userID)
+		if tt.wantBranches == nil {
+			if query != "" || args != nil {
+				t.Errorf("%s: build = %q, %v; want no query", tt.name, query, args)
+			}
+			continue
+		}
+		if got := searchBranches(t, query, tt.query.Get("folderId") != ""); !reflect.DeepEqual(got, tt.wantBranches) {
+			t.Errorf("%s: branches =\n%q\nwant\n%q", tt.name, got, tt.wantBranches)
+		}
+		if !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("%s: args = %#v, want %#v", tt.name, args, tt.wantArgs)
+		}
+		if n := strings.Count(query, "?"); n != len(args) {
+			t.Errorf("%s: %d placeholders for %d args", tt.name, n, len(args))
+		}
+	}
+}
+
+func TestParseSearchErrors(t *testing.T) {
+	for _, query := range []url.Values{
+		{"kind": {"link"}},
+		{"status": {"deleted"}},
+		{"owner": {"them"}},
+		{"sort": {"owner"}},
+		{"minSize": {"-1"}},
+		{"maxSize": {"big"}},
+		{"modifiedFrom": {"yesterday"}},
+		{"tag": {" "}},
+		{"limit": {"0"}},
+		{"offset": {"-5"}},
+	} {
+		if _, err := parseSearch(listingContext(query)); err == nil {
+			t.Errorf("parseSearch(%s) succeeded, want an error", query.Encode())
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+// defaultSettings are used for any settings group an admin has not saved yet
+func defaultSettings() AllSettings {
+	return AllSettings{
+		System: SystemSettings{
+			SiteName:                 "IT Cloud Storage",
+			SiteDescription:          "Secure file storage and sharing platform",
+			MaintenanceMode:          false,
+			AllowRegistration:        true,
+			MaxFileSize:              100, // MB
+			AllowedFileTypes:         []string{"pdf", "doc", "docx", "txt", "jpg", "png", "gif", "zip"},
+			RequireEmailVerification: false,
+			SupportEmail:             "admin@itcloud.com",
+		},
+		Storage: StorageSettings{
+			DefaultUserQuota:        5000,  // MB
+			MaxUserQuota:            50000, // MB
+			AutoCleanupEnabled:      true,
+			CleanupDays:             30,
+			StorageWarningThreshold: 80, // percentage
+			CompressionEnabled:      true,
+			VersionRetention:        10,
+		},
+		Security: SecuritySettings{
+			SessionTimeout:        24, // hours
+			PasswordMinLength:     8,
+			RequireStrongPassword: true,
+			MaxLoginAttempts:      5,
+			LockoutDuration:       15, // minutes
+			TwoFactorEnabled:      false,
+			AutoBackupEnabled:     true,
+			BackupRetentionDays:   30,
+		},
+	}
+}
+
+// settingsGroups maps each SYSTEM_SETTINGS row to the section of AllSettings it stores
+func settingsGroups(settings *AllSettings) map[string]interface{} {
+	return map[string]interface{}{
+		"system":   &settings.System,
+		"storage":  &settings.Storage,
+		"security": &settings.Security,
+	}
+}
+
+// loadSettings reads the saved settings, falling back to defaults for anything missing
+func loadSettings(db *sql.DB) (AllSettings, error) {
+	settings := defaultSettings()
+	groups := settingsGroups(&settings)
+
+	rows, err := db.Query("SELECT SETTINGS_GROUP, SETTINGS_VALUE FROM SYSTEM_SETTINGS")
+	if err != nil {
+		return settings, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var group, value string
+		if err := rows.Scan(&group, &value); err != nil {
+			return settings, err
+		}
+		if target, ok := groups[group]; ok {
+			if err := json.Unmarshal([]byte(value), target); err != nil {
+				return settings, err
+			}
+		}
+	}
+	return settings, rows.Err()
+}
+
+// saveSettings stores every settings group in one transaction
+func saveSettings(db *sql.DB, settings AllSettings) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for group, value := range settingsGroups(&settings) {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO SYSTEM_SETTINGS (SETTINGS_GROUP, SETTINGS_VALUE) VALUES (?, ?)
+			ON DUPLICATE KEY UPDATE SETTINGS_VALUE = VALUES(SETTINGS_VALUE)
+		`, group, string(data))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
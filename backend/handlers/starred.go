@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StarredItem is an item the user starred, their own or shared with them
+type StarredItem struct {
+	SearchResult
+	StarredAt time.Time `json:"starredAt"`
+}
+
+// scanListedItem reads an active item as the starred and recent listings select it: kind, ID,
+// name, size, type, modification time, parent ID, owner and permission, then extra. Its path
+// is left for attachPaths.
+func scanListedItem(rows *sql.Rows, extra ...interface{}) (SearchResult, error) {
+	r := SearchResult{Status: "active"}
+	dest := append([]interface{}{&r.Type, &r.ID, &r.Name, &r.Size, &r.MimeType, &r.Modified, &r.parentID, &r.OwnerName, &r.Permission}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return r, err
+	}
+	r.IsDir = r.Type == "folder"
+	if r.parentID.Valid {
+		r.ParentID = &r.parentID.String
+	}
+	return r, nil
+}
+
+// StarItem stars a file or folder for the user. Stars are the user's own, so items shared with
+// them can be starred too. Starring an item again keeps the first star.
+func (h *FileHandler) StarItem(c *gin.Context) {
+	target, userID, ok := h.labelTargetFor(c, false)
+	if !ok {
+		return
+	}
+	if _, err := h.db.Exec("INSERT IGNORE INTO "+target.stars+" (USER_ID, "+target.column+") VALUES (?, ?)", userID, target.id); err != nil {
+		log.Printf("Failed to star item: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to star item"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"starred": true})
+}
+
+// UnstarItem removes the user's star from a file or folder
+func (h *FileHandler) UnstarItem(c *gin.Context) {
+	target, userID, ok := h.labelTargetFor(c, false)
+	if !ok {
+		return
+	}
+	if _, err := h.db.Exec("DELETE FROM "+target.stars+" WHERE USER_ID = ? AND "+target.column+" = ?", userID, target.id); err != nil {
+		log.Printf("Failed to unstar item: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unstar item"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"starred": false})
+}
+
+// ListStarred lists the items the user starred, most recently starred first. Items in the trash
+// and items no longer shared with the user are left out but keep their star.
+func (h *FileHandler) ListStarred(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT * FROM (
+			SELECT 'file' AS KIND, CAST(t.FILE_ID AS CHAR) AS ID, t.FILE_NAME AS NAME, COALESCE(t.FILE_SIZE, 0) AS SIZE,
+				COALESCE(t.FILE_TYPE, '') AS MIME, t.modified_at AS MODIFIED, t.FOLDER_ID AS PARENT_ID,
+				IF(t.OWNER_ID = s.USER_ID, '', u.USERNAME) AS OWNER_NAME, COALESCE(sh.PERMISSION, '') AS PERMISSION, s.created_at AS STARRED_AT
+			FROM STARRED_FILE s JOIN FILE_LIST t ON t.FILE_ID = s.FILE_ID JOIN USERS u ON u.USER_ID = t.OWNER_ID
+			LEFT JOIN SHARED_FILE sh ON sh.FILE_ID = t.FILE_ID AND sh.USER_ID = s.USER_ID
+			WHERE s.USER_ID = ? AND t.STATUS = 'active' AND (t.OWNER_ID = s.USER_ID OR sh.USER_ID IS NOT NULL)
+			UNION ALL
+			SELECT 'folder', t.FOLDER_ID, t.FOLDER_NAME, 0, '', t.modified_at, t.PARENT_ID,
+				IF(t.OWNER_ID = s.USER_ID, '', u.USERNAME), COALESCE(sh.PERMISSION, ''), s.created_at
+			FROM STARRED_FOLDER s JOIN FOLDER_LIST t ON t.FOLDER_ID = s.FOLDER_ID JOIN USERS u ON u.USER_ID = t.OWNER_ID
+			LEFT JOIN SHARED_FOLDER sh ON sh.FOLDER_ID = t.FOLDER_ID AND sh.USER_ID = s.USER_ID
+			WHERE s.USER_ID = ? AND t.STATUS = 'active' AND (t.OWNER_ID = s.USER_ID OR sh.USER_ID IS NOT NULL)
+		) r ORDER BY r.STARRED_AT DESC, r.KIND DESC, r.ID
+	`, userID, userID)
+	if err != nil {
+		log.Printf("Error fetching starred items: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch starred items"})
+		return
+	}
+	defer rows.Close()
+
+	items := []StarredItem{}
+	for rows.Next() {
+		var item StarredItem
+		if item.SearchResult, err = scanListedItem(rows, &item.StarredAt); err != nil {
+			log.Printf("Error scanning starred item: %v", err)
+			continue
+		}
+		items = append(items, item)
+	}
+
+	refs := itemRefs(items)
+	if err := attachPaths(h.db, refs); err != nil {
+		log.Printf("Error fetching paths of starred items: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch starred items"})
+		return
+	}
+	h.attachTags(refs)
+
+	c.JSON(http.StatusOK, gin.H{"items": items})
+}
@@ -0,0 +1,669 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits on tags and metadata
+const (
+	maxTagLength       = 64
+	maxMetaKeyLength   = 64
+	maxMetaValueLength = 4096
+	// Tags or metadata entries a single request may set
+	maxLabelsPerRequest = 100
+	// Items a bulk tagging request may name
+	maxBulkTagItems = 1000
+)
+
+// errLabelsReadOnly is returned when a user an item is shared with tries to change its labels
+var errLabelsReadOnly = errors.New("only the owner can change tags and metadata")
+
+// labelTarget is the file or folder a tag, metadata or star route addresses, with the column
+// that names it in the tables of those labels
+type labelTarget struct {
+	id       interface{}
+	column   string
+	tags     string
+	metadata string
+	stars    string
+}
+
+func fileLabels(fileID int64) *labelTarget {
+	return &labelTarget{id: fileID, column: "FILE_ID", tags: "FILE_TAGS", metadata: "FILE_METADATA", stars: "STARRED_FILE"}
+}
+
+func folderLabels(folderID string) *labelTarget {
+	return &labelTarget{id: folderID, column: "FOLDER_ID", tags: "FOLDER_TAGS", metadata: "FOLDER_METADATA", stars: "STARRED_FOLDER"}
+}
+
+// normalizeTag trims and lowercases a tag, so "Final" and "final " are the same tag
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+		return "", fmt.Errorf("tags must be 1 to %d characters", maxTagLength)
+	}
+	if strings.IndexFunc(tag, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("invalid tag %q", tag)
+	}
+	return tag, nil
+}
+
+// normalizeTags normalizes a list of tags, dropping repeats
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) > maxLabelsPerRequest {
+		return nil, fmt.Errorf("at most %d tags can be given at once", maxLabelsPerRequest)
+	}
+	seen := make(map[string]bool, len(tags))
+	out := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			out = append(out, tag)
+		}
+	}
+	return out, nil
+}
+
+// normalizeMetaKey lowercases a metadata key, which may only use letters, digits, '-', '_' and '.'
+func normalizeMetaKey(key string) (string, error) {
+	key = strings.ToLower(strings.TrimSpace(key))
+	invalid := func(r rune) bool {
+		return r != '-' && r != '_' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+	if key == "" || utf8.RuneCountInString(key) > maxMetaKeyLength || strings.IndexFunc(key, invalid) >= 0 {
+		return "", fmt.Errorf("metadata keys must be 1 to %d letters, digits, '-', '_' or '.'", maxMetaKeyLength)
+	}
+	return key, nil
+}
+
+// checkMetaValue checks that a metadata value isn't too long
+func checkMetaValue(key, value string) error {
+	if utf8.RuneCountInString(value) > maxMetaValueLength {
+		return fmt.Errorf("the value of %q is longer than %d characters", key, maxMetaValueLength)
+	}
+	return nil
+}
+
+// labelTargetByID resolves the item a tag, metadata or star route addresses. Its owner may read and
+// change its labels in any status; users it is shared with may read them while it is active.
+func labelTargetByID(c *gin.Context, q queryer, userID int, write bool) (*labelTarget, error) {
+	var target *labelTarget
+	var ownerID int
+	var shared bool
+	var err error
+	if fileID := c.Param("fileId"); fileID != "" {
+		id, perr := strconv.ParseInt(fileID, 10, 64)
+		if perr != nil {
+			return nil, sql.ErrNoRows
+		}
+		target = fileLabels(id)
+		err = q.QueryRow(`
+			SELECT f.OWNER_ID, COALESCE(f.STATUS, '') = 'active'
+				AND EXISTS (SELECT 1 FROM SHARED_FILE s WHERE s.FILE_ID = f.FILE_ID AND s.USER_ID = ?)
+			FROM FILE_LIST f WHERE f.FILE_ID = ?`, userID, id).Scan(&ownerID, &shared)
+	} else {
+		target = folderLabels(c.Param("folderId"))
+		err = q.QueryRow(`
+			SELECT f.OWNER_ID, COALESCE(f.STATUS, '') = 'active'
+				AND EXISTS (SELECT 1 FROM SHARED_FOLDER s WHERE s.FOLDER_ID = f.FOLDER_ID AND s.USER_ID = ?)
+			FROM FOLDER_LIST f WHERE f.FOLDER_ID = ?`, userID, target.id).Scan(&ownerID, &shared)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case ownerID == userID:
+		return target, nil
+	case !shared:
+		return nil, sql.ErrNoRows
+	case write:
+		return nil, errLabelsReadOnly
+	}
+	return target, nil
+}
+
+// labelTargetFor resolves the item of a tag, metadata or star route for the caller, answering
+// the request itself if that fails
+func (h *FileHandler) labelTargetFor(c *gin.Context, write bool) (*labelTarget, int, bool) {
+	userID, _, ok := h.v2User(c)
+	if !ok {
+		return nil, 0, false
+	}
+	target, err := labelTargetByID(c, h.db, userID, write)
+	switch {
+	case errors.Is(err, errLabelsReadOnly):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can change tags and metadata"})
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+	case err != nil:
+		log.Printf("Error resolving item for labels: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+	return target, userID, err == nil
+}
+
+// tagsOf returns an item's tags in alphabetical order
+func tagsOf(db *sql.DB, target *labelTarget) ([]string, error) {
+	rows, err := db.Query("SELECT TAG FROM "+target.tags+" WHERE "+target.column+" = ? ORDER BY TAG", target.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// metadataOf returns an item's metadata
+func metadataOf(db *sql.DB, target *labelTarget) (map[string]string, error) {
+	rows, err := db.Query("SELECT META_KEY, META_VALUE FROM "+target.metadata+" WHERE "+target.column+" = ?", target.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	metadata := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		metadata[key] = value
+	}
+	return metadata, rows.Err()
+}
+
+// respondTags answers with an item's current tags
+func (h *FileHandler) respondTags(c *gin.Context, target *labelTarget) {
+	tags, err := tagsOf(h.db, target)
+	if err != nil {
+		log.Printf("Error fetching tags: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tags"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tags": tags})
+}
+
+// respondMetadata answers with an item's current metadata
+func (h *FileHandler) respondMetadata(c *gin.Context, target *labelTarget) {
+	metadata, err := metadataOf(h.db, target)
+	if err != nil {
+		log.Printf("Error fetching metadata: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch metadata"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"metadata": metadata})
+}
+
+// attachTags fills in the tags of listed items. Files and folders are told apart by IsDir, as
+// their IDs come from different tables. A failure is only logged, leaving the items untagged.
+func (h *FileHandler) attachTags(items []*ItemInfo) {
+	files := map[string][]*ItemInfo{}
+	folders := map[string][]*ItemInfo{}
+	for _, item := range items {
+		if item.IsDir {
+			folders[item.ID] = append(folders[item.ID], item)
+		} else {
+			files[item.ID] = append(files[item.ID], item)
+		}
+	}
+
+	load := func(table, column string, byID map[string][]*ItemInfo) error {
+		if len(byID) == 0 {
+			return nil
+		}
+		ids := make([]string, 0, len(byID))
+		for id := range byID {
+			ids = append(ids, id)
+		}
+		inClause, args := buildInClause(column, ids)
+		rows, err := h.db.Query("SELECT "+column+", TAG FROM "+table+" WHERE "+inClause+" ORDER BY TAG", args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id, tag string
+			if err := rows.Scan(&id, &tag); err != nil {
+				return err
+			}
+			for _, item := range byID[id] {
+				item.Tags = append(item.Tags, tag)
+			}
+		}
+		return rows.Err()
+	}
+	if err := load("FILE_TAGS", "FILE_ID", files); err != nil {
+		log.Printf("Error fetching file tags: %v", err)
+	}
+	if err := load("FOLDER_TAGS", "FOLDER_ID", folders); err != nil {
+		log.Printf("Error fetching folder tags: %v", err)
+	}
+}
+
+// listedItem is a listed item: an ItemInfo, or a result that embeds one
+type listedItem[T any] interface {
+	*T
+	info() *ItemInfo
+}
+
+func (i *ItemInfo) info() *ItemInfo {
+	return i
+}
+
+// itemRefs returns pointers to the ItemInfo of each item of a listing, for attachPaths and attachTags
+func itemRefs[T any, P listedItem[T]](items []T) []*ItemInfo {
+	refs := make([]*ItemInfo, len(items))
+	for i := range items {
+		refs[i] = P(&items[i]).info()
+	}
+	return refs
+}
+
+// GetTags returns the tags of a file or folder the user owns or has been shared
+func (h *FileHandler) GetTags(c *gin.Context) {
+	target, _, ok := h.labelTargetFor(c, false)
+	if !ok {
+		return
+	}
+	h.respondTags(c, target)
+}
+
+// tagsPayload is the body of the routes that set or add tags
+type tagsPayload struct {
+	Tags []string `json:"tags"`
+}
+
+// setTags adds tags to an item, first removing those it has if replace is set
+func (h *FileHandler) setTags(c *gin.Context, replace bool) {
+	target, _, ok := h.labelTargetFor(c, true)
+	if !ok {
+		return
+	}
+	var payload tagsPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	tags, err := normalizeTags(payload.Tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !replace && len(tags) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No tags provided"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if replace {
+		if _, err := tx.Exec("DELETE FROM "+target.tags+" WHERE "+target.column+" = ?", target.id); err != nil {
+			log.Printf("Failed to clear tags: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tags"})
+			return
+		}
+	}
+	if len(tags) > 0 {
+		args := make([]interface{}, 0, 2*len(tags))
+		for _, tag := range tags {
+			args = append(args, target.id, tag)
+		}
+		_, err := tx.Exec("INSERT IGNORE INTO "+target.tags+" ("+target.column+", TAG) VALUES "+
+			strings.TrimSuffix(strings.Repeat("(?, ?),", len(tags)), ","), args...)
+		if err != nil {
+			log.Printf("Failed to add tags: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tags"})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tags"})
+		return
+	}
+	h.respondTags(c, target)
+}
+
+// SetTags replaces the tags of a file or folder
+func (h *FileHandler) SetTags(c *gin.Context) {
+	h.setTags(c, true)
+}
+
+// AddTags adds tags to a file or folder, keeping those it has
+func (h *FileHandler) AddTags(c *gin.Context) {
+	h.setTags(c, false)
+}
+
+// RemoveTag removes a tag from a file or folder. Removing a tag it doesn't have is not an error.
+func (h *FileHandler) RemoveTag(c *gin.Context) {
+	target, _, ok := h.labelTargetFor(c, true)
+	if !ok {
+		return
+	}
+	tag, err := normalizeTag(c.Param("tag"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := h.db.Exec("DELETE FROM "+target.tags+" WHERE "+target.column+" = ? AND TAG = ?", target.id, tag); err != nil {
+		log.Printf("Failed to remove tag: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tags"})
+		return
+	}
+	h.respondTags(c, target)
+}
+
+// GetMetadata returns the metadata of a file or folder the user owns or has been shared
+func (h *FileHandler) GetMetadata(c *gin.Context) {
+	target, _, ok := h.labelTargetFor(c, false)
+	if !ok {
+		return
+	}
+	h.respondMetadata(c, target)
+}
+
+// SetMetadata replaces all metadata of a file or folder
+func (h *FileHandler) SetMetadata(c *gin.Context) {
+	target, _, ok := h.labelTargetFor(c, true)
+	if !ok {
+		return
+	}
+	var payload struct {
+		Metadata map[string]string `json:"metadata"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	if len(payload.Metadata) > maxLabelsPerRequest {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d metadata entries can be given at once", maxLabelsPerRequest)})
+		return
+	}
+	metadata := make(map[string]string, len(payload.Metadata))
+	for key, value := range payload.Metadata {
+		key, err := normalizeMetaKey(key)
+		if err == nil {
+			err = checkMetaValue(key, value)
+		}
+		if err == nil {
+			if _, repeated := metadata[key]; repeated {
+				err = fmt.Errorf("metadata key %q is given twice", key)
+			}
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		metadata[key] = value
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM "+target.metadata+" WHERE "+target.column+" = ?", target.id); err != nil {
+		log.Printf("Failed to clear metadata: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update metadata"})
+		return
+	}
+	if len(metadata) > 0 {
+		args := make([]interface{}, 0, 3*len(metadata))
+		for key, value := range metadata {
+			args = append(args, target.id, key, value)
+		}
+		_, err := tx.Exec("INSERT INTO "+target.metadata+" ("+target.column+", META_KEY, META_VALUE) VALUES "+
+			strings.TrimSuffix(strings.Repeat("(?, ?, ?),", len(metadata)), ","), args...)
+		if err != nil {
+			log.Printf("Failed to set metadata: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update metadata"})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update metadata"})
+		return
+	}
+	h.respondMetadata(c, target)
+}
+
+// SetMetadataValue sets one metadata entry of a file or folder
+func (h *FileHandler) SetMetadataValue(c *gin.Context) {
+	target, _, ok := h.labelTargetFor(c, true)
+	if !ok {
+		return
+	}
+	key, err := normalizeMetaKey(c.Param("key"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var payload struct {
+		Value *string `json:"value"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Value == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A value is required"})
+		return
+	}
+	if err := checkMetaValue(key, *payload.Value); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	_, err = h.db.Exec("INSERT INTO "+target.metadata+" ("+target.column+", META_KEY, META_VALUE) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE META_VALUE = VALUES(META_VALUE)",
+		target.id, key, *payload.Value)
+	if err != nil {
+		log.Printf("Failed to set metadata: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update metadata"})
+		return
+	}
+	h.respondMetadata(c, target)
+}
+
+// DeleteMetadataValue removes one metadata entry of a file or folder. Removing an entry it
+// doesn't have is not an error.
+func (h *FileHandler) DeleteMetadataValue(c *gin.Context) {
+	target, _, ok := h.labelTargetFor(c, true)
+	if !ok {
+		return
+	}
+	key, err := normalizeMetaKey(c.Param("key"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := h.db.Exec("DELETE FROM "+target.metadata+" WHERE "+target.column+" = ? AND META_KEY = ?", target.id, key); err != nil {
+		log.Printf("Failed to remove metadata: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update metadata"})
+		return
+	}
+	h.respondMetadata(c, target)
+}
+
+// BulkTags adds and removes tags on many of the user's files and folders at once. Every item
+// has to be the user's own, or nothing is changed.
+func (h *FileHandler) BulkTags(c *gin.Context) {
+	userID, _, ok := h.v2User(c)
+	if !ok {
+		return
+	}
+	var payload struct {
+		FileIDs   []int64  `json:"fileIds"`
+		FolderIDs []string `json:"folderIds"`
+		Add       []string `json:"add"`
+		Remove    []string `json:"remove"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	fileIDs := make([]string, 0, len(payload.FileIDs))
+	seenFiles := map[int64]bool{}
+	for _, id := range payload.FileIDs {
+		if !seenFiles[id] {
+			seenFiles[id] = true
+			fileIDs = append(fileIDs, strconv.FormatInt(id, 10))
+		}
+	}
+	folderIDs := make([]string, 0, len(payload.FolderIDs))
+	seenFolders := map[string]bool{}
+	for _, id := range payload.FolderIDs {
+		if !seenFolders[id] {
+			seenFolders[id] = true
+			folderIDs = append(folderIDs, id)
+		}
+	}
+	switch {
+	case len(fileIDs) == 0 && len(folderIDs) == 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No item IDs provided"})
+		return
+	case len(fileIDs)+len(folderIDs) > maxBulkTagItems:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d items can be tagged at once", maxBulkTagItems)})
+		return
+	}
+
+	add, err := normalizeTags(payload.Add)
+	var remove []string
+	if err == nil {
+		remove, err = normalizeTags(payload.Remove)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No tags provided"})
+		return
+	}
+	for _, tag := range add {
+		for _, other := range remove {
+			if tag == other {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("tag %q is both added and removed", tag)})
+				return
+			}
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// One statement per table adds every tag to every item, and one removes them
+	tagsTable := "SELECT ? AS TAG" + strings.Repeat(" UNION ALL SELECT ?", max(len(add)-1, 0))
+	addArgs := make([]interface{}, len(add))
+	for i, tag := range add {
+		addArgs[i] = tag
+	}
+	removeClause, removeArgs := buildInClause("g.TAG", remove)
+
+	apply := func(items []string, list, tags, column string) error {
+		if len(items) == 0 {
+			return nil
+		}
+		inClause, idArgs := buildInClause("t."+column, items)
+		var owned int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM "+list+" t WHERE t.OWNER_ID = ? AND "+inClause,
+			append([]interface{}{userID}, idArgs...)...).Scan(&owned); err != nil {
+			return err
+		}
+		if owned != len(items) {
+			return sql.ErrNoRows
+		}
+		if len(add) > 0 {
+			args := append(append(append([]interface{}{}, addArgs...), userID), idArgs...)
+			if _, err := tx.Exec("INSERT IGNORE INTO "+tags+" ("+column+", TAG) SELECT t."+column+", n.TAG FROM "+list+" t JOIN ("+tagsTable+") n WHERE t.OWNER_ID = ? AND "+inClause, args...); err != nil {
+				return err
+			}
+		}
+		if len(remove) > 0 {
+			args := append(append([]interface{}{userID}, idArgs...), removeArgs...)
+			if _, err := tx.Exec("DELETE g FROM "+tags+" g JOIN "+list+" t ON t."+column+" = g."+column+" WHERE t.OWNER_ID = ? AND "+inClause+" AND "+removeClause, args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = apply(fileIDs, "FILE_LIST", "FILE_TAGS", "FILE_ID")
+	if err == nil {
+		err = apply(folderIDs, "FOLDER_LIST", "FOLDER_TAGS", "FOLDER_ID")
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to update tags in bulk: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tags"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tags"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Tags updated", "items": len(fileIDs) + len(folderIDs)})
+}
+
+// tagCount is a tag with the number of the user's active items that carry it
+type tagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// ListTags lists the tags on the user's active files and folders, with how many carry each
+func (h *FileHandler) ListTags(c *gin.Context) {
+	userID, _, ok := h.v2User(c)
+	if !ok {
+		return
+	}
+	rows, err := h.db.Query(`
+		SELECT TAG, COUNT(*) FROM (
+			SELECT g.TAG FROM FILE_TAGS g JOIN FILE_LIST t ON t.FILE_ID = g.FILE_ID WHERE t.OWNER_ID = ? AND t.STATUS = 'active'
+			UNION ALL
+			SELECT g.TAG FROM FOLDER_TAGS g JOIN FOLDER_LIST t ON t.FOLDER_ID = g.FOLDER_ID WHERE t.OWNER_ID = ? AND t.STATUS = 'active'
+		) tagged GROUP BY TAG ORDER BY TAG
+	`, userID, userID)
+	if err != nil {
+		log.Printf("Error fetching tags: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tags"})
+		return
+	}
+	defer rows.Close()
+	tags := []tagCount{}
+	for rows.Next() {
+		var t tagCount
+		if err := rows.Scan(&t.Tag, &t.Count); err != nil {
+			continue
+		}
+		tags = append(tags, t)
+	}
+	c.JSON(http.StatusOK, gin.H{"tags": tags})
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"my-cloud-project/backend/middleware"
+	"my-cloud-project/backend/storage"
+	"my-cloud-project/backend/utils"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+var (
+	errUploadUnauthorized = tusd.NewError("ERR_UNAUTHORIZED", "a valid authorization token is required to upload", http.StatusUnauthorized)
+	errUploadLengthNeeded = tusd.NewError("ERR_UPLOAD_LENGTH_REQUIRED", "Upload-Length must be known when the upload is created", http.StatusBadRequest)
+	errUploadCheckFailed  = tusd.NewError("ERR_UPLOAD_CHECK_FAILED", "could not verify upload limits, please try again", http.StatusInternalServerError)
+)
+
+var (
+	errInvalidUploadID = errors.New("invalid upload ID")
+	uploadIDPattern    = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// readTusUpload loads the metadata tus stored for an upload and returns it with the path of its data
+func readTusUpload(uploadID string) (TusInfo, string, error) {
+	var tusInfo TusInfo
+	if !uploadIDPattern.MatchString(uploadID) {
+		return tusInfo, "", errInvalidUploadID
+	}
+
+	baseUploadPath, _ := utils.GetBaseUploadPath()
+	sourceFile := filepath.Join(baseUploadPath, uploadID)
+	infoData, err := os.ReadFile(sourceFile + ".info")
+	if err != nil {
+		return tusInfo, "", err
+	}
+	if err := json.Unmarshal(infoData, &tusInfo); err != nil {
+		return tusInfo, "", err
+	}
+	// tus does not rewrite the info file as chunks arrive, so the offset is the size of the data
+	stat, err := os.Stat(sourceFile)
+	if err != nil {
+		return tusInfo, "", err
+	}
+	tusInfo.Offset = stat.Size()
+	return tusInfo, sourceFile, nil
+}
+
+// removeTusUpload deletes an upload's data and metadata from the upload directory
+func removeTusUpload(uploadID string) {
+	if !uploadIDPattern.MatchString(uploadID) {
+		return
+	}
+	baseUploadPath, _ := utils.GetBaseUploadPath()
+	sourceFile := filepath.Join(baseUploadPath, uploadID)
+	os.Remove(sourceFile)
+	os.Remove(sourceFile + ".info")
+}
+
+// uploadUser resolves the user a tus request is made by from its bearer token
+func (h *FileHandler) uploadUser(req tusd.HTTPRequest) (string, int, error) {
+	uri, err := url.ParseRequestURI(req.URI)
+	if err != nil {
+		return "", 0, errUploadUnauthorized
+	}
+	username, err := middleware.ParseToken(middleware.TokenFromRequest(req.Header, uri.Query()))
+	if err != nil {
+		return "", 0, errUploadUnauthorized
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		return "", 0, errUploadUnauthorized
+	}
+	return username, userID, nil
+}
+
+// quotaOwner returns whose quota an upload is charged to. Uploads into a shared folder
+// name it in their metadata and count against the folder owner, like FinalizeSharedFolderUpload.
+func (h *FileHandler) quotaOwner(userID int, metaData tusd.MetaData) (int, error) {
+	sharedFolderID := metaData["sharedFolderId"]
+	if sharedFolderID == "" {
+		return userID, nil
+	}
+
+	var ownerID int
+	var permission string
+	err := h.db.QueryRow(`
+		SELECT fl.OWNER_ID, sf.PERMISSION
+		FROM FOLDER_LIST fl
+		JOIN SHARED_FOLDER sf ON fl.FOLDER_ID = sf.FOLDER_ID
+		WHERE sf.USER_ID = ? AND fl.FOLDER_ID = ? AND fl.STATUS = 'active'
+	`, userID, sharedFolderID).Scan(&ownerID, &permission)
+	if err != nil {
+		return 0, tusd.NewError("ERR_FOLDER_ACCESS_DENIED", "shared folder not found or access denied", http.StatusForbidden)
+	}
+	if permission != "write" {
+		return 0, tusd.NewError("ERR_FOLDER_ACCESS_DENIED", "write permission required", http.StatusForbidden)
+	}
+	return ownerID, nil
+}
+
+// checkUploadAllowed applies the admin's file size and type limits to a new upload
+func checkUploadAllowed(settings SystemSettings, fileName string, size int64) error {
+	if settings.MaxFileSize > 0 && size > settings.MaxFileSize*1024*1024 {
+		return tusd.NewError("ERR_MAX_FILE_SIZE_EXCEEDED",
+			fmt.Sprintf("file is larger than the maximum upload size of %d MB", settings.MaxFileSize), http.StatusRequestEntityTooLarge)
+	}
+
+	if len(settings.AllowedFileTypes) == 0 {
+		return nil
+	}
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(fileName)), ".")
+	for _, allowed := range settings.AllowedFileTypes {
+		if ext != "" && ext == strings.TrimPrefix(strings.ToLower(allowed), ".") {
+			return nil
+		}
+	}
+	return tusd.NewError("ERR_FILE_TYPE_NOT_ALLOWED",
+		fmt.Sprintf("file type is not allowed, allowed types are: %s", strings.Join(settings.AllowedFileTypes, ", ")), http.StatusUnsupportedMediaType)
+}
+
+// PreUploadCreate runs before tus creates an upload, so oversized or disallowed
+// files are rejected before any of their bytes are written
+func (h *FileHandler) PreUploadCreate(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+	var changes tusd.FileInfoChanges
+
+	username, userID, err := h.uploadUser(hook.HTTPRequest)
+	if err != nil {
+		return tusd.HTTPResponse{}, changes, err
+	}
+
+	// Record who owns the upload, overwriting anything the client sent under the same key
+	changes.MetaData = tusd.MetaData{}
+	for key, value := range hook.Upload.MetaData {
+		changes.MetaData[key] = value
+	}
+	changes.MetaData["ownerId"] = strconv.Itoa(userID)
+
+	if hook.Upload.SizeIsDeferred {
+		return tusd.HTTPResponse{}, changes, errUploadLengthNeeded
+	}
+
+	settings, err := loadSettings(h.db)
+	if err != nil {
+		log.Printf("Failed to load settings for upload check: %v", err)
+		return tusd.HTTPResponse{}, changes, errUploadCheckFailed
+	}
+	if hook.Upload.IsPartial {
+		// Parts of a concatenated upload carry no file name, its type is checked on the final upload
+		settings.System.AllowedFileTypes = nil
+	}
+	if err := checkUploadAllowed(settings.System, hook.Upload.MetaData["filename"], hook.Upload.Size); err != nil {
+		return tusd.HTTPResponse{}, changes, err
+	}
+
+	// A final upload may only stitch together parts its creator uploaded
+	for _, partialID := range hook.Upload.PartialUploads {
+		partial, _, err := readTusUpload(partialID)
+		if err != nil || !partial.IsPartial || partial.MetaData.OwnerID != strconv.Itoa(userID) {
+			return tusd.HTTPResponse{}, changes, tusd.NewError("ERR_PARTIAL_UPLOAD_INVALID", "partial upload not found", http.StatusBadRequest)
+		}
+	}
+
+	if _, err := parseConflict(hook.Upload.MetaData["conflict"], conflictKeepBoth); err != nil {
+		return tusd.HTTPResponse{}, changes, tusd.NewError("ERR_INVALID_CONFLICT", err.Error(), http.StatusBadRequest)
+	}
+
+	if dest := hook.Upload.MetaData["destinationPath"]; dest != "" {
+		if _, err := storage.UserKey(username, dest); err != nil {
+			return tusd.HTTPResponse{}, changes, tusd.NewError("ERR_INVALID_DESTINATION", "invalid destination path", http.StatusBadRequest)
+		}
+	}
+
+	ownerID, err := h.quotaOwner(userID, hook.Upload.MetaData)
+	if err != nil {
+		return tusd.HTTPResponse{}, changes, err
+	}
+	if err := h.checkQuotaLimit(ownerID, hook.Upload.Size); err != nil {
+		return tusd.HTTPResponse{}, changes, tusd.NewError("ERR_QUOTA_EXCEEDED", err.Error(), http.StatusRequestEntityTooLarge)
+	}
+
+	return tusd.HTTPResponse{}, changes, nil
+}
+
+// UploadOwnerMiddleware lets only the user who created a tus upload resume, inspect or terminate it
+func (h *FileHandler) UploadOwnerMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uploadID := strings.Trim(c.Param("path"), "/")
+		if c.Request.Method == http.MethodPost || c.Request.Method == http.MethodOptions || uploadID == "" {
+			c.Next()
+			return
+		}
+
+		username, ok := getUsername(c)
+		if !ok {
+			c.Abort()
+			return
+		}
+		userID, err := h.getUserId(username)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			return
+		}
+
+		tusInfo, _, err := readTusUpload(uploadID)
+		if errors.Is(err, errInvalidUploadID) || errors.Is(err, os.ErrNotExist) {
+			// Let tus answer for uploads that do not exist
+			c.Next()
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read upload %s: %v", uploadID, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Could not read upload metadata"})
+			return
+		}
+		if tusInfo.MetaData.OwnerID != strconv.Itoa(userID) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Upload belongs to another user"})
+			return
+		}
+		c.Next()
+	}
+}
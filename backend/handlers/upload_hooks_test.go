@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+func TestCheckUploadAllowed(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		name       string
+		settings   SystemSettings
+		fileName   string
+		size       int64
+		wantStatus int // 0 when the upload is allowed
+	}{
+		{"no limits", SystemSettings{}, "a.bin", 10 * mb, 0},
+		{"at the size limit", SystemSettings{MaxFileSize: 5}, "a.txt", 5 * mb, 0},
+		{"over the size limit", SystemSettings{MaxFileSize: 5}, "a.txt", 5*mb + 1, http.StatusRequestEntityTooLarge},
+		{"allowed type", SystemSettings{AllowedFileTypes: []string{"txt", "pdf"}}, "a.pdf", 1, 0},
+		{"allowed type any case and dot", SystemSettings{AllowedFileTypes: []string{".PDF"}}, "A.Pdf", 1, 0},
+		{"type not allowed", SystemSettings{AllowedFileTypes: []string{"txt"}}, "a.exe", 1, http.StatusUnsupportedMediaType},
+		{"no extension", SystemSettings{AllowedFileTypes: []string{"txt"}}, "README", 1, http.StatusUnsupportedMediaType},
+		{"only the last extension counts", SystemSettings{AllowedFileTypes: []string{"txt"}}, "a.txt.exe", 1, http.StatusUnsupportedMediaType},
+		{"size checked before type", SystemSettings{MaxFileSize: 1, AllowedFileTypes: []string{"txt"}}, "a.exe", 2 * mb, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		err := checkUploadAllowed(tt.settings, tt.fileName, tt.size)
+		if tt.wantStatus == 0 {
+			if err != nil {
+				t.Errorf("%s: checkUploadAllowed = %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		var te tusd.Error
+		if !errors.As(err, &te) {
+			t.Errorf("%s: checkUploadAllowed = %v, want a tus error", tt.name, err)
+			continue
+		}
+		if te.HTTPResponse.StatusCode != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, te.HTTPResponse.StatusCode, tt.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package handlers
+
+import (
+	"archive/zip"
+	"database/sql"
+	"fmt"
+	"log"
+	"my-cloud-project/backend/blobs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rootFolderID names the root of a user's drive wherever the v2 API takes a folder ID
+const rootFolderID = "root"
+
+// queryer is what both *sql.DB and *sql.Tx offer for reading
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// itemV2 is a file or folder as the v2 API reports it
+type itemV2 struct {
+	ID   string `json:"id"`
+	Type string `json:"type"` // "file" or "folder"
+	Name string `json:"name"`
+	// ParentID is null for items at the root of the drive
+	ParentID *string   `json:"parentId"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size,omitempty"`
+	MimeType string    `json:"mimeType,omitempty"`
+	Version  int       `json:"version,omitempty"`
+	Status   string    `json:"status"`
+	Modified time.Time `json:"modified"`
+}
+
+// itemV2Ref is the item a v2 route addresses: a file by :fileId or a folder by :folderId
+type itemV2Ref struct {
+	namedItem
+	Status string
+}
+
+// folderPathByID returns the path of the active folder folderID of ownerID, "/" for the root
+func folderPathByID(q queryer, ownerID int, folderID string) (string, error) {
+	if folderID == "" || folderID == rootFolderID {
+		return "/", nil
+	}
+	var found int
+	err := q.QueryRow("SELECT 1 FROM FOLDER_LIST WHERE FOLDER_ID = ? AND OWNER_ID = ? AND STATUS = 'active'",
+		folderID, ownerID).Scan(&found)
+	if err != nil {
+		return "", err
+	}
+	return folderPath(q, sql.NullString{String: folderID, Valid: true})
+}
+
+// itemByID loads the file or folder of ownerID addressed by the route, in any status
+func itemByID(c *gin.Context, q queryer, ownerID int) (*itemV2Ref, error) {
+	item := &itemV2Ref{}
+	var parentID sql.NullString
+	var err error
+	if fileID := c.Param("fileId"); fileID != "" {
+		if item.FileID, err = strconv.ParseInt(fileID, 10, 64); err != nil {
+			return nil, sql.ErrNoRows
+		}
+		err = q.QueryRow("SELECT FOLDER_ID, FILE_NAME, BLOB_ID, COALESCE(STATUS, '') FROM FILE_LIST WHERE FILE_ID = ? AND OWNER_ID = ?",
+			item.FileID, ownerID).Scan(&parentID, &item.Name, &item.BlobID, &item.Status)
+	} else {
+		item.FolderID = c.Param("folderId")
+		err = q.QueryRow("SELECT PARENT_ID, FOLDER_NAME, COALESCE(STATUS, '') FROM FOLDER_LIST WHERE FOLDER_ID = ? AND OWNER_ID = ?",
+			item.FolderID, ownerID).Scan(&parentID, &item.Name, &item.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	item.Folder, err = folderPath(q, parentID)
+	return item, err
+}
+
+// describeItem reads everything the v2 API reports about an item
+func (h *FileHandler) describeItem(item *namedItem) (*itemV2, error) {
+	out := &itemV2{}
+	var parentID sql.NullString
+	if item.isFolder() {
+		out.ID, out.Type = item.FolderID, "folder"
+		err := h.db.QueryRow("SELECT PARENT_ID, FOLDER_NAME, COALESCE(STATUS, ''), modified_at FROM FOLDER_LIST WHERE FOLDER_ID = ?", item.FolderID).
+			Scan(&parentID, &out.Name, &out.Status, &out.Modified)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var fileType sql.NullString
+		out.ID, out.Type = strconv.FormatInt(item.FileID, 10), "file"
+		err := h.db.QueryRow("SELECT FOLDER_ID, FILE_NAME, COALESCE(FILE_SIZE, 0), FILE_TYPE, VERSION_NO, COALESCE(STATUS, ''), modified_at FROM FILE_LIST WHERE FILE_ID = ?", item.FileID).
+			Scan(&parentID, &out.Name, &out.Size, &fileType, &out.Version, &out.Status, &out.Modified)
+		if err != nil {
+			return nil, err
+		}
+		out.MimeType = fileType.String
+	}
+	var err error
+	if item.Folder, err = folderPath(h.db, parentID); err != nil {
+		return nil, err
+	}
+	out.Path = path.Join(item.Folder, out.Name)
+	if parentID.Valid {
+		out.ParentID = &parentID.String
+	}
+	return out, nil
+}
+
+// v2User resolves the caller of a v2 route, answering the request itself if that fails
+func (h *FileHandler) v2User(c *gin.Context) (int, string, bool) {
+	username, ok := getUsername(c)
+	if !ok {
+		return 0, "", false
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return 0, "", false
+	}
+	return userID, username, true
+}
+
+// respondItem answers with the current state of an item
+func (h *FileHandler) respondItem(c *gin.Context, status int, item *namedItem) {
+	out, err := h.describeItem(item)
+	if err != nil {
+		log.Printf("Failed to describe item: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read item"})
+		return
+	}
+	c.JSON(status, out)
+}
+
+// GetItemV2 returns a file or folder by its ID
+func (h *FileHandler) GetItemV2(c *gin.Context) {
+	userID, _, ok := h.v2User(c)
+	if !ok {
+		return
+	}
+	item, err := itemByID(c, h.db, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	h.respondItem(c, http.StatusOK, &item.namedItem)
+}
+
+// ListChildrenV2 lists the active folders and files directly in a folder, folders first.
+// The folder ID "root" lists the top of the drive.
+func (h *FileHandler) ListChildrenV2(c *gin.Context) {
+	userID, _, ok := h.v2User(c)
+	if !ok {
+		return
+	}
+	folderID := c.Param("folderId")
+	folderPath, err := folderPathByID(h.db, userID, folderID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return
+	}
+	var parentID *string
+	var parent sql.NullString
+	if folderID != rootFolderID {
+		parentID = &folderID
+		parent = sql.NullString{String: folderID, Valid: true}
+	}
+
+	items := []itemV2{}
+	folderRows, err := h.db.Query("SELECT FOLDER_ID, FOLDER_NAME, modified_at FROM FOLDER_LIST WHERE OWNER_ID = ? AND PARENT_ID <=> ? AND STATUS = 'active'", userID, parent)
+	if err != nil {
+		log.Printf("Error fetching folders: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch folders"})
+		return
+	}
+	defer folderRows.Close()
+	for folderRows.Next() {
+		item := itemV2{Type: "folder", ParentID: parentID, Status: "active"}
+		if err := folderRows.Scan(&item.ID, &item.Name, &item.Modified); err != nil {
+			continue
+		}
+		item.Path = path.Join(folderPath, item.Name)
+		items = append(items, item)
+	}
+
+	fileRows, err := h.db.Query("SELECT FILE_ID, FILE_NAME, COALESCE(FILE_SIZE, 0), FILE_TYPE, VERSION_NO, modified_at FROM FILE_LIST WHERE OWNER_ID = ? AND FOLDER_ID <=> ? AND STATUS = 'active'", userID, parent)
+	if err != nil {
+		log.Printf("Error fetching files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+		return
+	}
+	defer fileRows.Close()
+	for fileRows.Next() {
+		var fileID int64
+		var fileType sql.NullString
+		item := itemV2{Type: "file", ParentID: parentID, Status: "active"}
+		if err := fileRows.Scan(&fileID, &item.Name, &item.Size, &fileType, &item.Version, &item.Modified); err != nil {
+			continue
+		}
+		item.ID = strconv.FormatInt(fileID, 10)
+		item.MimeType = fileType.String
+		item.Path = path.Join(folderPath, item.Name)
+		items = append(items, item)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].Type != items[j].Type {
+			return items[i].Type == "folder"
+		}
+		return strings.ToLower(items[i].Name) < strings.ToLower(items[j].Name)
+	})
+	c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+// relocateItem moves or renames the item a v2 route addresses and answers with its new state
+func (h *FileHandler) relocateItem(c *gin.Context, userID int, username string, destFolderID, newName, defaultConflict, conflictOption string) {
+	conflict, err := parseConflict(conflictOption, defaultConflict)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	item, err := itemByID(c, tx, userID)
+	if err != nil || item.Status != "active" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	destFolder := item.Folder
+	if destFolderID != "" {
+		destFolder, err = folderPathByID(tx, userID, destFolderID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Destination folder not found"})
+			return
+		}
+	}
+	if newName == "" {
+		newName = item.Name
+	}
+	if destFolder == item.Folder && newName == item.Name {
+		h.respondItem(c, http.StatusOK, &item.namedItem)
+		return
+	}
+
+	var cleanup moveCleanup
+	finalName, err := h.moveItem(c.Request.Context(), tx, userID, username, &item.namedItem, destFolder, newName, conflict, &cleanup)
+	if err != nil {
+		respondMoveError(c, err, newName)
+		return
+	}
+	// With keepBoth the item may have gone into the one it met, which is then what the caller gets
+	moved, err := activeItem(tx, userID, destFolder, finalName)
+	if err != nil || moved == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move item"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	h.finishMove(c.Request.Context(), userID, &cleanup)
+	h.respondItem(c, http.StatusOK, moved)
+}
+
+// MoveItemV2 moves a file or folder into the folder parentId, "root" being the top of the drive
+func (h *FileHandler) MoveItemV2(c *gin.Context) {
+	userID, username, ok := h.v2User(c)
+	if !ok {
+		return
+	}
+	var payload struct {
+		ParentID string `json:"parentId"`
+		Conflict string `json:"conflict"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.ParentID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A parentId is required"})
+		return
+	}
+	h.relocateItem(c, userID, username, payload.ParentID, "", conflictFail, payload.Conflict)
+}
+
+// RenameItemV2 gives a file or folder a new name in the folder it is in
+func (h *FileHandler) RenameItemV2(c *gin.Context) {
+	userID, username, ok := h.v2User(c)
+	if !ok {
+		return
+	}
+	var payload struct {
+		Name     string `json:"name"`
+		Conflict string `json:"conflict"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil || !validFileName(payload.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name"})
+		return
+	}
+	h.relocateItem(c, userID, username, "", payload.Name, conflictFail, payload.Conflict)
+}
+
+// DeleteItemV2 moves a file or folder to the trash. With ?permanent=true an item already in
+// the trash is deleted for good instead.
+func (h *FileHandler) DeleteItemV2(c *gin.Context) {
+	userID, username, ok := h.v2User(c)
+	if !ok {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	item, err := itemByID(c, tx, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	if c.Query("permanent") != "true" {
+		if item.Status != "active" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Item is not active"})
+			return
+		}
+		if err := trashItem(tx, &item.namedItem); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move item to trash"})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move item to trash"})
+			return
+		}
+		h.respondItem(c, http.StatusOK, &item.namedItem)
+		return
+	}
+
+	if item.Status != "trashed" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only items in the trash can be deleted permanently"})
+		return
+	}
+	var staleKeys []string
+	if item.isFolder() {
+		staleKeys, err = h.deleteFolderRecursive(tx, userID, username, item.FolderID, item.path())
+	} else {
+		var fileSize int64
+		if err = tx.QueryRow("SELECT COALESCE(FILE_SIZE, 0) FROM FILE_LIST WHERE FILE_ID = ?", item.FileID).Scan(&fileSize); err == nil {
+			staleKeys, err = h.purgeFile(tx, userID, username, item.FileID, item.Folder, fileSize, item.BlobID)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to permanently delete %s: %v", item.path(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete item"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit delete"})
+		return
+	}
+	h.removeStored(c.Request.Context(), staleKeys)
+	c.Status(http.StatusNoContent)
+}
+
+// RestoreItemV2 brings a file or folder back from the trash to where it was. The optional
+// conflict option, "fail" or "rename", settles a name that has been taken since.
+func (h *FileHandler) RestoreItemV2(c *gin.Context) {
+	userID, username, ok := h.v2User(c)
+	if !ok {
+		return
+	}
+	var payload struct {
+		Conflict string `json:"conflict"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+	conflict, err := parseRestoreConflict(payload.Conflict)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	item, err := itemByID(c, tx, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	if item.Status != "trashed" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Item is not in the trash"})
+		return
+	}
+
+	_, err = h.restoreItem(c.Request.Context(), tx, userID, username, &item.namedItem, conflict)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondRestoreError(c, err)
+		return
+	}
+	h.respondItem(c, http.StatusOK, &item.namedItem)
+}
+
+// DownloadItemV2 sends a file, or a folder as a zip archive
+func (h *FileHandler) DownloadItemV2(c *gin.Context) {
+	userID, username, ok := h.v2User(c)
+	if !ok {
+		return
+	}
+	item, err := itemByID(c, h.db, userID)
+	if err != nil || item.Status != "active" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	if item.isFolder() {
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", item.Name))
+		zipWriter := zip.NewWriter(c.Writer)
+		defer zipWriter.Close()
+		if err := h.addPathToZipDB(c.Request.Context(), zipWriter, userID, username, item.path()); err != nil {
+			log.Printf("[ERROR] DownloadItemV2: Error during zipping for %s: %v", item.path(), err)
+		}
+		return
+	}
+
+	var fileType sql.NullString
+	var blobKey sql.NullString
+	ref := blobs.Ref{OwnerID: userID}
+	err = h.db.QueryRow(`
+		SELECT f.FILE_TYPE, COALESCE(f.FILE_SIZE, 0), b.STORAGE_KEY, COALESCE(b.ENCRYPTED, 0), COALESCE(b.CODEC, 'none')
+		FROM FILE_LIST f LEFT JOIN BLOB_LIST b ON f.BLOB_ID = b.BLOB_ID
+		WHERE f.FILE_ID = ?
+	`, item.FileID).Scan(&fileType, &ref.Size, &blobKey, &ref.Encrypted, &ref.Codec)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found in database"})
+		return
+	}
+	ref.Key, err = storedFileKey(username, item.Folder, item.FileID, blobKey)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file path"})
+		return
+	}
+	h.serveStoredFile(c, ref, item.Name, fileType.String)
+	h.recordDownload(c, userID, item.FileID)
+}
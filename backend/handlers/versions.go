@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"my-cloud-project/backend/blobs"
+	"my-cloud-project/backend/fulltext"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fileVersion is an older version of a file kept in FILE_VERSIONS
+type fileVersion struct {
+	VersionID int64     `json:"-"`
+	VersionNo int       `json:"version"`
+	BlobID    int64     `json:"-"`
+	FileType  string    `json:"fileType"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+	Current   bool      `json:"current"`
+}
+
+// addVersion keeps a file's current contents as a version and makes the given blob current.
+// The blob reference moves along with the contents, so only the new blob needs acquiring.
+func (h *FileHandler) addVersion(tx *sql.Tx, fileID, blobID, size int64, fileType string) (int, error) {
+	_, err := tx.Exec(`
+		INSERT INTO FILE_VERSIONS (FILE_ID, VERSION_NO, BLOB_ID, FILE_TYPE, FILE_SIZE, created_at)
+		SELECT FILE_ID, VERSION_NO, BLOB_ID, FILE_TYPE, COALESCE(FILE_SIZE, 0), modified_at FROM FILE_LIST WHERE FILE_ID = ?
+	`, fileID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE FILE_LIST SET BLOB_ID = ?, FILE_SIZE = ?, FILE_TYPE = ?, VERSION_NO = VERSION_NO + 1 WHERE FILE_ID = ?",
+		blobID, size, fileType, fileID)
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = tx.QueryRow("SELECT VERSION_NO FROM FILE_LIST WHERE FILE_ID = ?", fileID).Scan(&version)
+	return version, err
+}
+
+// undoVersion removes a committed version whose contents could not be stored. If it is still
+// the current one, the version before it becomes current again.
+func (h *FileHandler) undoVersion(ownerID int, fileID int64, version int, blobID, size int64) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Failed to roll back version %d of file %d: %v", version, fileID, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var current int
+	if err := tx.QueryRow("SELECT VERSION_NO FROM FILE_LIST WHERE FILE_ID = ? FOR UPDATE", fileID).Scan(&current); err != nil {
+		log.Printf("Failed to roll back version %d of file %d: %v", version, fileID, err)
+		return
+	}
+	if current == version {
+		var previous fileVersion
+		err = tx.QueryRow(`
+			SELECT VERSION_ID, VERSION_NO, BLOB_ID, COALESCE(FILE_TYPE, ''), FILE_SIZE
+			FROM FILE_VERSIONS WHERE FILE_ID = ? ORDER BY VERSION_NO DESC LIMIT 1
+		`, fileID).Scan(&previous.VersionID, &previous.VersionNo, &previous.BlobID, &previous.FileType, &previous.Size)
+		if err == nil {
+			_, err = tx.Exec("UPDATE FILE_LIST SET BLOB_ID = ?, FILE_SIZE = ?, FILE_TYPE = ?, VERSION_NO = ? WHERE FILE_ID = ?",
+				previous.BlobID, previous.Size, previous.FileType, previous.VersionNo, fileID)
+		}
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM FILE_VERSIONS WHERE VERSION_ID = ?", previous.VersionID)
+		}
+	} else {
+		// A newer upload has made it an older version meanwhile
+		_, err = tx.Exec("DELETE FROM FILE_VERSIONS WHERE FILE_ID = ? AND VERSION_NO = ?", fileID, version)
+	}
+
+	var staleKey string
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM UPLOAD_LIST WHERE FILE_ID = ? AND VERSION_NO = ?", fileID, version)
+	}
+	if err == nil {
+		staleKey, err = h.blobs.Release(tx, blobID)
+	}
+	if err == nil {
+		err = h.updateUserQuota(tx, ownerID, -size)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to roll back version %d of file %d: %v", version, fileID, err)
+		return
+	}
+	// Whatever part of the contents made it into storage goes once nothing refers to them
+	h.removeStored(context.Background(), []string{staleKey})
+}
+
+// versionRetention is how many older versions of each file ownerID keeps
+func (h *FileHandler) versionRetention(ownerID int) (int, error) {
+	var retention sql.NullInt64
+	if err := h.db.QueryRow("SELECT VERSION_RETENTION FROM USERS WHERE USER_ID = ?", ownerID).Scan(&retention); err != nil {
+		return 0, err
+	}
+	if retention.Valid {
+		return int(retention.Int64), nil
+	}
+	settings, err := loadSettings(h.db)
+	if err != nil {
+		return 0, err
+	}
+	return settings.Storage.VersionRetention, nil
+}
+
+// olderVersions lists the kept versions of a file, newest first
+func olderVersions(tx *sql.Tx, fileID int64) ([]fileVersion, error) {
+	rows, err := tx.Query(`
+		SELECT VERSION_ID, VERSION_NO, BLOB_ID, COALESCE(FILE_TYPE, ''), FILE_SIZE, created_at
+		FROM FILE_VERSIONS WHERE FILE_ID = ? ORDER BY VERSION_NO DESC
+	`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []fileVersion
+	for rows.Next() {
+		var v fileVersion
+		if err := rows.Scan(&v.VersionID, &v.VersionNo, &v.BlobID, &v.FileType, &v.Size, &v.CreatedAt); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// dropVersions deletes versions of a file owned by ownerID, releasing their blobs and quota.
+// It returns the storage keys that became unreferenced, to be deleted after commit.
+func (h *FileHandler) dropVersions(tx *sql.Tx, ownerID int, versions []fileVersion) ([]string, error) {
+	var staleKeys []string
+	for _, v := range versions {
+		if _, err := tx.Exec("DELETE FROM FILE_VERSIONS WHERE VERSION_ID = ?", v.VersionID); err != nil {
+			return nil, err
+		}
+		key, err := h.blobs.Release(tx, v.BlobID)
+		if err != nil {
+			return nil, err
+		}
+		staleKeys = append(staleKeys, key)
+		if err := h.updateUserQuota(tx, ownerID, -v.Size); err != nil {
+			return nil, err
+		}
+	}
+	return staleKeys, nil
+}
+
+// dropAllVersions deletes every older version of a file that is about to be deleted itself
+func (h *FileHandler) dropAllVersions(tx *sql.Tx, ownerID int, fileID int64) ([]string, error) {
+	versions, err := olderVersions(tx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	return h.dropVersions(tx, ownerID, versions)
+}
+
+// trimVersions keeps the newest keep older versions of a file and deletes the rest
+func (h *FileHandler) trimVersions(ctx context.Context, ownerID int, fileID int64, keep int) (int, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	versions, err := olderVersions(tx, fileID)
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) <= keep {
+		return 0, nil
+	}
+	staleKeys, err := h.dropVersions(tx, ownerID, versions[keep:])
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	h.removeStored(ctx, staleKeys)
+	return len(versions) - keep, nil
+}
+
+// pruneVersions applies the owner's retention limit after a file got a new version
+func (h *FileHandler) pruneVersions(ctx context.Context, ownerID int, fileID int64) {
+	keep, err := h.versionRetention(ownerID)
+	if err != nil {
+		log.Printf("Failed to read version retention for user %d: %v", ownerID, err)
+		return
+	}
+	if _, err := h.trimVersions(ctx, ownerID, fileID, keep); err != nil {
+		log.Printf("Failed to prune versions of file %d: %v", fileID, err)
+	}
+}
+
+// ownedFile looks up an active file of userID by the fileId URL parameter
+func (h *FileHandler) ownedFile(c *gin.Context, userID int) (int64, string, bool) {
+	fileID, err := strconv.ParseInt(c.Param("fileId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return 0, "", false
+	}
+	var fileName string
+	err = h.db.QueryRow("SELECT FILE_NAME FROM FILE_LIST WHERE FILE_ID = ? AND OWNER_ID = ? AND STATUS = 'active'", fileID, userID).Scan(&fileName)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return 0, "", false
+	}
+	return fileID, fileName, true
+}
+
+// ListVersions returns the current and kept versions of a file, newest first
+func (h *FileHandler) ListVersions(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+	fileID, fileName, ok := h.ownedFile(c, userID)
+	if !ok {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	current := fileVersion{Current: true}
+	err = tx.QueryRow("SELECT VERSION_NO, COALESCE(FILE_TYPE, ''), COALESCE(FILE_SIZE, 0), modified_at FROM FILE_LIST WHERE FILE_ID = ?", fileID).
+		Scan(&current.VersionNo, &current.FileType, &current.Size, &current.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	versions, err := olderVersions(tx, fileID)
+	if err != nil {
+		log.Printf("Failed to list versions of file %d: %v", fileID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list versions"})
+		return
+	}
+	retention, err := h.versionRetention(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read version retention"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"fileId":    fileID,
+		"fileName":  fileName,
+		"retention": retention,
+		"versions":  append([]fileVersion{current}, versions...),
+	})
+}
+
+// DownloadVersion serves one version of a file, current or older
+func (h *FileHandler) DownloadVersion(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+	fileID, fileName, ok := h.ownedFile(c, userID)
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	var fileType string
+	ref := blobs.Ref{OwnerID: userID}
+	err = h.db.QueryRow(`
+		SELECT v.FILE_TYPE, v.FILE_SIZE, b.STORAGE_KEY, b.ENCRYPTED, b.CODEC
+		FROM (
+			SELECT COALESCE(FILE_TYPE, '') AS FILE_TYPE, FILE_SIZE, BLOB_ID FROM FILE_VERSIONS WHERE FILE_ID = ? AND VERSION_NO = ?
+			UNION ALL
+			SELECT COALESCE(FILE_TYPE, ''), COALESCE(FILE_SIZE, 0), BLOB_ID FROM FILE_LIST WHERE FILE_ID = ? AND VERSION_NO = ?
+		) v JOIN BLOB_LIST b ON v.BLOB_ID = b.BLOB_ID
+	`, fileID, version, fileID, version).Scan(&fileType, &ref.Size, &ref.Key, &ref.Encrypted, &ref.Codec)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+	h.serveStoredFile(c, ref, fileName, fileType)
+}
+
+// RestoreVersion makes an older version current again. The restored contents become a new
+// version on top, so the version being replaced stays in the history.
+func (h *FileHandler) RestoreVersion(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+	fileID, _, ok := h.ownedFile(c, userID)
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database transaction could not be started"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the file so versions cannot be added underneath the restore
+	var current int
+	if err := tx.QueryRow("SELECT VERSION_NO FROM FILE_LIST WHERE FILE_ID = ? FOR UPDATE", fileID).Scan(&current); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	var size int64
+	var fileType, contentHash, codec string
+	err = tx.QueryRow(`
+		SELECT v.FILE_SIZE, COALESCE(v.FILE_TYPE, ''), b.CONTENT_HASH, b.CODEC
+		FROM FILE_VERSIONS v JOIN BLOB_LIST b ON v.BLOB_ID = b.BLOB_ID
+		WHERE v.FILE_ID = ? AND v.VERSION_NO = ?
+	`, fileID, version).Scan(&size, &fileType, &contentHash, &codec)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+
+	// The restored copy counts against quota like any new version
+	if err := h.checkQuotaLimit(userID, size); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The contents are stored already, the new version only takes another reference to them
+	blob, err := h.blobs.Acquire(tx, userID, contentHash, size, codec)
+	if err != nil {
+		log.Printf("Failed to reference version %d of file %d: %v", version, fileID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore version"})
+		return
+	}
+	newVersion, err := h.addVersion(tx, fileID, blob.ID, size, fileType)
+	if err != nil {
+		log.Printf("Failed to restore version %d of file %d: %v", version, fileID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore version"})
+		return
+	}
+	if err := h.updateUserQuota(tx, userID, size); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota usage"})
+		return
+	}
+	if err := fulltext.QueueFiles(tx, true, fileID); err != nil {
+		log.Printf("Failed to queue file %d for indexing: %v", fileID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore version"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore version"})
+		return
+	}
+
+	h.pruneVersions(c.Request.Context(), userID, fileID)
+	h.recordActivity(userID, fileID, activityModified)
+	c.JSON(http.StatusOK, gin.H{"message": "Version restored successfully", "fileId": fileID, "version": newVersion})
+}
+
+// DeleteVersion deletes a single older version of a file
+func (h *FileHandler) DeleteVersion(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+	fileID, _, ok := h.ownedFile(c, userID)
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database transaction could not be started"})
+		return
+	}
+	defer tx.Rollback()
+
+	v := fileVersion{VersionNo: version}
+	err = tx.QueryRow("SELECT VERSION_ID, BLOB_ID, FILE_SIZE FROM FILE_VERSIONS WHERE FILE_ID = ? AND VERSION_NO = ?", fileID, version).
+		Scan(&v.VersionID, &v.BlobID, &v.Size)
+	if err != nil {
+		// The current version is not in FILE_VERSIONS, so it cannot be deleted here
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+	staleKeys, err := h.dropVersions(tx, userID, []fileVersion{v})
+	if err != nil {
+		log.Printf("Failed to delete version %d of file %d: %v", version, fileID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete version"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete version"})
+		return
+	}
+	h.removeStored(c.Request.Context(), staleKeys)
+	c.JSON(http.StatusOK, gin.H{"message": "Version deleted successfully"})
+}
+
+// PruneVersions deletes older versions of a file, keeping the newest ?keep= of them (none by default)
+func (h *FileHandler) PruneVersions(c *gin.Context) {
+	username, ok := getUsername(c)
+	if !ok {
+		return
+	}
+	userID, err := h.getUserId(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+	fileID, _, ok := h.ownedFile(c, userID)
+	if !ok {
+		return
+	}
+	keep, err := strconv.Atoi(c.DefaultQuery("keep", "0"))
+	if err != nil || keep < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "keep must be a non-negative number"})
+		return
+	}
+
+	removed, err := h.trimVersions(c.Request.Context(), userID, fileID, keep)
+	if err != nil {
+		log.Printf("Failed to prune versions of file %d: %v", fileID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prune versions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Versions pruned successfully", "removed": removed})
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"log"
+	"my-cloud-project/backend/blobs"
 	"my-cloud-project/backend/database"
+	"my-cloud-project/backend/encryption"
+	"my-cloud-project/backend/fulltext"
 	"my-cloud-project/backend/handlers"
+	"my-cloud-project/backend/maintenance"
 	"my-cloud-project/backend/middleware"
+	"my-cloud-project/backend/storage"
 	"my-cloud-project/backend/utils"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/static" 
@@ -35,13 +42,40 @@ func main() {
 	}
 	defer db.Close()
 
+	if err := database.Migrate(db); err != nil {
+		log.Fatalf("Fatal: Failed to migrate database schema: %v", err)
+	}
+
+	fileStore, err := storage.NewFromEnv(context.Background(), baseUploadPath)
+	if err != nil {
+		log.Fatalf("Fatal: Failed to set up file storage: %v", err)
+	}
+
+	keyring, err := encryption.NewKeyringFromEnv(db)
+	if err != nil {
+		log.Fatalf("Fatal: Failed to load encryption keys: %v", err)
+	}
+	if keyring == nil {
+		log.Println("Warning: MASTER_KEY not set, new files will be stored unencrypted")
+	}
+
+	// QUOTA_RECONCILE_INTERVAL (e.g. "24h") turns on the scheduled job; corrections are
+	// only logged unless QUOTA_RECONCILE_APPLY=true
+	if interval := os.Getenv("QUOTA_RECONCILE_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			log.Fatalf("Fatal: Invalid QUOTA_RECONCILE_INTERVAL %q", interval)
+		}
+		maintenance.StartQuotaReconciler(context.Background(), db, d, os.Getenv("QUOTA_RECONCILE_APPLY") == "true")
+	}
+
 	router := gin.Default()
 
 	corsConfig := cors.Config{
 		// AllowOrigins:     []string{"http://localhost:8080","http://localhost:5173"},
 		AllowAllOrigins:  true,
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "HEAD", "PATCH"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", "Upload-Concat", "Upload-Checksum"},
 		ExposeHeaders:    []string{"Location", "Upload-Offset", "Upload-Length"},
 		// AllowCredentials: true,
 	}
@@ -51,21 +85,47 @@ func main() {
 	composer := tusd.NewStoreComposer()
 	store.UseIn(composer)
 
+	// FULLTEXT_INDEX_PATH is where the content search index lives; it is rebuilt from the database when missing
+	indexPath := os.Getenv("FULLTEXT_INDEX_PATH")
+	if indexPath == "" {
+		indexPath = "./search-index"
+	}
+	index, err := fulltext.Open(db, blobs.NewStore(db, fileStore, keyring), indexPath)
+	if err != nil {
+		log.Fatalf("Fatal: Failed to open full-text index: %v", err)
+	}
+	defer index.Close()
+	index.Start(context.Background())
+
+	authHandler := handlers.NewAuthHandler(db)
+	fileHandler := handlers.NewFileHandler(db, fileStore, keyring, index)
+	uploads := maintenance.NewUploads(baseUploadPath, composer)
+	adminHandler := handlers.NewAdminHandler(db, fileStore, uploads)
+
+	// Uploads nobody has touched for UPLOAD_TTL are removed, finished or not, along with stale spool files
+	uploadTTL := 24 * time.Hour
+	if ttl := os.Getenv("UPLOAD_TTL"); ttl != "" {
+		uploadTTL, err = time.ParseDuration(ttl)
+		if err != nil || uploadTTL <= 0 {
+			log.Fatalf("Fatal: Invalid UPLOAD_TTL %q", ttl)
+		}
+	}
+	uploads.StartSweeper(context.Background(), min(uploadTTL/4, time.Hour), uploadTTL)
+
 	tusdHandler, err := tusd.NewHandler(tusd.Config{
-		BasePath:      "/uploads/",
-		StoreComposer: composer,
+		BasePath:                "/uploads/",
+		StoreComposer:           composer,
+		PreUploadCreateCallback: fileHandler.PreUploadCreate,
+		NotifyCompleteUploads:   true,
 	})
 	if err != nil {
 		log.Fatalf("Fatal: Unable to create tusd handler: %s", err)
 	}
-
-	authHandler := handlers.NewAuthHandler(db)
-	fileHandler := handlers.NewFileHandler(db)
-	adminHandler := handlers.NewAdminHandler(db)
+	go fileHandler.ConsumeCompletedUploads(tusdHandler.CompleteUploads)
 
 	router.POST("/auth/register", authHandler.Register)
 	router.POST("/login", authHandler.Login)
-	router.Any("/uploads/*path", gin.WrapH(http.StripPrefix("/uploads/", tusdHandler)))
+	router.Any("/uploads/*path", middleware.AuthMiddleware(), fileHandler.UploadOwnerMiddleware(), middleware.TusChecksum(baseUploadPath, composer), gin.WrapH(http.StripPrefix("/uploads/", tusdHandler)))
 
 	router.Use(func(c *gin.Context) {
 		c.Set("db", db)
@@ -77,11 +137,25 @@ func main() {
 	{
 		// File & Folder Management
 		api.GET("/files", fileHandler.ListFiles)
+		api.GET("/search", fileHandler.Search)
+		api.GET("/search/content", fileHandler.SearchContent)
+		api.GET("/starred", fileHandler.ListStarred)
+		api.GET("/recent", fileHandler.ListRecent)
 		api.POST("/folders", fileHandler.CreateFolder)
 		api.POST("/folders/structure", fileHandler.CreateFolderPath)
 
 		api.POST("/move", fileHandler.MoveItem)
+		api.POST("/rename", fileHandler.RenameItem)
+		api.POST("/copy", fileHandler.CopyItem)
 		api.POST("/finalize-upload", fileHandler.FinalizeUpload)
+		api.POST("/finalize-uploads", fileHandler.FinalizeUploads)
+		api.PUT("/files/*path", fileHandler.PutFile)
+		api.GET("/files/:fileId/versions", fileHandler.ListVersions)
+		api.DELETE("/files/:fileId/versions", fileHandler.PruneVersions)
+		api.GET("/files/:fileId/versions/:version/download", fileHandler.DownloadVersion)
+		api.POST("/files/:fileId/versions/:version/restore", fileHandler.RestoreVersion)
+		api.DELETE("/files/:fileId/versions/:version", fileHandler.DeleteVersion)
+		api.POST("/upload", fileHandler.UploadFiles)
 		api.GET("/quota", fileHandler.GetQuotaInfo)
 		api.DELETE("/items/*path", fileHandler.DeleteItem)
 		api.POST("/items/bulk-delete", fileHandler.BulkDeleteItems)
@@ -108,6 +182,12 @@ func main() {
 		{
 			admin.GET("/users", adminHandler.GetAllUsers)
 			admin.GET("/stats", adminHandler.GetSystemStats)
+			admin.GET("/storage/savings", adminHandler.GetStorageSavings)
+			admin.POST("/fsck", adminHandler.RunFsck)
+			admin.POST("/quota/reconcile", adminHandler.ReconcileQuota)
+			admin.GET("/quota/audit", adminHandler.GetQuotaAudit)
+			admin.GET("/uploads", adminHandler.ListUploads)
+			admin.DELETE("/uploads/:id", adminHandler.TerminateUpload)
 			admin.PUT("/users/:id", adminHandler.UpdateUser)
 			admin.DELETE("/users/:id", adminHandler.DeleteUser)
 			admin.GET("/settings", adminHandler.GetSettings)
@@ -124,6 +204,50 @@ func main() {
 		api.GET("/shared-folders/:folderId/contents", fileHandler.ListSharedFolderContents)
 		api.POST("/shared-folders/finalize-upload", fileHandler.FinalizeSharedFolderUpload)
 
+		// ID-based file API
+		v2 := api.Group("/v2")
+		{
+			v2.GET("/files/:fileId", fileHandler.GetItemV2)
+			v2.DELETE("/files/:fileId", fileHandler.DeleteItemV2)
+			v2.POST("/files/:fileId/move", fileHandler.MoveItemV2)
+			v2.POST("/files/:fileId/rename", fileHandler.RenameItemV2)
+			v2.POST("/files/:fileId/restore", fileHandler.RestoreItemV2)
+			v2.GET("/files/:fileId/download", fileHandler.DownloadItemV2)
+			v2.GET("/folders/:folderId", fileHandler.GetItemV2)
+			v2.GET("/folders/:folderId/children", fileHandler.ListChildrenV2)
+			v2.DELETE("/folders/:folderId", fileHandler.DeleteItemV2)
+			v2.POST("/folders/:folderId/move", fileHandler.MoveItemV2)
+			v2.POST("/folders/:folderId/rename", fileHandler.RenameItemV2)
+			v2.POST("/folders/:folderId/restore", fileHandler.RestoreItemV2)
+			v2.GET("/folders/:folderId/download", fileHandler.DownloadItemV2)
+
+			// Tags and metadata
+			v2.GET("/tags", fileHandler.ListTags)
+			v2.POST("/tags/bulk", fileHandler.BulkTags)
+			v2.GET("/files/:fileId/tags", fileHandler.GetTags)
+			v2.PUT("/files/:fileId/tags", fileHandler.SetTags)
+			v2.POST("/files/:fileId/tags", fileHandler.AddTags)
+			v2.DELETE("/files/:fileId/tags/:tag", fileHandler.RemoveTag)
+			v2.GET("/files/:fileId/metadata", fileHandler.GetMetadata)
+			v2.PUT("/files/:fileId/metadata", fileHandler.SetMetadata)
+			v2.PUT("/files/:fileId/metadata/:key", fileHandler.SetMetadataValue)
+			v2.DELETE("/files/:fileId/metadata/:key", fileHandler.DeleteMetadataValue)
+			v2.GET("/folders/:folderId/tags", fileHandler.GetTags)
+			v2.PUT("/folders/:folderId/tags", fileHandler.SetTags)
+			v2.POST("/folders/:folderId/tags", fileHandler.AddTags)
+			v2.DELETE("/folders/:folderId/tags/:tag", fileHandler.RemoveTag)
+			v2.GET("/folders/:folderId/metadata", fileHandler.GetMetadata)
+			v2.PUT("/folders/:folderId/metadata", fileHandler.SetMetadata)
+			v2.PUT("/folders/:folderId/metadata/:key", fileHandler.SetMetadataValue)
+			v2.DELETE("/folders/:folderId/metadata/:key", fileHandler.DeleteMetadataValue)
+
+			// Stars
+			v2.PUT("/files/:fileId/star", fileHandler.StarItem)
+			v2.DELETE("/files/:fileId/star", fileHandler.UnstarItem)
+			v2.PUT("/folders/:folderId/star", fileHandler.StarItem)
+			v2.DELETE("/folders/:folderId/star", fileHandler.UnstarItem)
+		}
+
 	}
 
 	router.Use(static.Serve("/", static.LocalFile("./frontend/build", true)))
@@ -0,0 +1,467 @@
+package maintenance
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"my-cloud-project/backend/blobs"
+	"my-cloud-project/backend/database"
+	"my-cloud-project/backend/encryption"
+	"my-cloud-project/backend/storage"
+)
+
+// QuarantinePrefix is where repair moves objects no row refers to, instead of deleting them
+const QuarantinePrefix = ".quarantine"
+
+// DefaultGracePeriod leaves recent uploads alone while they may still be finalizing
+const DefaultGracePeriod = time.Hour
+
+// Kinds of problems fsck reports
+const (
+	IssueOrphanObject     = "orphan_object"
+	IssueMissingObject    = "missing_object"
+	IssueSizeMismatch     = "size_mismatch"
+	IssueFolderWithoutRow = "folder_without_row"
+	IssueWrongParent      = "wrong_parent"
+)
+
+// FsckOptions controls a consistency check
+type FsckOptions struct {
+	Repair bool
+	// Objects and rows younger than this are skipped, since an upload may still be finalizing
+	GracePeriod time.Duration
+}
+
+// Issue is a single inconsistency between the database and storage
+type Issue struct {
+	Kind       string  `json:"kind"`
+	Key        string  `json:"key,omitempty"`
+	OwnerID    int     `json:"ownerId,omitempty"`
+	FolderID   string  `json:"folderId,omitempty"`
+	FileIDs    []int64 `json:"fileIds,omitempty"`
+	VersionIDs []int64 `json:"versionIds,omitempty"`
+	Expected   int64   `json:"expected,omitempty"`
+	Actual     int64   `json:"actual,omitempty"`
+	Repaired   bool    `json:"repaired"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// FsckReport is the result of a consistency check
+type FsckReport struct {
+	StartedAt      time.Time      `json:"startedAt"`
+	FinishedAt     time.Time      `json:"finishedAt"`
+	Repair         bool           `json:"repair"`
+	ObjectsScanned int            `json:"objectsScanned"`
+	FilesScanned   int            `json:"filesScanned"`
+	BlobsScanned   int            `json:"blobsScanned"`
+	Counts         map[string]int `json:"counts"`
+	Issues         []Issue        `json:"issues"`
+}
+
+func (r *FsckReport) add(issue Issue) *Issue {
+	r.Counts[issue.Kind]++
+	r.Issues = append(r.Issues, issue)
+	return &r.Issues[len(r.Issues)-1]
+}
+
+// expectedObject is a stored object some row refers to
+type expectedObject struct {
+	ownerID    int
+	fileIDs    []int64
+	versionIDs []int64
+	size       int64 // -1 when the stored size cannot be predicted
+	created    time.Time
+}
+
+// Fsck compares FILE_LIST, FOLDER_LIST and BLOB_LIST against what is actually in storage.
+// With Repair set, orphan objects are moved under QuarantinePrefix, rows whose contents are
+// missing or damaged get STATUS 'broken', folders that items are linked to get their missing
+// rows back and items linked to another user's folder are moved to the top of their owner's drive.
+func Fsck(ctx context.Context, db *sql.DB, backend storage.Backend, opts FsckOptions) (*FsckReport, error) {
+	report := &FsckReport{StartedAt: time.Now(), Repair: opts.Repair, Counts: map[string]int{}, Issues: []Issue{}}
+	cutoff := report.StartedAt.Add(-opts.GracePeriod)
+
+	expected, err := expectedBlobs(ctx, db, report)
+	if err != nil {
+		return nil, err
+	}
+	usernames, err := loadUsernames(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectedLegacyFiles(ctx, db, usernames, expected, report); err != nil {
+		return nil, err
+	}
+
+	objects, err := backend.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage: %w", err)
+	}
+
+	found := map[string]bool{}
+	for _, obj := range objects {
+		// Top-level entries are in-flight tus uploads, not stored files
+		if !strings.Contains(obj.Key, "/") || strings.HasPrefix(obj.Key, QuarantinePrefix+"/") {
+			continue
+		}
+		report.ObjectsScanned++
+
+		exp, ok := expected[obj.Key]
+		if !ok {
+			if obj.ModTime.After(cutoff) {
+				continue
+			}
+			issue := report.add(Issue{Kind: IssueOrphanObject, Key: obj.Key, Actual: obj.Size})
+			if opts.Repair {
+				quarantineKey := path.Join(QuarantinePrefix, report.StartedAt.Format("20060102-150405"), obj.Key)
+				markRepaired(issue, backend.Move(ctx, obj.Key, quarantineKey))
+			}
+			continue
+		}
+
+		found[obj.Key] = true
+		if exp.size >= 0 && exp.size != obj.Size {
+			issue := report.add(Issue{Kind: IssueSizeMismatch, Key: obj.Key, OwnerID: exp.ownerID, FileIDs: exp.fileIDs, VersionIDs: exp.versionIDs, Expected: exp.size, Actual: obj.Size})
+			if opts.Repair {
+				markRepaired(issue, markBroken(ctx, db, exp))
+			}
+		}
+	}
+
+	for key, exp := range expected {
+		if found[key] || exp.created.After(cutoff) {
+			continue
+		}
+		issue := report.add(Issue{Kind: IssueMissingObject, Key: key, OwnerID: exp.ownerID, FileIDs: exp.fileIDs, VersionIDs: exp.versionIDs, Expected: exp.size})
+		if opts.Repair {
+			markRepaired(issue, markBroken(ctx, db, exp))
+		}
+	}
+
+	if err := checkFolders(ctx, db, opts.Repair, report); err != nil {
+		return nil, err
+	}
+	if err := checkParents(ctx, db, opts.Repair, report); err != nil {
+		return nil, err
+	}
+
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+func markRepaired(issue *Issue, err error) {
+	if err != nil {
+		issue.Error = err.Error()
+		return
+	}
+	issue.Repaired = true
+}
+
+// markBroken hides rows whose contents are gone or damaged from listings and downloads.
+// Older versions cannot be hidden, so they are dropped along with their blob reference;
+// the next quota reconciliation gives their size back.
+func markBroken(ctx context.Context, db *sql.DB, exp *expectedObject) error {
+	for _, id := range exp.fileIDs {
+		if _, err := db.ExecContext(ctx, "UPDATE FILE_LIST SET STATUS = 'broken' WHERE FILE_ID = ?", id); err != nil {
+			return err
+		}
+	}
+	for _, id := range exp.versionIDs {
+		if err := dropVersion(ctx, db, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropVersion(ctx context.Context, db *sql.DB, versionID int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE BLOB_LIST b JOIN FILE_VERSIONS v ON v.BLOB_ID = b.BLOB_ID
+		SET b.REF_COUNT = b.REF_COUNT - 1
+		WHERE v.VERSION_ID = ? AND b.REF_COUNT > 0
+	`, versionID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM FILE_VERSIONS WHERE VERSION_ID = ?", versionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func loadUsernames(ctx context.Context, db *sql.DB) (map[int]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT USER_ID, USERNAME FROM USERS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usernames := map[int]string{}
+	for rows.Next() {
+		var id int
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			return nil, err
+		}
+		usernames[id] = username
+	}
+	return usernames, rows.Err()
+}
+
+// expectedBlobs lists every blob object along with the files and versions that use it
+func expectedBlobs(ctx context.Context, db *sql.DB, report *FsckReport) (map[string]*expectedObject, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT b.BLOB_ID, b.OWNER_ID, b.STORAGE_KEY, b.BLOB_SIZE, b.STORED_SIZE, b.ENCRYPTED, b.CODEC, b.created_at
+		FROM BLOB_LIST b
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	expected := map[string]*expectedObject{}
+	byBlob := map[int64]*expectedObject{}
+	for rows.Next() {
+		var blobID, size int64
+		var storedSize sql.NullInt64
+		var encrypted bool
+		var key, codec string
+		exp := &expectedObject{}
+		if err := rows.Scan(&blobID, &exp.ownerID, &key, &size, &storedSize, &encrypted, &codec, &exp.created); err != nil {
+			return nil, err
+		}
+		exp.size = expectedStoredSize(size, storedSize, encrypted, codec)
+		expected[key] = exp
+		byBlob[blobID] = exp
+		report.BlobsScanned++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	fileRows, err := db.QueryContext(ctx, "SELECT FILE_ID, BLOB_ID FROM FILE_LIST WHERE BLOB_ID IS NOT NULL AND STATUS <> 'broken'")
+	if err != nil {
+		return nil, err
+	}
+	defer fileRows.Close()
+	for fileRows.Next() {
+		var fileID, blobID int64
+		if err := fileRows.Scan(&fileID, &blobID); err != nil {
+			return nil, err
+		}
+		if exp, ok := byBlob[blobID]; ok {
+			exp.fileIDs = append(exp.fileIDs, fileID)
+		}
+		report.FilesScanned++
+	}
+	if err := fileRows.Err(); err != nil {
+		return nil, err
+	}
+
+	versionRows, err := db.QueryContext(ctx, "SELECT VERSION_ID, BLOB_ID FROM FILE_VERSIONS")
+	if err != nil {
+		return nil, err
+	}
+	defer versionRows.Close()
+	for versionRows.Next() {
+		var versionID, blobID int64
+		if err := versionRows.Scan(&versionID, &blobID); err != nil {
+			return nil, err
+		}
+		if exp, ok := byBlob[blobID]; ok {
+			exp.versionIDs = append(exp.versionIDs, versionID)
+		}
+	}
+	return expected, versionRows.Err()
+}
+
+// expectedStoredSize predicts how large a blob object should be in storage
+func expectedStoredSize(size int64, storedSize sql.NullInt64, encrypted bool, codec string) int64 {
+	if storedSize.Valid {
+		return storedSize.Int64
+	}
+	if codec != blobs.CodecNone {
+		return -1
+	}
+	if encrypted {
+		encryptedSize, err := encryption.EncryptedSize(size)
+		if err != nil {
+			return -1
+		}
+		return encryptedSize
+	}
+	return size
+}
+
+// expectedLegacyFiles adds files stored under their per-file key from before the blob store.
+// The key names the folder the file is in by its path, which is derived from the folder rows.
+func expectedLegacyFiles(ctx context.Context, db *sql.DB, usernames map[int]string, expected map[string]*expectedObject, report *FsckReport) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT FILE_ID, OWNER_ID, FOLDER_ID, COALESCE(FILE_SIZE, 0), created_at
+		FROM FILE_LIST
+		WHERE BLOB_ID IS NULL AND STATUS <> 'broken'
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type legacyFile struct {
+		fileID, size int64
+		ownerID      int
+		folderID     sql.NullString
+		created      time.Time
+	}
+	var files []legacyFile
+	var folderIDs []string
+	for rows.Next() {
+		var f legacyFile
+		if err := rows.Scan(&f.fileID, &f.ownerID, &f.folderID, &f.size, &f.created); err != nil {
+			return err
+		}
+		report.FilesScanned++
+		files = append(files, f)
+		if f.folderID.Valid {
+			folderIDs = append(folderIDs, f.folderID.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	folderPaths, err := database.FolderPaths(db, folderIDs)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		dir := "/"
+		if f.folderID.Valid {
+			var ok bool
+			// A file whose folder has no row is reported by checkFolders
+			if dir, ok = folderPaths[f.folderID.String]; !ok {
+				continue
+			}
+		}
+		key, err := storage.UserKey(usernames[f.ownerID], dir, strconv.FormatInt(f.fileID, 10))
+		if err != nil {
+			continue
+		}
+		expected[key] = &expectedObject{ownerID: f.ownerID, fileIDs: []int64{f.fileID}, size: f.size, created: f.created}
+	}
+	return nil
+}
+
+// foldersWithoutRow selects the folders that files and folders are linked to but that have no
+// FOLDER_LIST row, along with the owner of the items in them
+const foldersWithoutRow = `
+	SELECT f.FOLDER_ID, f.OWNER_ID FROM FILE_LIST f
+	LEFT JOIN FOLDER_LIST p ON p.FOLDER_ID = f.FOLDER_ID
+	WHERE f.FOLDER_ID IS NOT NULL AND p.FOLDER_ID IS NULL AND f.STATUS <> 'broken'
+	UNION
+	SELECT f.PARENT_ID, f.OWNER_ID FROM FOLDER_LIST f
+	LEFT JOIN FOLDER_LIST p ON p.FOLDER_ID = f.PARENT_ID
+	WHERE f.PARENT_ID IS NOT NULL AND p.FOLDER_ID IS NULL`
+
+// checkFolders reports folders that items are linked to but that have no FOLDER_LIST row.
+// Repair gives each one a row at the top of its owner's drive, named after its ID, so what is
+// in it can be found and moved back.
+func checkFolders(ctx context.Context, db *sql.DB, repair bool, report *FsckReport) error {
+	type missing struct {
+		folderID string
+		ownerID  int
+	}
+	var folders []missing
+	rows, err := db.QueryContext(ctx, foldersWithoutRow)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var m missing
+		if err := rows.Scan(&m.folderID, &m.ownerID); err != nil {
+			rows.Close()
+			return err
+		}
+		folders = append(folders, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range folders {
+		issue := report.add(Issue{Kind: IssueFolderWithoutRow, OwnerID: m.ownerID, FolderID: m.folderID})
+		if repair {
+			_, err := db.ExecContext(ctx, "INSERT INTO FOLDER_LIST (FOLDER_ID, OWNER_ID, FOLDER_NAME, STATUS) VALUES (?, ?, ?, 'active')",
+				m.folderID, m.ownerID, "Recovered "+m.folderID)
+			markRepaired(issue, err)
+		}
+	}
+	return nil
+}
+
+// misplacedItems selects folders and files linked to a folder of another owner
+const misplacedItems = `
+	SELECT f.FOLDER_ID, 0, f.OWNER_ID FROM FOLDER_LIST f
+	JOIN FOLDER_LIST p ON p.FOLDER_ID = f.PARENT_ID
+	WHERE p.OWNER_ID <> f.OWNER_ID
+	UNION ALL
+	SELECT '', f.FILE_ID, f.OWNER_ID FROM FILE_LIST f
+	JOIN FOLDER_LIST p ON p.FOLDER_ID = f.FOLDER_ID
+	WHERE p.OWNER_ID <> f.OWNER_ID`
+
+// checkParents reports items linked to a folder their owner does not own. Repair moves them to
+// the top of their owner's drive; one whose name is taken there stays as it is.
+func checkParents(ctx context.Context, db *sql.DB, repair bool, report *FsckReport) error {
+	type misplaced struct {
+		folderID string
+		fileID   int64
+		ownerID  int
+	}
+	var items []misplaced
+	rows, err := db.QueryContext(ctx, misplacedItems)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var m misplaced
+		if err := rows.Scan(&m.folderID, &m.fileID, &m.ownerID); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range items {
+		issue := Issue{Kind: IssueWrongParent, OwnerID: m.ownerID, FolderID: m.folderID}
+		if m.folderID == "" {
+			issue.FileIDs = []int64{m.fileID}
+		}
+		reported := report.add(issue)
+		if !repair {
+			continue
+		}
+		if m.folderID != "" {
+			_, err = db.ExecContext(ctx, "UPDATE FOLDER_LIST SET PARENT_ID = NULL WHERE FOLDER_ID = ?", m.folderID)
+		} else {
+			_, err = db.ExecContext(ctx, "UPDATE FILE_LIST SET FOLDER_ID = NULL WHERE FILE_ID = ?", m.fileID)
+		}
+		markRepaired(reported, err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package maintenance
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// QuotaCorrection is a user whose recorded usage differs from what their files add up to
+type QuotaCorrection struct {
+	UserID   int    `json:"userId"`
+	Username string `json:"username"`
+	Before   int64  `json:"before"`
+	After    int64  `json:"after"`
+	Delta    int64  `json:"delta"`
+}
+
+// QuotaReport is the result of a quota reconciliation
+type QuotaReport struct {
+	StartedAt    time.Time         `json:"startedAt"`
+	Applied      bool              `json:"applied"`
+	UsersChecked int               `json:"usersChecked"`
+	Corrections  []QuotaCorrection `json:"corrections"`
+}
+
+// ReconcileQuota recomputes every user's USED_QUOTA from FILE_LIST and FILE_VERSIONS. Files
+// marked broken are not charged. With apply set the corrections are written, each with a
+// QUOTA_AUDIT record naming source; otherwise the differences are only reported.
+func ReconcileQuota(ctx context.Context, db *sql.DB, apply bool, source string) (*QuotaReport, error) {
+	report := &QuotaReport{StartedAt: time.Now(), Applied: apply, Corrections: []QuotaCorrection{}}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the users first so uploads finalizing meanwhile either land in the sums
+	// below or apply their own increment on top of the corrected value
+	rows, err := tx.QueryContext(ctx, "SELECT USER_ID, USERNAME, USED_QUOTA FROM USERS FOR UPDATE")
+	if err != nil {
+		return nil, err
+	}
+	var users []QuotaCorrection
+	for rows.Next() {
+		var u QuotaCorrection
+		if err := rows.Scan(&u.UserID, &u.Username, &u.Before); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+
+	usage, err := actualUsage(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range users {
+		report.UsersChecked++
+		u.After = usage[u.UserID]
+		u.Delta = u.After - u.Before
+		if u.Delta == 0 {
+			continue
+		}
+		report.Corrections = append(report.Corrections, u)
+
+		if !apply {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE USERS SET USED_QUOTA = ? WHERE USER_ID = ?", u.After, u.UserID); err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO QUOTA_AUDIT (USER_ID, OLD_USED, NEW_USED, DELTA, SOURCE) VALUES (?, ?, ?, ?, ?)",
+			u.UserID, u.Before, u.After, u.Delta, source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// actualUsage sums the logical size of each user's files and their kept versions,
+// the same amounts finalizing charges
+func actualUsage(ctx context.Context, tx *sql.Tx) (map[int]int64, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT OWNER_ID, COALESCE(SUM(FILE_SIZE), 0)
+		FROM (
+			SELECT OWNER_ID, FILE_SIZE FROM FILE_LIST WHERE STATUS <> 'broken'
+			UNION ALL
+			SELECT f.OWNER_ID, v.FILE_SIZE FROM FILE_VERSIONS v JOIN FILE_LIST f ON v.FILE_ID = f.FILE_ID
+		) charged
+		GROUP BY OWNER_ID
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := map[int]int64{}
+	for rows.Next() {
+		var ownerID int
+		var used int64
+		if err := rows.Scan(&ownerID, &used); err != nil {
+			return nil, err
+		}
+		usage[ownerID] = used
+	}
+	return usage, rows.Err()
+}
+
+// StartQuotaReconciler runs ReconcileQuota every interval until ctx is cancelled
+func StartQuotaReconciler(ctx context.Context, db *sql.DB, interval time.Duration, apply bool) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			report, err := ReconcileQuota(ctx, db, apply, "scheduled")
+			if err != nil {
+				log.Printf("Scheduled quota reconciliation failed: %v", err)
+				continue
+			}
+			for _, c := range report.Corrections {
+				log.Printf("Quota drift for %s: recorded %d, actual %d (applied: %t)", c.Username, c.Before, c.After, apply)
+			}
+		}
+	}()
+}
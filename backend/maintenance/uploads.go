@@ -0,0 +1,205 @@
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// InFlightUpload is a tus upload that has not been turned into a file yet
+type InFlightUpload struct {
+	ID           string    `json:"id"`
+	OwnerID      int       `json:"ownerId"`
+	Filename     string    `json:"filename"`
+	Size         int64     `json:"size"`
+	Offset       int64     `json:"offset"`
+	Complete     bool      `json:"complete"`
+	Partial      bool      `json:"partial"`
+	LastActivity time.Time `json:"lastActivity"`
+	AgeSeconds   int64     `json:"ageSeconds"`
+}
+
+// Uploads manages the tus uploads kept in the root of the upload directory
+type Uploads struct {
+	dir      string
+	composer *tusd.StoreComposer
+}
+
+// NewUploads creates an upload manager for the tus store in dir
+func NewUploads(dir string, composer *tusd.StoreComposer) *Uploads {
+	return &Uploads{dir: dir, composer: composer}
+}
+
+// List returns every upload tus still holds, oldest activity first
+func (u *Uploads) List() ([]InFlightUpload, error) {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	uploads := []InFlightUpload{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".info")
+		if entry.IsDir() || !ok {
+			continue
+		}
+		upload, err := u.read(id)
+		if err != nil {
+			continue
+		}
+		upload.AgeSeconds = int64(now.Sub(upload.LastActivity).Seconds())
+		uploads = append(uploads, upload)
+	}
+
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].LastActivity.Before(uploads[j].LastActivity) })
+	return uploads, nil
+}
+
+// read loads an upload's tus metadata. Its last activity is when its data or metadata last changed.
+func (u *Uploads) read(id string) (InFlightUpload, error) {
+	infoPath := filepath.Join(u.dir, id+".info")
+	data, err := os.ReadFile(infoPath)
+	if err != nil {
+		return InFlightUpload{}, err
+	}
+	var info tusd.FileInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return InFlightUpload{}, err
+	}
+
+	upload := InFlightUpload{
+		ID:       id,
+		Filename: info.MetaData["filename"],
+		Size:     info.Size,
+		Partial:  info.IsPartial,
+	}
+	upload.OwnerID, _ = strconv.Atoi(info.MetaData["ownerId"])
+	for _, p := range []string{infoPath, filepath.Join(u.dir, id)} {
+		if stat, err := os.Stat(p); err == nil && stat.ModTime().After(upload.LastActivity) {
+			upload.LastActivity = stat.ModTime()
+		}
+	}
+	// The info file is not rewritten as chunks arrive, so the offset is the size of the data
+	if stat, err := os.Stat(filepath.Join(u.dir, id)); err == nil {
+		upload.Offset = stat.Size()
+	}
+	upload.Complete = !info.SizeIsDeferred && upload.Offset >= info.Size
+	return upload, nil
+}
+
+// Terminate removes an upload through tus, the same way a client cancelling it would
+func (u *Uploads) Terminate(ctx context.Context, id string) error {
+	if u.composer.Terminater == nil {
+		return errors.New("the upload store does not support termination")
+	}
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return tusd.ErrNotFound
+	}
+	upload, err := u.composer.Core.GetUpload(ctx, id)
+	if err != nil {
+		return err
+	}
+	return u.composer.Terminater.AsTerminatableUpload(upload).Terminate(ctx)
+}
+
+// Sweep terminates uploads that have seen no activity for longer than ttl
+func (u *Uploads) Sweep(ctx context.Context, ttl time.Duration) (int, error) {
+	uploads, err := u.List()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	cutoff := time.Now().Add(-ttl)
+	for _, upload := range uploads {
+		if upload.LastActivity.After(cutoff) {
+			break
+		}
+		if err := u.Terminate(ctx, upload.ID); err != nil {
+			log.Printf("Failed to remove expired upload %s: %v", upload.ID, err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// spoolPrefixes start the names of the temporary files direct uploads and checksummed tus
+// chunks are spooled to before they are stored
+var spoolPrefixes = []string{".upload-", ".checksum-"}
+
+// isSpool reports whether name is one of the spool files kept in the upload directory
+func isSpool(name string) bool {
+	for _, prefix := range spoolPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SweepSpools removes spool files that have not been written for longer than ttl. They are
+// removed once their request is done, so old ones are left behind by a process that stopped.
+func (u *Uploads) SweepSpools(ttl time.Duration) (int, error) {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	cutoff := time.Now().Add(-ttl)
+	for _, entry := range entries {
+		if entry.IsDir() || !isSpool(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(u.dir, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove stale spool file %s: %v", entry.Name(), err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// StartSweeper runs Sweep and SweepSpools every interval until ctx is cancelled
+func (u *Uploads) StartSweeper(ctx context.Context, interval, ttl time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			removed, err := u.Sweep(ctx, ttl)
+			if err != nil {
+				log.Printf("Upload sweep failed: %v", err)
+			} else if removed > 0 {
+				log.Printf("Removed %d uploads inactive for more than %s", removed, ttl)
+			}
+
+			removed, err = u.SweepSpools(ttl)
+			if err != nil {
+				log.Printf("Spool sweep failed: %v", err)
+			} else if removed > 0 {
+				log.Printf("Removed %d spool files older than %s", removed, ttl)
+			}
+		}
+	}()
+}
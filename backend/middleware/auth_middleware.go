@@ -1,7 +1,9 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 
@@ -9,35 +11,49 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// TokenFromRequest returns the bearer token of a request, falling back to the token query parameter
+func TokenFromRequest(header http.Header, query url.Values) string {
+	authHeader := header.Get("Authorization")
+	if authHeader != "" && strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	return query.Get("token")
+}
+
+// ParseToken validates a JWT and returns the username it was issued to
+func ParseToken(tokenString string) (string, error) {
+	if tokenString == "" {
+		return "", errors.New("authorization token not provided")
+	}
+
+	jwtKey := []byte(os.Getenv("JWT_SECRET_KEY"))
+	claims := &jwt.RegisteredClaims{}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	})
+
+	if err != nil || !token.Valid {
+		return "", errors.New("invalid or expired token")
+	}
+	return claims.Subject, nil
+}
+
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var tokenString string
-		
-		authHeader := c.GetHeader("Authorization")
-		if authHeader != "" && strings.HasPrefix(authHeader, "Bearer ") {
-			tokenString = strings.TrimPrefix(authHeader, "Bearer ")
-		} else {
-			tokenString = c.Query("token")
-		}
-		
+		tokenString := TokenFromRequest(c.Request.Header, c.Request.URL.Query())
 		if tokenString == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization token not provided"})
 			return
 		}
 
-		jwtKey := []byte(os.Getenv("JWT_SECRET_KEY"))
-		claims := &jwt.RegisteredClaims{}
-
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
-
-		if err != nil || !token.Valid {
+		username, err := ParseToken(tokenString)
+		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
 			return
 		}
 
-		c.Set("username", claims.Subject)
+		c.Set("username", username)
 		c.Next()
 	}
-}
\ No newline at end of file
+}
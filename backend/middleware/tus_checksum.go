@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// StatusChecksumMismatch is the status the tus checksum extension answers a corrupted chunk with
+const StatusChecksumMismatch = 460
+
+// checksumAlgorithms are the algorithms a client may name in Upload-Checksum
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+const checksumAlgorithmList = "sha1,sha256,md5"
+
+// errUploadLength is returned when how long an upload is cannot be told from the request and the upload
+var errUploadLength = errors.New("missing or invalid Upload-Length")
+
+// TusChecksum adds the tus checksum extension in front of the tus handler. A chunk sent with
+// Upload-Checksum is spooled to spoolDir and verified before tus writes any of it, so a
+// corrupted chunk is refused and the client can send it again from the same offset. Only as
+// much as is left of the upload in composer's store is spooled.
+func TusChecksum(spoolDir string, composer *tusd.StoreComposer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodOptions {
+			c.Header("Tus-Checksum-Algorithm", checksumAlgorithmList)
+			c.Writer = &checksumExtensionWriter{ResponseWriter: c.Writer}
+			c.Next()
+			return
+		}
+
+		header := c.GetHeader("Upload-Checksum")
+		if header == "" || (c.Request.Method != http.MethodPatch && c.Request.Method != http.MethodPost) {
+			c.Next()
+			return
+		}
+
+		algorithm, encoded, _ := strings.Cut(header, " ")
+		newHash, ok := checksumAlgorithms[algorithm]
+		expected, err := base64.StdEncoding.DecodeString(encoded)
+		if !ok || err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Unsupported or malformed Upload-Checksum, supported algorithms are " + checksumAlgorithmList})
+			return
+		}
+
+		remaining, err := remainingLength(c, composer)
+		if errors.Is(err, tusd.ErrNotFound) {
+			// Let tus answer for uploads that do not exist
+			c.Next()
+			return
+		}
+		if errors.Is(err, errUploadLength) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "A checksummed chunk needs a valid Upload-Length unless the upload already has one"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read upload for checksum: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Could not read upload metadata"})
+			return
+		}
+		if c.Request.ContentLength > remaining {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Upload chunk is larger than what is left of the upload"})
+			return
+		}
+
+		spool, err := os.CreateTemp(spoolDir, ".checksum-*")
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Could not buffer upload chunk"})
+			return
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		h := newHash()
+		// One byte past what is left tells a chunk that is too large from one that just fits
+		n, err := io.Copy(io.MultiWriter(spool, h), io.LimitReader(c.Request.Body, remaining+1))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Could not read upload chunk"})
+			return
+		}
+		if n > remaining {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Upload chunk is larger than what is left of the upload"})
+			return
+		}
+		if !bytes.Equal(h.Sum(nil), expected) {
+			c.AbortWithStatusJSON(StatusChecksumMismatch, gin.H{"error": "Checksum Mismatch"})
+			return
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Could not buffer upload chunk"})
+			return
+		}
+
+		// Hand tus the verified bytes in place of the original body
+		c.Request.Body = io.NopCloser(spool)
+		c.Request.ContentLength = n
+		c.Next()
+	}
+}
+
+// remainingLength is how many bytes are left to send of the upload a request adds to. An upload
+// created with the request is as long as its Upload-Length; one whose length is deferred takes
+// the Upload-Length sent with the chunk.
+func remainingLength(c *gin.Context, composer *tusd.StoreComposer) (int64, error) {
+	declared := int64(-1)
+	if v := c.GetHeader("Upload-Length"); v != "" {
+		length, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || length < 0 {
+			return 0, errUploadLength
+		}
+		declared = length
+	}
+	if c.Request.Method == http.MethodPost {
+		if declared < 0 {
+			return 0, errUploadLength
+		}
+		return declared, nil
+	}
+
+	id := strings.Trim(c.Param("path"), "/")
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return 0, tusd.ErrNotFound
+	}
+	upload, err := composer.Core.GetUpload(c.Request.Context(), id)
+	if err != nil {
+		return 0, err
+	}
+	info, err := upload.GetInfo(c.Request.Context())
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size
+	if info.SizeIsDeferred {
+		if declared < 0 {
+			return 0, errUploadLength
+		}
+		size = declared
+	}
+	return max(size-info.Offset, 0), nil
+}
+
+// checksumExtensionWriter adds checksum to the extensions tus advertises
+type checksumExtensionWriter struct {
+	gin.ResponseWriter
+}
+
+func (w *checksumExtensionWriter) WriteHeader(status int) {
+	if extensions := w.Header().Get("Tus-Extension"); extensions != "" && !strings.Contains(extensions, "checksum") {
+		w.Header().Set("Tus-Extension", extensions+",checksum")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,274 @@
+//go:build ignore
+
+// scripts/bench_subtree.go
+// Compares walking a folder tree one folder at a time, the way zipping, deleting and sharing
+// a folder used to work, with the single subtree query and set-based statements they use now.
+// It builds a throwaway tree of about 10k items for a throwaway user inside a transaction that
+// is rolled back at the end, so nothing is left behind.
+// Run this script from the backend directory: go run scripts/bench_subtree.go [--fanout 10] [--depth 3] [--files 8]
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"my-cloud-project/backend/database"
+
+	"github.com/google/uuid"
+	"github.com/joho/godotenv"
+)
+
+// subtreeCTE matches the one in handlers/hierarchy.go
+const subtreeCTE = `
+	WITH RECURSIVE subtree (FOLDER_ID, FULL_PATH, ACTIVE, DEPTH) AS (
+		SELECT FOLDER_ID, CAST(? AS CHAR(4096)), STATUS = 'active', 0
+		FROM FOLDER_LIST WHERE FOLDER_ID = ?
+		UNION ALL
+		SELECT c.FOLDER_ID, CONCAT(s.FULL_PATH, '/', c.FOLDER_NAME), s.ACTIVE AND c.STATUS = 'active', s.DEPTH + 1
+		FROM FOLDER_LIST c JOIN subtree s ON c.PARENT_ID = s.FOLDER_ID
+		WHERE s.DEPTH < 256
+	)`
+
+// counted counts the statements sent through it, which is what a deep tree multiplies
+type counted struct {
+	tx         *sql.Tx
+	statements int
+}
+
+func (c *counted) exec(query string, args ...interface{}) {
+	c.statements++
+	if _, err := c.tx.Exec(query, args...); err != nil {
+		log.Fatalf("Statement failed: %v\n%s", err, query)
+	}
+}
+
+func (c *counted) column(query string, args ...interface{}) []string {
+	c.statements++
+	rows, err := c.tx.Query(query, args...)
+	if err != nil {
+		log.Fatalf("Query failed: %v\n%s", err, query)
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			log.Fatal(err)
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// result is one operation timed both ways
+type result struct {
+	operation           string
+	walkTime, setTime   time.Duration
+	walkStmts, setStmts int
+}
+
+func main() {
+	fanout := flag.Int("fanout", 10, "subfolders per folder")
+	depth := flag.Int("depth", 3, "levels of subfolders below the top folder")
+	filesPer := flag.Int("files", 8, "files per folder")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: .env file not found")
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+	defer db.Close()
+
+	if err := database.Migrate(db); err != nil {
+		log.Fatal("Failed to migrate database schema:", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Everything the benchmark writes goes away with the transaction
+	defer tx.Rollback()
+
+	ownerID, shareeID := benchUser(tx, "owner"), benchUser(tx, "sharee")
+	topID, topPath, nodes := buildTree(tx, ownerID, *fanout, *depth, *filesPer)
+	fmt.Printf("Built a tree of %d folders and files below %s\n\n", nodes, topPath)
+
+	var results []result
+
+	// Reading the tree, as zipping it does
+	r := result{operation: "read tree (zip)"}
+	r.walkTime, r.walkStmts = timed(tx, func(c *counted) { walkRead(c, topID) })
+	r.setTime, r.setStmts = timed(tx, func(c *counted) {
+		c.column(subtreeCTE+" SELECT FULL_PATH FROM subtree WHERE ACTIVE ORDER BY DEPTH", topPath, topID)
+		c.column(subtreeCTE+` SELECT CONCAT(s.FULL_PATH, '/', f.FILE_NAME) FROM FILE_LIST f
+			JOIN subtree s ON f.FOLDER_ID = s.FOLDER_ID WHERE s.ACTIVE AND f.STATUS = 'active'`, topPath, topID)
+	})
+	results = append(results, r)
+
+	// Sharing and unsharing the tree with another user
+	r = result{operation: "share"}
+	r.walkTime, r.walkStmts = timed(tx, func(c *counted) { walkShare(c, topID, shareeID, true) })
+	clearShares(tx, shareeID)
+	r.setTime, r.setStmts = timed(tx, func(c *counted) {
+		c.exec(`INSERT INTO SHARED_FOLDER (USER_ID, FOLDER_ID, PERMISSION)
+			SELECT ?, s.FOLDER_ID, 'read' FROM (`+subtreeCTE+` SELECT FOLDER_ID, ACTIVE, DEPTH FROM subtree) s
+			WHERE s.ACTIVE AND s.DEPTH > 0 ON DUPLICATE KEY UPDATE PERMISSION = 'read'`, shareeID, "", topID)
+		c.exec(`INSERT INTO SHARED_FILE (USER_ID, FILE_ID, PERMISSION)
+			SELECT ?, f.FILE_ID, 'read' FROM FILE_LIST f
+			JOIN (`+subtreeCTE+` SELECT FOLDER_ID, ACTIVE FROM subtree) s ON f.FOLDER_ID = s.FOLDER_ID
+			WHERE s.ACTIVE AND f.STATUS = 'active' ON DUPLICATE KEY UPDATE PERMISSION = 'read'`, shareeID, "", topID)
+	})
+	results = append(results, r)
+
+	r = result{operation: "unshare"}
+	r.walkTime, r.walkStmts = timed(tx, func(c *counted) { walkShare(c, topID, shareeID, false) })
+	walkShare(&counted{tx: tx}, topID, shareeID, true)
+	r.setTime, r.setStmts = timed(tx, func(c *counted) {
+		c.exec(`DELETE sf FROM SHARED_FOLDER sf JOIN (`+subtreeCTE+` SELECT FOLDER_ID, DEPTH FROM subtree) s
+			ON sf.FOLDER_ID = s.FOLDER_ID WHERE sf.USER_ID = ? AND s.DEPTH > 0`, "", topID, shareeID)
+		c.exec(`DELETE sf FROM SHARED_FILE sf JOIN FILE_LIST f ON sf.FILE_ID = f.FILE_ID
+			JOIN (`+subtreeCTE+` SELECT FOLDER_ID FROM subtree) s ON f.FOLDER_ID = s.FOLDER_ID
+			WHERE sf.USER_ID = ?`, "", topID, shareeID)
+	})
+	results = append(results, r)
+
+	// Deleting the tree, rows only; the files have no blobs to release
+	r = result{operation: "delete"}
+	mustExec(tx, "SAVEPOINT bench_delete")
+	r.walkTime, r.walkStmts = timed(tx, func(c *counted) { walkDelete(c, ownerID, topID) })
+	mustExec(tx, "ROLLBACK TO SAVEPOINT bench_delete")
+	r.setTime, r.setStmts = timed(tx, func(c *counted) {
+		c.exec(`DELETE f FROM FILE_LIST f JOIN (`+subtreeCTE+` SELECT FOLDER_ID FROM subtree) s ON f.FOLDER_ID = s.FOLDER_ID`, "", topID)
+		c.exec(`DELETE fl FROM FOLDER_LIST fl JOIN (`+subtreeCTE+` SELECT FOLDER_ID FROM subtree) s ON fl.FOLDER_ID = s.FOLDER_ID`, "", topID)
+	})
+	results = append(results, r)
+
+	fmt.Printf("%-16s %22s %22s %8s\n", "operation", "per folder", "subtree query", "speedup")
+	for _, r := range results {
+		fmt.Printf("%-16s %10s %6d stmts %10s %6d stmts %7.1fx\n", r.operation,
+			r.walkTime.Round(time.Millisecond), r.walkStmts, r.setTime.Round(time.Millisecond), r.setStmts,
+			float64(r.walkTime)/float64(max(r.setTime, time.Microsecond)))
+	}
+}
+
+func mustExec(tx *sql.Tx, query string, args ...interface{}) sql.Result {
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		log.Fatalf("Statement failed: %v\n%s", err, query)
+	}
+	return res
+}
+
+func timed(tx *sql.Tx, run func(c *counted)) (time.Duration, int) {
+	c := &counted{tx: tx}
+	start := time.Now()
+	run(c)
+	return time.Since(start), c.statements
+}
+
+func benchUser(tx *sql.Tx, role string) int {
+	username := fmt.Sprintf("bench-subtree-%s-%d", role, time.Now().UnixNano())
+	res := mustExec(tx, "INSERT INTO USERS (USERNAME, DISPLAYNAME, ROLE, USER_QUOTA, STATUS) VALUES (?, ?, 'User', 0, 'active')", username, username)
+	id, _ := res.LastInsertId()
+	return int(id)
+}
+
+func clearShares(tx *sql.Tx, userID int) {
+	mustExec(tx, "DELETE FROM SHARED_FOLDER WHERE USER_ID = ?", userID)
+	mustExec(tx, "DELETE FROM SHARED_FILE WHERE USER_ID = ?", userID)
+}
+
+// buildTree adds a folder "/top" with depth levels of fanout subfolders and filesPer files in
+// every folder. It returns the top folder's ID and path and how many items it made.
+func buildTree(tx *sql.Tx, ownerID, fanout, depth, filesPer int) (string, string, int) {
+	var folderRows, fileRows [][]interface{}
+
+	top := uuid.New().String()
+	folderRows = append(folderRows, []interface{}{top, ownerID, nil, "top"})
+	level := []string{top}
+	all := []string{top}
+	for d := 0; d < depth; d++ {
+		var next []string
+		for _, parent := range level {
+			for i := 0; i < fanout; i++ {
+				child := uuid.New().String()
+				folderRows = append(folderRows, []interface{}{child, ownerID, parent, fmt.Sprintf("folder-%d", i)})
+				next = append(next, child)
+			}
+		}
+		all = append(all, next...)
+		level = next
+	}
+	for _, folderID := range all {
+		for i := 0; i < filesPer; i++ {
+			fileRows = append(fileRows, []interface{}{ownerID, folderID, fmt.Sprintf("file-%d.txt", i), "text/plain", 0})
+		}
+	}
+
+	insertRows(tx, "INSERT INTO FOLDER_LIST (FOLDER_ID, OWNER_ID, PARENT_ID, FOLDER_NAME, STATUS) VALUES ", "(?, ?, ?, ?, 'active')", folderRows)
+	insertRows(tx, "INSERT INTO FILE_LIST (OWNER_ID, FOLDER_ID, FILE_NAME, FILE_TYPE, FILE_SIZE, STATUS) VALUES ", "(?, ?, ?, ?, ?, 'active')", fileRows)
+	return top, "/top", len(folderRows) + len(fileRows)
+}
+
+func insertRows(tx *sql.Tx, insert, placeholders string, rows [][]interface{}) {
+	const batch = 500
+	for start := 0; start < len(rows); start += batch {
+		chunk := rows[start:min(start+batch, len(rows))]
+		var args []interface{}
+		for _, row := range chunk {
+			args = append(args, row...)
+		}
+		mustExec(tx, insert+strings.TrimSuffix(strings.Repeat(placeholders+",", len(chunk)), ","), args...)
+	}
+}
+
+// walkRead reads a tree the way addPathToZipDB used to, two queries per folder
+func walkRead(c *counted, folderID string) {
+	c.column("SELECT FILE_NAME FROM FILE_LIST WHERE FOLDER_ID = ? AND STATUS = 'active'", folderID)
+	for _, subFolderID := range c.column("SELECT FOLDER_ID FROM FOLDER_LIST WHERE PARENT_ID = ? AND STATUS = 'active'", folderID) {
+		walkRead(c, subFolderID)
+	}
+}
+
+// walkShare shares or unshares a tree the way recursiveShareFolderContents and
+// recursiveUnshareFolderContents used to, one statement per item
+func walkShare(c *counted, folderID string, targetUserID int, share bool) {
+	for _, fileID := range c.column("SELECT FILE_ID FROM FILE_LIST WHERE FOLDER_ID = ? AND STATUS = 'active'", folderID) {
+		if share {
+			c.exec("INSERT INTO SHARED_FILE (USER_ID, FILE_ID, PERMISSION) VALUES (?, ?, 'read') ON DUPLICATE KEY UPDATE PERMISSION = 'read'", targetUserID, fileID)
+		} else {
+			c.exec("DELETE FROM SHARED_FILE WHERE FILE_ID = ? AND USER_ID = ?", fileID, targetUserID)
+		}
+	}
+	for _, subFolderID := range c.column("SELECT FOLDER_ID FROM FOLDER_LIST WHERE PARENT_ID = ? AND STATUS = 'active'", folderID) {
+		if share {
+			c.exec("INSERT INTO SHARED_FOLDER (USER_ID, FOLDER_ID, PERMISSION) VALUES (?, ?, 'read') ON DUPLICATE KEY UPDATE PERMISSION = 'read'", targetUserID, subFolderID)
+		} else {
+			c.exec("DELETE FROM SHARED_FOLDER WHERE FOLDER_ID = ? AND USER_ID = ?", subFolderID, targetUserID)
+		}
+		walkShare(c, subFolderID, targetUserID, share)
+	}
+}
+
+// walkDelete deletes a tree the way deleteFolderRecursive used to, row by row
+func walkDelete(c *counted, ownerID int, folderID string) {
+	for _, fileID := range c.column("SELECT FILE_ID FROM FILE_LIST WHERE FOLDER_ID = ?", folderID) {
+		c.exec("UPDATE USERS SET USED_QUOTA = USED_QUOTA - 0 WHERE USER_ID = ?", ownerID)
+		c.column("SELECT VERSION_ID FROM FILE_VERSIONS WHERE FILE_ID = ?", fileID)
+		c.exec("DELETE FROM FILE_LIST WHERE FILE_ID = ?", fileID)
+	}
+	for _, subFolderID := range c.column("SELECT FOLDER_ID FROM FOLDER_LIST WHERE PARENT_ID = ?", folderID) {
+		walkDelete(c, ownerID, subFolderID)
+	}
+	c.exec("DELETE FROM FOLDER_LIST WHERE FOLDER_ID = ?", folderID)
+}
@@ -0,0 +1,89 @@
+//go:build ignore
+
+// scripts/fsck.go
+// Checks that stored files and the database agree, reporting orphan objects, missing
+// objects, size mismatches and folders without rows.
+// Run this script from the backend directory: go run scripts/fsck.go [--repair] [--grace 1h]
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"my-cloud-project/backend/database"
+	"my-cloud-project/backend/maintenance"
+	"my-cloud-project/backend/storage"
+	"my-cloud-project/backend/utils"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	repair := flag.Bool("repair", false, "quarantine orphan objects and mark broken rows")
+	grace := flag.Duration("grace", maintenance.DefaultGracePeriod, "skip objects and rows younger than this")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: .env file not found")
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+	defer db.Close()
+
+	if err := database.Migrate(db); err != nil {
+		log.Fatal("Failed to migrate database schema:", err)
+	}
+
+	ctx := context.Background()
+	baseUploadPath, _ := utils.GetBaseUploadPath()
+	backend, err := storage.NewFromEnv(ctx, baseUploadPath)
+	if err != nil {
+		log.Fatal("Failed to set up file storage:", err)
+	}
+
+	report, err := maintenance.Fsck(ctx, db, backend, maintenance.FsckOptions{Repair: *repair, GracePeriod: *grace})
+	if err != nil {
+		log.Fatal("Consistency check failed:", err)
+	}
+
+	for _, issue := range report.Issues {
+		line := fmt.Sprintf("%-20s", issue.Kind)
+		if issue.Key != "" {
+			line += " " + issue.Key
+		}
+		if issue.FolderID != "" {
+			line += fmt.Sprintf(" user %d folder %s", issue.OwnerID, issue.FolderID)
+		}
+		if len(issue.FileIDs) > 0 {
+			line += fmt.Sprintf(" files %v", issue.FileIDs)
+		}
+		if issue.Kind == maintenance.IssueSizeMismatch {
+			line += fmt.Sprintf(" expected %d bytes, found %d", issue.Expected, issue.Actual)
+		}
+		if issue.Repaired {
+			line += " (repaired)"
+		} else if issue.Error != "" {
+			line += " (repair failed: " + issue.Error + ")"
+		}
+		fmt.Println(line)
+	}
+
+	fmt.Println()
+	fmt.Printf("Scanned %d objects, %d files, %d blobs\n", report.ObjectsScanned, report.FilesScanned, report.BlobsScanned)
+	if len(report.Issues) == 0 {
+		fmt.Println("✅ No problems found")
+		return
+	}
+	for kind, count := range report.Counts {
+		fmt.Printf("  %s: %d\n", kind, count)
+	}
+	if !*repair {
+		fmt.Println("Run again with --repair to quarantine orphans and mark broken rows")
+	}
+}
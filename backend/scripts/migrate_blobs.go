@@ -0,0 +1,112 @@
+//go:build ignore
+
+// scripts/migrate_blobs.go
+// Moves files uploaded before the blob store existed into it, deduplicating them per user.
+// Run this script from the backend directory: go run scripts/migrate_blobs.go
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"my-cloud-project/backend/blobs"
+	"my-cloud-project/backend/database"
+	"my-cloud-project/backend/encryption"
+	"my-cloud-project/backend/storage"
+	"my-cloud-project/backend/utils"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: .env file not found")
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+	defer db.Close()
+
+	if err := database.Migrate(db); err != nil {
+		log.Fatal("Failed to migrate database schema:", err)
+	}
+
+	ctx := context.Background()
+	baseUploadPath, _ := utils.GetBaseUploadPath()
+	backend, err := storage.NewFromEnv(ctx, baseUploadPath)
+	if err != nil {
+		log.Fatal("Failed to set up file storage:", err)
+	}
+	keyring, err := encryption.NewKeyringFromEnv(db)
+	if err != nil {
+		log.Fatal("Failed to load encryption keys:", err)
+	}
+	store := blobs.NewStore(db, backend, keyring)
+
+	rows, err := db.Query(`
+		SELECT f.FILE_ID, f.OWNER_ID, f.FOLDER_ID, u.USERNAME
+		FROM FILE_LIST f JOIN USERS u ON f.OWNER_ID = u.USER_ID
+		WHERE f.BLOB_ID IS NULL
+	`)
+	if err != nil {
+		log.Fatal("Failed to list files:", err)
+	}
+
+	type legacyFile struct {
+		id       int64
+		ownerID  int
+		folderID sql.NullString
+		username string
+	}
+	var files []legacyFile
+	var folderIDs []string
+	for rows.Next() {
+		var f legacyFile
+		if err := rows.Scan(&f.id, &f.ownerID, &f.folderID, &f.username); err == nil {
+			files = append(files, f)
+			if f.folderID.Valid {
+				folderIDs = append(folderIDs, f.folderID.String)
+			}
+		}
+	}
+	rows.Close()
+
+	// Legacy keys name the folder a file is in by its path
+	folderPaths, err := database.FolderPaths(db, folderIDs)
+	if err != nil {
+		log.Fatal("Failed to look up folders:", err)
+	}
+
+	fmt.Printf("Found %d files to migrate\n", len(files))
+
+	migrated, failed := 0, 0
+	for _, f := range files {
+		dir, ok := "/", true
+		if f.folderID.Valid {
+			dir, ok = folderPaths[f.folderID.String]
+		}
+		if !ok {
+			log.Printf("File %d: folder %s not found", f.id, f.folderID.String)
+			failed++
+			continue
+		}
+		legacyKey, err := storage.UserKey(f.username, dir, fmt.Sprintf("%d", f.id))
+		if err == nil {
+			err = store.Adopt(ctx, f.ownerID, f.id, legacyKey)
+		}
+		if err != nil {
+			log.Printf("File %d (%s): %v", f.id, legacyKey, err)
+			failed++
+			continue
+		}
+		migrated++
+	}
+
+	fmt.Println()
+	fmt.Printf("✅ Migrated %d files, %d failed\n", migrated, failed)
+}
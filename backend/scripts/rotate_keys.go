@@ -0,0 +1,51 @@
+//go:build ignore
+
+// scripts/rotate_keys.go
+// Re-wraps every user's data key with the current MASTER_KEY. File contents are not rewritten.
+// Set MASTER_KEY to the new key and MASTER_KEY_PREVIOUS to the old one, then
+// run this script from the backend directory: go run scripts/rotate_keys.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"my-cloud-project/backend/database"
+	"my-cloud-project/backend/encryption"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: .env file not found")
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+	defer db.Close()
+
+	if err := database.Migrate(db); err != nil {
+		log.Fatal("Failed to migrate database schema:", err)
+	}
+
+	keyring, err := encryption.NewKeyringFromEnv(db)
+	if err != nil {
+		log.Fatal("Failed to load encryption keys:", err)
+	}
+	if keyring == nil {
+		log.Fatal("MASTER_KEY is not set")
+	}
+
+	rotated, err := keyring.Rotate(context.Background())
+	if err != nil {
+		log.Fatalf("Rotation stopped after %d keys: %v", rotated, err)
+	}
+
+	fmt.Printf("✅ Re-wrapped %d user keys\n", rotated)
+	fmt.Println("MASTER_KEY_PREVIOUS can now be removed")
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrNotExist is returned when a key is not present in the backend
+var ErrNotExist = errors.New("storage: object does not exist")
+
+// ObjectInfo describes a single stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend is the place where file contents live. Keys are slash separated
+// and relative to the backend root, e.g. "alice/docs/42".
+//
+// Delete and Move operate on the key itself and on everything stored below
+// "key/", so a folder can be removed or relocated with a single call.
+// Put accepts a size of -1 when the length of r is not known in advance.
+type Backend interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	Move(ctx context.Context, srcKey, dstKey string) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// LocalImporter is implemented by backends that can take over a file on the
+// local disk more cheaply than streaming it through Put.
+type LocalImporter interface {
+	Import(ctx context.Context, localPath, key string) error
+}
+
+// ImportFile moves a local file (such as a finished tus upload) into the backend.
+// The local file is gone once ImportFile returns without error.
+func ImportFile(ctx context.Context, b Backend, localPath, key string) error {
+	if importer, ok := b.(LocalImporter); ok {
+		return importer.Import(ctx, localPath, key)
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = b.Put(ctx, key, f, info.Size())
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(localPath)
+}
+
+// UserKey builds the key for a path inside a user's tree and rejects paths
+// that would escape it.
+func UserKey(username string, elem ...string) (string, error) {
+	if username == "" || strings.ContainsAny(username, "/\\") || username == "." || username == ".." {
+		return "", fmt.Errorf("invalid path: access denied")
+	}
+	// Cleaning against "/" resolves any ".." before the username is prefixed
+	rel := path.Clean("/" + strings.ReplaceAll(path.Join(elem...), "\\", "/"))
+	return strings.TrimSuffix(path.Join(username, rel), "/"), nil
+}
+
+// cleanKey normalises a key and refuses anything that is not relative to the root
+func cleanKey(key string) (string, error) {
+	cleaned := path.Clean("/" + strings.ReplaceAll(key, "\\", "/"))
+	cleaned = strings.TrimPrefix(cleaned, "/")
+	if cleaned == "" || cleaned == "." {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LocalBackend stores objects as plain files below a root directory
+type LocalBackend struct {
+	root string
+}
+
+// NewLocalBackend creates a backend rooted at dir, creating it if needed
+func NewLocalBackend(dir string) (*LocalBackend, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalBackend{root: root}, nil
+}
+
+func (b *LocalBackend) fullPath(key string) (string, error) {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(b.root, filepath.FromSlash(cleaned)), nil
+}
+
+func (b *LocalBackend) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	fullPath, err := b.fullPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+
+	// Write next to the target and rename so readers never see a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(fullPath), ".put-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fullPath); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (b *LocalBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	fullPath, err := b.fullPath(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fullPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+func (b *LocalBackend) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	fullPath, err := b.fullPath(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(fullPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, ErrNotExist
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (b *LocalBackend) Delete(ctx context.Context, key string) error {
+	fullPath, err := b.fullPath(key)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(fullPath)
+}
+
+func (b *LocalBackend) Move(ctx context.Context, srcKey, dstKey string) error {
+	srcPath, err := b.fullPath(srcKey)
+	if err != nil {
+		return err
+	}
+	dstPath, err := b.fullPath(dstKey)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(srcPath); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotExist
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(srcPath, dstPath)
+}
+
+func (b *LocalBackend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	// Walk the deepest directory that can contain the prefix and filter from there
+	prefix = strings.TrimPrefix(prefix, "/")
+	walkRoot := b.root
+	if dir := path.Dir(prefix); strings.Contains(prefix, "/") && dir != "." {
+		walkRoot = filepath.Join(b.root, filepath.FromSlash(dir))
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(walkRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(b.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+func (b *LocalBackend) Import(ctx context.Context, localPath, key string) error {
+	fullPath, err := b.fullPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(localPath, fullPath)
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newTestBackend(t *testing.T) *LocalBackend {
+	t.Helper()
+	b, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	return b
+}
+
+func put(t *testing.T, b Backend, key, data string) {
+	t.Helper()
+	if err := b.Put(context.Background(), key, strings.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put(%q): %v", key, err)
+	}
+}
+
+func read(t *testing.T, b Backend, key string) string {
+	t.Helper()
+	r, err := b.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return string(data)
+}
+
+// The checks below hold for every backend; s3_test.go runs them against an object store
+
+func checkPutGetStat(t *testing.T, b Backend) {
+	ctx := context.Background()
+	put(t, b, "alice/docs/1", "hello")
+	if got := read(t, b, "alice/docs/1"); got != "hello" {
+		t.Errorf("Get = %q, want %q", got, "hello")
+	}
+	info, err := b.Stat(ctx, "alice/docs/1")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Key != "alice/docs/1" || info.Size != 5 {
+		t.Errorf("Stat = %+v, want key alice/docs/1 and size 5", info)
+	}
+
+	// Overwriting replaces the contents
+	put(t, b, "alice/docs/1", "bye")
+	if got := read(t, b, "alice/docs/1"); got != "bye" {
+		t.Errorf("Get after overwrite = %q, want %q", got, "bye")
+	}
+}
+
+func checkMissing(t *testing.T, b Backend) {
+	ctx := context.Background()
+	if _, err := b.Get(ctx, "nobody/1"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Get of a missing key = %v, want ErrNotExist", err)
+	}
+	if _, err := b.Stat(ctx, "nobody/1"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat of a missing key = %v, want ErrNotExist", err)
+	}
+	if err := b.Move(ctx, "nobody/1", "nobody/2"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Move of a missing key = %v, want ErrNotExist", err)
+	}
+	if err := b.Delete(ctx, "nobody/1"); err != nil {
+		t.Errorf("Delete of a missing key = %v, want nil", err)
+	}
+}
+
+func checkFolders(t *testing.T, b Backend) {
+	ctx := context.Background()
+	put(t, b, "alice/a/1", "one")
+	put(t, b, "alice/a/b/2", "two")
+	put(t, b, "alice/ab/3", "three")
+
+	// Move and Delete take everything below the key along
+	if err := b.Move(ctx, "alice/a", "alice/c"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if got := read(t, b, "alice/c/b/2"); got != "two" {
+		t.Errorf("moved file = %q, want %q", got, "two")
+	}
+	if _, err := b.Stat(ctx, "alice/a/1"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat of the old key = %v, want ErrNotExist", err)
+	}
+
+	objects, err := b.List(ctx, "alice/c")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var keys []string
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	sort.Strings(keys)
+	if want := []string{"alice/c/1", "alice/c/b/2"}; strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("List = %v, want %v", keys, want)
+	}
+
+	if err := b.Delete(ctx, "alice/c"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := b.Stat(ctx, "alice/c/b/2"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat below a deleted key = %v, want ErrNotExist", err)
+	}
+	if got := read(t, b, "alice/ab/3"); got != "three" {
+		t.Errorf("sibling with a shared prefix = %q, want %q", got, "three")
+	}
+}
+
+func TestLocalBackendPutGetStat(t *testing.T) {
+	b := newTestBackend(t)
+	checkPutGetStat(t, b)
+
+	// Overwriting leaves no temporary files behind
+	entries, err := os.ReadDir(filepath.Join(b.root, "alice", "docs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("docs holds %d entries, want 1", len(entries))
+	}
+}
+
+func TestLocalBackendMissing(t *testing.T) {
+	checkMissing(t, newTestBackend(t))
+}
+
+func TestLocalBackendFolders(t *testing.T) {
+	checkFolders(t, newTestBackend(t))
+}
+
+func TestLocalBackendImport(t *testing.T) {
+	b := newTestBackend(t)
+	src := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(src, []byte("uploaded"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ImportFile(context.Background(), b, src, "alice/42"); err != nil {
+		t.Fatalf("ImportFile: %v", err)
+	}
+	if got := read(t, b, "alice/42"); got != "uploaded" {
+		t.Errorf("imported file = %q, want %q", got, "uploaded")
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source still exists after import: %v", err)
+	}
+}
+
+func TestLocalBackendStaysInRoot(t *testing.T) {
+	b := newTestBackend(t)
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"alice/1", "alice/1"},
+		{"/alice/1", "alice/1"},
+		{"../../etc/passwd", "etc/passwd"},
+		{`alice\..\..\x`, "x"},
+	}
+	for _, tt := range tests {
+		got, err := b.fullPath(tt.key)
+		if err != nil {
+			t.Errorf("fullPath(%q): %v", tt.key, err)
+			continue
+		}
+		if want := filepath.Join(b.root, filepath.FromSlash(tt.want)); got != want {
+			t.Errorf("fullPath(%q) = %q, want %q", tt.key, got, want)
+		}
+	}
+
+	for _, key := range []string{"", "/", ".", ".."} {
+		if err := b.Put(context.Background(), key, bytes.NewReader(nil), 0); err == nil {
+			t.Errorf("Put(%q) succeeded, want an error", key)
+		}
+	}
+}
+
+func TestUserKey(t *testing.T) {
+	tests := []struct {
+		username string
+		elem     []string
+		want     string
+		wantErr  bool
+	}{
+		{"alice", []string{"/docs", "1"}, "alice/docs/1", false},
+		{"alice", []string{"/"}, "alice", false},
+		{"alice", []string{"../bob/secret"}, "alice/bob/secret", false},
+		{"alice", []string{`..\..\bob`}, "alice/bob", false},
+		{"", []string{"docs"}, "", true},
+		{"..", []string{"docs"}, "", true},
+		{"a/b", []string{"docs"}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := UserKey(tt.username, tt.elem...)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("UserKey(%q, %q) = %q, %v; want %q, error %v", tt.username, tt.elem, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
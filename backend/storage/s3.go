@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config holds the connection settings for an S3-compatible object store
+type S3Config struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	Region    string
+	Prefix    string
+	UseSSL    bool
+}
+
+// S3Backend stores objects in an S3-compatible bucket (AWS S3, MinIO, ...)
+type S3Backend struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Backend connects to the object store and creates the bucket if it does not exist yet
+func NewS3Backend(ctx context.Context, cfg S3Config) (*S3Backend, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket %s: %w", cfg.Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, fmt.Errorf("failed to create bucket %s: %w", cfg.Bucket, err)
+		}
+	}
+
+	return &S3Backend{client: client, bucket: cfg.Bucket, prefix: strings.Trim(cfg.Prefix, "/")}, nil
+}
+
+func (b *S3Backend) objectName(key string) (string, error) {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	if b.prefix == "" {
+		return cleaned, nil
+	}
+	return path.Join(b.prefix, cleaned), nil
+}
+
+func (b *S3Backend) keyFor(objectName string) string {
+	if b.prefix == "" {
+		return objectName
+	}
+	return strings.TrimPrefix(objectName, b.prefix+"/")
+}
+
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+func (b *S3Backend) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	name, err := b.objectName(key)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.PutObject(ctx, b.bucket, name, r, size, minio.PutObjectOptions{})
+	return err
+}
+
+func (b *S3Backend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	name, err := b.objectName(key)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := b.client.GetObject(ctx, b.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, so stat it to surface a missing key right away
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if isNotFound(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (b *S3Backend) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	name, err := b.objectName(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := b.client.StatObject(ctx, b.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return ObjectInfo{}, ErrNotExist
+		}
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (b *S3Backend) Delete(ctx context.Context, key string) error {
+	name, err := b.objectName(key)
+	if err != nil {
+		return err
+	}
+	if err := b.client.RemoveObject(ctx, b.bucket, name, minio.RemoveObjectOptions{}); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	children, err := b.List(ctx, key+"/")
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		childName, _ := b.objectName(child.Key)
+		if err := b.client.RemoveObject(ctx, b.bucket, childName, minio.RemoveObjectOptions{}); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *S3Backend) Move(ctx context.Context, srcKey, dstKey string) error {
+	moved := false
+	if _, err := b.Stat(ctx, srcKey); err == nil {
+		if err := b.moveObject(ctx, srcKey, dstKey); err != nil {
+			return err
+		}
+		moved = true
+	} else if !errors.Is(err, ErrNotExist) {
+		return err
+	}
+
+	// Object stores have no directories, so a folder move is a move of every key below it
+	children, err := b.List(ctx, srcKey+"/")
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		target := dstKey + strings.TrimPrefix(child.Key, srcKey)
+		if err := b.moveObject(ctx, child.Key, target); err != nil {
+			return err
+		}
+		moved = true
+	}
+
+	if !moved {
+		return ErrNotExist
+	}
+	return nil
+}
+
+func (b *S3Backend) moveObject(ctx context.Context, srcKey, dstKey string) error {
+	srcName, err := b.objectName(srcKey)
+	if err != nil {
+		return err
+	}
+	dstName, err := b.objectName(dstKey)
+	if err != nil {
+		return err
+	}
+	// ComposeObject falls back to a multipart copy for objects above the 5 GiB CopyObject limit
+	_, err = b.client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: b.bucket, Object: dstName},
+		minio.CopySrcOptions{Bucket: b.bucket, Object: srcName},
+	)
+	if err != nil {
+		return err
+	}
+	return b.client.RemoveObject(ctx, b.bucket, srcName, minio.RemoveObjectOptions{})
+}
+
+func (b *S3Backend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	listPrefix := strings.TrimPrefix(prefix, "/")
+	if b.prefix != "" {
+		listPrefix = b.prefix + "/" + listPrefix
+	}
+
+	var objects []ObjectInfo
+	for obj := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: listPrefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objects = append(objects, ObjectInfo{Key: b.keyFor(obj.Key), Size: obj.Size, ModTime: obj.LastModified})
+	}
+	return objects, nil
+}
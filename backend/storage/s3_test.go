@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// newS3TestBackend connects to the S3-compatible store at S3_TEST_ENDPOINT, e.g. a local MinIO,
+// and skips the test when it is not set. Every test works below a prefix of its own, which is
+// emptied when the test ends.
+func newS3TestBackend(t *testing.T) *S3Backend {
+	t.Helper()
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+	bucket := os.Getenv("S3_TEST_BUCKET")
+	if bucket == "" {
+		bucket = "storage-test"
+	}
+
+	ctx := context.Background()
+	b, err := NewS3Backend(ctx, S3Config{
+		Endpoint:  endpoint,
+		AccessKey: os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_TEST_SECRET_KEY"),
+		Bucket:    bucket,
+		Region:    os.Getenv("S3_TEST_REGION"),
+		Prefix:    fmt.Sprintf("test-%d", time.Now().UnixNano()),
+		UseSSL:    os.Getenv("S3_TEST_USE_SSL") == "true",
+	})
+	if err != nil {
+		t.Fatalf("NewS3Backend: %v", err)
+	}
+	t.Cleanup(func() {
+		objects, err := b.List(ctx, "")
+		if err != nil {
+			t.Errorf("listing what the test left: %v", err)
+			return
+		}
+		for _, o := range objects {
+			if err := b.Delete(ctx, o.Key); err != nil {
+				t.Errorf("Delete(%q): %v", o.Key, err)
+			}
+		}
+	})
+	return b
+}
+
+func TestS3BackendPutGetStat(t *testing.T) {
+	checkPutGetStat(t, newS3TestBackend(t))
+}
+
+func TestS3BackendMissing(t *testing.T) {
+	checkMissing(t, newS3TestBackend(t))
+}
+
+func TestS3BackendFolders(t *testing.T) {
+	checkFolders(t, newS3TestBackend(t))
+}
+
+// Keys are cleaned the same way as on the local disk, so they cannot leave the prefix
+func TestS3BackendStaysInPrefix(t *testing.T) {
+	b := newS3TestBackend(t)
+	put(t, b, "../../alice/1", "hello")
+	if got := read(t, b, "alice/1"); got != "hello" {
+		t.Errorf("Get = %q, want %q", got, "hello")
+	}
+	objects, err := b.List(context.Background(), "")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(objects) != 1 || objects[0].Key != "alice/1" {
+		t.Errorf("List = %+v, want just alice/1", objects)
+	}
+}